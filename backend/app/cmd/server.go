@@ -2,9 +2,11 @@ package cmd
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/mail"
 	"net/url"
 	"os"
 	"os/signal"
@@ -20,6 +22,8 @@ import (
 	log "github.com/go-pkgz/lgr"
 	"github.com/kyokomi/emoji"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	bolt "go.etcd.io/bbolt"
 
 	"github.com/go-pkgz/auth"
@@ -77,6 +81,7 @@ type ServerCommand struct {
 	SimpleView       bool          `long:"simpler-view" env:"SIMPLE_VIEW" description:"minimal comment editor mode"`
 	ProxyCORS        bool          `long:"proxy-cors" env:"PROXY_CORS" description:"disable internal CORS and delegate it to proxy"`
 	AllowedHosts     []string      `long:"allowed-hosts" env:"ALLOWED_HOSTS" description:"limit hosts/sources allowed to embed comments"`
+	Metrics          bool          `long:"metrics" env:"METRICS" description:"expose prometheus metrics on /metrics"`
 
 	Auth struct {
 		TTL struct {
@@ -188,28 +193,180 @@ type AdminGroup struct {
 
 // SMTPGroup defines options for SMTP server connection, used in auth and notify modules
 type SMTPGroup struct {
-	Host     string        `long:"host" env:"HOST" description:"SMTP host"`
-	Port     int           `long:"port" env:"PORT" description:"SMTP port"`
-	Username string        `long:"username" env:"USERNAME" description:"SMTP user name"`
-	Password string        `long:"password" env:"PASSWORD" description:"SMTP password"`
-	TLS      bool          `long:"tls" env:"TLS" description:"enable TLS"`
-	TimeOut  time.Duration `long:"timeout" env:"TIMEOUT" default:"10s" description:"SMTP TCP connection timeout"`
+	Host               string        `long:"host" env:"HOST" description:"SMTP host"`
+	Port               int           `long:"port" env:"PORT" description:"SMTP port"`
+	Username           string        `long:"username" env:"USERNAME" description:"SMTP user name"`
+	Password           string        `long:"password" env:"PASSWORD" description:"SMTP password"`
+	TLS                bool          `long:"tls" env:"TLS" description:"enable TLS"`
+	StartTLS           bool          `long:"starttls" env:"STARTTLS" description:"enable StartTLS"`
+	TLSMinVersion      string        `long:"tls_min_version" env:"TLS_MIN_VERSION" choice:"1.0" choice:"1.1" choice:"1.2" choice:"1.3" default:"1.2" description:"minimal TLS version"` //nolint
+	InsecureSkipVerify bool          `long:"insecure_skip_verify" env:"INSECURE_SKIP_VERIFY" description:"skip verification of SMTP server certificate"`
+	TLSServerName      string        `long:"tls_server_name" env:"TLS_SERVER_NAME" description:"SMTP server name to verify certificate against, host if not set"`
+	Auth               string        `long:"auth" env:"AUTH" choice:"plain" choice:"login" default:"plain" description:"SMTP authentication method"` //nolint
+	TimeOut            time.Duration `long:"timeout" env:"TIMEOUT" default:"10s" description:"SMTP TCP connection timeout"`
+	ConnectTimeout     time.Duration `long:"connect_timeout" env:"CONNECT_TIMEOUT" description:"SMTP connection establishment timeout, timeout if not set"`
+	SendTimeout        time.Duration `long:"send_timeout" env:"SEND_TIMEOUT" description:"SMTP command and message write timeout, timeout if not set"`
+	Proxy              string        `long:"proxy" env:"PROXY" description:"proxy URL for SMTP connections, socks5:// or http://"`
+	LocalName          string        `long:"local_name" env:"LOCAL_NAME" description:"hostname sent in SMTP EHLO/HELO, localhost if not set"`
+}
+
+// tlsVersions maps SMTPGroup.TLSMinVersion choices to tls versions
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// overflowPolicies maps notify.overflow option values to notification queue overflow policies
+var overflowPolicies = map[string]notify.OverflowPolicy{
+	"drop-newest": notify.OverflowDropNewest,
+	"drop-oldest": notify.OverflowDropOldest,
+	"block":       notify.OverflowBlock,
 }
 
 // NotifyGroup defines options for notification
 type NotifyGroup struct {
-	Type      []string `long:"type" env:"TYPE" description:"type of notification" choice:"none" choice:"telegram" choice:"email" default:"none" env-delim:","` //nolint
-	QueueSize int      `long:"queue" env:"QUEUE" description:"size of notification queue" default:"100"`
-	Telegram  struct {
-		Token   string        `long:"token" env:"TOKEN" description:"telegram token"`
-		Channel string        `long:"chan" env:"CHAN" description:"telegram channel"`
-		Timeout time.Duration `long:"timeout" env:"TIMEOUT" default:"5s" description:"telegram timeout"`
-		API     string        `long:"api" env:"API" default:"https://api.telegram.org/bot" description:"telegram api prefix"`
+	Type        []string      `long:"type" env:"TYPE" description:"type of notification" choice:"none" choice:"telegram" choice:"email" choice:"webhook" choice:"slack" choice:"discord" choice:"mattermost" choice:"sms" choice:"pushover" choice:"matrix" choice:"websub" default:"none" env-delim:","` //nolint
+	QueueSize   int           `long:"queue" env:"QUEUE" description:"size of notification queue" default:"100"`
+	Timeout     time.Duration `long:"timeout" env:"TIMEOUT" description:"time given to each destination for a notification" default:"1m"`
+	Concurrency int           `long:"concurrency" env:"CONCURRENCY" description:"max number of destinations notified at once, unlimited if 0"`
+	URLRewrite  []string      `long:"url-rewrite" env:"URL_REWRITE" description:"rewrite of comment URL prefix in notifications, as internal=public" env-delim:","`
+	Mentions    bool          `long:"mentions" env:"MENTIONS" description:"notify users mentioned in comments by @name"`
+	MinScore    int           `long:"min-score" env:"MIN_SCORE" description:"minimal score of comment to notify about it, disabled if 0"`
+	ScoreDelay  time.Duration `long:"score-delay" env:"SCORE_DELAY" description:"delay of notifications checked against min-score"`
+	QuietHours  string        `long:"quiet-hours" env:"QUIET_HOURS" description:"daily period of deferred notifications, as 22:00-07:00"`
+	QuietTZ     string        `long:"quiet-tz" env:"QUIET_TZ" default:"UTC" description:"time zone of quiet-hours, i.e. Europe/Berlin"`
+	SpamWords   []string      `long:"spam-words" env:"SPAM_WORDS" description:"keywords of spam comments not notified about, case-insensitive" env-delim:","`
+	SpamRegex   []string      `long:"spam-regex" env:"SPAM_REGEX" description:"regular expressions of spam comments not notified about" env-delim:";"`
+	SpamToAdmin bool          `long:"spam-to-admin" env:"SPAM_TO_ADMIN" description:"notify admin emails only about spam comments instead of skipping them"`
+	Overflow    string        `long:"overflow" env:"OVERFLOW" choice:"drop-newest" choice:"drop-oldest" choice:"block" default:"drop-newest" description:"handling of notifications submitted to the full queue"` //nolint
+	Telegram    struct {
+		Token        string        `long:"token" env:"TOKEN" description:"telegram token"`
+		Channel      string        `long:"chan" env:"CHAN" description:"telegram channel"`
+		SiteChannels []string      `long:"site-chan" env:"SITE_CHANS" description:"telegram channel for site, as site:channel" env-delim:","`
+		Timeout      time.Duration `long:"timeout" env:"TIMEOUT" default:"5s" description:"telegram timeout"`
+		API          string        `long:"api" env:"API" default:"https://api.telegram.org/bot" description:"telegram api prefix"`
+		Moderation   bool          `long:"moderation" env:"MODERATION" description:"add moderation buttons to telegram notifications"`
+		Admins       []int64       `long:"admin" env:"ADMINS" description:"telegram ids of users allowed to moderate, required with moderation" env-delim:","`
+		Proxy        string        `long:"proxy" env:"PROXY" description:"proxy URL for telegram requests, socks5:// or http://"`
 	} `group:"telegram" namespace:"telegram" env-namespace:"TELEGRAM"`
+	Webhook struct {
+		URL        string        `long:"url" env:"URL" description:"webhook URL"`
+		Headers    []string      `long:"header" env:"HEADERS" description:"webhook request header, as key:value" env-delim:","`
+		Timeout    time.Duration `long:"timeout" env:"TIMEOUT" default:"5s" description:"webhook timeout"`
+		Template   string        `long:"template" env:"TEMPLATE" description:"webhook payload template, JSON with comment and parent is sent by default"`
+		Secret     string        `long:"secret" env:"SECRET" description:"secret to sign webhook payload with HMAC-SHA256"`
+		Retries    int           `long:"retries" env:"RETRIES" default:"3" description:"max number of webhook delivery retries"`
+		DeadLetter string        `long:"dead-letter" env:"DEAD_LETTER" description:"file to append failed webhook deliveries to"`
+		Proxy      string        `long:"proxy" env:"PROXY" description:"proxy URL for webhook requests, socks5:// or http://"`
+		Raw        bool          `long:"raw" env:"RAW" description:"add comment and parent as stored to webhook payload"`
+		Sensitive  bool          `long:"sensitive" env:"SENSITIVE" description:"keep IPs and add emails of notified users in raw webhook payload"`
+	} `group:"webhook" namespace:"webhook" env-namespace:"WEBHOOK"`
+	Slack struct {
+		Token        string        `long:"token" env:"TOKEN" description:"slack bot token"`
+		Webhook      string        `long:"webhook" env:"WEBHOOK" description:"slack incoming webhook URL, used without token"`
+		Channel      string        `long:"chan" env:"CHAN" description:"slack channel"`
+		SiteChannels []string      `long:"site-chan" env:"SITE_CHANS" description:"slack channel for site, as site:channel" env-delim:","`
+		Timeout      time.Duration `long:"timeout" env:"TIMEOUT" default:"5s" description:"slack timeout"`
+	} `group:"slack" namespace:"slack" env-namespace:"SLACK"`
+	Discord struct {
+		Webhook  string        `long:"webhook" env:"WEBHOOK" description:"discord webhook URL"`
+		Username string        `long:"username" env:"USERNAME" description:"discord username override"`
+		Avatar   string        `long:"avatar" env:"AVATAR" description:"discord avatar URL override"`
+		Timeout  time.Duration `long:"timeout" env:"TIMEOUT" default:"5s" description:"discord timeout"`
+	} `group:"discord" namespace:"discord" env-namespace:"DISCORD"`
+	Mattermost struct {
+		Webhook      string        `long:"webhook" env:"WEBHOOK" description:"mattermost incoming webhook URL"`
+		Channel      string        `long:"chan" env:"CHAN" description:"mattermost channel, webhook's channel if not set"`
+		SiteChannels []string      `long:"site-chan" env:"SITE_CHANS" description:"mattermost channel for site, as site:channel" env-delim:","`
+		Username     string        `long:"username" env:"USERNAME" description:"mattermost username override"`
+		Icon         string        `long:"icon" env:"ICON" description:"mattermost icon URL override"`
+		Timeout      time.Duration `long:"timeout" env:"TIMEOUT" default:"5s" description:"mattermost timeout"`
+	} `group:"mattermost" namespace:"mattermost" env-namespace:"MATTERMOST"`
+	SMS struct {
+		URL      string        `long:"url" env:"URL" description:"sms gateway URL, Twilio API if not set"`
+		SID      string        `long:"sid" env:"SID" description:"sms gateway account SID"`
+		Token    string        `long:"token" env:"TOKEN" description:"sms gateway auth token"`
+		From     string        `long:"from" env:"FROM" description:"sms sender number"`
+		Template string        `long:"template" env:"TEMPLATE" description:"sms verification message template"`
+		Timeout  time.Duration `long:"timeout" env:"TIMEOUT" default:"5s" description:"sms gateway timeout"`
+	} `group:"sms" namespace:"sms" env-namespace:"SMS"`
+	Pushover struct {
+		Token   string        `long:"token" env:"TOKEN" description:"pushover application API token"`
+		User    string        `long:"user" env:"USER" description:"pushover user or group key"`
+		Device  string        `long:"device" env:"DEVICE" description:"pushover device name, all user's devices if not set"`
+		API     string        `long:"api" env:"API" default:"https://api.pushover.net/1/messages.json" description:"pushover messages API URL"`
+		Timeout time.Duration `long:"timeout" env:"TIMEOUT" default:"5s" description:"pushover timeout"`
+	} `group:"pushover" namespace:"pushover" env-namespace:"PUSHOVER"`
+	Matrix struct {
+		Homeserver string        `long:"homeserver" env:"HOMESERVER" description:"matrix homeserver URL"`
+		Token      string        `long:"token" env:"TOKEN" description:"matrix access token"`
+		Room       string        `long:"room" env:"ROOM" description:"matrix room id"`
+		Timeout    time.Duration `long:"timeout" env:"TIMEOUT" default:"5s" description:"matrix timeout"`
+	} `group:"matrix" namespace:"matrix" env-namespace:"MATRIX"`
+	WebSub struct {
+		Timeout          time.Duration `long:"timeout" env:"TIMEOUT" default:"5s" description:"websub verification and delivery timeout"`
+		Lease            time.Duration `long:"lease" env:"LEASE" default:"240h" description:"websub subscription lease if not requested"`
+		MaxLease         time.Duration `long:"max_lease" env:"MAX_LEASE" default:"720h" description:"max websub subscription lease"`
+		MaxSubscriptions int           `long:"max_subscriptions" env:"MAX_SUBSCRIPTIONS" default:"1000" description:"max number of websub subscriptions"`
+		Concurrency      int           `long:"concurrency" env:"CONCURRENCY" default:"8" description:"max number of parallel deliveries to websub subscribers"`
+	} `group:"websub" namespace:"websub" env-namespace:"WEBSUB"`
 	Email struct {
-		From                string `long:"from_address" env:"FROM" description:"from email address"`
-		VerificationSubject string `long:"verification_subj" env:"VERIFICATION_SUBJ" description:"verification message subject"`
-		AdminNotifications  bool   `long:"notify_admin" env:"ADMIN" description:"notify admin on new comments via ADMIN_SHARED_EMAIL"`
+		From                string        `long:"from_address" env:"FROM" description:"from email address"`
+		FromName            string        `long:"from_name" env:"FROM_NAME" description:"from display name"`
+		FromPool            []string      `long:"from_pool" env:"FROM_POOL" description:"from email addresses rotated instead of from address" env-delim:","`
+		FromPoolSticky      bool          `long:"from_pool_sticky" env:"FROM_POOL_STICKY" description:"send to each recipient from the same address of the pool"`
+		FromPoolMultiDomain bool          `long:"from_pool_multi_domain" env:"FROM_POOL_MULTI_DOMAIN" description:"allow from pool addresses of different domains"`
+		SigningDomain       string        `long:"signing_domain" env:"SIGNING_DOMAIN" description:"domain sender addresses should be aligned with for DMARC"`
+		ReplyTo             string        `long:"reply_to" env:"REPLY_TO" description:"reply-to email address"`
+		ReturnPath          string        `long:"return_path" env:"RETURN_PATH" description:"envelope sender address receiving bounces, from address if not set"`
+		SiteFrom            []string      `long:"site_from" env:"SITE_FROM" description:"from email address for site, as site:address" env-delim:","`
+		SiteReplyTo         []string      `long:"site_reply_to" env:"SITE_REPLY_TO" description:"reply-to email address for site, as site:address" env-delim:","`
+		SiteTitle           []string      `long:"site_title" env:"SITE_TITLE" description:"name of site shown in notifications, as site:title" env-delim:","`
+		SiteLogo            []string      `long:"site_logo" env:"SITE_LOGO" description:"logo URL of site shown in notifications, as site:url" env-delim:","`
+		CC                  []string      `long:"cc" env:"CC" description:"email address to send copy of each notification to" env-delim:","`
+		ToHeader            string        `long:"to_header" env:"TO_HEADER" description:"To header of messages instead of the recipient address"`
+		PGPKeysDir          string        `long:"pgp_keys_dir" env:"PGP_KEYS_DIR" description:"directory with recipients public PGP keys as email.asc, messages encrypted for them"`
+		Archive             string        `long:"archive" env:"ARCHIVE" description:"email address to send hidden copy of every message to, for archiving"`
+		VerificationSubject string        `long:"verification_subj" env:"VERIFICATION_SUBJ" description:"verification message subject"`
+		Preheader           string        `long:"preheader" env:"PREHEADER" description:"template of hidden preview text of notification email, i.e. {{.UserName}} replied"`
+		Footer              string        `long:"footer" env:"FOOTER" description:"html template of footer added to all emails, i.e. company address and privacy link"`
+		AdminNotifications  bool          `long:"notify_admin" env:"ADMIN" description:"notify admin on new comments via ADMIN_SHARED_EMAIL"`
+		NotifyOnEdit        bool          `long:"notify_edit" env:"EDIT" description:"notify on comment edits as well as on new comments"`
+		NotifyOnDelete      bool          `long:"notify_delete" env:"DELETE" description:"notify authors of comments deleted by moderator"`
+		Digest              time.Duration `long:"digest" env:"DIGEST" description:"send digest of new comments once in this period instead of email for each, i.e. 24h or 168h"`
+		DigestMaxAge        time.Duration `long:"digest_max_age" env:"DIGEST_MAX_AGE" description:"send digest early once a comment waits in it longer than this, i.e. 1h"`
+		DigestFlushOnClose  bool          `long:"digest_flush_on_close" env:"DIGEST_FLUSH_ON_CLOSE" description:"send pending digests on shutdown instead of keeping them till the next start"`
+		DigestJitter        time.Duration `long:"digest_jitter" env:"DIGEST_JITTER" description:"shift digest send time randomly within +/- this period, i.e. 5m"`
+		Persist             bool          `long:"persist" env:"PERSIST" description:"persist pending email messages and redeliver them after restart"`
+		DedupWindow         time.Duration `long:"dedup" env:"DEDUP" description:"suppress repeated notifications about the same comment within this period, i.e. 5m"`
+		IdempotencyKeys     int           `long:"idempotency_keys" env:"IDEMPOTENCY_KEYS" description:"number of delivered notifications remembered to skip repeated sends, disabled if 0"`
+		MaxPerWindow        int           `long:"max_per_window" env:"MAX_PER_WINDOW" description:"max notifications to the same recipient within throttle_window, the rest sent as summary, unlimited if 0"`
+		ThrottleWindow      time.Duration `long:"throttle_window" env:"THROTTLE_WINDOW" default:"1h" description:"period max_per_window is counted in"`
+		BufferSize          int           `long:"buffer_size" env:"BUFFER_SIZE" description:"number of notifications collected to send them in a single SMTP session, sent right away if 0"`
+		MaxBufferSize       int           `long:"max_buffer_size" env:"MAX_BUFFER_SIZE" description:"buffer size grows up to this under load, fixed size if not greater than buffer_size"`
+		FlushDuration       time.Duration `long:"flush_duration" env:"FLUSH_DURATION" default:"1s" description:"max time notifications wait in the buffer, not used with digest"`
+		MaxQueueAge         time.Duration `long:"max_queue_age" env:"MAX_QUEUE_AGE" description:"send the buffer before flush_duration once a notification waits in it longer than this"`
+		FlushJitter         time.Duration `long:"flush_jitter" env:"FLUSH_JITTER" description:"shorten each flush_duration period randomly by up to twice of this, less than half of flush_duration"`
+		MaxBodyBytes        int           `long:"max_body" env:"MAX_BODY" description:"max size of notification message in bytes, with headers and all parts, comment truncated to fit it, unlimited if 0"`
+		Priority            []string      `long:"priority" env:"PRIORITY" description:"notifications sent with high priority headers" choice:"admin" choice:"new_comment" choice:"reply" choice:"edit" env-delim:","` //nolint
+		StripLinkParams     []string      `long:"strip_link_params" env:"STRIP_LINK_PARAMS" description:"query parameters removed from links in comments, i.e. utm_*" env-delim:","`
+		HTTPSLinks          bool          `long:"https_links" env:"HTTPS_LINKS" description:"rewrite http links in comments to https"`
+		Headers             []string      `long:"header" env:"HEADERS" description:"custom header of notification email, as name:value" env-delim:","`
+		Format              string        `long:"format" env:"FORMAT" description:"notification email format" choice:"html" choice:"text" default:"html"` //nolint
+		DryRun              bool          `long:"dry_run" env:"DRY_RUN" description:"log email messages instead of sending them"`
+		LangTemplates       []string      `long:"lang_template" env:"LANG_TEMPLATES" description:"localized message template, as lang:path" env-delim:","`
+		AdminTemplate       string        `long:"admin_template" env:"ADMIN_TEMPLATE" description:"path to message template for admin notifications"`
+		AmpTemplate         string        `long:"amp_template" env:"AMP_TEMPLATE" description:"path to AMP for Email message template, added as text/x-amp-html part"`
+		TemplateDir         string        `long:"template_dir" env:"TEMPLATE_DIR" description:"directory with email templates reloaded on change"`
+		BreakerThreshold    int           `long:"breaker_threshold" env:"BREAKER_THRESHOLD" description:"stop connecting to SMTP server after this number of consecutive failures, disabled if 0"`
+		BreakerCooldown     time.Duration `long:"breaker_cooldown" env:"BREAKER_COOLDOWN" default:"30s" description:"period without connection attempts after SMTP failures"`
+		Backend             string        `long:"backend" env:"BACKEND" description:"email sending backend" choice:"smtp" choice:"http" default:"smtp"`                                   //nolint
+		APIProvider         string        `long:"api_provider" env:"API_PROVIDER" description:"mail API provider for http backend" choice:"sendgrid" choice:"mailgun" default:"sendgrid"` //nolint
+		APIKey              string        `long:"api_key" env:"API_KEY" description:"mail API key for http backend"`
+		APIDomain           string        `long:"api_domain" env:"API_DOMAIN" description:"mail API sending domain for http backend, required for mailgun"`
+		APIURL              string        `long:"api_url" env:"API_URL" description:"mail API base URL for http backend, provider's default if not set"`
 	} `group:"email" namespace:"email" env-namespace:"EMAIL"`
 }
 
@@ -248,6 +405,7 @@ type serverApp struct {
 	dataService   *service.DataStore
 	avatarStore   avatar.Store
 	notifyService *notify.Service
+	tgModerator   *notify.TelegramModerator
 	imageService  *image.Service
 	authenticator *auth.Service
 	terminated    chan struct{}
@@ -332,6 +490,11 @@ func (s *ServerCommand) newServerApp() (*serverApp, error) {
 	}
 	log.Printf("[INFO] root url=%s", s.RemarkURL)
 
+	// moderation buttons can be pressed by anyone seeing the notification, i.e. by every channel subscriber
+	if s.Notify.Telegram.Moderation && len(s.Notify.Telegram.Admins) == 0 {
+		return nil, errors.New("telegram moderation requires at least one telegram admin")
+	}
+
 	storeEngine, err := s.makeDataStore()
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to make data store engine")
@@ -393,7 +556,7 @@ func (s *ServerCommand) newServerApp() (*serverApp, error) {
 	}
 
 	var emailNotifications bool
-	notifyService, err := s.makeNotify(dataService, authenticator)
+	notifyService, tgModerator, webSub, err := s.makeNotify(dataService, authenticator, loadingCache)
 
 	for _, t := range s.Notify.Type {
 		switch t {
@@ -406,6 +569,7 @@ func (s *ServerCommand) newServerApp() (*serverApp, error) {
 		log.Printf("[WARN] failed to make notify service, %s", err)
 		notifyService = notify.NopService // disable notifier
 		emailNotifications = false        // email notifications are not available in this case
+		webSub = nil                      // websub hub is not mounted without notifier
 	}
 
 	imgProxy := &proxy.Image{
@@ -451,6 +615,12 @@ func (s *ServerCommand) newServerApp() (*serverApp, error) {
 		AllowedAncestors:   s.AllowedHosts,
 		SendJWTHeader:      s.Auth.SendJWTHeader,
 	}
+	if s.Metrics {
+		srv.MetricsHandler = promhttp.Handler()
+	}
+	if webSub != nil {
+		srv.WebSubHandler = webSub
+	}
 
 	srv.ScoreThresholds.Low, srv.ScoreThresholds.Critical = s.LowScore, s.CriticalScore
 
@@ -473,6 +643,7 @@ func (s *ServerCommand) newServerApp() (*serverApp, error) {
 		dataService:      dataService,
 		avatarStore:      avatarStore,
 		notifyService:    notifyService,
+		tgModerator:      tgModerator,
 		imageService:     imageService,
 		authenticator:    authenticator,
 		terminated:       make(chan struct{}),
@@ -505,6 +676,10 @@ func (a *serverApp) run(ctx context.Context) error {
 
 	go a.imageService.Cleanup(ctx) // pictures cleanup for staging images
 
+	if a.tgModerator != nil {
+		go a.tgModerator.Run(ctx) // moderation buttons of telegram notifications
+	}
+
 	a.restSrv.Run(a.Port)
 
 	// shutdown procedures after HTTP server is stopped
@@ -802,23 +977,253 @@ func (s *ServerCommand) loadEmailTemplate() (string, error) {
 	return string(file), nil
 }
 
-func (s *ServerCommand) makeNotify(dataStore *service.DataStore, authenticator *auth.Service) (*notify.Service, error) {
+func (s *ServerCommand) makeNotify(dataStore *service.DataStore, authenticator *auth.Service,
+	loadingCache LoadingCache) (*notify.Service, *notify.TelegramModerator, *notify.WebSub, error) {
 	var notifyService *notify.Service
+	var tgModerator *notify.TelegramModerator
+	var webSub *notify.WebSub
 	var destinations []notify.Destination
 	for _, t := range s.Notify.Type {
 		switch t {
 		case "telegram":
-			tg, err := notify.NewTelegram(s.Notify.Telegram.Token, s.Notify.Telegram.Channel,
-				s.Notify.Telegram.Timeout, s.Notify.Telegram.API)
+			siteChannels := map[string]string{}
+			for _, sc := range s.Notify.Telegram.SiteChannels {
+				elems := strings.SplitN(sc, ":", 2)
+				if len(elems) != 2 {
+					return nil, nil, nil, errors.Errorf("invalid telegram site channel %q, should be site:channel", sc)
+				}
+				siteChannels[elems[0]] = elems[1]
+			}
+			tg, err := notify.NewTelegram(s.Notify.Telegram.Token, s.Notify.Telegram.Channel, siteChannels,
+				s.Notify.Telegram.Timeout, s.Notify.Telegram.API, s.Notify.Telegram.Proxy)
 			if err != nil {
-				return nil, errors.Wrap(err, "failed to create telegram notification destination")
+				return nil, nil, nil, errors.Wrap(err, "failed to create telegram notification destination")
+			}
+			if s.Notify.Telegram.Moderation {
+				tgModerator = notify.NewTelegramModerator(tg, &moderationStore{DataStore: dataStore, cache: loadingCache},
+					s.Notify.Telegram.Admins)
 			}
 			destinations = append(destinations, tg)
+		case "webhook":
+			headers := map[string]string{}
+			for _, h := range s.Notify.Webhook.Headers {
+				elems := strings.SplitN(h, ":", 2)
+				if len(elems) != 2 {
+					return nil, nil, nil, errors.Errorf("invalid webhook header %q, should be key:value", h)
+				}
+				headers[strings.TrimSpace(elems[0])] = strings.TrimSpace(elems[1])
+			}
+			whParams := notify.WebhookParams{
+				URL:              s.Notify.Webhook.URL,
+				Headers:          headers,
+				Timeout:          s.Notify.Webhook.Timeout,
+				PayloadTemplate:  s.Notify.Webhook.Template,
+				Secret:           s.Notify.Webhook.Secret,
+				MaxRetries:       s.Notify.Webhook.Retries,
+				BaseURL:          s.RemarkURL,
+				Proxy:            s.Notify.Webhook.Proxy,
+				IncludeRaw:       s.Notify.Webhook.Raw,
+				IncludeSensitive: s.Notify.Webhook.Sensitive,
+			}
+			if s.Notify.Webhook.DeadLetter != "" {
+				fh, err := os.OpenFile(s.Notify.Webhook.DeadLetter, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600) //nolint:gocritic //octalLiteral is OK as FileMode
+				if err != nil {
+					return nil, nil, nil, errors.Wrap(err, "failed to open webhook dead letter file")
+				}
+				whParams.DeadLetter = &notify.DeadLetterWriter{Writer: fh}
+			}
+			wh, err := notify.NewWebhook(whParams)
+			if err != nil {
+				return nil, nil, nil, errors.Wrap(err, "failed to create webhook notification destination")
+			}
+			destinations = append(destinations, wh)
+		case "slack":
+			siteChannels := map[string]string{}
+			for _, sc := range s.Notify.Slack.SiteChannels {
+				elems := strings.SplitN(sc, ":", 2)
+				if len(elems) != 2 {
+					return nil, nil, nil, errors.Errorf("invalid slack site channel %q, should be site:channel", sc)
+				}
+				siteChannels[elems[0]] = elems[1]
+			}
+			slack, err := notify.NewSlack(notify.SlackParams{
+				Token:        s.Notify.Slack.Token,
+				WebhookURL:   s.Notify.Slack.Webhook,
+				Channel:      s.Notify.Slack.Channel,
+				SiteChannels: siteChannels,
+				Timeout:      s.Notify.Slack.Timeout,
+			})
+			if err != nil {
+				return nil, nil, nil, errors.Wrap(err, "failed to create slack notification destination")
+			}
+			destinations = append(destinations, slack)
+		case "discord":
+			discord, err := notify.NewDiscord(notify.DiscordParams{
+				WebhookURL: s.Notify.Discord.Webhook,
+				Username:   s.Notify.Discord.Username,
+				AvatarURL:  s.Notify.Discord.Avatar,
+				Timeout:    s.Notify.Discord.Timeout,
+			})
+			if err != nil {
+				return nil, nil, nil, errors.Wrap(err, "failed to create discord notification destination")
+			}
+			destinations = append(destinations, discord)
+		case "sms":
+			sms, err := notify.NewSMS(notify.SMSParams{
+				URL:             s.Notify.SMS.URL,
+				AccountSID:      s.Notify.SMS.SID,
+				AuthToken:       s.Notify.SMS.Token,
+				From:            s.Notify.SMS.From,
+				MessageTemplate: s.Notify.SMS.Template,
+				Timeout:         s.Notify.SMS.Timeout,
+			})
+			if err != nil {
+				return nil, nil, nil, errors.Wrap(err, "failed to create sms verification destination")
+			}
+			destinations = append(destinations, sms)
+		case "mattermost":
+			siteChannels := map[string]string{}
+			for _, sc := range s.Notify.Mattermost.SiteChannels {
+				elems := strings.SplitN(sc, ":", 2)
+				if len(elems) != 2 {
+					return nil, nil, nil, errors.Errorf("invalid mattermost site channel %q, should be site:channel", sc)
+				}
+				siteChannels[elems[0]] = elems[1]
+			}
+			mm, err := notify.NewMattermost(notify.MattermostParams{
+				WebhookURL:   s.Notify.Mattermost.Webhook,
+				Channel:      s.Notify.Mattermost.Channel,
+				SiteChannels: siteChannels,
+				Username:     s.Notify.Mattermost.Username,
+				IconURL:      s.Notify.Mattermost.Icon,
+				Timeout:      s.Notify.Mattermost.Timeout,
+			})
+			if err != nil {
+				return nil, nil, nil, errors.Wrap(err, "failed to create mattermost notification destination")
+			}
+			destinations = append(destinations, mm)
+		case "pushover":
+			po, err := notify.NewPushover(notify.PushoverParams{
+				Token:   s.Notify.Pushover.Token,
+				User:    s.Notify.Pushover.User,
+				Device:  s.Notify.Pushover.Device,
+				APIURL:  s.Notify.Pushover.API,
+				Timeout: s.Notify.Pushover.Timeout,
+			})
+			if err != nil {
+				return nil, nil, nil, errors.Wrap(err, "failed to create pushover notification destination")
+			}
+			destinations = append(destinations, po)
+		case "matrix":
+			mx, err := notify.NewMatrix(notify.MatrixParams{
+				Homeserver:  s.Notify.Matrix.Homeserver,
+				AccessToken: s.Notify.Matrix.Token,
+				RoomID:      s.Notify.Matrix.Room,
+				Timeout:     s.Notify.Matrix.Timeout,
+			})
+			if err != nil {
+				return nil, nil, nil, errors.Wrap(err, "failed to create matrix notification destination")
+			}
+			destinations = append(destinations, mx)
+		case "websub":
+			if err := makeDirs(s.Store.Bolt.Path); err != nil {
+				return nil, nil, nil, errors.Wrap(err, "failed to create websub db location")
+			}
+			var err error
+			if webSub, err = notify.NewWebSub(notify.WebSubParams{
+				BaseURL:          s.RemarkURL,
+				Timeout:          s.Notify.WebSub.Timeout,
+				DefaultLease:     s.Notify.WebSub.Lease,
+				MaxLease:         s.Notify.WebSub.MaxLease,
+				MaxSubscriptions: s.Notify.WebSub.MaxSubscriptions,
+				Concurrency:      s.Notify.WebSub.Concurrency,
+				DBPath:           fmt.Sprintf("%s/websub.db", s.Store.Bolt.Path),
+			}); err != nil {
+				return nil, nil, nil, errors.Wrap(err, "failed to create websub notification destination")
+			}
+			destinations = append(destinations, webSub)
 		case "email":
+			langTemplates := map[string]string{}
+			for _, lt := range s.Notify.Email.LangTemplates {
+				elems := strings.SplitN(lt, ":", 2)
+				if len(elems) != 2 {
+					return nil, nil, nil, errors.Errorf("invalid email language template %q, should be lang:path", lt)
+				}
+				langTemplates[elems[0]] = elems[1]
+			}
+			headers := map[string]string{}
+			for _, h := range s.Notify.Email.Headers {
+				elems := strings.SplitN(h, ":", 2)
+				if len(elems) != 2 {
+					return nil, nil, nil, errors.Errorf("invalid email header %q, should be name:value", h)
+				}
+				headers[strings.TrimSpace(elems[0])] = strings.TrimSpace(elems[1])
+			}
+			siteSenders, err := s.makeEmailSiteSenders()
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			siteBrandings, err := s.makeEmailSiteBrandings()
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			priorityEvents, priorityAdmin := map[notify.Event]bool{}, false
+			for _, p := range s.Notify.Email.Priority {
+				switch p {
+				case "admin":
+					priorityAdmin = true
+				case "new_comment":
+					priorityEvents[notify.EventNewComment] = true
+				case "reply":
+					priorityEvents[notify.EventReply] = true
+				case "edit":
+					priorityEvents[notify.EventEdit] = true
+				}
+			}
 			emailParams := notify.EmailParams{
-				From:                s.Notify.Email.From,
-				VerificationSubject: s.Notify.Email.VerificationSubject,
-				UnsubscribeURL:      s.RemarkURL + "/email/unsubscribe.html",
+				From:                 s.Notify.Email.From,
+				FromName:             s.Notify.Email.FromName,
+				FromPool:             s.Notify.Email.FromPool,
+				FromPoolSticky:       s.Notify.Email.FromPoolSticky,
+				FromPoolMultiDomain:  s.Notify.Email.FromPoolMultiDomain,
+				SigningDomain:        s.Notify.Email.SigningDomain,
+				ReplyTo:              s.Notify.Email.ReplyTo,
+				ReturnPath:           s.Notify.Email.ReturnPath,
+				SiteSenders:          siteSenders,
+				SiteBrandings:        siteBrandings,
+				ToHeaderOverride:     s.Notify.Email.ToHeader,
+				CC:                   s.Notify.Email.CC,
+				ArchiveEmail:         s.Notify.Email.Archive,
+				VerificationSubject:  s.Notify.Email.VerificationSubject,
+				PreheaderTemplate:    s.Notify.Email.Preheader,
+				FooterTemplate:       s.Notify.Email.Footer,
+				NotifyOnEdit:         s.Notify.Email.NotifyOnEdit,
+				NotifyOnDelete:       s.Notify.Email.NotifyOnDelete,
+				DedupWindow:          s.Notify.Email.DedupWindow,
+				IdempotencyKeys:      s.Notify.Email.IdempotencyKeys,
+				MaxPerWindow:         s.Notify.Email.MaxPerWindow,
+				ThrottleWindow:       s.Notify.Email.ThrottleWindow,
+				BufferSize:           s.Notify.Email.BufferSize,
+				MaxBufferSize:        s.Notify.Email.MaxBufferSize,
+				FlushDuration:        s.Notify.Email.FlushDuration,
+				MaxQueueAge:          s.Notify.Email.MaxQueueAge,
+				FlushJitter:          s.Notify.Email.FlushJitter,
+				MaxBodyBytes:         s.Notify.Email.MaxBodyBytes,
+				PriorityForEvents:    priorityEvents,
+				PriorityForAdmin:     priorityAdmin,
+				ExtraHeaders:         headers,
+				LinkSanitizer:        notify.LinkSanitizer{StripParams: s.Notify.Email.StripLinkParams, ForceHTTPS: s.Notify.Email.HTTPSLinks},
+				Format:               s.Notify.Email.Format,
+				DryRun:               s.Notify.Email.DryRun,
+				LangMsgTemplatePaths: langTemplates,
+				AdminMsgTemplatePath: s.Notify.Email.AdminTemplate,
+				AmpMsgTemplatePath:   s.Notify.Email.AmpTemplate,
+				TemplateDir:          s.Notify.Email.TemplateDir,
+				BreakerThreshold:     s.Notify.Email.BreakerThreshold,
+				BreakerCooldown:      s.Notify.Email.BreakerCooldown,
+				Backend:              s.Notify.Email.Backend,
+				BaseURL:              s.RemarkURL,
+				UnsubscribeURL:       s.RemarkURL + "/email/unsubscribe.html",
 				// TODO: uncomment after #560 frontend part is ready and URL is known
 				// SubscribeURL:        s.RemarkURL + "/subscribe.html?token=",
 				TokenGenFn: func(userID, email, site string) (string, error) {
@@ -837,35 +1242,230 @@ func (s *ServerCommand) makeNotify(dataStore *service.DataStore, authenticator *
 					}
 					return tkn, nil
 				},
+				TokenParseFn: func(tkn string) (userID, email, site string, err error) {
+					claims, err := authenticator.TokenService().Parse(tkn)
+					if err != nil {
+						return "", "", "", errors.Wrapf(err, "failed to parse unsubscription token")
+					}
+					if authenticator.TokenService().IsExpired(claims) {
+						return "", "", "", errors.New("unsubscription token expired")
+					}
+					if claims.Handshake == nil {
+						return "", "", "", errors.New("unsubscription token without handshake")
+					}
+					elems := strings.Split(claims.Handshake.ID, "::")
+					if len(elems) != 2 {
+						return "", "", "", errors.Errorf("invalid unsubscription handshake %q", claims.Handshake.ID)
+					}
+					return elems[0], elems[1], claims.Audience, nil
+				},
+			}
+			if s.Notify.Email.Backend == notify.EmailBackendHTTP {
+				emailParams.HTTPMail = notify.HTTPMailParams{
+					Provider: s.Notify.Email.APIProvider,
+					APIKey:   s.Notify.Email.APIKey,
+					Domain:   s.Notify.Email.APIDomain,
+					URL:      s.Notify.Email.APIURL,
+				}
 			}
 			if s.Notify.Email.AdminNotifications {
 				emailParams.AdminEmails = s.Admin.Shared.Email
 			}
+			if s.Metrics {
+				emailParams.MetricsRegisterer = prometheus.DefaultRegisterer
+			}
+			if s.Notify.Email.PGPKeysDir != "" {
+				emailParams.PGPKeys = notify.PGPKeyDir(s.Notify.Email.PGPKeysDir)
+			}
+			if s.Notify.Email.Persist {
+				if err := makeDirs(s.Store.Bolt.Path); err != nil {
+					return nil, nil, nil, errors.Wrap(err, "failed to create email queue db location")
+				}
+				queue, err := notify.NewBoltEmailQueue(fmt.Sprintf("%s/email_queue.db", s.Store.Bolt.Path))
+				if err != nil {
+					return nil, nil, nil, errors.Wrap(err, "failed to create email queue")
+				}
+				emailParams.Queue = queue
+			}
 			smtpParams := notify.SMTPParams{
-				Host:     s.SMTP.Host,
-				Port:     s.SMTP.Port,
-				TLS:      s.SMTP.TLS,
-				Username: s.SMTP.Username,
-				Password: s.SMTP.Password,
-				TimeOut:  s.SMTP.TimeOut,
+				Host:               s.SMTP.Host,
+				Port:               s.SMTP.Port,
+				TLS:                s.SMTP.TLS,
+				StartTLS:           s.SMTP.StartTLS,
+				MinTLSVersion:      tlsVersions[s.SMTP.TLSMinVersion],
+				InsecureSkipVerify: s.SMTP.InsecureSkipVerify,
+				TLSServerName:      s.SMTP.TLSServerName,
+				Proxy:              s.SMTP.Proxy,
+				LocalName:          s.SMTP.LocalName,
+				AuthMethod:         s.SMTP.Auth,
+				Username:           s.SMTP.Username,
+				Password:           s.SMTP.Password,
+				TimeOut:            s.SMTP.TimeOut,
+				ConnectTimeout:     s.SMTP.ConnectTimeout,
+				SendTimeout:        s.SMTP.SendTimeout,
 			}
 			emailService, err := notify.NewEmail(emailParams, smtpParams)
 			if err != nil {
-				return nil, errors.Wrap(err, "failed to create email notification destination")
+				return nil, nil, nil, errors.Wrap(err, "failed to create email notification destination")
+			}
+			if s.Notify.Email.Digest <= 0 {
+				destinations = append(destinations, emailService)
+				break
+			}
+			if err = makeDirs(s.Store.Bolt.Path); err != nil {
+				return nil, nil, nil, errors.Wrap(err, "failed to create digest db location")
+			}
+			digest, err := notify.NewDigest(emailService, notify.DigestParams{
+				Interval:     s.Notify.Email.Digest,
+				DBPath:       fmt.Sprintf("%s/digest.db", s.Store.Bolt.Path),
+				MaxQueueAge:  s.Notify.Email.DigestMaxAge,
+				FlushOnClose: s.Notify.Email.DigestFlushOnClose,
+				FlushJitter:  s.Notify.Email.DigestJitter,
+			})
+			if err != nil {
+				return nil, nil, nil, errors.Wrap(err, "failed to create email digest notification destination")
 			}
-			destinations = append(destinations, emailService)
+			destinations = append(destinations, digest)
 		case "none":
 			notifyService = notify.NopService
 		default:
-			return nil, errors.Errorf("unsupported notification type %q", s.Notify.Type)
+			return nil, nil, nil, errors.Errorf("unsupported notification type %q", s.Notify.Type)
 		}
 	}
 
 	if len(destinations) > 0 {
 		log.Printf("[INFO] make notify, types=%s", s.Notify.Type)
-		notifyService = notify.NewService(dataStore, s.Notify.QueueSize, destinations...)
+		urlRewrite, err := s.makeNotifyURLRewrite()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		quietHours, err := s.makeNotifyQuietHours()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		spamChecker, err := s.makeNotifySpamChecker()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		serviceParams := notify.ServiceParams{
+			QueueSize:          s.Notify.QueueSize,
+			DestinationTimeout: s.Notify.Timeout,
+			Concurrency:        s.Notify.Concurrency,
+			URLRewrite:         urlRewrite,
+			Mentions:           s.Notify.Mentions,
+			MinScore:           s.Notify.MinScore,
+			ScoreDelay:         s.Notify.ScoreDelay,
+			OverflowPolicy:     overflowPolicies[s.Notify.Overflow],
+			QuietHours:         quietHours,
+			SpamChecker:        spamChecker,
+			SpamToAdmin:        s.Notify.SpamToAdmin,
+		}
+		if s.Metrics {
+			serviceParams.MetricsRegisterer = prometheus.DefaultRegisterer
+		}
+		notifyService = notify.NewServiceWithParams(dataStore, serviceParams, destinations...)
+	}
+	return notifyService, tgModerator, webSub, nil
+}
+
+// makeEmailSiteSenders makes sender overrides for sites from site:address pairs of
+// Notify.Email.SiteFrom and Notify.Email.SiteReplyTo. Display name of from address, i.e.
+// "site:Brand <noreply@brand.com>", is used as the site's from name.
+func (s *ServerCommand) makeEmailSiteSenders() (map[string]notify.EmailSender, error) {
+	res := map[string]notify.EmailSender{}
+	for _, sf := range s.Notify.Email.SiteFrom {
+		elems := strings.SplitN(sf, ":", 2)
+		if len(elems) != 2 {
+			return nil, errors.Errorf("invalid email site from address %q, should be site:address", sf)
+		}
+		addr, err := mail.ParseAddress(elems[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid email site from address %q", sf)
+		}
+		sender := res[elems[0]]
+		sender.From, sender.FromName = addr.Address, addr.Name
+		res[elems[0]] = sender
+	}
+	for _, sr := range s.Notify.Email.SiteReplyTo {
+		elems := strings.SplitN(sr, ":", 2)
+		if len(elems) != 2 {
+			return nil, errors.Errorf("invalid email site reply-to address %q, should be site:address", sr)
+		}
+		sender := res[elems[0]]
+		sender.ReplyTo = elems[1]
+		res[elems[0]] = sender
+	}
+	return res, nil
+}
+
+// makeEmailSiteBrandings makes per-site titles and logos from site:value pairs of SiteTitle and SiteLogo
+func (s *ServerCommand) makeEmailSiteBrandings() (map[string]notify.SiteBranding, error) {
+	res := map[string]notify.SiteBranding{}
+	for _, st := range s.Notify.Email.SiteTitle {
+		elems := strings.SplitN(st, ":", 2)
+		if len(elems) != 2 {
+			return nil, errors.Errorf("invalid email site title %q, should be site:title", st)
+		}
+		branding := res[elems[0]]
+		branding.Title = elems[1]
+		res[elems[0]] = branding
+	}
+	for _, sl := range s.Notify.Email.SiteLogo {
+		elems := strings.SplitN(sl, ":", 2)
+		if len(elems) != 2 {
+			return nil, errors.Errorf("invalid email site logo %q, should be site:url", sl)
+		}
+		branding := res[elems[0]]
+		branding.LogoURL = elems[1]
+		res[elems[0]] = branding
+	}
+	return res, nil
+}
+
+// makeNotifyURLRewrite makes comment URL prefix replacements from internal=public pairs of Notify.URLRewrite
+func (s *ServerCommand) makeNotifyURLRewrite() (map[string]string, error) {
+	res := map[string]string{}
+	for _, rw := range s.Notify.URLRewrite {
+		elems := strings.SplitN(rw, "=", 2)
+		if len(elems) != 2 || elems[0] == "" || elems[1] == "" {
+			return nil, errors.Errorf("invalid notification url rewrite %q, should be internal=public", rw)
+		}
+		res[elems[0]] = elems[1]
 	}
-	return notifyService, nil
+	return res, nil
+}
+
+// makeNotifyQuietHours parses quiet hours period as start-end, i.e. 22:00-07:00, nil if not set
+func (s *ServerCommand) makeNotifyQuietHours() (*notify.QuietHours, error) {
+	if s.Notify.QuietHours == "" {
+		return nil, nil
+	}
+	elems := strings.SplitN(s.Notify.QuietHours, "-", 2)
+	if len(elems) != 2 {
+		return nil, errors.Errorf("invalid notification quiet hours %q, should be start-end, i.e. 22:00-07:00", s.Notify.QuietHours)
+	}
+	var res notify.QuietHours
+	for i, dst := range []*time.Duration{&res.Start, &res.End} {
+		t, err := time.Parse("15:04", strings.TrimSpace(elems[i]))
+		if err != nil {
+			return nil, errors.Errorf("invalid notification quiet hours %q, should be start-end, i.e. 22:00-07:00", s.Notify.QuietHours)
+		}
+		*dst = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	loc, err := time.LoadLocation(s.Notify.QuietTZ)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid notification quiet hours time zone %q", s.Notify.QuietTZ)
+	}
+	res.Location = loc
+	return &res, nil
+}
+
+// makeNotifySpamChecker makes keyword spam checker, nil if no keywords or expressions set
+func (s *ServerCommand) makeNotifySpamChecker() (notify.SpamChecker, error) {
+	if len(s.Notify.SpamWords) == 0 && len(s.Notify.SpamRegex) == 0 {
+		return nil, nil
+	}
+	return notify.NewKeywordSpamChecker(s.Notify.SpamWords, s.Notify.SpamRegex)
 }
 
 func (s *ServerCommand) makeSSLConfig() (config api.SSLConfig, err error) {
@@ -995,3 +1595,27 @@ func (c *authRefreshCache) Get(key interface{}) (interface{}, bool) {
 func (c *authRefreshCache) Set(key, value interface{}) {
 	_, _ = c.LoadingCache.Get(key.(string), func() (interface{}, error) { return value, nil })
 }
+
+// moderationStore used by telegram moderation, resets rest cache of the site on changes
+type moderationStore struct {
+	*service.DataStore
+	cache LoadingCache
+}
+
+// Delete comment and reset cache of the site
+func (m *moderationStore) Delete(locator store.Locator, commentID string, mode store.DeleteMode) error {
+	if err := m.DataStore.Delete(locator, commentID, mode); err != nil {
+		return err
+	}
+	m.cache.Flush(cache.Flusher(locator.SiteID))
+	return nil
+}
+
+// SetBlock blocks user and resets cache of the site
+func (m *moderationStore) SetBlock(siteID, userID string, status bool, ttl time.Duration) error {
+	if err := m.DataStore.SetBlock(siteID, userID, status, ttl); err != nil {
+		return err
+	}
+	m.cache.Flush(cache.Flusher(siteID))
+	return nil
+}
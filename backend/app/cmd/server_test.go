@@ -22,6 +22,9 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/remark42/backend/app/notify"
+	"github.com/umputun/remark42/backend/app/store"
 )
 
 func TestServerApp(t *testing.T) {
@@ -331,6 +334,16 @@ func TestServerApp_Failed(t *testing.T) {
 	assert.EqualError(t, err, "invalid remark42 url demo.remark42.com")
 	t.Log(err)
 
+	// telegram moderation without admins
+	opts = ServerCommand{}
+	opts.SetCommon(CommonOpts{RemarkURL: "https://demo.remark42.com", SharedSecret: "123456"})
+	p = flags.NewParser(&opts, flags.Default)
+	_, err = p.ParseArgs([]string{"--backup=/tmp", "--store.bolt.path=/tmp", "--notify.type=telegram",
+		"--notify.telegram.token=abcd", "--notify.telegram.chan=remark_test", "--notify.telegram.moderation"})
+	assert.NoError(t, err)
+	_, err = opts.newServerApp()
+	assert.EqualError(t, err, "telegram moderation requires at least one telegram admin")
+
 	opts = ServerCommand{}
 	opts.SetCommon(CommonOpts{RemarkURL: "https://demo.remark42.com", SharedSecret: "123456"})
 
@@ -609,6 +622,132 @@ func TestServerCommand_parseSameSite(t *testing.T) {
 	}
 }
 
+func TestServerCommand_makeEmailSiteSenders(t *testing.T) {
+	cmd := ServerCommand{}
+	cmd.Notify.Email.SiteFrom = []string{"brand1:Brand One <noreply@brand1.com>", "brand2:noreply@brand2.com"}
+	cmd.Notify.Email.SiteReplyTo = []string{"brand1:help@brand1.com", "brand3:help@brand3.com"}
+	res, err := cmd.makeEmailSiteSenders()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]notify.EmailSender{
+		"brand1": {From: "noreply@brand1.com", FromName: "Brand One", ReplyTo: "help@brand1.com"},
+		"brand2": {From: "noreply@brand2.com"},
+		"brand3": {ReplyTo: "help@brand3.com"},
+	}, res)
+
+	cmd.Notify.Email.SiteFrom = []string{"brand1"}
+	_, err = cmd.makeEmailSiteSenders()
+	assert.EqualError(t, err, `invalid email site from address "brand1", should be site:address`)
+	cmd.Notify.Email.SiteFrom = []string{"brand1:bad"}
+	_, err = cmd.makeEmailSiteSenders()
+	assert.EqualError(t, err, `invalid email site from address "brand1:bad": mail: missing '@' or angle-addr`)
+}
+
+func TestServerCommand_makeEmailSiteBrandings(t *testing.T) {
+	cmd := ServerCommand{}
+	cmd.Notify.Email.SiteTitle = []string{"blog:My Blog: Notes", "news:News"}
+	cmd.Notify.Email.SiteLogo = []string{"blog:https://example.com/logo.png", "shop:/logo.svg"}
+	res, err := cmd.makeEmailSiteBrandings()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]notify.SiteBranding{
+		"blog": {Title: "My Blog: Notes", LogoURL: "https://example.com/logo.png"},
+		"news": {Title: "News"},
+		"shop": {LogoURL: "/logo.svg"},
+	}, res)
+
+	cmd.Notify.Email.SiteTitle = []string{"blog"}
+	_, err = cmd.makeEmailSiteBrandings()
+	assert.EqualError(t, err, `invalid email site title "blog", should be site:title`)
+	cmd.Notify.Email.SiteTitle, cmd.Notify.Email.SiteLogo = nil, []string{"blog"}
+	_, err = cmd.makeEmailSiteBrandings()
+	assert.EqualError(t, err, `invalid email site logo "blog", should be site:url`)
+}
+
+func TestServerCommand_makeNotifyURLRewrite(t *testing.T) {
+	cmd := ServerCommand{}
+	res, err := cmd.makeNotifyURLRewrite()
+	require.NoError(t, err)
+	assert.Empty(t, res)
+
+	cmd.Notify.URLRewrite = []string{"http://blog:8080/internal/=https://example.com/", "http://a/=http://b/?x=1"}
+	res, err = cmd.makeNotifyURLRewrite()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"http://blog:8080/internal/": "https://example.com/", "http://a/": "http://b/?x=1"}, res)
+
+	cmd.Notify.URLRewrite = []string{"http://blog:8080/internal/"}
+	_, err = cmd.makeNotifyURLRewrite()
+	assert.EqualError(t, err, `invalid notification url rewrite "http://blog:8080/internal/", should be internal=public`)
+}
+
+func TestServerCommand_makeNotifyQuietHours(t *testing.T) {
+	cmd := ServerCommand{}
+	res, err := cmd.makeNotifyQuietHours()
+	require.NoError(t, err)
+	assert.Nil(t, res)
+
+	cmd.Notify.QuietHours, cmd.Notify.QuietTZ = "22:00-07:30", "UTC"
+	res, err = cmd.makeNotifyQuietHours()
+	require.NoError(t, err)
+	assert.Equal(t, &notify.QuietHours{Start: 22 * time.Hour, End: 7*time.Hour + 30*time.Minute, Location: time.UTC}, res)
+
+	cmd.Notify.QuietHours = "22:00"
+	_, err = cmd.makeNotifyQuietHours()
+	assert.EqualError(t, err, `invalid notification quiet hours "22:00", should be start-end, i.e. 22:00-07:00`)
+
+	cmd.Notify.QuietHours = "22:00-25:00"
+	_, err = cmd.makeNotifyQuietHours()
+	assert.EqualError(t, err, `invalid notification quiet hours "22:00-25:00", should be start-end, i.e. 22:00-07:00`)
+
+	cmd.Notify.QuietHours, cmd.Notify.QuietTZ = "22:00-07:00", "Nowhere/City"
+	_, err = cmd.makeNotifyQuietHours()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `invalid notification quiet hours time zone "Nowhere/City"`)
+}
+
+func TestServerCommand_makeNotifyWebSub(t *testing.T) {
+	cmd := ServerCommand{}
+	cmd.RemarkURL = "https://remark42.example.com"
+	cmd.Notify.Type, cmd.Notify.QueueSize = []string{"websub"}, 10
+	cmd.Notify.WebSub.Lease, cmd.Notify.WebSub.MaxLease = time.Hour, 2*time.Hour
+	cmd.Notify.WebSub.MaxSubscriptions = 10
+	dir, err := ioutil.TempDir("", "websub")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	cmd.Store.Bolt.Path = dir
+	svc, tgModerator, webSub, err := cmd.makeNotify(nil, nil, nil)
+	require.NoError(t, err)
+	require.NotNil(t, svc)
+	defer svc.Close()
+	assert.Nil(t, tgModerator)
+	require.NotNil(t, webSub)
+	assert.Equal(t, "websub hub: https://remark42.example.com/api/v1/websub", webSub.String())
+	assert.Equal(t, time.Hour, webSub.DefaultLease)
+	assert.Equal(t, 2*time.Hour, webSub.MaxLease)
+	assert.Equal(t, 10, webSub.MaxSubscriptions)
+
+	cmd.Notify.Type = []string{"none"}
+	_, _, webSub, err = cmd.makeNotify(nil, nil, nil)
+	require.NoError(t, err)
+	assert.Nil(t, webSub, "hub is not made without websub notifications")
+}
+
+func TestServerCommand_makeNotifySpamChecker(t *testing.T) {
+	cmd := ServerCommand{}
+	res, err := cmd.makeNotifySpamChecker()
+	require.NoError(t, err)
+	assert.Nil(t, res)
+
+	cmd.Notify.SpamWords, cmd.Notify.SpamRegex = []string{"casino"}, []string{`\.xyz\b`}
+	res, err = cmd.makeNotifySpamChecker()
+	require.NoError(t, err)
+	require.NotNil(t, res)
+	assert.True(t, res.IsSpam(notify.Request{Comment: store.Comment{Orig: "visit cheap.xyz"}}))
+	assert.False(t, res.IsSpam(notify.Request{Comment: store.Comment{Orig: "clean"}}))
+
+	cmd.Notify.SpamRegex = []string{"[a-"}
+	_, err = cmd.makeNotifySpamChecker()
+	assert.Error(t, err)
+}
+
 func chooseRandomUnusedPort() (port int) {
 	for i := 0; i < 10; i++ {
 		port = 40000 + int(rand.Int31n(10000))
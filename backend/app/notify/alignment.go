@@ -0,0 +1,74 @@
+package notify
+
+import (
+	"fmt"
+	"net/mail"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var domainRe = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z]{2,}$`)
+
+// senderAlignment checks sender addresses against DMARC alignment, as From header address is also used
+// as the envelope sender. Returns error for invalid SigningDomain and warnings for misconfiguration
+// likely to send messages to spam folder: From, FromPool or site From domain not aligned with SigningDomain,
+// i.e. not the same domain or its subdomain, and FromPool addresses of different domains, unless FromPoolMultiDomain set.
+func (e *Email) senderAlignment() (warnings []string, err error) {
+	signing := strings.ToLower(strings.TrimSuffix(e.SigningDomain, "."))
+	if signing != "" && !domainRe.MatchString(signing) {
+		return nil, errors.Errorf("invalid signing domain %q", e.SigningDomain)
+	}
+
+	type sender struct{ name, addr string }
+	senders := []sender{{"from", e.From}}
+	for _, addr := range e.FromPool {
+		senders = append(senders, sender{"from pool", addr})
+	}
+	sites := make([]string, 0, len(e.SiteSenders))
+	for site := range e.SiteSenders {
+		sites = append(sites, site)
+	}
+	sort.Strings(sites)
+	for _, site := range sites {
+		if addr := e.SiteSenders[site].From; addr != "" {
+			senders = append(senders, sender{fmt.Sprintf("site %q from", site), addr})
+		}
+	}
+
+	poolDomains := map[string]bool{}
+	for _, s := range senders {
+		domain := addressDomain(s.addr)
+		if domain == "" {
+			continue
+		}
+		if s.name == "from pool" {
+			poolDomains[domain] = true
+		}
+		if signing != "" && domain != signing && !strings.HasSuffix(domain, "."+signing) {
+			warnings = append(warnings, fmt.Sprintf("%s address %q is not aligned with signing domain %q",
+				s.name, s.addr, signing))
+		}
+	}
+	if len(poolDomains) > 1 && !e.FromPoolMultiDomain {
+		domains := make([]string, 0, len(poolDomains))
+		for d := range poolDomains {
+			domains = append(domains, d)
+		}
+		sort.Strings(domains)
+		warnings = append(warnings, fmt.Sprintf("from pool addresses span multiple domains %s, "+
+			"set multi-domain pool explicitly if it's intended", strings.Join(domains, ", ")))
+	}
+	return warnings, nil
+}
+
+// addressDomain returns lowercase domain of the address, empty for the invalid one
+func addressDomain(addr string) string {
+	a, err := mail.ParseAddress(addr)
+	if err != nil {
+		return ""
+	}
+	return recipientDomain(a.Address)
+}
@@ -0,0 +1,55 @@
+package notify
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmail_senderAlignment(t *testing.T) {
+	tbl := []struct {
+		name     string
+		params   EmailParams
+		warnings []string
+		err      string
+	}{
+		{name: "no signing domain", params: EmailParams{From: "from@example.org"}},
+		{name: "aligned", params: EmailParams{From: "Site <from@mail.Example.org>", SigningDomain: "example.org",
+			FromPool: []string{"a@example.org", "b@example.org"}}},
+		{name: "from not aligned", params: EmailParams{From: "from@example.com", SigningDomain: "example.org"},
+			warnings: []string{`from address "from@example.com" is not aligned with signing domain "example.org"`}},
+		{name: "parent domain not aligned", params: EmailParams{From: "from@example.org", SigningDomain: "mail.example.org"},
+			warnings: []string{`from address "from@example.org" is not aligned with signing domain "mail.example.org"`}},
+		{name: "site and pool not aligned", params: EmailParams{From: "from@example.org", SigningDomain: "example.org",
+			FromPool:    []string{"a@example.org", "b@notexample.org"},
+			SiteSenders: map[string]EmailSender{"s2": {From: "s2@other.com"}, "s1": {ReplyTo: "r@other.com"}}},
+			warnings: []string{
+				`from pool address "b@notexample.org" is not aligned with signing domain "example.org"`,
+				`site "s2" from address "s2@other.com" is not aligned with signing domain "example.org"`,
+				"from pool addresses span multiple domains example.org, notexample.org, set multi-domain pool explicitly if it's intended",
+			}},
+		{name: "multi-domain pool", params: EmailParams{From: "from@example.org", FromPool: []string{"a@example.org", "b@example.com"}},
+			warnings: []string{"from pool addresses span multiple domains example.com, example.org, " +
+				"set multi-domain pool explicitly if it's intended"}},
+		{name: "multi-domain pool acknowledged", params: EmailParams{From: "from@example.org",
+			FromPool: []string{"a@example.org", "b@example.com"}, FromPoolMultiDomain: true}},
+		{name: "invalid signing domain", params: EmailParams{From: "from@example.org", SigningDomain: "example org"},
+			err: `invalid signing domain "example org"`},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			e := Email{EmailParams: tt.params}
+			warnings, err := e.senderAlignment()
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.warnings, warnings)
+		})
+	}
+
+	_, err := NewEmail(EmailParams{From: "from@example.org", SigningDomain: "-bad-"}, SMTPParams{})
+	assert.EqualError(t, err, `invalid signing domain "-bad-"`)
+}
@@ -0,0 +1,82 @@
+package notify
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// errCircuitOpen returned instead of connecting to the server while circuit breaker is open
+var errCircuitOpen = errors.New("circuit open")
+
+// circuitBreaker stops connection attempts after threshold consecutive failures for cooldown period.
+// After cooldown it lets a single attempt through (half-open state), success of which closes the circuit
+// and failure opens it for another cooldown period. Thread safe.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	lock     sync.Mutex
+	failures int       // consecutive failures
+	openedAt time.Time // zero if circuit is closed
+	probing  bool      // attempt in half-open state is in progress
+}
+
+// circuit breaker states
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half-open"
+)
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown, now: time.Now}
+}
+
+// allow checks if attempt can be made, returns errCircuitOpen otherwise
+func (b *circuitBreaker) allow() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.openedAt.IsZero() {
+		return nil
+	}
+	if b.probing || b.now().Sub(b.openedAt) < b.cooldown {
+		return errCircuitOpen
+	}
+	b.probing = true
+	return nil
+}
+
+// success closes the circuit, returns true if it was open before
+func (b *circuitBreaker) success() (recovered bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	recovered = !b.openedAt.IsZero()
+	b.failures, b.openedAt, b.probing = 0, time.Time{}, false
+	return recovered
+}
+
+// failure counts failed attempt, opens the circuit on threshold or on failure in half-open state
+func (b *circuitBreaker) failure() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.failures++
+	if b.probing || b.failures >= b.threshold {
+		b.openedAt, b.probing = b.now(), false
+	}
+}
+
+// state returns current state of the circuit
+func (b *circuitBreaker) state() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	switch {
+	case b.openedAt.IsZero():
+		return circuitClosed
+	case b.probing || b.now().Sub(b.openedAt) >= b.cooldown:
+		return circuitHalfOpen
+	}
+	return circuitOpen
+}
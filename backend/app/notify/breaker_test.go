@@ -0,0 +1,48 @@
+package notify
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC)
+	b := newCircuitBreaker(3, time.Minute)
+	b.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		require.NoError(t, b.allow())
+		b.failure()
+	}
+	assert.Equal(t, circuitClosed, b.state(), "below threshold")
+	assert.False(t, b.success(), "circuit was not open")
+	b.failure()
+	b.failure()
+	assert.Equal(t, circuitClosed, b.state(), "success resets failures count")
+	b.failure()
+	assert.Equal(t, circuitOpen, b.state())
+	assert.Equal(t, errCircuitOpen, b.allow())
+
+	now = now.Add(59 * time.Second)
+	assert.Equal(t, errCircuitOpen, b.allow(), "cooldown is not over")
+
+	// half-open, single attempt allowed
+	now = now.Add(time.Second)
+	assert.Equal(t, circuitHalfOpen, b.state())
+	require.NoError(t, b.allow())
+	assert.Equal(t, errCircuitOpen, b.allow(), "attempt in progress")
+	b.failure()
+	assert.Equal(t, circuitOpen, b.state(), "failed attempt opens circuit again")
+	assert.Equal(t, errCircuitOpen, b.allow())
+
+	now = now.Add(time.Minute)
+	require.NoError(t, b.allow())
+	assert.True(t, b.success(), "circuit recovered")
+	assert.Equal(t, circuitClosed, b.state())
+	require.NoError(t, b.allow())
+	b.failure()
+	assert.Equal(t, circuitClosed, b.state(), "failures counted from zero")
+}
@@ -0,0 +1,73 @@
+package notify
+
+import (
+	"bytes"
+	"html/template"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// deleteTmplData store data for deletion message template execution
+type deleteTmplData struct {
+	UserName        string
+	PostTitle       string
+	PostLink        string
+	CommentText     template.HTML // sanitized html of the deleted comment
+	CommentDate     time.Time
+	Reason          string
+	SiteTitle       string
+	UnsubscribeLink string
+}
+
+var deleteTmpl = template.Must(template.New("delete").Parse(`<!DOCTYPE html>
+<html>
+<body>
+<p>Hi {{.UserName}}, your comment{{if .PostTitle}} on "{{.PostTitle}}"{{end}} was deleted by the moderator of {{.SiteTitle}}.</p>
+{{if .Reason}}<p>Reason: {{.Reason}}</p>
+{{end}}<blockquote>{{.CommentText}}</blockquote>
+<p><a href="{{.PostLink}}">{{.PostLink}}</a></p>
+{{if .UnsubscribeLink}}<p><a href="{{.UnsubscribeLink}}">Unsubscribe</a></p>{{end}}
+</body>
+</html>
+`))
+
+// buildDeleteMessage generates message to the author of the comment deleted by moderator,
+// with Request.DeleteReason if it's set
+func (e *Email) buildDeleteMessage(sender EmailSender, req Request, email string) (string, error) {
+	siteID := req.Comment.Locator.SiteID
+	token, err := e.TokenGenFn(req.Comment.User.ID, email, siteID)
+	if err != nil {
+		return "", errors.Wrapf(err, "error creating token for unsubscribe link")
+	}
+	data := deleteTmplData{
+		UserName:        req.Comment.User.Name,
+		PostTitle:       req.Comment.PostTitle,
+		PostLink:        req.Comment.Locator.URL,
+		CommentText:     template.HTML(e.LinkSanitizer.Sanitize(commentHTML(req.Comment))), //nolint:gosec // sanitized
+		CommentDate:     req.Comment.Timestamp,
+		Reason:          req.DeleteReason,
+		UnsubscribeLink: e.UnsubscribeURL + "?site=" + siteID + "&tkn=" + token,
+	}
+	data.SiteTitle, _ = e.branding(siteID)
+
+	body := bytes.Buffer{}
+	if err = deleteTmpl.Execute(&body, data); err != nil {
+		return "", errors.Wrapf(err, "error executing template to build deletion message")
+	}
+	subject := "Your comment was deleted"
+	if data.PostTitle != "" {
+		subject += " on " + data.PostTitle
+	}
+	footer, err := e.footer(siteID, email, data.UnsubscribeLink)
+	if err != nil {
+		return "", err
+	}
+	htmlBody, plain := withFooter(body.String(), htmlToText(body.String()), footer)
+	if e.Format == EmailFormatText {
+		return e.buildMessage(sender, subject, plain, email, "text/plain",
+			data.UnsubscribeLink, e.customHeaders(), time.Time{})
+	}
+	return e.buildMultipartMessage(sender, subject, plain, htmlBody, "", email,
+		data.UnsubscribeLink, e.customHeaders(), time.Time{})
+}
@@ -0,0 +1,55 @@
+package notify
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/remark42/backend/app/store"
+)
+
+func TestEmail_SendDelete(t *testing.T) {
+	email, err := NewEmail(EmailParams{
+		From:                     "from@example.org",
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "testdata/msg.html.tmpl",
+		AdminEmails:              []string{"admin@example.org"},
+		NotifyOnDelete:           true,
+		TokenGenFn:               TokenGenFn,
+		UnsubscribeURL:           "https://remark42.com/api/v1/email/unsubscribe",
+	}, SMTPParams{})
+	require.NoError(t, err)
+	fakeSMTP := fakeTestSMTP{}
+	email.smtp = &fakeSMTP
+	assert.True(t, email.Accepts(EventDelete))
+
+	req := Request{
+		Event: EventDelete,
+		Comment: store.Comment{ID: "999", User: store.User{ID: "1", Name: "test_user"}, PostTitle: "test_title",
+			Text: "<p>some <b>rude</b> text</p>", Locator: store.Locator{SiteID: "remark", URL: "https://example.com/post"}},
+		Moderated:    true,
+		DeleteReason: "off-topic & rude",
+		Emails:       []string{"test@example.org"},
+	}
+	require.NoError(t, email.Send(context.TODO(), req))
+	assert.Equal(t, "test@example.org", fakeSMTP.readRcpt(), "admin copy is not sent")
+
+	res, err := email.buildMessageFromRequest(email.sender("remark"), req, "test@example.org", false)
+	require.NoError(t, err)
+	assert.Contains(t, res, "Subject: Your comment was deleted on test_title\n")
+	assert.Contains(t, res, "Hi test_user, your comment on \"test_title\" was deleted by the moderator of =\r\nremark.")
+	assert.Contains(t, res, "<p>Reason: off-topic &amp; rude</p>")
+	assert.Contains(t, res, "<blockquote><p>some <b>rude</b> text</p></blockquote>")
+	assert.Contains(t, res, "List-Unsubscribe: <https://remark42.com/api/v1/email/unsubscribe?site=remark&tkn=token>")
+
+	// no reason
+	req.DeleteReason = ""
+	res, err = email.buildMessageFromRequest(email.sender("remark"), req, "test@example.org", false)
+	require.NoError(t, err)
+	assert.NotContains(t, res, "Reason:")
+
+	email.NotifyOnDelete = false
+	assert.False(t, email.Accepts(EventDelete))
+}
@@ -0,0 +1,96 @@
+package notify
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+// maxDiffTokens limits number of words and spaces in each text compared by editDiff
+const maxDiffTokens = 2000
+
+var diffTokenRe = regexp.MustCompile(`\s+|\S+`)
+
+// diffOp is a run of tokens kept, added or removed by the edit
+type diffOp struct {
+	kind byte // '=' kept, '+' added, '-' removed
+	text string
+}
+
+// editDiff returns html of word changes between the previous and the current text of the comment,
+// added words are wrapped in <ins> and removed ones in <del>. Empty if there is no previous text,
+// texts are the same or too long to compare.
+func editDiff(prev, cur string) string {
+	if prev == "" || prev == cur {
+		return ""
+	}
+	a, b := diffTokenRe.FindAllString(prev, -1), diffTokenRe.FindAllString(cur, -1)
+	if len(a) > maxDiffTokens || len(b) > maxDiffTokens {
+		return ""
+	}
+
+	res := strings.Builder{}
+	for _, op := range diffTokens(a, b) {
+		text := strings.ReplaceAll(html.EscapeString(op.text), "\n", "<br>\n")
+		switch op.kind {
+		case '+':
+			res.WriteString(`<ins style="background-color: #dfd; color: #070; text-decoration: none;">` + text + "</ins>")
+		case '-':
+			res.WriteString(`<del style="background-color: #fdd; color: #a00;">` + text + "</del>")
+		default:
+			res.WriteString(text)
+		}
+	}
+	return res.String()
+}
+
+// diffTokens returns runs of tokens turning a into b, based on the longest common subsequence of tokens
+func diffTokens(a, b []string) (res []diffOp) {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	add := func(kind byte, text string) {
+		if n := len(res); n > 0 && res[n-1].kind == kind {
+			res[n-1].text += text
+			return
+		}
+		res = append(res, diffOp{kind: kind, text: text})
+	}
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			add('=', a[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			add('-', a[i])
+			i++
+		default:
+			add('+', b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		add('-', a[i])
+	}
+	for ; j < len(b); j++ {
+		add('+', b[j])
+	}
+	return res
+}
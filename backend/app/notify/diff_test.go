@@ -0,0 +1,73 @@
+package notify
+
+import (
+	"context"
+	"io/ioutil"
+	"mime/quotedprintable"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/remark42/backend/app/store"
+)
+
+const (
+	insOpen = `<ins style="background-color: #dfd; color: #070; text-decoration: none;">`
+	delOpen = `<del style="background-color: #fdd; color: #a00;">`
+)
+
+func TestEditDiff(t *testing.T) {
+	tbl := []struct {
+		prev, cur, res string
+	}{
+		{"", "first version", ""},
+		{"same", "same", ""},
+		{"Hello world.", "Hello world. I've added a sentence.", "Hello world." + insOpen + " I&#39;ve added a sentence.</ins>"},
+		{"one two three", "one three", "one " + delOpen + "two </del>three"},
+		{"a <b> c", "a <i> c", "a " + delOpen + "&lt;b&gt;</del>" + insOpen + "&lt;i&gt;</ins> c"},
+		{"line1\nline2", "line1\nline2\nline3", "line1<br>\nline2" + insOpen + "<br>\nline3</ins>"},
+		{strings.Repeat("w ", maxDiffTokens), "w", ""},
+	}
+	for i, tt := range tbl {
+		assert.Equal(t, tt.res, editDiff(tt.prev, tt.cur), "case #%d", i)
+	}
+}
+
+func TestEmail_SendEditDiff(t *testing.T) {
+	email, err := NewEmail(EmailParams{
+		From:                     "from@example.org",
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "../../templates/email_reply.html.tmpl",
+		NotifyOnEdit:             true,
+		TokenGenFn:               TokenGenFn,
+	}, SMTPParams{})
+	require.NoError(t, err)
+	fakeSMTP := &fakeTestSMTP{}
+	email.smtp = fakeSMTP
+
+	req := Request{
+		Event: EventEdit,
+		Comment: store.Comment{ID: "999", User: store.User{ID: "1", Name: "test_user"}, ParentID: "1",
+			Text: "<p>The first one. The second one.</p>", Orig: "The first one. The second one."},
+		parent:   store.Comment{ID: "1", User: store.User{ID: "999", Name: "parent_user"}},
+		PrevOrig: "The first one.",
+		Emails:   []string{"test@example.org"},
+	}
+	htmlPart := func() string {
+		msg, err := email.buildMessageFromRequest(email.sender(""), req, "test@example.org", false)
+		require.NoError(t, err)
+		body, err := ioutil.ReadAll(quotedprintable.NewReader(strings.NewReader(msg[strings.Index(msg, "text/html"):])))
+		require.NoError(t, err)
+		return string(body)
+	}
+	assert.Contains(t, htmlPart(), "The first one."+insOpen+" The second one.</ins>")
+
+	// the first version
+	req.PrevOrig = ""
+	body := htmlPart()
+	assert.Contains(t, body, "<p>The first one. The second one.</p>")
+	assert.NotContains(t, body, "<ins")
+	require.NoError(t, email.Send(context.Background(), req))
+}
@@ -0,0 +1,597 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"text/template"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/umputun/remark42/backend/app/templates"
+)
+
+// DigestParams contain settings for digest emails
+type DigestParams struct {
+	Interval     time.Duration // period of digest, i.e. 24h for daily and 168h for weekly one
+	Offset       time.Duration // shift of send time from the period start, i.e. 9h to send daily digest at 09:00 UTC
+	TemplatePath string        // path to digest message template
+	Subject      string        // digest message subject
+	DBPath       string        // path to bolt file with pending comments and last sent watermark for each recipient
+	MaxQueueAge  time.Duration // send recipient's digest early once a comment waits in it longer than this, disabled if 0
+	FlushOnClose bool          // send pending digests on Close instead of keeping them till the next start
+	// FlushJitter shifts each digest send randomly within ±FlushJitter of the interval boundary, so instances
+	// sharing SMTP server don't send at the same moment. Should be less than half of Interval, disabled if 0.
+	FlushJitter time.Duration
+}
+
+// Digest implements notify.Destination collecting comment notifications for each recipient and sending
+// them as a single email once in DigestParams.Interval. Intervals are aligned to UTC, so daily digest starts
+// at midnight and weekly one on Monday, both shifted by DigestParams.Offset.
+// With DigestParams.MaxQueueAge set, recipient's digest is sent before the end of interval
+// as soon as the oldest comment in it waits longer than MaxQueueAge.
+// With DigestParams.FlushJitter set, send time is shifted from the boundary by random per instance value
+// within ±FlushJitter, so digest waits at most Interval+FlushJitter. Early sends are not shifted.
+// Verification requests are sent by wrapped Email right away. Digests are sent bypassing the buffer of wrapped Email,
+// so its BufferSize, MaxBufferSize and FlushDuration don't apply to them, same as DigestParams don't apply to the buffer.
+type Digest struct {
+	DigestParams
+
+	email      *Email
+	tmpl       *template.Template
+	db         *bolt.DB
+	now        func() time.Time
+	jitterSeed uint64 // random per instance, makes FlushJitter shift for the same boundary different between instances
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+	added  chan struct{} // signals new comment to reschedule early send, used with MaxQueueAge only
+}
+
+// digestItem is a single comment waiting to be included in the digest
+type digestItem struct {
+	SiteID         string    `json:"site"`
+	PostURL        string    `json:"post_url"`
+	PostTitle      string    `json:"post_title"`
+	UserID         string    `json:"user_id"` // id of the recipient, used for unsubscribe link
+	ForAdmin       bool      `json:"for_admin"`
+	CommentID      string    `json:"comment_id"`
+	UserName       string    `json:"user_name"`
+	Text           string    `json:"text"`
+	Link           string    `json:"link"`
+	ParentUserName string    `json:"parent_user_name"`
+	Timestamp      time.Time `json:"time"`
+	Queued         time.Time `json:"queued,omitempty"` // time the comment was added to the digest
+}
+
+// digestThread is a list of comments to the same post
+type digestThread struct {
+	PostTitle string
+	PostURL   string
+	Comments  []digestItem
+}
+
+// digestTmplData store data for digest message template execution
+type digestTmplData struct {
+	Email           string
+	Since           time.Time // time the latest comment of the previous digest was queued, zero for the first one
+	Threads         []digestThread
+	UnsubscribeLink string
+}
+
+const (
+	defaultDigestInterval     = 24 * time.Hour
+	defaultDigestTemplatePath = "email_digest.html.tmpl"
+	defaultDigestSubject      = "New comments digest"
+)
+
+var (
+	digestPendingBucket = []byte("pending") // recipient email -> json list of digestItem
+	digestSentBucket    = []byte("sent")    // recipient email -> queue time of the latest comment sent
+)
+
+// NewDigest makes digest destination sending messages with provided email
+func NewDigest(email *Email, params DigestParams) (*Digest, error) {
+	if email == nil {
+		return nil, errors.New("email destination is required for digest")
+	}
+	res := Digest{DigestParams: params, email: email, now: time.Now}
+	if res.Interval <= 0 {
+		res.Interval = defaultDigestInterval
+	}
+	if res.Offset < 0 || res.Offset >= res.Interval {
+		return nil, errors.Errorf("digest offset %v should be within interval %v", res.Offset, res.Interval)
+	}
+	if res.FlushJitter < 0 || res.FlushJitter*2 >= res.Interval {
+		return nil, errors.Errorf("digest flush jitter %v should be less than half of interval %v", res.FlushJitter, res.Interval)
+	}
+	res.jitterSeed = rand.New(rand.NewSource(time.Now().UnixNano())).Uint64() //nolint:gosec // not used for security
+	if res.Subject == "" {
+		res.Subject = defaultDigestSubject
+	}
+	if res.TemplatePath == "" {
+		res.TemplatePath = defaultDigestTemplatePath
+	}
+
+	tmplFile, err := templates.NewFS().ReadFile(res.TemplatePath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't read digest template")
+	}
+	if res.tmpl, err = template.New("digestTmpl").Funcs(templateFuncs).Parse(string(tmplFile)); err != nil {
+		return nil, errors.Wrapf(err, "can't parse digest template")
+	}
+
+	if res.db, err = bolt.Open(res.DBPath, 0600, &bolt.Options{Timeout: 30 * time.Second}); err != nil { //nolint:gocritic //octalLiteral is OK as FileMode
+		return nil, errors.Wrapf(err, "failed to open digest db %s", res.DBPath)
+	}
+	err = res.db.Update(func(tx *bolt.Tx) error {
+		for _, bkt := range [][]byte{digestPendingBucket, digestSentBucket} {
+			if _, e := tx.CreateBucketIfNotExists(bkt); e != nil {
+				return errors.Wrapf(e, "failed to create bucket %s", string(bkt))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = res.db.Close()
+		return nil, err
+	}
+
+	res.ctx, res.cancel = context.WithCancel(context.Background())
+	res.done = make(chan struct{})
+	res.added = make(chan struct{}, 1)
+	go res.run()
+	log.Printf("[INFO] create digest %s, interval %v, offset %v, max queue age %v, flush jitter %v",
+		res.email, res.Interval, res.Offset, res.MaxQueueAge, res.FlushJitter)
+	return &res, nil
+}
+
+// Send saves comment to digests of Request.Emails and Email.AdminEmails, it will be delivered with the next digest.
+// Thread safe
+func (d *Digest) Send(ctx context.Context, req Request) error {
+	select {
+	case <-ctx.Done():
+		return errors.Errorf("adding comment %q to digest aborted due to canceled context", req.Comment.ID)
+	default:
+	}
+
+	item := digestItem{
+		SiteID:    req.Comment.Locator.SiteID,
+		PostURL:   req.Comment.Locator.URL,
+		PostTitle: req.Comment.PostTitle,
+		UserID:    req.parent.User.ID,
+		CommentID: req.Comment.ID,
+		UserName:  req.Comment.User.Name,
+		Text:      commentHTML(req.Comment),
+		Link:      req.Comment.Locator.URL + uiNav + req.Comment.ID,
+		Timestamp: req.Comment.Timestamp,
+		Queued:    d.now(),
+	}
+	if req.Comment.ParentID != "" {
+		item.ParentUserName = req.parent.User.Name
+	}
+	if item.Timestamp.IsZero() {
+		item.Timestamp = d.now()
+	}
+
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		for _, email := range req.Emails {
+			if err := d.addItem(tx, email, item); err != nil {
+				return err
+			}
+		}
+		adminItem := item
+		adminItem.ForAdmin, adminItem.UserID = true, ""
+		for _, email := range d.email.AdminEmails {
+			if err := d.addItem(tx, email, adminItem); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil && d.MaxQueueAge > 0 {
+		select {
+		case d.added <- struct{}{}:
+		default:
+		}
+	}
+	return err
+}
+
+// Ping checks SMTP server of wrapped Email is reachable
+func (d *Digest) Ping(ctx context.Context) error {
+	return d.email.Ping(ctx)
+}
+
+// SendVerification sends verification email right away with wrapped Email
+func (d *Digest) SendVerification(ctx context.Context, req VerificationRequest) error {
+	return d.email.SendVerification(ctx, req)
+}
+
+// Close stops sending digests and closes wrapped Email,
+// pending comments are kept and delivered with the next digest after restart.
+// With DigestParams.FlushOnClose set, it does Shutdown instead.
+func (d *Digest) Close(ctx context.Context) error {
+	if d.FlushOnClose {
+		return d.Shutdown(ctx)
+	}
+	d.Stop()
+	<-d.Stopped()
+	errs := new(multierror.Error)
+	errs = multierror.Append(errs, d.email.Close(ctx), d.db.Close())
+	return errs.ErrorOrNil()
+}
+
+// Shutdown stops sending digests on schedule, sends all pending ones till the context is done
+// and closes wrapped Email. Digests not sent in time are reported in returned error,
+// their comments are kept and delivered with the next digest after restart.
+func (d *Digest) Shutdown(ctx context.Context) error {
+	d.Stop()
+	<-d.Stopped()
+	errs := new(multierror.Error)
+	if err := d.flush(ctx); err != nil {
+		errs = multierror.Append(errs, errors.Wrap(err, "failed to send pending digests on shutdown"))
+	}
+	errs = multierror.Append(errs, d.email.Close(ctx), d.db.Close())
+	return errs.ErrorOrNil()
+}
+
+// Stop stops sending digests on schedule, digest in progress is aborted. Comments are still added
+// by Send and can be delivered with Shutdown. Doesn't wait for termination, see Stopped. Thread safe.
+func (d *Digest) Stop() {
+	d.cancel()
+	// drain pending signal of new comment, nobody is going to reschedule sending anymore
+	select {
+	case <-d.added:
+	default:
+	}
+}
+
+// Stopped returns channel closed once sending digests on schedule is terminated after Stop
+func (d *Digest) Stopped() <-chan struct{} {
+	return d.done
+}
+
+// Name of Digest destination
+func (d *Digest) Name() string {
+	return "digest"
+}
+
+// String representation of Digest object
+func (d *Digest) String() string {
+	return "digest of " + d.email.String()
+}
+
+// run sends digests at the end of each interval until Close is called.
+// With MaxQueueAge set, digests with comments waiting longer than it are sent in between.
+func (d *Digest) run() {
+	defer close(d.done)
+	var retryAged time.Time // earliest time of the next early send, prevents busy loop on failed ones
+	for {
+		next, aged := d.nextFlush(d.now()), false
+		if early := d.nextAgedFlush(); !early.IsZero() && early.Before(next) {
+			if early.Before(retryAged) {
+				early = retryAged
+			}
+			next, aged = early, true
+		}
+		timer := time.NewTimer(next.Sub(d.now()))
+		select {
+		case <-d.ctx.Done():
+			timer.Stop()
+			return
+		case <-d.added:
+			timer.Stop()
+		case <-timer.C:
+			if !aged {
+				if err := d.flush(d.ctx); err != nil {
+					log.Printf("[WARN] failed to send digest, %v", err)
+				}
+				continue
+			}
+			retryAged = d.now().Add(d.MaxQueueAge)
+			if err := d.flushQueuedBefore(d.ctx, d.now().Add(-d.MaxQueueAge)); err != nil {
+				log.Printf("[WARN] failed to send early digest, %v", err)
+			}
+		}
+	}
+}
+
+// nextAgedFlush returns time the oldest pending comment exceeds MaxQueueAge,
+// zero if MaxQueueAge is not set or there are no pending comments
+func (d *Digest) nextAgedFlush() time.Time {
+	if d.MaxQueueAge <= 0 {
+		return time.Time{}
+	}
+	var oldest time.Time
+	err := d.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(digestPendingBucket).ForEach(func(k, v []byte) error {
+			var items []digestItem
+			if err := json.Unmarshal(v, &items); err != nil {
+				return errors.Wrapf(err, "failed to unmarshal digest of %s", string(k))
+			}
+			for _, item := range items {
+				if q := item.queuedAt(); oldest.IsZero() || q.Before(oldest) {
+					oldest = q
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		log.Printf("[WARN] failed to read pending digests, %v", err)
+		return time.Time{}
+	}
+	if oldest.IsZero() {
+		return time.Time{}
+	}
+	return oldest.Add(d.MaxQueueAge)
+}
+
+// nextFlush returns the next time digest should be sent after provided time.
+// With FlushJitter the shift of each boundary is fixed, so the last passed boundary shifted forward
+// may still be ahead, while the next one shifted back and already reached is skipped.
+func (d *Digest) nextFlush(now time.Time) time.Time {
+	next := now.UTC().Truncate(d.Interval).Add(d.Offset)
+	if next.After(now) {
+		next = next.Add(-d.Interval)
+	}
+	for {
+		if shifted := next.Add(d.jitter(next)); shifted.After(now) {
+			return shifted
+		}
+		next = next.Add(d.Interval)
+	}
+}
+
+// jitter returns shift of the send time for the interval boundary within ±FlushJitter,
+// same for the same boundary and instance
+func (d *Digest) jitter(boundary time.Time) time.Duration {
+	if d.FlushJitter <= 0 {
+		return 0
+	}
+	h := fnv.New64a()
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint64(b, d.jitterSeed)
+	binary.BigEndian.PutUint64(b[8:], uint64(boundary.UnixNano()))
+	_, _ = h.Write(b)
+	return time.Duration(h.Sum64()%uint64(2*d.FlushJitter+1)) - d.FlushJitter
+}
+
+// flush sends digest to every recipient with pending comments. Comments queued not later than
+// the recipient's watermark were already sent before and skipped, so restart in the middle
+// of flush doesn't lead to duplicate digests. Queue time is used instead of comment time, as comment
+// could be queued long after it was made, i.e. imported or delayed by moderation.
+func (d *Digest) flush(ctx context.Context) error {
+	return d.flushQueuedBefore(ctx, time.Time{})
+}
+
+// flushQueuedBefore sends digests only to recipients having pending comments queued not later than
+// provided time, same as flush does. Zero time means all recipients.
+func (d *Digest) flushQueuedBefore(ctx context.Context, before time.Time) error {
+	type digest struct {
+		email     string
+		items     []digestItem
+		watermark time.Time
+	}
+	var digests []digest
+	err := d.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(digestPendingBucket).ForEach(func(k, v []byte) error {
+			dg := digest{email: string(k)}
+			if err := json.Unmarshal(v, &dg.items); err != nil {
+				return errors.Wrapf(err, "failed to unmarshal digest of %s", dg.email)
+			}
+			if ts := tx.Bucket(digestSentBucket).Get(k); ts != nil {
+				if err := dg.watermark.UnmarshalText(ts); err != nil {
+					return errors.Wrapf(err, "failed to unmarshal digest watermark of %s", dg.email)
+				}
+			}
+			digests = append(digests, dg)
+			return nil
+		})
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to read pending digests")
+	}
+
+	result := new(multierror.Error)
+	cid := correlationID(ctx)
+	var msgs []emailMessage
+	var sent []digest // digests to mark as sent, corresponding to msgs
+	for _, dg := range digests {
+		var fresh []digestItem
+		for _, item := range dg.items {
+			if item.queuedAt().After(dg.watermark) {
+				fresh = append(fresh, item)
+			}
+		}
+		if len(fresh) == 0 {
+			// everything was sent already, clean up pending list
+			if e := d.markSent(dg.email, dg.items, time.Time{}); e != nil {
+				result = multierror.Append(result, e)
+			}
+			continue
+		}
+		if !before.IsZero() && !queuedBefore(fresh, before) {
+			continue
+		}
+		msg, e := d.buildMessage(dg.email, fresh, dg.watermark)
+		if e != nil {
+			result = multierror.Append(result, errors.Wrapf(e, "problem building digest for %q", dg.email))
+			continue
+		}
+		msg.cid = cid
+		msgs = append(msgs, msg)
+		sent = append(sent, digest{email: dg.email, items: dg.items, watermark: lastQueued(fresh)})
+	}
+	if len(msgs) == 0 {
+		return result.ErrorOrNil()
+	}
+
+	for i, e := range d.email.sendWithRetries(ctx, msgs) {
+		if e != nil {
+			result = multierror.Append(result, errors.Wrapf(e, "problem sending digest to %q, cid %s", msgs[i].to, cid))
+			continue
+		}
+		if e = d.markSent(sent[i].email, sent[i].items, sent[i].watermark); e != nil {
+			result = multierror.Append(result, e)
+		}
+	}
+	return result.ErrorOrNil()
+}
+
+// queuedBefore checks if any of items queued not later than provided time
+func queuedBefore(items []digestItem, before time.Time) bool {
+	for _, item := range items {
+		if !item.queuedAt().After(before) {
+			return true
+		}
+	}
+	return false
+}
+
+// lastQueued returns the latest queue time of items
+func lastQueued(items []digestItem) (res time.Time) {
+	for _, item := range items {
+		if item.queuedAt().After(res) {
+			res = item.queuedAt()
+		}
+	}
+	return res
+}
+
+// queuedAt returns time the item was added to the digest, comment time for items added before it was recorded
+func (item digestItem) queuedAt() time.Time {
+	if item.Queued.IsZero() {
+		return item.Timestamp
+	}
+	return item.Queued
+}
+
+// markSent removes sent items from the recipient's pending list and moves the watermark forward,
+// comments added to the list while digest was sent are kept for the next one
+func (d *Digest) markSent(email string, items []digestItem, watermark time.Time) error {
+	sentIDs := make(map[string]bool, len(items))
+	for _, item := range items {
+		sentIDs[item.CommentID] = true
+	}
+	return d.db.Update(func(tx *bolt.Tx) error {
+		var pending, rest []digestItem
+		if v := tx.Bucket(digestPendingBucket).Get([]byte(email)); v != nil {
+			if err := json.Unmarshal(v, &pending); err != nil {
+				return errors.Wrapf(err, "failed to unmarshal digest of %s", email)
+			}
+		}
+		for _, item := range pending {
+			if !sentIDs[item.CommentID] {
+				rest = append(rest, item)
+			}
+		}
+		if err := d.putItems(tx, email, rest); err != nil {
+			return err
+		}
+		if watermark.IsZero() {
+			return nil
+		}
+		ts, err := watermark.MarshalText()
+		if err != nil {
+			return errors.Wrapf(err, "failed to marshal digest watermark of %s", email)
+		}
+		return errors.Wrapf(tx.Bucket(digestSentBucket).Put([]byte(email), ts), "failed to save digest watermark of %s", email)
+	})
+}
+
+// addItem appends item to the recipient's pending list, ignoring already added comments
+func (d *Digest) addItem(tx *bolt.Tx, email string, item digestItem) error {
+	var items []digestItem
+	if v := tx.Bucket(digestPendingBucket).Get([]byte(email)); v != nil {
+		if err := json.Unmarshal(v, &items); err != nil {
+			return errors.Wrapf(err, "failed to unmarshal digest of %s", email)
+		}
+	}
+	for _, it := range items {
+		if it.CommentID == item.CommentID {
+			return nil
+		}
+	}
+	return d.putItems(tx, email, append(items, item))
+}
+
+// putItems saves the recipient's pending list, removing the recipient if the list is empty
+func (d *Digest) putItems(tx *bolt.Tx, email string, items []digestItem) error {
+	bkt := tx.Bucket(digestPendingBucket)
+	if len(items) == 0 {
+		return errors.Wrapf(bkt.Delete([]byte(email)), "failed to delete digest of %s", email)
+	}
+	v, err := json.Marshal(items)
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal digest of %s", email)
+	}
+	return errors.Wrapf(bkt.Put([]byte(email), v), "failed to save digest of %s", email)
+}
+
+// buildMessage makes digest message with comments grouped by post, threads and comments in them ordered by time.
+// Unsubscribe link is added only if all comments are replies to the same user on the same site,
+// as unsubscribe token is issued for the site. Sender and footer are of the site if all comments are from it,
+// default ones otherwise.
+func (d *Digest) buildMessage(email string, items []digestItem, since time.Time) (emailMessage, error) {
+	sort.SliceStable(items, func(i, j int) bool { return items[i].Timestamp.Before(items[j].Timestamp) })
+	tmplData := digestTmplData{Email: email, Since: since}
+	threadIdx := map[string]int{}
+	for _, item := range items {
+		idx, ok := threadIdx[item.SiteID+"::"+item.PostURL]
+		if !ok {
+			idx = len(tmplData.Threads)
+			threadIdx[item.SiteID+"::"+item.PostURL] = idx
+			tmplData.Threads = append(tmplData.Threads, digestThread{PostTitle: item.PostTitle, PostURL: item.PostURL})
+		}
+		tmplData.Threads[idx].Comments = append(tmplData.Threads[idx].Comments, item)
+	}
+
+	siteID, sameRecipient := items[0].SiteID, !items[0].ForAdmin
+	for _, item := range items {
+		if item.SiteID != siteID {
+			siteID, sameRecipient = "", false
+			break
+		}
+		if item.ForAdmin || item.UserID != items[0].UserID {
+			sameRecipient = false
+		}
+	}
+	if sameRecipient && d.email.TokenGenFn != nil && d.email.UnsubscribeURL != "" {
+		token, err := d.email.TokenGenFn(items[0].UserID, email, siteID)
+		if err != nil {
+			return emailMessage{}, errors.Wrapf(err, "error creating token for unsubscribe link")
+		}
+		tmplData.UnsubscribeLink = d.email.UnsubscribeURL + "?site=" + siteID + "&tkn=" + token
+	}
+
+	msg := bytes.Buffer{}
+	if err := d.tmpl.Execute(&msg, tmplData); err != nil {
+		return emailMessage{}, errors.Wrapf(err, "error executing template to build digest message")
+	}
+	footer, err := d.email.footer(siteID, email, tmplData.UnsubscribeLink)
+	if err != nil {
+		return emailMessage{}, err
+	}
+	htmlBody, plain := withFooter(msg.String(), htmlToText(msg.String()), footer)
+	sender := d.email.requestSender(siteID, email)
+	res, err := d.email.buildMultipartMessage(sender, d.Subject, plain, htmlBody, "", email, tmplData.UnsubscribeLink,
+		d.email.customHeaders(), time.Time{})
+	if err == nil {
+		res, err = d.email.encryptMessage(res, email)
+	}
+	if err != nil {
+		return emailMessage{}, err
+	}
+	return emailMessage{from: sender.envelope(), to: email, message: res}, nil
+}
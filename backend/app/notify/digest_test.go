@@ -0,0 +1,421 @@
+package notify
+
+import (
+	"context"
+	"io/ioutil"
+	"mime/quotedprintable"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/remark42/backend/app/store"
+)
+
+func TestDigest_New(t *testing.T) {
+	dir, err := ioutil.TempDir("", "digest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = NewDigest(nil, DigestParams{})
+	assert.EqualError(t, err, "email destination is required for digest")
+
+	email := prepDigestEmail(t, &fakeTestSMTP{})
+	_, err = NewDigest(email, DigestParams{Interval: time.Hour, Offset: 2 * time.Hour})
+	assert.EqualError(t, err, "digest offset 2h0m0s should be within interval 1h0m0s")
+	_, err = NewDigest(email, DigestParams{Interval: time.Hour, FlushJitter: 30 * time.Minute})
+	assert.EqualError(t, err, "digest flush jitter 30m0s should be less than half of interval 1h0m0s")
+
+	_, err = NewDigest(email, DigestParams{TemplatePath: "testdata/no-such-file.tmpl"})
+	assert.EqualError(t, err, "can't read digest template: open testdata/no-such-file.tmpl: no such file or directory")
+
+	_, err = NewDigest(email, DigestParams{TemplatePath: "testdata/digest.html.tmpl", DBPath: filepath.Join(dir, "no-such-dir", "digest.db")})
+	assert.Error(t, err)
+
+	d, err := NewDigest(email, DigestParams{TemplatePath: "testdata/digest.html.tmpl", DBPath: filepath.Join(dir, "digest.db")})
+	require.NoError(t, err)
+	assert.Equal(t, 24*time.Hour, d.Interval)
+	assert.Equal(t, "New comments digest", d.Subject)
+	assert.Equal(t, "digest of email: from \"from@example.org\" with username '' at server :0", d.String())
+	assert.NoError(t, d.Close(context.Background()))
+}
+
+func TestDigest_nextFlush(t *testing.T) {
+	d := Digest{DigestParams: DigestParams{Interval: 24 * time.Hour, Offset: 9 * time.Hour}}
+	now := time.Date(2020, 11, 4, 8, 30, 0, 0, time.UTC) // wednesday
+	assert.Equal(t, time.Date(2020, 11, 4, 9, 0, 0, 0, time.UTC), d.nextFlush(now))
+	assert.Equal(t, time.Date(2020, 11, 5, 9, 0, 0, 0, time.UTC), d.nextFlush(now.Add(time.Hour)))
+	assert.Equal(t, time.Date(2020, 11, 5, 9, 0, 0, 0, time.UTC), d.nextFlush(time.Date(2020, 11, 4, 9, 0, 0, 0, time.UTC)))
+
+	d = Digest{DigestParams: DigestParams{Interval: 7 * 24 * time.Hour}}
+	assert.Equal(t, time.Date(2020, 11, 9, 0, 0, 0, 0, time.UTC), d.nextFlush(now), "weekly digest sent on monday")
+}
+
+func TestDigest_nextFlushJitter(t *testing.T) {
+	jitter := 10 * time.Minute
+	d := Digest{DigestParams: DigestParams{Interval: time.Hour, FlushJitter: jitter}, jitterSeed: 42}
+	start := time.Date(2020, 11, 4, 8, 30, 0, 0, time.UTC)
+	flush, boundary := d.nextFlush(start), start.Truncate(time.Hour).Add(time.Hour)
+	intervals := map[time.Duration]bool{}
+	for i := 0; i < 20; i++ {
+		assert.True(t, !flush.Before(boundary.Add(-jitter)) && !flush.After(boundary.Add(jitter)),
+			"flush %v within jitter of %v", flush, boundary)
+		next := d.nextFlush(flush)
+		interval := next.Sub(flush)
+		assert.True(t, interval >= time.Hour-2*jitter && interval <= time.Hour+2*jitter, "interval %v", interval)
+		intervals[interval] = true
+		assert.Equal(t, next, d.nextFlush(flush.Add(interval/2)), "same flush time for the same boundary")
+		flush, boundary = next, boundary.Add(time.Hour)
+	}
+	assert.True(t, len(intervals) > 10, "intervals vary, %v", intervals)
+
+	other := Digest{DigestParams: d.DigestParams, jitterSeed: 43}
+	assert.NotEqual(t, d.nextFlush(start), other.nextFlush(start), "instances flush at different time")
+}
+
+func TestDigest_SendAndFlush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "digest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fakeSMTP := &fakeTestSMTP{}
+	email := prepDigestEmail(t, fakeSMTP)
+	email.AdminEmails = []string{"admin@example.org"}
+	d, err := NewDigest(email, DigestParams{TemplatePath: "testdata/digest.html.tmpl", DBPath: filepath.Join(dir, "digest.db")})
+	require.NoError(t, err)
+
+	ts := time.Date(2020, 11, 4, 8, 30, 0, 0, time.UTC)
+	parent := store.Comment{ID: "p1", User: store.User{ID: "u1", Name: "parent_user"}}
+	reqs := []Request{
+		{Comment: store.Comment{ID: "c2", ParentID: "p1", Text: "<p>second</p>", Timestamp: ts.Add(time.Minute),
+			User: store.User{Name: "user2"}, Locator: store.Locator{SiteID: "remark", URL: "https://example.com/post1"}, PostTitle: "Post 1"},
+			parent: parent, Emails: []string{"user@example.org"}},
+		{Comment: store.Comment{ID: "c1", ParentID: "p1", Orig: "**first**", Timestamp: ts,
+			User: store.User{Name: "user1"}, Locator: store.Locator{SiteID: "remark", URL: "https://example.com/post1"}, PostTitle: "Post 1"},
+			parent: parent, Emails: []string{"user@example.org"}},
+		{Comment: store.Comment{ID: "c3", ParentID: "p1", Text: "third", Timestamp: ts.Add(2 * time.Minute),
+			User: store.User{Name: "user3"}, Locator: store.Locator{SiteID: "remark", URL: "https://example.com/post2"}, PostTitle: "Post 2"},
+			parent: parent, Emails: []string{"user@example.org"}},
+	}
+	for _, req := range reqs {
+		require.NoError(t, d.Send(context.Background(), req))
+	}
+	require.NoError(t, d.Send(context.Background(), reqs[0]), "duplicate comment ignored")
+	assert.Equal(t, 0, fakeSMTP.dataCount, "nothing sent before flush")
+
+	require.NoError(t, d.flush(context.Background()))
+	assert.Equal(t, []string{"admin@example.org", "user@example.org"}, fakeSMTP.rcpts)
+	bodies := digestBodies(t, fakeSMTP.buff.String())
+	require.Len(t, bodies, 2)
+	assert.Equal(t, `Digest for admin@example.org
+Post Post 1 https://example.com/post1
+- user1 to parent_user: <p><strong>first</strong></p>
+ https://example.com/post1#remark42__comment-c1
+- user2 to parent_user: <p>second</p> https://example.com/post1#remark42__comment-c2
+Post Post 2 https://example.com/post2
+- user3 to parent_user: third https://example.com/post2#remark42__comment-c3
+`, bodies[0])
+	assert.Contains(t, bodies[1], "Digest for user@example.org\nPost Post 1")
+	assert.Contains(t, bodies[1], "Unsubscribe link: https://remark42.com/api/v1/email/unsubscribe?site=remark&tkn=token")
+	assert.Contains(t, fakeSMTP.buff.String(), "Subject: New comments digest\n")
+
+	// nothing pending, nothing sent
+	fakeSMTP.buff.Reset()
+	require.NoError(t, d.flush(context.Background()))
+	assert.Equal(t, 2, fakeSMTP.dataCount)
+
+	// new comment after restart sent with Since set to queue time of the latest sent comment
+	require.NoError(t, d.Close(context.Background()))
+	d, err = NewDigest(email, DigestParams{TemplatePath: "testdata/digest.html.tmpl", DBPath: filepath.Join(dir, "digest.db")})
+	require.NoError(t, err)
+	defer d.Close(context.Background())
+	req := reqs[2]
+	req.Comment.ID, req.Comment.Timestamp = "c4", ts.Add(time.Hour)
+	email.AdminEmails = nil
+	require.NoError(t, d.Send(context.Background(), req))
+	require.NoError(t, d.flush(context.Background()))
+	bodies = digestBodies(t, fakeSMTP.buff.String())
+	require.Len(t, bodies, 1)
+	assert.Regexp(t, `^Digest for user@example.org since \d\d\.\d\d\.\d{4} \d\d:\d\d\nPost Post 2`, bodies[0])
+	assert.Contains(t, bodies[0], "comment-c4")
+	assert.NotContains(t, bodies[0], "comment-c3")
+}
+
+func TestDigest_FlushSkipsAlreadySent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "digest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fakeSMTP := &fakeTestSMTP{}
+	d, err := NewDigest(prepDigestEmail(t, fakeSMTP), DigestParams{TemplatePath: "testdata/digest.html.tmpl", DBPath: filepath.Join(dir, "digest.db")})
+	require.NoError(t, err)
+	defer d.Close(context.Background())
+
+	ts := time.Date(2020, 11, 4, 8, 30, 0, 0, time.UTC)
+	req := Request{Comment: store.Comment{ID: "c1", Text: "first", Timestamp: ts}, Emails: []string{"user@example.org"}}
+	require.NoError(t, d.Send(context.Background(), req))
+
+	// digest was delivered, but pending list wasn't cleaned up, i.e. due to crash
+	require.NoError(t, d.markSent("user@example.org", nil, time.Now()))
+	require.NoError(t, d.flush(context.Background()))
+	assert.Equal(t, 0, fakeSMTP.dataCount, "already sent comment skipped")
+
+	require.NoError(t, d.flush(context.Background()))
+	assert.Equal(t, 0, fakeSMTP.dataCount)
+}
+
+func TestDigest_FlushOldComment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "digest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fakeSMTP := &fakeTestSMTP{}
+	d, err := NewDigest(prepDigestEmail(t, fakeSMTP), DigestParams{TemplatePath: "testdata/digest.html.tmpl", DBPath: filepath.Join(dir, "digest.db")})
+	require.NoError(t, err)
+	defer d.Close(context.Background())
+
+	ts := time.Now()
+	req := Request{Comment: store.Comment{ID: "c1", Text: "first", Timestamp: ts}, Emails: []string{"user@example.org"}}
+	require.NoError(t, d.Send(context.Background(), req))
+	require.NoError(t, d.flush(context.Background()))
+	assert.Equal(t, 1, fakeSMTP.dataCount)
+
+	// comment made before the previous digest, but queued after it, i.e. imported or released by moderation
+	req.Comment.ID, req.Comment.Text, req.Comment.Timestamp = "c2", "second", ts.Add(-time.Hour)
+	require.NoError(t, d.Send(context.Background(), req))
+	require.NoError(t, d.flush(context.Background()))
+	assert.Equal(t, 2, fakeSMTP.dataCount, "old comment is not skipped")
+	assert.Contains(t, fakeSMTP.buff.String(), "comment-c2")
+
+	require.NoError(t, d.flush(context.Background()))
+	assert.Equal(t, 2, fakeSMTP.dataCount, "sent once")
+}
+
+func TestDigest_SenderAndFooter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "digest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fakeSMTP := &fakeTestSMTP{}
+	email := prepDigestEmail(t, fakeSMTP)
+	email.FromPool = []string{"pool1@example.org", "pool2@example.org"}
+	email.SiteSenders = map[string]EmailSender{"site1": {From: "noreply@site1.com"}}
+	email.FooterTemplate = `<p class="footer">{{.SiteTitle}} footer</p>`
+	require.NoError(t, email.setTemplates())
+	d, err := NewDigest(email, DigestParams{TemplatePath: "testdata/digest.html.tmpl", DBPath: filepath.Join(dir, "digest.db")})
+	require.NoError(t, err)
+
+	item := digestItem{SiteID: "site1", PostURL: "https://example.com/p", UserID: "u1", CommentID: "c1", UserName: "user",
+		Text: "comment", Timestamp: time.Now()}
+	msg, err := d.buildMessage("user@example.org", []digestItem{item}, time.Time{})
+	require.NoError(t, err)
+	assert.Equal(t, "noreply@site1.com", msg.from, "sender of the site")
+	assert.Contains(t, msg.message, "From: noreply@site1.com\n")
+	assert.Contains(t, msg.message, `<p class=3D"footer">site1 footer</p>`)
+	assert.Contains(t, msg.message, "--=20\r\nsite1 footer\n", "footer in plain text part")
+
+	other := item
+	other.SiteID, other.CommentID = "site2", "c2"
+	msg, err = d.buildMessage("user@example.org", []digestItem{item, other}, time.Time{})
+	require.NoError(t, err)
+	assert.Equal(t, "pool1@example.org", msg.from, "default sender from the pool for digest of different sites")
+	assert.Contains(t, msg.message, `<p class=3D"footer"> footer</p>`)
+}
+
+func TestDigest_FlushFailed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "digest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fakeSMTP := &fakeTestSMTP{fail: map[string]bool{"data": true}}
+	email := prepDigestEmail(t, fakeSMTP)
+	email.MaxRetries = 1
+	d, err := NewDigest(email, DigestParams{TemplatePath: "testdata/digest.html.tmpl", DBPath: filepath.Join(dir, "digest.db")})
+	require.NoError(t, err)
+	defer d.Close(context.Background())
+
+	req := Request{Comment: store.Comment{ID: "c1", Text: "first"}, Emails: []string{"user@example.org"}}
+	require.NoError(t, d.Send(context.Background(), req))
+	err = d.flush(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `problem sending digest to "user@example.org"`)
+
+	fakeSMTP.fail = nil
+	require.NoError(t, d.flush(context.Background()))
+	bodies := digestBodies(t, fakeSMTP.buff.String())
+	require.Len(t, bodies, 1, "comment kept after failed attempt")
+	assert.Contains(t, bodies[0], "first")
+}
+
+func TestDigest_Shutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "digest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fakeSMTP := &fakeTestSMTP{}
+	params := DigestParams{TemplatePath: "testdata/digest.html.tmpl", DBPath: filepath.Join(dir, "digest.db"), FlushOnClose: true}
+	d, err := NewDigest(prepDigestEmail(t, fakeSMTP), params)
+	require.NoError(t, err)
+	req := Request{Comment: store.Comment{ID: "c1", Text: "first"}, Emails: []string{"user@example.org"}}
+	require.NoError(t, d.Send(context.Background(), req))
+	assert.Equal(t, 0, fakeSMTP.dataCount)
+
+	require.NoError(t, d.Close(context.Background()))
+	assert.Equal(t, 1, fakeSMTP.dataCount, "pending digest sent on close")
+	bodies := digestBodies(t, fakeSMTP.buff.String())
+	require.Len(t, bodies, 1)
+	assert.Contains(t, bodies[0], "first")
+
+	// digest not sent before the deadline is reported and kept for the next start
+	fakeSMTP = &fakeTestSMTP{fail: map[string]bool{"data": true}}
+	d, err = NewDigest(prepDigestEmail(t, fakeSMTP), params)
+	require.NoError(t, err)
+	req.Comment.ID, req.Comment.Text, req.Comment.Timestamp = "c2", "second", time.Now()
+	require.NoError(t, d.Send(context.Background(), req))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = d.Shutdown(ctx)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `failed to send pending digests on shutdown`)
+	assert.Contains(t, err.Error(), `problem sending digest to "user@example.org"`)
+
+	fakeSMTP.fail = nil
+	d, err = NewDigest(prepDigestEmail(t, fakeSMTP), DigestParams{TemplatePath: "testdata/digest.html.tmpl", DBPath: filepath.Join(dir, "digest.db")})
+	require.NoError(t, err)
+	defer d.Close(context.Background())
+	require.NoError(t, d.flush(context.Background()))
+	bodies = digestBodies(t, fakeSMTP.buff.String())
+	require.Len(t, bodies, 1)
+	assert.Contains(t, bodies[0], "second")
+	assert.NotContains(t, bodies[0], "first")
+}
+
+func TestDigest_Stop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "digest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fakeSMTP := &fakeTestSMTP{}
+	d, err := NewDigest(prepDigestEmail(t, fakeSMTP), DigestParams{TemplatePath: "testdata/digest.html.tmpl",
+		DBPath: filepath.Join(dir, "digest.db"), MaxQueueAge: time.Millisecond})
+	require.NoError(t, err)
+	select {
+	case <-d.Stopped():
+		t.Fatal("stopped before Stop call")
+	default:
+	}
+
+	d.Stop()
+	d.Stop() // second call is noop
+	select {
+	case <-d.Stopped():
+	case <-time.After(time.Second):
+		t.Fatal("not stopped")
+	}
+
+	// comment is kept, but not sent on schedule anymore
+	req := Request{Comment: store.Comment{ID: "c1", Text: "first"}, Emails: []string{"user@example.org"}}
+	require.NoError(t, d.Send(context.Background(), req))
+	assert.False(t, d.nextAgedFlush().IsZero(), "comment pending")
+	assert.Equal(t, 0, fakeSMTP.dataCount)
+
+	require.NoError(t, d.Shutdown(context.Background()))
+	assert.Equal(t, 1, fakeSMTP.dataCount, "pending comment sent on shutdown")
+}
+
+func TestDigest_MaxQueueAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "digest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fakeSMTP := &fakeTestSMTP{}
+	d, err := NewDigest(prepDigestEmail(t, fakeSMTP), DigestParams{TemplatePath: "testdata/digest.html.tmpl",
+		DBPath: filepath.Join(dir, "digest.db"), MaxQueueAge: 100 * time.Millisecond})
+	require.NoError(t, err)
+	defer d.Close(context.Background())
+
+	st := time.Now()
+	req := Request{Comment: store.Comment{ID: "c1", Text: "first"}, Emails: []string{"user@example.org"}}
+	require.NoError(t, d.Send(context.Background(), req))
+	assert.Eventually(t, func() bool { return fakeSMTP.readRcpt() == "user@example.org" }, 2*time.Second, 10*time.Millisecond,
+		"single comment sent after max queue age instead of the end of the day")
+	assert.True(t, time.Since(st) >= 100*time.Millisecond, "not sent before max queue age")
+	fakeSMTP.lock.RLock()
+	assert.Equal(t, 1, fakeSMTP.dataCount)
+	assert.Contains(t, fakeSMTP.buff.String(), "first")
+	fakeSMTP.lock.RUnlock()
+	assert.Eventually(t, func() bool { return d.nextAgedFlush().IsZero() }, time.Second, 10*time.Millisecond, "nothing pending")
+}
+
+func TestDigest_flushQueuedBefore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "digest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fakeSMTP := &fakeTestSMTP{}
+	d, err := NewDigest(prepDigestEmail(t, fakeSMTP), DigestParams{TemplatePath: "testdata/digest.html.tmpl",
+		DBPath: filepath.Join(dir, "digest.db")})
+	require.NoError(t, err)
+	defer d.Close(context.Background())
+
+	require.NoError(t, d.Send(context.Background(), Request{Comment: store.Comment{ID: "c1", Text: "first"},
+		Emails: []string{"user1@example.org"}}))
+	time.Sleep(10 * time.Millisecond)
+	mark := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, d.Send(context.Background(), Request{Comment: store.Comment{ID: "c2", Text: "second"},
+		Emails: []string{"user2@example.org"}}))
+	assert.True(t, d.nextAgedFlush().IsZero(), "max queue age not set")
+
+	require.NoError(t, d.flushQueuedBefore(context.Background(), mark))
+	assert.Equal(t, []string{"user1@example.org"}, fakeSMTP.rcpts, "only digest with old enough comment sent")
+	require.NoError(t, d.flush(context.Background()))
+	assert.Equal(t, []string{"user1@example.org", "user2@example.org"}, fakeSMTP.rcpts)
+}
+
+func TestDigest_SendVerification(t *testing.T) {
+	dir, err := ioutil.TempDir("", "digest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fakeSMTP := &fakeTestSMTP{}
+	d, err := NewDigest(prepDigestEmail(t, fakeSMTP), DigestParams{TemplatePath: "testdata/digest.html.tmpl", DBPath: filepath.Join(dir, "digest.db")})
+	require.NoError(t, err)
+	defer d.Close(context.Background())
+
+	require.NoError(t, d.SendVerification(context.Background(), VerificationRequest{SiteID: "remark", User: "u", Email: "u@example.org", Token: "t"}))
+	assert.Equal(t, "u@example.org", fakeSMTP.readRcpt(), "verification sent right away")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.EqualError(t, d.Send(ctx, Request{Comment: store.Comment{ID: "c1"}}), `adding comment "c1" to digest aborted due to canceled context`)
+}
+
+func prepDigestEmail(t *testing.T, fakeSMTP *fakeTestSMTP) *Email {
+	email, err := NewEmail(EmailParams{
+		From:                     "from@example.org",
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "testdata/msg.html.tmpl",
+		UnsubscribeURL:           "https://remark42.com/api/v1/email/unsubscribe",
+		TokenGenFn:               TokenGenFn,
+		RetryBaseDelay:           time.Millisecond,
+	}, SMTPParams{})
+	require.NoError(t, err)
+	email.smtp = fakeSMTP
+	return email
+}
+
+// digestBodies returns decoded html parts of all messages in the buffer
+func digestBodies(t *testing.T, buff string) (res []string) {
+	for _, part := range strings.Split(buff, "Content-Type: text/html; charset=\"UTF-8\"\nContent-Transfer-Encoding: quoted-printable\n\n")[1:] {
+		part = part[:strings.Index(part, "\n--remark42-")]
+		body, err := ioutil.ReadAll(quotedprintable.NewReader(strings.NewReader(part)))
+		require.NoError(t, err)
+		res = append(res, strings.ReplaceAll(string(body), "\r\n", "\n"))
+	}
+	return res
+}
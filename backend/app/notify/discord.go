@@ -0,0 +1,113 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/pkg/errors"
+)
+
+// DiscordParams contain settings for discord destination
+type DiscordParams struct {
+	WebhookURL string        // discord webhook URL
+	Username   string        // overrides default username of the webhook, optional
+	AvatarURL  string        // overrides default avatar of the webhook, optional
+	Timeout    time.Duration // request timeout
+	MaxRetries int           // max number of retries on rate limit responses
+}
+
+// Discord implements notify.Destination for discord webhook, comments are posted as rich embeds
+type Discord struct {
+	DiscordParams
+	hookDestination
+}
+
+// discord limits, https://discord.com/developers/docs/resources/channel#embed-limits,
+// description is kept within 2000 chars of the message content limit
+const (
+	discordTitleLimit       = 256
+	discordAuthorLimit      = 256
+	discordDescriptionLimit = 2000
+)
+
+// NewDiscord makes discord destination
+func NewDiscord(params DiscordParams) (*Discord, error) {
+	if params.WebhookURL == "" {
+		return nil, errors.New("discord webhook URL is required")
+	}
+	res := Discord{DiscordParams: params}
+	if res.Timeout <= 0 {
+		res.Timeout = hookTimeOut
+	}
+	if res.MaxRetries <= 0 {
+		res.MaxRetries = hookMaxRetries
+	}
+	log.Printf("[DEBUG] create new discord notifier, timeout=%s", res.Timeout)
+	return &res, nil
+}
+
+// Send comment to discord webhook
+func (d *Discord) Send(ctx context.Context, req Request) error {
+	log.Printf("[DEBUG] send discord notification, comment id %s", req.Comment.ID)
+	b, err := json.Marshal(d.message(req))
+	if err != nil {
+		return errors.Wrap(err, "failed to make discord body")
+	}
+
+	hr := hookRequest{name: "discord", url: d.WebhookURL, contentType: "application/json; charset=utf-8", body: b, timeout: d.Timeout}
+	return retryAttempts(ctx, "discord notification", d.MaxRetries, func() (time.Duration, error) { return postHook(ctx, hr) })
+}
+
+// message makes discord webhook message with a single embed for the comment
+func (d *Discord) message(req Request) interface{} {
+	type author struct {
+		Name    string `json:"name"`
+		IconURL string `json:"icon_url,omitempty"`
+	}
+	type embed struct {
+		Title       string `json:"title"`
+		URL         string `json:"url"`
+		Description string `json:"description"`
+		Timestamp   string `json:"timestamp,omitempty"`
+		Author      author `json:"author"`
+	}
+
+	title := "New comment"
+	if req.Comment.ParentID != "" {
+		title = "Reply to " + req.parent.User.Name
+	}
+	if req.Comment.PostTitle != "" {
+		title += " on " + req.Comment.PostTitle
+	}
+	text := req.Comment.Orig
+	if text == "" {
+		text = htmlToText(req.Comment.Text)
+	}
+
+	e := embed{
+		Title:       truncateRunes(title, discordTitleLimit),
+		URL:         req.Comment.Locator.URL + uiNav + req.Comment.ID,
+		Description: truncateRunes(text, discordDescriptionLimit),
+		Author:      author{Name: truncateRunes(req.Comment.User.Name, discordAuthorLimit), IconURL: req.Comment.User.Picture},
+	}
+	if !req.Comment.Timestamp.IsZero() {
+		e.Timestamp = req.Comment.Timestamp.UTC().Format(time.RFC3339)
+	}
+
+	return struct {
+		Username  string  `json:"username,omitempty"`
+		AvatarURL string  `json:"avatar_url,omitempty"`
+		Embeds    []embed `json:"embeds"`
+	}{Username: d.Username, AvatarURL: d.AvatarURL, Embeds: []embed{e}}
+}
+
+// Name of Discord destination
+func (d *Discord) Name() string {
+	return "discord"
+}
+
+func (d *Discord) String() string {
+	return "discord"
+}
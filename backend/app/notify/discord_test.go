@@ -0,0 +1,128 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/remark42/backend/app/store"
+)
+
+func TestDiscord_New(t *testing.T) {
+	_, err := NewDiscord(DiscordParams{})
+	assert.EqualError(t, err, "discord webhook URL is required")
+
+	d, err := NewDiscord(DiscordParams{WebhookURL: "https://discord.com/api/webhooks/1/xxx"})
+	require.NoError(t, err)
+	assert.Equal(t, hookTimeOut, d.Timeout)
+	assert.Equal(t, hookMaxRetries, d.MaxRetries)
+	assert.Equal(t, "discord", d.String())
+	assert.NoError(t, d.SendVerification(context.Background(), VerificationRequest{}))
+}
+
+func TestDiscord_Send(t *testing.T) {
+	var body string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		body = string(b)
+		if r.URL.Path == "/bad" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	d, err := NewDiscord(DiscordParams{WebhookURL: ts.URL, Username: "remark42", AvatarURL: "https://example.com/logo.png"})
+	require.NoError(t, err)
+	req := Request{
+		Comment: store.Comment{ID: "c2", ParentID: "c1", Orig: "some **text**", PostTitle: "Post title",
+			User:      store.User{Name: "user2", Picture: "https://example.com/user2.png"},
+			Timestamp: time.Date(2020, 5, 1, 10, 20, 30, 0, time.FixedZone("X", 3600)),
+			Locator:   store.Locator{SiteID: "remark", URL: "https://example.com/post"}},
+		parent: store.Comment{ID: "c1", User: store.User{Name: "user1"}},
+	}
+	require.NoError(t, d.Send(context.Background(), req))
+	assert.JSONEq(t, `{"username":"remark42","avatar_url":"https://example.com/logo.png","embeds":[{
+		"title":"Reply to user1 on Post title","url":"https://example.com/post#remark42__comment-c2",
+		"description":"some **text**","timestamp":"2020-05-01T09:20:30Z",
+		"author":{"name":"user2","icon_url":"https://example.com/user2.png"}}]}`, body)
+
+	d.Username, d.AvatarURL = "", ""
+	require.NoError(t, d.Send(context.Background(), Request{Comment: store.Comment{ID: "c1", Text: "<p>html <b>text</b></p>",
+		User: store.User{Name: "user"}}}))
+	assert.JSONEq(t, `{"embeds":[{"title":"New comment","url":"#remark42__comment-c1","description":"html text",
+		"author":{"name":"user"}}]}`, body, "no overrides and timestamp, html text used without orig")
+
+	d.WebhookURL = ts.URL + "/bad"
+	assert.EqualError(t, d.Send(context.Background(), req), "failed after 1 attempt(s): unexpected discord status code 400")
+}
+
+func TestDiscord_SendLimits(t *testing.T) {
+	d, err := NewDiscord(DiscordParams{WebhookURL: "http://example.com"})
+	require.NoError(t, err)
+	b, err := json.Marshal(d.message(Request{Comment: store.Comment{Orig: strings.Repeat("x", 5000),
+		PostTitle: strings.Repeat("t", 300), User: store.User{Name: strings.Repeat("u", 300)}}}))
+	require.NoError(t, err)
+	msg := struct {
+		Embeds []struct {
+			Title       string `json:"title"`
+			Description string `json:"description"`
+			Author      struct {
+				Name string `json:"name"`
+			} `json:"author"`
+		} `json:"embeds"`
+	}{}
+	require.NoError(t, json.Unmarshal(b, &msg))
+	require.Equal(t, 1, len(msg.Embeds))
+	assert.Equal(t, discordTitleLimit, len([]rune(msg.Embeds[0].Title)))
+	assert.Equal(t, discordDescriptionLimit, len([]rune(msg.Embeds[0].Description)))
+	assert.Equal(t, discordAuthorLimit, len([]rune(msg.Embeds[0].Author.Name)))
+	assert.True(t, strings.HasSuffix(msg.Embeds[0].Description, "…"))
+}
+
+func TestDiscord_SendRateLimited(t *testing.T) {
+	var attempts int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&attempts, 1) {
+		case 1:
+			w.Header().Set("Retry-After", "0.2")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case 2:
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = w.Write([]byte(`{"message":"You are being rate limited.","retry_after":0.3,"global":false}`))
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer ts.Close()
+
+	d, err := NewDiscord(DiscordParams{WebhookURL: ts.URL})
+	require.NoError(t, err)
+	st := time.Now()
+	require.NoError(t, d.Send(context.Background(), Request{Comment: store.Comment{ID: "c1"}}))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&attempts))
+	assert.True(t, time.Since(st) >= 500*time.Millisecond, "retry_after honored")
+
+	atomic.StoreInt32(&attempts, 0)
+	d.MaxRetries = 1
+	assert.EqualError(t, d.Send(context.Background(), Request{Comment: store.Comment{ID: "c1"}}),
+		"failed after 2 attempt(s): discord rate limit exceeded")
+
+	atomic.StoreInt32(&attempts, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = d.Send(ctx, Request{Comment: store.Comment{ID: "c1"}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "aborted due to canceled context after 1 attempt(s)")
+}
@@ -3,66 +3,241 @@ package notify
 import (
 	"bytes"
 	"context"
+	"crypto/sha1" //nolint:gosec // used for multipart boundary only
 	"crypto/tls"
+	"encoding/base32"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"math/rand"
 	"mime"
 	"mime/quotedprintable"
 	"net"
+	"net/mail"
 	"net/smtp"
+	"net/textproto"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"text/template"
 	"time"
+	"unicode/utf8"
 
+	cache "github.com/go-pkgz/expirable-cache"
 	log "github.com/go-pkgz/lgr"
-	"github.com/go-pkgz/repeater"
+	"github.com/google/uuid"
 	"github.com/hashicorp/go-multierror"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"golang.org/x/time/rate"
 
+	"github.com/umputun/remark42/backend/app/store"
 	"github.com/umputun/remark42/backend/app/templates"
 )
 
 // EmailParams contain settings for email notifications
 type EmailParams struct {
-	From                     string   // from email address
-	AdminEmails              []string // administrator emails to send copy of comment notification to
-	MsgTemplatePath          string   // path to request message template
-	VerificationSubject      string   // verification message sub
-	VerificationTemplatePath string   // path to verification template
-	SubscribeURL             string   // full subscribe handler URL
-	UnsubscribeURL           string   // full unsubscribe handler URL
+	From                        string                  // from email address
+	FromName                    string                  // display name for From header, optional
+	FromPool                    []string                // addresses rotated as From of request messages instead of From, site's own From is not rotated
+	FromPoolSticky              bool                    // pick FromPool address by recipient, so the recipient always gets messages from the same address
+	FromPoolMultiDomain         bool                    // acknowledges FromPool addresses of different domains, warned at startup otherwise
+	AllowRequestFrom            bool                    // allow Request.From to override From of request messages, ignored otherwise
+	SigningDomain               string                  // domain sender addresses should be aligned with for DMARC, i.e. DKIM signing one, not checked if empty
+	ReplyTo                     string                  // Reply-To address of request messages, optional
+	InboundAddress              string                  // address of inbound replies, set to Reply-To of request messages with token signed by InboundSecret, see ParseInboundReply
+	InboundSecret               string                  // secret of inbound reply tokens, required with InboundAddress
+	ReturnPath                  string                  // envelope sender receiving bounces of all messages, From header is not changed, sender's From if empty
+	SiteSenders                 map[string]EmailSender  // sender overrides for sites, site id -> sender, empty fields are taken from defaults above
+	SiteBrandings               map[string]SiteBranding // sites title and logo shown in request messages, site id -> branding
+	CC                          []string                // addresses to send copy of each request message to, Request.CC overrides it
+	ToHeaderOverride            string                  // To header of messages instead of the recipient, i.e. "undisclosed-recipients:;", envelope recipient is not changed
+	PGPKeys                     PGPKeyStore             // public keys of recipients, request messages to recipients with a key are encrypted, optional
+	ArchiveEmail                string                  // address receiving hidden copy of every message, for archiving, optional
+	AdminEmails                 []string                // administrator emails to send copy of comment notification to
+	MsgTemplatePath             string                  // path to request message template
+	AdminMsgTemplatePath        string                  // path to request message template for AdminEmails, MsgTemplatePath used if empty
+	PlainMsgTemplatePath        string                  // path to plain text request message template, tags stripped from html one if empty
+	AmpMsgTemplatePath          string                  // path to AMP for Email request message template, sent as text/x-amp-html part with html format only, optional
+	TemplateDir                 string                  // directory with message, verification and subject templates reloaded on change, templates above used for missing ones
+	TemplateReloadInterval      time.Duration           // period of TemplateDir change checks, default one used if not set
+	Format                      string                  // format of request messages, EmailFormatHTML (default) or EmailFormatText
+	SubjectTemplate             string                  // request message subject template, default one used if empty
+	PreheaderTemplate           string                  // template of hidden preview text at the top of html request message, not added if empty
+	FooterTemplate              string                  // html template of footer added to request, summary, digest and verification messages, not added if empty
+	LangMsgTemplatePaths        map[string]string       // localized request message templates paths, language -> path
+	LangSubjectTemplates        map[string]string       // localized request message subject templates, language -> template
+	VerificationSubject         string                  // verification message sub
+	VerificationSubjectTemplate string                  // verification message subject template, VerificationSubject used if empty
+	VerificationTemplatePath    string                  // path to verification template
+	VerificationTTL             time.Duration           // lifetime of verification token, shown in verification message
+	SubscribeURL                string                  // full subscribe handler URL
+	BaseURL                     string                  // remark42 URL, relative avatar URLs are resolved against it
+	UnsubscribeURL              string                  // full unsubscribe handler URL
+	MaxRetries                  int                     // max number of retries on transient send failures
+	RetryBaseDelay              time.Duration           // delay before the first retry, doubled for each next one
+	MaxPerSecond                float64                 // max number of messages sent per second, unlimited if 0
+	BufferSize                  int                     // number of request messages collected to send them in a single SMTP session, sent right away if 0, not used for Digest messages
+	MaxBufferSize               int                     // buffer size grows up to it under load and shrinks back to BufferSize, fixed size if not greater than BufferSize
+	FlushDuration               time.Duration           // max time request messages wait in the buffer, default one used with BufferSize, buffer is sent on Close
+	MaxQueueAge                 time.Duration           // buffer is sent before FlushDuration once its oldest message waits longer than this, disabled if 0
+	FlushJitter                 time.Duration           // each FlushDuration period is shortened by random value up to twice of it, less than half of FlushDuration, disabled if 0
+	BreakerThreshold            int                     // consecutive connection failures to stop connecting for BreakerCooldown, disabled if 0
+	BreakerCooldown             time.Duration           // period without connection attempts after BreakerThreshold failures
+	RampDuration                time.Duration           // send rate grows to MaxPerSecond within this period after the breaker closes, used with MaxPerSecond and BreakerThreshold
+	NotifyOnEdit                bool                    // send notifications on comment edits, only new comments and replies notified if false
+	NotifyOnDelete              bool                    // notify authors of comments deleted by moderator
+	DedupWindow                 time.Duration           // suppress repeated notifications about the same comment to the same recipient within this period, disabled if 0
+	IdempotencyKeys             int                     // number of delivered notifications remembered to skip repeated sends of them, default one used with DedupWindow, disabled if 0
+	MaxPerWindow                int                     // max number of request messages to the same recipient within ThrottleWindow, the rest are sent as summary at its end, unlimited if 0
+	ThrottleWindow              time.Duration           // period MaxPerWindow is counted in, started by the first message to the recipient, default one used with MaxPerWindow
+	MaxBodyBytes                int                     // max size of assembled request message with headers and all parts, before encryption, comment text truncated to fit it, unlimited if 0
+	PriorityForEvents           map[Event]bool          // events notified with high priority headers, i.e. EventReply, none if empty
+	PriorityForAdmin            bool                    // send notifications to AdminEmails with high priority headers
+	LinkSanitizer               LinkSanitizer           // cleans links in comment html of request messages, disabled if empty
+	ExtraHeaders                map[string]string       // custom headers of request messages, i.e. X-Mailgun-Tag, reserved ones are ignored
 
-	TokenGenFn func(userID, email, site string) (string, error) // Unsubscribe token generation function
+	MetricsRegisterer prometheus.Registerer // registerer for email metrics, metrics are not collected if nil
+	Tracer            Tracer                // starts spans of request sending and delivery attempts, not traced if nil
+	Queue             EmailQueue            // persists messages pending delivery, buffered ones included, to redeliver them after restart, optional
+	DryRun            bool                  // log rendered messages instead of sending them, AdminEmails copies are skipped
+	DryRunSink        io.Writer             // receives rendered messages in DryRun mode, optional
+	Backend           string                // sending backend, EmailBackendSMTP (default) or EmailBackendHTTP
+	HTTPMail          HTTPMailParams        // HTTP mail API settings, used with EmailBackendHTTP only
+
+	TokenGenFn   func(userID, email, site string) (string, error)           // Unsubscribe token generation function
+	TokenParseFn func(token string) (userID, email, site string, err error) // Unsubscribe token parsing function, reverse of TokenGenFn
+}
+
+// SiteBranding is human-readable identity of the site for request message templates
+type SiteBranding struct {
+	Title   string // site name, site id used if empty
+	LogoURL string // site logo, relative one is resolved against BaseURL, optional
+}
+
+// EmailSender is identity messages are sent with
+type EmailSender struct {
+	From     string // from email address
+	FromName string // display name for From header, optional
+	ReplyTo  string // Reply-To address of request messages, optional
+	sender   string // actual sender address, set in Sender header and envelope when From is on behalf of someone else
 }
 
 // SMTPParams contain settings for smtp server connection
 type SMTPParams struct {
-	Host     string        // SMTP host
-	Port     int           // SMTP port
-	TLS      bool          // TLS auth
-	Username string        // user name
-	Password string        // password
-	TimeOut  time.Duration // TCP connection timeout
+	Host               string                 // SMTP host
+	Port               int                    // SMTP port
+	TLS                bool                   // TLS auth
+	StartTLS           bool                   // StartTLS upgrade of plain connection, can't be used together with TLS
+	Proxy              string                 // proxy URL for connections to the server, socks5:// or http://, direct if empty
+	MinTLSVersion      uint16                 // minimal TLS version, one of tls.VersionTLS1x, TLS 1.2 if not set
+	InsecureSkipVerify bool                   // skip verification of server certificate, for relays with self-signed certificates
+	TLSServerName      string                 // server name to verify certificate against, Host if not set
+	LocalName          string                 // hostname sent in EHLO/HELO, "localhost" if not set
+	Username           string                 // user name
+	Password           string                 // password
+	AuthMethod         string                 // authentication method, one of AuthMethodPlain (default), AuthMethodLogin or AuthMethodXOAuth2
+	AccessTokenFn      func() (string, error) // OAuth2 access token provider, required for AuthMethodXOAuth2
+	TimeOut            time.Duration          // default for ConnectTimeout and SendTimeout
+	ConnectTimeout     time.Duration          // timeout of connection establishment, including greeting, TLS and auth
+	SendTimeout        time.Duration          // timeout of each command and message body write, stuck send aborted after it
+	KeepAlive          bool                   // reuse the connection between messages instead of making a new one for each
+	IdleTimeout        time.Duration          // close kept alive connection after this period of inactivity
 }
 
+// Email message formats
+const (
+	EmailFormatHTML = "html" // multipart message with html and plain text parts
+	EmailFormatText = "text" // plain text only message, for mail gateways stripping html
+)
+
+// SMTP authentication methods
+const (
+	AuthMethodPlain   = "plain"
+	AuthMethodLogin   = "login"
+	AuthMethodXOAuth2 = "xoauth2"
+)
+
 // Email implements notify.Destination for email
 type Email struct {
 	EmailParams
 	SMTPParams
 
-	smtp       smtpClientCreator
-	msgTmpl    *template.Template // parsed request message template
-	verifyTmpl *template.Template // parsed verification message template
+	smtp           smtpClientCreator
+	msgTmpl        *template.Template            // parsed request message template
+	adminMsgTmpl   *template.Template            // parsed request message template for admins, optional
+	plainMsgTmpl   *template.Template            // parsed plain text request message template, optional
+	ampMsgTmpl     *template.Template            // parsed AMP request message template, optional
+	subjectTmpl    *template.Template            // parsed request message subject template
+	preheaderTmpl  *template.Template            // parsed request message preheader template, optional
+	footerTmpl     *template.Template            // parsed footer template, optional
+	verifyTmpl     *template.Template            // parsed verification message template
+	verifySubjTmpl *template.Template            // parsed verification message subject template, optional
+	langMsgTmpls   map[string]*template.Template // parsed localized request message templates, language -> template
+	langSubjTmpls  map[string]*template.Template // parsed localized request message subject templates, language -> template
+
+	limiter  *rate.Limiter      // paces messages sending, nil for unlimited
+	ramp     *rateRamp          // lowers limiter rate after recovery of the server, nil if RampDuration not set
+	breaker  *circuitBreaker    // stops connection attempts to unavailable server, nil if BreakerThreshold not set
+	dedup    cache.Cache        // idempotency keys of recently delivered notifications, nil if DedupWindow and IdempotencyKeys not set
+	throttle *recipientThrottle // limits request messages to each recipient, nil if MaxPerWindow not set
+	metrics  *emailMetrics      // nil if metrics are not collected
+
+	fromPoolNext uint32 // index of the next FromPool address, accessed atomically
+
+	dryRunLock sync.Mutex // serializes writes to DryRunSink
+	dedupLock  sync.Mutex // makes check and claim of idempotency key atomic
+
+	sequencer threadSequencer // holds back messages till earlier messages of the same thread are sent
+
+	poolLock  sync.Mutex
+	pooled    smtpClient  // kept alive connection, used with KeepAlive only, closed by Close
+	idleTimer *time.Timer // closes kept alive connection after IdleTimeout of inactivity
+
+	redeliveryCancel context.CancelFunc // stops redelivery of queued messages
+	redeliveryDone   chan struct{}      // closed once redelivery of queued messages is finished
+
+	tmplLock      sync.RWMutex       // guards msgTmpl, subjectTmpl and verifyTmpl replaced on TemplateDir reload
+	dirTmpls      []dirTemplate      // templates loaded from TemplateDir
+	dirTmplStamps map[string]string  // template file name -> modification time and size at the last load
+	dirTmplCancel context.CancelFunc // stops reloading of TemplateDir
+	dirTmplDone   chan struct{}      // closed once reloading of TemplateDir is stopped
+
+	bufLock     sync.Mutex
+	buffer      []bufferedMessage // request messages waiting for BufferSize or FlushDuration, used with BufferSize only
+	bufSize     int               // effective buffer size, changed with MaxBufferSize set
+	fullFlushes int               // number of consecutive flushes of the full buffer
+	bufQuit     chan struct{}     // closed by Stop to stop flushing by timer
+	bufCtx      context.Context   // context of flush by timer, canceled by Close deadline
+	bufCancel   context.CancelFunc
+	bufAborted  error         // failures of flush by timer aborted by Close deadline
+	bufStop     sync.Once     // closes bufQuit once
+	bufDone     chan struct{} // closed once flushing by timer is stopped
+	bufAdded    chan struct{} // signals the first message added to empty buffer, used with MaxQueueAge only
+	bufRand     *rand.Rand    // makes FlushJitter shift, used by flushing goroutine only
 }
 
 // default email client implementation
-type emailClient struct{ smtpClientCreator }
+type emailClient struct {
+	smtpClientCreator
+	dial DialFunc // makes connections through the proxy, direct connection made if nil
+}
 
 // smtpClient interface defines subset of net/smtp used by email client
 type smtpClient interface {
+	Hello(string) error
 	Mail(string) error
 	Auth(smtp.Auth) error
+	StartTLS(*tls.Config) error
+	Reset() error
 	Rcpt(string) error
 	Data() (io.WriteCloser, error)
+	Noop() error
 	Quit() error
 	Close() error
 }
@@ -73,27 +248,58 @@ type smtpClientCreator interface {
 }
 
 type emailMessage struct {
+	id      string // id in EmailParams.Queue, empty if not queued yet
 	from    string
 	to      string
+	cc      []string // additional recipients, listed in Cc header of the message
 	message string
+	cid     string // correlation id of the request the message made for, used in logs
+	thread  string // thread of the comment for the recipient, messages of the thread are delivered in order of seq
+	seq     int64  // sequence of the message in the thread, made from the comment timestamp
 }
 
 // msgTmplData store data for message from request template execution
 type msgTmplData struct {
-	UserName          string
-	UserPicture       string
-	CommentText       string
-	CommentLink       string
-	CommentDate       time.Time
-	ParentUserName    string
-	ParentUserPicture string
-	ParentCommentText string
-	ParentCommentLink string
-	ParentCommentDate time.Time
-	PostTitle         string
-	Email             string
-	UnsubscribeLink   string
-	ForAdmin          bool
+	UserName            string
+	UserPicture         string
+	UserAvatarURL       string // absolute URL of UserPicture, empty if user has no avatar
+	CommentText         string
+	CommentOrig         string // comment text in markdown, as written by user
+	CommentLink         string
+	CommentDate         time.Time
+	ParentUserName      string
+	ParentUserPicture   string
+	ParentUserAvatarURL string // absolute URL of ParentUserPicture, empty if user has no avatar
+	ParentCommentText   string
+	RenderedParent      string // sanitized html of parent comment rendered from its markdown, empty for top-level comment
+	ParentCommentLink   string
+	ParentCommentDate   time.Time
+	PostTitle           string
+	Email               string
+	UnsubscribeLink     string
+	ForAdmin            bool
+	Spam                bool   // comment classified as spam, sent to admins only with ServiceParams.SpamToAdmin
+	IsReply             bool   // comment has parent, false for new top-level comment
+	MentionedUserName   string // name of the user mentioned in the comment, set for mention notifications only
+	EditDiff            string // html of changes made by the edit, set for edit notifications with previous text only
+	SiteID              string
+	SiteTitle           string // site name from SiteBrandings, SiteID if not set
+	SiteLogoURL         string // absolute URL of site logo from SiteBrandings, empty if not set
+	Lang                string
+	// Count and Replies are set for message combining several notifications: replies to the same comment
+	// sent together from the buffer, or notifications over EmailParams.MaxPerWindow sent as summary.
+	// The rest of the data is of the last reply, parent and post ones are not set for summary.
+	Count   int
+	Replies []replyTmplData
+}
+
+// replyTmplData store data of a single notification listed in the message combining several of them
+type replyTmplData struct {
+	UserName    string
+	CommentText string // sanitized html of the comment, empty for summary
+	CommentLink string
+	CommentDate time.Time // zero for summary
+	PostTitle   string
 }
 
 // verifyTmplData store data for verification message template execution
@@ -103,11 +309,43 @@ type verifyTmplData struct {
 	Email        string
 	Site         string
 	SubscribeURL string
+	ExpiresAt    time.Time // verification token expiration time
+	ExpiresIn    string    // human readable verification token lifetime, i.e. "30 minutes"
+}
+
+// templateFuncs are helpers available in all notification templates
+var templateFuncs = template.FuncMap{
+	// formatDate formats time with layout, i.e. {{.CommentDate | formatDate "2006-01-02"}}
+	"formatDate": func(layout string, t time.Time) string { return t.Format(layout) },
+	// truncate cuts text to given number of characters, i.e. {{.CommentText | truncate 100}}
+	"truncate": func(n int, s string) string { return truncateRunes(s, n) },
+	// trimMarkdown removes markdown formatting, i.e. {{.CommentText | trimMarkdown}}
+	"trimMarkdown": trimMarkdown,
 }
 
+var (
+	spacesRe      = regexp.MustCompile(`\s+`)
+	blankLinesRe  = regexp.MustCompile(`\n{3,}`)
+	msgIDUnsafeRe = regexp.MustCompile(`[^A-Za-z0-9!#$%&'*+/=?^_{|}~-]+`)
+	ampHTMLRe     = regexp.MustCompile(`(?i)<html[^>]*\s(⚡4email|amp4email)[\s>=]`)
+)
+
 const (
+	defaultSubjectTemplate = `{{if .Replies}}{{.Count}} new replies{{if .IsReply}} to your comment{{end}}` +
+		`{{else if .Spam}}Spam comment to your site{{else if .ForAdmin}}New comment to your site{{else if .MentionedUserName}}You were mentioned in a comment` +
+		`{{else}}New reply to your comment{{end}}` +
+		`{{if .PostTitle}} for {{printf "%q" .PostTitle}}{{end}}`
 	defaultVerificationSubject           = "Email verification"
 	defaultEmailTimeout                  = 10 * time.Second
+	defaultEmailIdleTimeout              = 30 * time.Second
+	defaultEmailMaxRetries               = 4
+	defaultEmailRetryBaseDelay           = 250 * time.Millisecond
+	defaultEmailDedupMaxKeys             = 10000
+	defaultEmailThrottleWindow           = time.Hour
+	defaultEmailFlushDuration            = time.Second
+	defaultEmailBreakerCooldown          = 30 * time.Second
+	defaultVerificationTTL               = 30 * time.Minute
+	verificationClockSkew                = time.Minute // grace period for verification token expiration check
 	defaultEmailTemplatePath             = "email_reply.html.tmpl"
 	defaultEmailVerificationTemplatePath = "email_confirmation_subscription.html.tmpl"
 )
@@ -116,28 +354,259 @@ const (
 func NewEmail(emailParams EmailParams, smtpParams SMTPParams) (*Email, error) {
 	// set up Email emailParams
 	res := Email{EmailParams: emailParams}
-	res.smtp = &emailClient{}
 	res.SMTPParams = smtpParams
+	var dial DialFunc
+	if res.Proxy != "" {
+		var err error
+		if dial, err = ProxyDialer(res.Proxy, nil); err != nil {
+			return nil, errors.Wrap(err, "can't make smtp proxy dialer")
+		}
+	}
+	res.smtp = &emailClient{dial: dial}
+	switch res.Backend {
+	case "":
+		res.Backend = EmailBackendSMTP
+	case EmailBackendSMTP:
+	case EmailBackendHTTP:
+		if err := res.HTTPMail.validate(); err != nil {
+			return nil, errors.Wrap(err, "invalid http mail api settings")
+		}
+		res.smtp = &httpMailCreator{HTTPMailParams: res.HTTPMail, dial: dial}
+	default:
+		return nil, errors.Errorf("unsupported email backend %q", res.Backend)
+	}
+	if res.TLS && res.StartTLS {
+		return nil, errors.New("can't use TLS and StartTLS at the same time")
+	}
+	switch res.MinTLSVersion {
+	case 0, tls.VersionTLS10, tls.VersionTLS11, tls.VersionTLS12, tls.VersionTLS13:
+	default:
+		return nil, errors.Errorf("unsupported minimal tls version %#x", res.MinTLSVersion)
+	}
+	if res.InsecureSkipVerify {
+		log.Printf("[WARN] smtp server certificate verification disabled")
+	}
+	switch res.AuthMethod {
+	case "", AuthMethodPlain, AuthMethodLogin:
+	case AuthMethodXOAuth2:
+		if res.AccessTokenFn == nil {
+			return nil, errors.New("access token provider is required for xoauth2 authentication")
+		}
+	default:
+		return nil, errors.Errorf("unsupported smtp authentication method %q", res.AuthMethod)
+	}
+	switch res.Format {
+	case "":
+		res.Format = EmailFormatHTML
+	case EmailFormatHTML, EmailFormatText:
+	default:
+		return nil, errors.Errorf("unsupported email format %q", res.Format)
+	}
 	if res.TimeOut <= 0 {
 		res.TimeOut = defaultEmailTimeout
 	}
+	if res.ConnectTimeout <= 0 {
+		res.ConnectTimeout = res.TimeOut
+	}
+	if res.SendTimeout <= 0 {
+		res.SendTimeout = res.TimeOut
+	}
+	if res.IdleTimeout <= 0 {
+		res.IdleTimeout = defaultEmailIdleTimeout
+	}
+	if res.MaxRetries <= 0 {
+		res.MaxRetries = defaultEmailMaxRetries
+	}
+	if res.RetryBaseDelay <= 0 {
+		res.RetryBaseDelay = defaultEmailRetryBaseDelay
+	}
+	if res.BufferSize > 0 && res.FlushDuration <= 0 {
+		res.FlushDuration = defaultEmailFlushDuration
+	}
+	if res.FlushJitter < 0 || (res.BufferSize > 0 && res.FlushJitter*2 >= res.FlushDuration) {
+		return nil, errors.Errorf("email flush jitter %v should be less than half of flush duration %v",
+			res.FlushJitter, res.FlushDuration)
+	}
+	if res.MaxPerSecond > 0 {
+		res.limiter = rate.NewLimiter(rate.Limit(res.MaxPerSecond), 1)
+	}
+	if res.BreakerThreshold > 0 {
+		if res.BreakerCooldown <= 0 {
+			res.BreakerCooldown = defaultEmailBreakerCooldown
+		}
+		res.breaker = newCircuitBreaker(res.BreakerThreshold, res.BreakerCooldown)
+	}
+	if res.RampDuration > 0 && res.limiter != nil && res.breaker != nil {
+		res.ramp = newRateRamp(res.limiter, res.RampDuration)
+	}
+	if res.ReplyTo != "" {
+		if _, err := mail.ParseAddress(res.ReplyTo); err != nil {
+			return nil, errors.Wrapf(err, "invalid reply-to address %q", res.ReplyTo)
+		}
+	}
+	if res.InboundAddress != "" {
+		if _, err := mail.ParseAddress(res.InboundAddress); err != nil {
+			return nil, errors.Wrapf(err, "invalid inbound address %q", res.InboundAddress)
+		}
+		if res.InboundSecret == "" {
+			return nil, errors.New("inbound secret is required with inbound address")
+		}
+	}
+	for site, sender := range res.SiteSenders {
+		for _, addr := range []string{sender.From, sender.ReplyTo} {
+			if addr == "" {
+				continue
+			}
+			if _, err := mail.ParseAddress(addr); err != nil {
+				return nil, errors.Wrapf(err, "invalid sender address %q for site %q", addr, site)
+			}
+		}
+	}
+	if strings.ContainsAny(res.ToHeaderOverride, "\r\n") {
+		return nil, errors.New("invalid to header override, line breaks are not allowed")
+	}
+	warnings, err := res.senderAlignment()
+	if err != nil {
+		return nil, err
+	}
+	for _, w := range warnings {
+		log.Printf("[WARN] email sender misconfiguration, %s", w)
+	}
+	for _, cc := range res.CC {
+		if err := validateRecipient(cc); err != nil {
+			return nil, err
+		}
+	}
+	if res.ArchiveEmail != "" {
+		if err := validateRecipient(res.ArchiveEmail); err != nil {
+			return nil, errors.Wrap(err, "invalid archive address")
+		}
+	}
+	if res.ReturnPath != "" {
+		if err := validateRecipient(res.ReturnPath); err != nil {
+			return nil, errors.Wrap(err, "invalid return path")
+		}
+	}
+	if res.ExtraHeaders, err = extraHeaders(res.ExtraHeaders); err != nil {
+		return nil, err
+	}
+	if res.DedupWindow > 0 || res.IdempotencyKeys > 0 {
+		if res.IdempotencyKeys <= 0 {
+			res.IdempotencyKeys = defaultEmailDedupMaxKeys
+		}
+		opts := []cache.Option{cache.MaxKeys(res.IdempotencyKeys), cache.LRU()}
+		if res.DedupWindow > 0 {
+			opts = append(opts, cache.TTL(res.DedupWindow))
+		}
+		if res.dedup, err = cache.NewCache(opts...); err != nil {
+			return nil, errors.Wrap(err, "can't make dedup cache")
+		}
+	}
+	if res.MaxPerWindow > 0 {
+		if res.ThrottleWindow <= 0 {
+			res.ThrottleWindow = defaultEmailThrottleWindow
+		}
+		res.throttle = newRecipientThrottle(res.MaxPerWindow, res.ThrottleWindow)
+	}
+	if res.metrics, err = newEmailMetrics(res.MetricsRegisterer); err != nil {
+		return nil, err
+	}
 
 	if res.VerificationSubject == "" {
 		res.VerificationSubject = defaultVerificationSubject
 	}
+	if res.VerificationTTL <= 0 {
+		res.VerificationTTL = defaultVerificationTTL
+	}
 
 	// initialize templates
-	err := res.setTemplates()
+	err = res.setTemplates()
 	if err != nil {
 		return nil, errors.Wrap(err, "can't set templates")
 	}
+	if err = res.watchTemplateDir(); err != nil {
+		return nil, err
+	}
+	if err = res.redeliver(); err != nil {
+		res.stopTemplateDir()
+		return nil, err
+	}
+	res.startBuffer()
 
-	log.Printf("[DEBUG] Create new email notifier for server %s with user %s, timeout=%s",
-		res.Host, res.Username, res.TimeOut)
-
+	log.Printf("[DEBUG] Create new email notifier %s, connect timeout=%s, send timeout=%s",
+		res.String(), res.ConnectTimeout, res.SendTimeout)
 	return &res, nil
 }
 
+// redeliver starts delivery of messages left in the queue by previous run
+func (e *Email) redeliver() error {
+	e.redeliveryDone = make(chan struct{})
+	if e.Queue == nil {
+		close(e.redeliveryDone)
+		return nil
+	}
+	queued, err := e.Queue.List()
+	if err != nil {
+		return errors.Wrap(err, "can't load queued email messages")
+	}
+	if len(queued) == 0 {
+		close(e.redeliveryDone)
+		return nil
+	}
+
+	msgs := make([]emailMessage, len(queued))
+	for i, q := range queued {
+		// correlation id of the original request is lost on restart, queue id is used instead
+		msgs[i] = emailMessage{id: q.ID, from: q.From, to: q.To, cc: q.CC, message: q.Message, cid: q.ID}
+	}
+	var ctx context.Context
+	ctx, e.redeliveryCancel = context.WithCancel(context.Background())
+	log.Printf("[INFO] redeliver %d queued email message(s)", len(msgs))
+	go func() {
+		defer close(e.redeliveryDone)
+		for i, err := range e.sendWithRetries(ctx, msgs) {
+			if err != nil {
+				log.Printf("[WARN] problem redelivering queued email to %q, %v", msgs[i].to, err)
+			}
+		}
+	}()
+	return nil
+}
+
+// Close waits for redelivery of queued messages till the context is done, then stops it.
+// Sends buffered messages and summaries of throttled notifications pending in the current windows,
+// buffered messages not sent till the context is done are reported in returned error.
+// Closes kept alive connection and the queue if it's closable. Messages left undelivered
+// stay in the queue for the next start.
+func (e *Email) Close(ctx context.Context) error {
+	if e.redeliveryDone != nil {
+		select {
+		case <-e.redeliveryDone:
+		case <-ctx.Done():
+			log.Printf("[WARN] email redelivery interrupted by shutdown, %v", ctx.Err())
+		}
+	}
+	if e.redeliveryCancel != nil {
+		e.redeliveryCancel()
+	}
+	if e.redeliveryDone != nil {
+		<-e.redeliveryDone
+	}
+	errs := new(multierror.Error)
+	if err := e.stopBuffer(ctx); err != nil {
+		errs = multierror.Append(errs, err)
+	}
+	e.flushThrottled(ctx)
+	e.stopTemplateDir()
+	e.closePooled()
+	if c, ok := e.Queue.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			errs = multierror.Append(errs, errors.Wrap(err, "failed to close email queue"))
+		}
+	}
+	return errs.ErrorOrNil()
+}
+
 func (e *Email) setTemplates() error {
 	var err error
 	var msgTmplFile, verifyTmplFile []byte
@@ -157,53 +626,283 @@ func (e *Email) setTemplates() error {
 	if verifyTmplFile, err = fs.ReadFile(e.VerificationTemplatePath); err != nil {
 		return errors.Wrapf(err, "can't read verification template")
 	}
-	if e.msgTmpl, err = template.New("msgTmpl").Parse(string(msgTmplFile)); err != nil {
+	if e.msgTmpl, err = template.New("msgTmpl").Funcs(templateFuncs).Parse(string(msgTmplFile)); err != nil {
 		return errors.Wrapf(err, "can't parse message template")
 	}
-	if e.verifyTmpl, err = template.New("verifyTmpl").Parse(string(verifyTmplFile)); err != nil {
+	if e.verifyTmpl, err = template.New("verifyTmpl").Funcs(templateFuncs).Parse(string(verifyTmplFile)); err != nil {
 		return errors.Wrapf(err, "can't parse verification template")
 	}
 
+	if e.SubjectTemplate == "" {
+		e.SubjectTemplate = defaultSubjectTemplate
+	}
+	if e.subjectTmpl, err = template.New("subjectTmpl").Funcs(templateFuncs).Parse(e.SubjectTemplate); err != nil {
+		return errors.Wrapf(err, "can't parse subject template")
+	}
+	if e.PreheaderTemplate != "" {
+		if e.preheaderTmpl, err = template.New("preheaderTmpl").Funcs(templateFuncs).Parse(e.PreheaderTemplate); err != nil {
+			return errors.Wrapf(err, "can't parse preheader template")
+		}
+	}
+	if e.FooterTemplate != "" {
+		if e.footerTmpl, err = template.New("footerTmpl").Funcs(templateFuncs).Parse(e.FooterTemplate); err != nil {
+			return errors.Wrapf(err, "can't parse footer template")
+		}
+	}
+	if e.VerificationSubjectTemplate != "" {
+		if e.verifySubjTmpl, err = template.New("verifySubjTmpl").Funcs(templateFuncs).Parse(e.VerificationSubjectTemplate); err != nil {
+			return errors.Wrapf(err, "can't parse verification subject template")
+		}
+	}
+
+	if e.AdminMsgTemplatePath != "" {
+		var adminMsgTmplFile []byte
+		if adminMsgTmplFile, err = fs.ReadFile(e.AdminMsgTemplatePath); err != nil {
+			return errors.Wrapf(err, "can't read admin message template")
+		}
+		if e.adminMsgTmpl, err = template.New("adminMsgTmpl").Funcs(templateFuncs).Parse(string(adminMsgTmplFile)); err != nil {
+			return errors.Wrapf(err, "can't parse admin message template")
+		}
+	}
+
+	if e.PlainMsgTemplatePath != "" {
+		var plainMsgTmplFile []byte
+		if plainMsgTmplFile, err = fs.ReadFile(e.PlainMsgTemplatePath); err != nil {
+			return errors.Wrapf(err, "can't read plain message template")
+		}
+		if e.plainMsgTmpl, err = template.New("plainMsgTmpl").Funcs(templateFuncs).Parse(string(plainMsgTmplFile)); err != nil {
+			return errors.Wrapf(err, "can't parse plain message template")
+		}
+	}
+
+	if e.AmpMsgTemplatePath != "" {
+		if e.Format == EmailFormatText {
+			return errors.New("amp message template can't be used with text format")
+		}
+		var ampMsgTmplFile []byte
+		if ampMsgTmplFile, err = fs.ReadFile(e.AmpMsgTemplatePath); err != nil {
+			return errors.Wrapf(err, "can't read amp message template")
+		}
+		if !ampHTMLRe.Match(ampMsgTmplFile) {
+			return errors.Errorf("amp message template %s should have <html ⚡4email> or <html amp4email> tag", e.AmpMsgTemplatePath)
+		}
+		if e.ampMsgTmpl, err = template.New("ampMsgTmpl").Funcs(templateFuncs).Parse(string(ampMsgTmplFile)); err != nil {
+			return errors.Wrapf(err, "can't parse amp message template")
+		}
+	}
+
+	e.langMsgTmpls = map[string]*template.Template{}
+	for lang, path := range e.LangMsgTemplatePaths {
+		tmplFile, err := fs.ReadFile(path)
+		if err != nil {
+			return errors.Wrapf(err, "can't read message template for %q", lang)
+		}
+		if e.langMsgTmpls[strings.ToLower(lang)], err = template.New("msgTmpl_" + lang).Funcs(templateFuncs).Parse(string(tmplFile)); err != nil {
+			return errors.Wrapf(err, "can't parse message template for %q", lang)
+		}
+	}
+	e.langSubjTmpls = map[string]*template.Template{}
+	for lang, subj := range e.LangSubjectTemplates {
+		if e.langSubjTmpls[strings.ToLower(lang)], err = template.New("subjectTmpl_" + lang).Funcs(templateFuncs).Parse(subj); err != nil {
+			return errors.Wrapf(err, "can't parse subject template for %q", lang)
+		}
+	}
+
 	return nil
 }
 
+// langTemplate returns template for the language, falls back to the base language (i.e. "pt" for "pt-BR")
+// and then to the default template if there is no translation
+func langTemplate(tmpls map[string]*template.Template, lang string, def *template.Template) *template.Template {
+	lang = strings.ToLower(lang)
+	if t, ok := tmpls[lang]; ok {
+		return t
+	}
+	if i := strings.IndexAny(lang, "-_"); i > 0 {
+		if t, ok := tmpls[lang[:i]]; ok {
+			return t
+		}
+	}
+	return def
+}
+
+// Accepts new comments, replies and mentions, edits if NotifyOnEdit set and deletions if NotifyOnDelete set
+func (e *Email) Accepts(ev Event) bool {
+	return ev == EventNewComment || ev == EventReply || ev == EventMention || (ev == EventEdit && e.NotifyOnEdit) ||
+		(ev == EventDelete && e.NotifyOnDelete)
+}
+
+// AcceptsSpam is true as requests about spam are sent to Email.AdminEmails only, see Request.Spam
+func (e *Email) AcceptsSpam() bool {
+	return true
+}
+
 // Send email about comment reply to Request.Emails and Email.AdminEmails
-// if they're set.
+// if they're set. All messages are delivered within a single SMTP session.
 // Thread safe
-func (e *Email) Send(ctx context.Context, req Request) error {
+func (e *Email) Send(ctx context.Context, req Request) (err error) {
 	select {
 	case <-ctx.Done():
 		return errors.Errorf("sending email messages about comment %q aborted due to canceled context", req.Comment.ID)
 	default:
 	}
 
+	ctx, span := e.startSpan(ctx, spanEmailSend)
+	span.SetAttribute(attrEvent, req.Event.String())
+	span.SetAttribute(attrCommentID, req.Comment.ID)
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.End()
+	}()
+
 	result := new(multierror.Error)
+	cid := correlationID(ctx)
+	log.Printf("[DEBUG] send notification via %s, comment id %s, cid %s", e, req.Comment.ID, cid)
 
-	for _, email := range req.Emails {
-		err := e.buildAndSendMessage(ctx, req, email, false)
-		result = multierror.Append(errors.Wrapf(err, "problem sending user email notification to %q", email))
+	if req.CC != nil {
+		cc := make([]string, 0, len(req.CC))
+		for _, addr := range req.CC {
+			if err := validateRecipient(addr); err != nil {
+				result = multierror.Append(result, errors.Wrap(err, "problem with cc address"))
+				continue
+			}
+			cc = append(cc, addr)
+		}
+		req.CC = cc
+	}
+
+	var msgs []emailMessage
+	var errPrefixes []string // error description for each message in msgs
+	var keys []string        // idempotency key for each message in msgs
+	var coalesceKeys []string
+	addMessage := func(email string, forAdmin bool) {
+		if err := validateRecipient(email); err != nil {
+			result = multierror.Append(result, err)
+			e.report(ctx, req, email, err)
+			return
+		}
+		key := idempotencyKey(req, email)
+		if !e.claim(key) {
+			log.Printf("[DEBUG] skip duplicate notification to %q, comment id %s, cid %s", email, req.Comment.ID, cid)
+			return
+		}
+		if !forAdmin && e.throttled(req, email) {
+			log.Printf("[DEBUG] notification to %q left for summary, comment id %s, cid %s", email, req.Comment.ID, cid)
+			return
+		}
+		errPrefix := fmt.Sprintf("problem sending user email notification to %q, cid %s", email, cid)
+		if forAdmin {
+			errPrefix = fmt.Sprintf("problem sending admin email notification to %q, cid %s", email, cid)
+		}
+		sender := e.onBehalfSender(req, e.requestSender(req.Comment.Locator.SiteID, email))
+		msg, err := e.buildMessageFromRequest(sender, req, email, forAdmin)
+		if err != nil {
+			e.release(key)
+			result = multierror.Append(result, errors.Wrap(err, errPrefix))
+			e.report(ctx, req, email, errors.Wrap(err, errPrefix))
+			return
+		}
+		log.Printf("[DEBUG] enqueue email to %q, comment id %s, cid %s", email, req.Comment.ID, cid)
+		msgs = append(msgs, emailMessage{from: sender.envelope(), to: email, cc: e.ccFor(req),
+			message: msg, cid: cid, thread: threadKey(req, email), seq: req.Comment.Timestamp.UnixNano()})
+		errPrefixes = append(errPrefixes, errPrefix)
+		keys = append(keys, key)
+		coalesceKeys = append(coalesceKeys, coalesceKey(req, email, forAdmin))
 	}
 
+	for _, email := range req.Emails {
+		addMessage(email, false)
+	}
+	// admin copies are not made in dry run, only messages to actual recipients are previewed,
+	// and not made for mentions as admin already got a copy of the comment itself, nor for deletions made by admin
 	for _, email := range e.AdminEmails {
-		err := e.buildAndSendMessage(ctx, req, email, true)
-		result = multierror.Append(errors.Wrapf(err, "problem sending admin email notification to %q", email))
+		if e.DryRun || req.Event == EventMention || req.Event == EventDelete {
+			break
+		}
+		addMessage(email, true)
 	}
 
+	if len(msgs) == 0 {
+		return result.ErrorOrNil()
+	}
+	if e.bufDone != nil { // buffering started with BufferSize
+		buffered := make([]bufferedMessage, len(msgs))
+		for i, m := range msgs {
+			buffered[i] = bufferedMessage{emailMessage: m, req: req, errPrefix: errPrefixes[i], key: keys[i],
+				coalesce: coalesceKeys[i]}
+		}
+		e.bufferMessages(ctx, buffered)
+		return result.ErrorOrNil()
+	}
+	for i, err := range e.sendWithRetries(ctx, msgs) {
+		if err != nil {
+			e.release(keys[i])
+			err = errors.Wrap(err, errPrefixes[i])
+			result = multierror.Append(result, err)
+		}
+		e.report(ctx, req, msgs[i].to, err)
+	}
 	return result.ErrorOrNil()
 }
 
-func (e *Email) buildAndSendMessage(ctx context.Context, req Request, email string, forAdmin bool) error {
-	log.Printf("[DEBUG] send notification via %s, comment id %s", e, req.Comment.ID)
-	msg, err := e.buildMessageFromRequest(req, email, forAdmin)
-	if err != nil {
-		return err
+// report sends result of the message to the recipient to Request.Results if it's set,
+// result is dropped if it's not received till the end of the context
+func (e *Email) report(ctx context.Context, req Request, to string, err error) {
+	if req.Results == nil {
+		return
+	}
+	res := SendResult{MessageID: e.messageID(req.Comment.ID, req.Comment.Locator.SiteID), To: to, Err: err}
+	select {
+	case req.Results <- res:
+	case <-ctx.Done():
+		log.Printf("[WARN] send result for %q dropped, comment id %s", to, req.Comment.ID)
+	}
+}
+
+// ccFor returns copy recipients of request messages, Request.CC if set or EmailParams.CC otherwise
+func (e *Email) ccFor(req Request) []string {
+	if req.CC != nil {
+		return req.CC
+	}
+	return e.CC
+}
+
+// validateRecipient checks email address is well-formed, so the malformed one is rejected before queuing
+func validateRecipient(email string) error {
+	if _, err := mail.ParseAddress(email); err != nil {
+		return errors.Wrapf(err, "invalid recipient address %q", email)
+	}
+	return nil
+}
+
+// idempotencyKey identifies notification about the comment event to the recipient
+func idempotencyKey(req Request, email string) string {
+	return req.Event.String() + "::" + req.Comment.ID + "::" + email
+}
+
+// claim remembers notification key before sending, returns false if notification with this key
+// was delivered within DedupWindow or is being sent right now. Thread safe.
+func (e *Email) claim(key string) bool {
+	if e.dedup == nil {
+		return true
 	}
+	e.dedupLock.Lock()
+	defer e.dedupLock.Unlock()
+	if _, ok := e.dedup.Get(key); ok {
+		return false
+	}
+	e.dedup.Set(key, struct{}{}, 0)
+	return true
+}
 
-	return repeater.NewDefault(5, time.Millisecond*250).Do(
-		ctx,
-		func() error {
-			return e.sendMessage(emailMessage{from: e.From, to: email, message: msg})
-		})
+// release forgets claimed notification key after failed delivery, so the notification can be sent again
+func (e *Email) release(key string) {
+	if e.dedup == nil {
+		return
+	}
+	e.dedup.Invalidate(key)
 }
 
 // SendVerification email verification VerificationRequest.Email if it's set.
@@ -219,213 +918,1598 @@ func (e *Email) SendVerification(ctx context.Context, req VerificationRequest) e
 	default:
 	}
 
-	log.Printf("[DEBUG] send verification via %s, user %s", e, req.User)
-	msg, err := e.buildVerificationMessage(req.User, req.Email, req.Token, req.SiteID)
-	if err != nil {
+	if err := validateRecipient(req.Email); err != nil {
 		return err
 	}
 
-	return repeater.NewDefault(5, time.Millisecond*250).Do(
-		ctx,
-		func() error {
-			return e.sendMessage(emailMessage{from: e.From, to: req.Email, message: msg})
-		})
-}
-
-// buildVerificationMessage generates verification email message based on given input
-func (e *Email) buildVerificationMessage(user, email, token, site string) (string, error) {
-	subject := e.VerificationSubject
-	msg := bytes.Buffer{}
-	err := e.verifyTmpl.Execute(&msg, verifyTmplData{
-		User:         user,
-		Token:        token,
-		Email:        email,
-		Site:         site,
-		SubscribeURL: e.SubscribeURL,
-	})
+	cid := correlationID(ctx)
+	log.Printf("[DEBUG] send verification via %s, user %s, cid %s", e, req.User, cid)
+	msg, err := e.buildVerificationMessage(req.User, req.Email, req.Token, req.SiteID)
 	if err != nil {
-		return "", errors.Wrapf(err, "error executing template to build verification message")
+		return err
+	}
+	if msg, err = e.encryptMessage(msg, req.Email); err != nil {
+		return err
 	}
-	return e.buildMessage(subject, msg.String(), email, "text/html", "")
+
+	return e.sendWithRetries(ctx, []emailMessage{{from: e.sender(req.SiteID).From, to: req.Email, message: msg, cid: cid}})[0]
 }
 
-// buildMessageFromRequest generates email message based on Request using e.MsgTemplate
-func (e *Email) buildMessageFromRequest(req Request, email string, forAdmin bool) (string, error) {
-	subject := "New reply to your comment"
-	if forAdmin {
-		subject = "New comment to your site"
-	}
-	if req.Comment.PostTitle != "" {
-		subject += fmt.Sprintf(" for %q", req.Comment.PostTitle)
+// SendTest renders request message with sample reply and sends it to the address right away, without queue,
+// retries and deduplication, to check email settings. Returns the rendered message.
+func (e *Email) SendTest(ctx context.Context, to string) (string, error) {
+	if err := validateRecipient(to); err != nil {
+		return "", err
 	}
-
-	token, err := e.TokenGenFn(req.parent.User.ID, email, req.Comment.Locator.SiteID)
+	req := testRequest()
+	sender := e.requestSender(req.Comment.Locator.SiteID, to)
+	msg, err := e.buildMessageFromRequest(sender, req, to, false)
 	if err != nil {
-		return "", errors.Wrapf(err, "error creating token for unsubscribe link")
+		return "", errors.Wrap(err, "can't build test message")
 	}
-	unsubscribeLink := e.UnsubscribeURL + "?site=" + req.Comment.Locator.SiteID + "&tkn=" + token
-	if forAdmin {
-		unsubscribeLink = ""
+	cid := correlationID(ctx)
+	log.Printf("[INFO] send test message via %s to %q, cid %s", e, to, cid)
+	if err := e.sendMessages(ctx, []emailMessage{{from: sender.From, to: to, message: msg, cid: cid}})[0]; err != nil {
+		return "", errors.Wrapf(err, "problem sending test message to %q, cid %s", to, cid)
 	}
+	return msg, nil
+}
 
-	commentURLPrefix := req.Comment.Locator.URL + uiNav
-	msg := bytes.Buffer{}
-	tmplData := msgTmplData{
-		UserName:        req.Comment.User.Name,
-		UserPicture:     req.Comment.User.Picture,
-		CommentText:     req.Comment.Text,
-		CommentLink:     commentURLPrefix + req.Comment.ID,
-		CommentDate:     req.Comment.Timestamp,
-		PostTitle:       req.Comment.PostTitle,
-		Email:           email,
-		UnsubscribeLink: unsubscribeLink,
-		ForAdmin:        forAdmin,
-	}
-	// in case of message to admin, parent message might be empty
-	if req.Comment.ParentID != "" {
-		tmplData.ParentUserName = req.parent.User.Name
-		tmplData.ParentUserPicture = req.parent.User.Picture
-		tmplData.ParentCommentText = req.parent.Text
-		tmplData.ParentCommentLink = commentURLPrefix + req.parent.ID
-		tmplData.ParentCommentDate = req.parent.Timestamp
-	}
-	err = e.msgTmpl.Execute(&msg, tmplData)
-	if err != nil {
-		return "", errors.Wrapf(err, "error executing template to build comment reply message")
+// testRequest makes reply notification with sample data, used by SendTest
+func testRequest() Request {
+	now := time.Now()
+	locator := store.Locator{URL: "https://example.com/test-post"}
+	parent := store.Comment{ID: "test-parent", Locator: locator, Timestamp: now.Add(-time.Hour),
+		User: store.User{ID: "test-user", Name: "Test User"},
+		Text: "<p>This is a sample comment.</p>", Orig: "This is a sample comment."}
+	return Request{
+		Event: EventReply,
+		Comment: store.Comment{ID: "test-reply", ParentID: parent.ID, Locator: locator, Timestamp: now,
+			User: store.User{ID: "test-replier", Name: "Sample Replier"}, PostTitle: "Test post",
+			Text: "<p>This is a sample reply, sent to check email notification settings.</p>",
+			Orig: "This is a sample reply, sent to check email notification settings."},
+		parent: parent,
 	}
-	return e.buildMessage(subject, msg.String(), email, "text/html", unsubscribeLink)
 }
 
-// buildMessage generates email message to send using net/smtp.Data()
-func (e *Email) buildMessage(subject, body, to, contentType, unsubscribeLink string) (message string, err error) {
-	addHeader := func(msg, h, v string) string {
-		msg += fmt.Sprintf("%s: %s\n", h, v)
-		return msg
-	}
-	message = addHeader(message, "From", e.From)
-	message = addHeader(message, "To", to)
-	message = addHeader(message, "Subject", mime.BEncoding.Encode("utf-8", subject))
-	message = addHeader(message, "Content-Transfer-Encoding", "quoted-printable")
+// sendWithRetries sends messages, retrying transient failures up to e.MaxRetries times with exponential backoff.
+// Only failed messages are retried. Returns error for each message, nil ones for delivered,
+// errors report the number of attempts made.
+func (e *Email) sendWithRetries(ctx context.Context, msgs []emailMessage) []error {
+	e.metrics.addBuffer(len(msgs))
+	defer e.metrics.addBuffer(-len(msgs))
 
-	if contentType != "" {
-		message = addHeader(message, "MIME-version", "1.0")
-		message = addHeader(message, "Content-Type", contentType+`; charset="UTF-8"`)
+	sendCtx, span := e.startSpan(ctx, spanEmailSendBuffer)
+	span.SetAttribute(attrMessages, len(msgs))
+	attempts := 0
+	msgs = e.enqueue(msgs)
+	errs := make([]error, len(msgs))
+	defer func() {
+		e.dequeue(msgs, errs)
+		span.SetAttribute(attrAttempts, attempts)
+		for _, err := range errs {
+			if err != nil {
+				span.RecordError(err)
+			}
+		}
+		span.End()
+	}()
+	// messages are done in the sequencer once sent or failed permanently, the rest is released on return
+	e.sequencer.add(msgs)
+	finished := make([]bool, len(msgs))
+	finish := func(idx int) {
+		finished[idx] = true
+		e.sequencer.done(msgs[idx])
 	}
+	defer func() {
+		for idx := range msgs {
+			if !finished[idx] {
+				e.sequencer.done(msgs[idx])
+			}
+		}
+	}()
 
-	if unsubscribeLink != "" {
-		// https://support.google.com/mail/answer/81126 -> "Include option to unsubscribe"
-		message = addHeader(message, "List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
-		message = addHeader(message, "List-Unsubscribe", "<"+unsubscribeLink+">")
+	pending := make([]int, len(msgs)) // indexes of messages to send
+	for i := range pending {
+		pending[i] = i
 	}
-
-	message = addHeader(message, "Date", time.Now().Format(time.RFC1123Z))
-
-	buff := &bytes.Buffer{}
-	qp := quotedprintable.NewWriter(buff)
-	if _, err := qp.Write([]byte(body)); err != nil {
+	tries := make([]int, len(msgs)) // attempts made for each message
+	delay := e.RetryBaseDelay
+	for {
+		// messages held back by earlier messages to the same thread are sent once those are done
+		changed := e.sequencer.changes()
+		var ready, held []int
+		for _, idx := range pending {
+			if e.sequencer.ready(msgs[idx]) {
+				ready = append(ready, idx)
+				continue
+			}
+			held = append(held, idx)
+		}
+		if len(ready) == 0 { // all held back by messages sent by other calls
+			select {
+			case <-ctx.Done():
+				for _, idx := range held {
+					errs[idx] = errors.Wrap(ctx.Err(), "aborted due to canceled context while waiting for earlier message of the thread")
+				}
+				return errs
+			case <-changed:
+			}
+			continue
+		}
+
+		if err := ctx.Err(); err != nil { // i.e. Close deadline, the rest is kept in the queue
+			for _, idx := range pending {
+				errs[idx] = errors.Wrapf(err, "aborted due to canceled context after %d attempt(s)", tries[idx])
+			}
+			return errs
+		}
+
+		batch := make([]emailMessage, len(ready))
+		spans := make([]Span, len(ready))
+		for i, idx := range ready {
+			tries[idx]++
+			if tries[idx] > attempts {
+				attempts = tries[idx]
+			}
+			batch[i] = msgs[idx]
+			_, spans[i] = e.startSpan(sendCtx, spanEmailSendMessage)
+			spans[i].SetAttribute(attrRecipientDomain, recipientDomain(batch[i].to))
+			spans[i].SetAttribute(attrMessageSize, len(batch[i].message))
+			spans[i].SetAttribute(attrAttempt, tries[idx])
+		}
+		var retry []int
+		for i, err := range e.sendMessages(sendCtx, batch) {
+			if err != nil {
+				spans[i].RecordError(err)
+			}
+			spans[i].End()
+			idx := ready[i]
+			errs[idx] = err
+			if err == nil {
+				e.metrics.incSent()
+				finish(idx)
+				continue
+			}
+			if tries[idx] > e.MaxRetries || !isTransientError(err) {
+				errs[idx] = errors.Wrapf(err, "failed after %d attempt(s)", tries[idx])
+				finish(idx)
+				continue
+			}
+			retry = append(retry, idx)
+		}
+		pending = append(retry, held...)
+		if len(pending) == 0 {
+			return errs
+		}
+		if len(retry) == 0 {
+			continue
+		}
+
+		for _, idx := range retry {
+			log.Printf("[DEBUG] transient error sending email to %q, attempt %d, retry in %s, cid %s, %v",
+				msgs[idx].to, tries[idx], delay, msgs[idx].cid, errs[idx])
+		}
+		select {
+		case <-ctx.Done():
+			for _, idx := range retry {
+				errs[idx] = errors.Wrapf(errs[idx], "aborted due to canceled context after %d attempt(s)", tries[idx])
+			}
+			for _, idx := range held {
+				errs[idx] = errors.Wrap(ctx.Err(), "aborted due to canceled context while waiting for earlier message of the thread")
+			}
+			return errs
+		case <-time.After(delay):
+		}
+		delay *= 2
+		sort.Ints(pending) // keep order of messages in the batch
+	}
+}
+
+// enqueue puts messages not queued yet to EmailParams.Queue, returns them with ids set.
+// Failure to persist messages doesn't prevent sending them.
+func (e *Email) enqueue(msgs []emailMessage) []emailMessage {
+	if e.Queue == nil {
+		return msgs
+	}
+	res := make([]emailMessage, len(msgs))
+	var queued []QueuedEmail
+	for i, m := range msgs {
+		if m.id == "" {
+			m.id = uuid.New().String()
+			queued = append(queued, QueuedEmail{ID: m.id, From: m.from, To: m.to, CC: m.cc, Message: m.message, Time: time.Now()})
+		}
+		res[i] = m
+	}
+	if len(queued) == 0 {
+		return res
+	}
+	if err := e.Queue.Put(queued...); err != nil {
+		log.Printf("[WARN] can't queue %d email message(s), %v", len(queued), err)
+	}
+	return res
+}
+
+// dequeue removes delivered and permanently failed messages from EmailParams.Queue,
+// messages failed with transient errors are kept for redelivery after restart
+func (e *Email) dequeue(msgs []emailMessage, errs []error) {
+	if e.Queue == nil {
+		return
+	}
+	var ids []string
+	for i, m := range msgs {
+		if errs[i] == nil || !isTransientError(errs[i]) {
+			ids = append(ids, m.id)
+		}
+	}
+	e.removeQueued(ids)
+}
+
+// removeQueued removes messages with given ids from EmailParams.Queue
+func (e *Email) removeQueued(ids []string) {
+	if e.Queue == nil || len(ids) == 0 {
+		return
+	}
+	if err := e.Queue.Remove(ids...); err != nil {
+		log.Printf("[WARN] can't remove %d email message(s) from queue, %v", len(ids), err)
+	}
+}
+
+// isTransientError checks if the error is worth retrying. SMTP replies with 4xx codes are transient,
+// 5xx ones are permanent. Mail API responses are transient for 429 and 5xx statuses only.
+// Any other error considered to be a network failure and retried as well.
+func isTransientError(err error) bool {
+	var tpErr *textproto.Error
+	if errors.As(err, &tpErr) {
+		return tpErr.Code >= 400 && tpErr.Code < 500
+	}
+	var apiErr *mailAPIError
+	if errors.As(err, &apiErr) {
+		return apiErr.transient()
+	}
+	return true
+}
+
+// buildVerificationMessage generates verification email message based on given input
+func (e *Email) buildVerificationMessage(user, email, token, site string) (string, error) {
+	msg := bytes.Buffer{}
+	tmplData := verifyTmplData{
+		User:         user,
+		Token:        token,
+		Email:        email,
+		Site:         site,
+		SubscribeURL: e.SubscribeURL,
+		ExpiresAt:    time.Now().Add(e.VerificationTTL),
+		ExpiresIn:    humanDuration(e.VerificationTTL),
+	}
+	_, _, verifyTmpl := e.baseTemplates()
+	err := verifyTmpl.Execute(&msg, tmplData)
+	if err != nil {
+		return "", errors.Wrapf(err, "error executing template to build verification message")
+	}
+	subject := e.VerificationSubject
+	if e.verifySubjTmpl != nil {
+		if subject, err = executeSubject(e.verifySubjTmpl, tmplData); err != nil {
+			return "", errors.Wrapf(err, "error executing template to build verification message subject")
+		}
+	}
+	footer, err := e.footer(site, email, "")
+	if err != nil {
 		return "", err
 	}
-	// flush now, must NOT use defer, for small body, defer may cause buff.String() got empty body
-	if err := qp.Close(); err != nil {
-		return "", fmt.Errorf("quotedprintable Write failed: %w", err)
+	body, _ := withFooter(msg.String(), "", footer)
+	return e.buildMessage(e.sender(site), subject, body, email, "text/html", "", "", time.Time{})
+}
+
+// CheckVerificationExpiry returns error if verification token expiring at given time is expired.
+// Expiration is checked with small grace period to tolerate clock skew between servers.
+func (e *Email) CheckVerificationExpiry(expiresAt time.Time) error {
+	if time.Now().After(expiresAt.Add(verificationClockSkew)) {
+		return errors.Errorf("verification token expired at %s", expiresAt.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// humanDuration formats duration in whole hours or minutes, i.e. "1 hour" or "30 minutes"
+func humanDuration(d time.Duration) string {
+	plural := func(n int64, unit string) string {
+		if n == 1 {
+			return fmt.Sprintf("%d %s", n, unit)
+		}
+		return fmt.Sprintf("%d %ss", n, unit)
+	}
+	if d >= time.Hour && d%time.Hour == 0 {
+		return plural(int64(d/time.Hour), "hour")
+	}
+	return plural(int64(d.Round(time.Minute)/time.Minute), "minute")
+}
+
+// buildMessageFromRequest generates email message from the sender based on Request using e.MsgTemplate,
+// encrypted if the recipient has a key in PGPKeys
+func (e *Email) buildMessageFromRequest(sender EmailSender, req Request, email string, forAdmin bool) (string, error) {
+	msg, err := e.buildRequestMessage(sender, req, email, forAdmin)
+	if err != nil {
+		return "", err
+	}
+	return e.encryptMessage(msg, email)
+}
+
+// buildRequestMessage generates not encrypted email message from the sender based on Request
+func (e *Email) buildRequestMessage(sender EmailSender, req Request, email string, forAdmin bool) (string, error) {
+	if req.Event == EventDelete {
+		return e.buildDeleteMessage(sender, req, email)
+	}
+	tmplData, err := e.requestTmplData(req, email, forAdmin)
+	if err != nil {
+		return "", err
+	}
+	extraHeaders := e.threadHeaders(req) + e.replyHeaders(req, email) + e.priorityHeaders(req, forAdmin) + e.customHeaders()
+	assemble := func(data msgTmplData) (string, error) {
+		return e.renderMessage(sender, data, extraHeaders, req.Comment.Timestamp)
+	}
+
+	res, err := assemble(tmplData)
+	if err != nil || e.MaxBodyBytes <= 0 || len(res) <= e.MaxBodyBytes {
+		return res, err
+	}
+	return e.truncateComment(assemble, tmplData)
+}
+
+// requestTmplData makes message template data of the Request for the recipient, with unsubscribe link
+// unless the message is for admin
+func (e *Email) requestTmplData(req Request, email string, forAdmin bool) (msgTmplData, error) {
+	recipientID := req.parent.User.ID
+	if req.Event == EventMention {
+		recipientID = req.mention.ID
+	}
+	token, err := e.TokenGenFn(recipientID, email, req.Comment.Locator.SiteID)
+	if err != nil {
+		return msgTmplData{}, errors.Wrapf(err, "error creating token for unsubscribe link")
+	}
+	unsubscribeLink := e.UnsubscribeURL + "?site=" + req.Comment.Locator.SiteID + "&tkn=" + token
+	if forAdmin {
+		unsubscribeLink = ""
+	}
+
+	commentURLPrefix := req.Comment.Locator.URL + uiNav
+	tmplData := msgTmplData{
+		UserName:        req.Comment.User.Name,
+		UserPicture:     req.Comment.User.Picture,
+		UserAvatarURL:   absoluteURL(e.BaseURL, req.Comment.User.Picture),
+		CommentText:     e.LinkSanitizer.Sanitize(commentHTML(req.Comment)),
+		CommentOrig:     req.Comment.Orig,
+		CommentLink:     commentURLPrefix + req.Comment.ID,
+		CommentDate:     req.Comment.Timestamp,
+		PostTitle:       req.Comment.PostTitle,
+		Email:           email,
+		UnsubscribeLink: unsubscribeLink,
+		ForAdmin:        forAdmin,
+		Spam:            req.Spam,
+		Lang:            req.Lang,
+	}
+	if req.Event == EventMention {
+		tmplData.MentionedUserName = req.mention.Name
+	}
+	if req.Event == EventEdit {
+		tmplData.EditDiff = editDiff(req.PrevOrig, req.Comment.Orig)
+	}
+	tmplData.SiteID = req.Comment.Locator.SiteID
+	tmplData.SiteTitle, tmplData.SiteLogoURL = e.branding(req.Comment.Locator.SiteID)
+	// in case of message to admin, parent message might be empty
+	if req.Comment.ParentID != "" {
+		tmplData.IsReply = true
+		tmplData.ParentUserName = req.parent.User.Name
+		tmplData.ParentUserPicture = req.parent.User.Picture
+		tmplData.ParentUserAvatarURL = absoluteURL(e.BaseURL, req.parent.User.Picture)
+		tmplData.ParentCommentText = e.LinkSanitizer.Sanitize(commentHTML(req.parent))
+		tmplData.RenderedParent = e.LinkSanitizer.Sanitize(renderedHTML(req.parent))
+		tmplData.ParentCommentLink = commentURLPrefix + req.parent.ID
+		tmplData.ParentCommentDate = req.parent.Timestamp
+	}
+	return tmplData, nil
+}
+
+// renderMessage generates not encrypted email message from the template data with message, subject, plain
+// and AMP templates, localized ones for data.Lang and admin one for data.ForAdmin, with preheader and footer
+// of data.SiteID added. Used for request messages as well as for ones combining several of them.
+func (e *Email) renderMessage(sender EmailSender, data msgTmplData, extraHeaders string, date time.Time) (string, error) {
+	baseMsgTmpl, subjectTmpl, _ := e.baseTemplates()
+	msgTmpl := langTemplate(e.langMsgTmpls, data.Lang, baseMsgTmpl)
+	if data.ForAdmin && e.adminMsgTmpl != nil {
+		msgTmpl = e.adminMsgTmpl
+	}
+	msg := bytes.Buffer{}
+	if err := msgTmpl.Execute(&msg, data); err != nil {
+		return "", errors.Wrapf(err, "error executing template to build comment reply message")
+	}
+	subject, err := executeSubject(langTemplate(e.langSubjTmpls, data.Lang, subjectTmpl), data)
+	if err != nil {
+		return "", errors.Wrapf(err, "error executing template to build comment reply message subject")
+	}
+
+	plain := htmlToText(msg.String())
+	if e.plainMsgTmpl != nil && msgTmpl == baseMsgTmpl { // plain template is not localized, text of localized html used instead
+		plainMsg := bytes.Buffer{}
+		if err = e.plainMsgTmpl.Execute(&plainMsg, data); err != nil {
+			return "", errors.Wrapf(err, "error executing template to build plain comment reply message")
+		}
+		plain = plainMsg.String()
+	}
+	footer, err := e.footer(data.SiteID, data.Email, data.UnsubscribeLink)
+	if err != nil {
+		return "", err
+	}
+	htmlBody, plain := withFooter(msg.String(), plain, footer)
+	if e.Format == EmailFormatText {
+		return e.buildMessage(sender, subject, plain, data.Email, "text/plain", data.UnsubscribeLink, extraHeaders, date)
+	}
+	if e.preheaderTmpl != nil {
+		preheader, err := executeSubject(e.preheaderTmpl, data)
+		if err != nil {
+			return "", errors.Wrapf(err, "error executing template to build comment reply message preheader")
+		}
+		htmlBody = insertPreheader(htmlBody, preheader)
+	}
+	amp := ""
+	if e.ampMsgTmpl != nil && msgTmpl == baseMsgTmpl { // amp template is not localized, same as plain one
+		ampMsg := bytes.Buffer{}
+		if err = e.ampMsgTmpl.Execute(&ampMsg, data); err != nil {
+			return "", errors.Wrapf(err, "error executing template to build amp comment reply message")
+		}
+		amp = ampMsg.String()
+	}
+	return e.buildMultipartMessage(sender, subject, plain, htmlBody, amp, data.Email, data.UnsubscribeLink, extraHeaders, date)
+}
+
+// insertPreheader adds text hidden in message view right after the opening body tag, or at the top
+// of the message without it. Mail clients show the first text of the message as a preview in inbox.
+func insertPreheader(htmlBody, preheader string) string {
+	if preheader == "" {
+		return htmlBody
+	}
+	span := `<span style="display:none !important;visibility:hidden;mso-hide:all;font-size:1px;line-height:1px;` +
+		`max-height:0;max-width:0;opacity:0;overflow:hidden;">` + html.EscapeString(preheader) + "</span>"
+	pos := 0
+	if start := strings.Index(strings.ToLower(htmlBody), "<body"); start >= 0 {
+		if end := strings.Index(htmlBody[start:], ">"); end >= 0 {
+			pos = start + end + 1
+		}
+	}
+	return htmlBody[:pos] + span + htmlBody[pos:]
+}
+
+// truncateComment assembles message with comment text cut to fit MaxBodyBytes, followed by the link to the full comment.
+// Comment is cut as plain text, so html of the message stays valid. Comment may be included in several parts of the message
+// and grows with their encoding, so the cut is adjusted a few times; if the rest of the message is over the limit alone,
+// only the link is left.
+func (e *Email) truncateComment(assemble func(msgTmplData) (string, error), data msgTmplData) (string, error) {
+	text := html.EscapeString(htmlToText(data.CommentText))
+	marker := fmt.Sprintf(` <a href="%s">…(truncated, view full comment)</a>`, data.CommentLink)
+	data.EditDiff = "" // diff can't be cut as it's made of html tags, truncated comment is shown instead
+	render := func(cut string) (string, error) {
+		data.CommentText, data.CommentOrig = cut+marker, html.UnescapeString(cut)
+		return assemble(data)
+	}
+
+	msg, err := render("")
+	if err != nil || len(msg) >= e.MaxBodyBytes {
+		return msg, err
+	}
+	for limit, i := e.MaxBodyBytes-len(msg), 0; limit > 0 && i < 5; i++ {
+		res, err := render(cutEscaped(text, limit))
+		if err != nil {
+			return res, err
+		}
+		if len(res) <= e.MaxBodyBytes {
+			return res, nil
+		}
+		limit = limit * (e.MaxBodyBytes - len(msg)) / (len(res) - len(msg)) // scale cut to the growth of the message
+	}
+	return msg, nil
+}
+
+// cutEscaped cuts html escaped text to at most n bytes, not breaking utf-8 characters and html entities
+func cutEscaped(s string, n int) string {
+	if n <= 0 {
+		return ""
+	}
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	s = s[:n]
+	if amp := strings.LastIndex(s, "&"); amp >= 0 && !strings.Contains(s[amp:], ";") {
+		s = s[:amp]
+	}
+	return s
+}
+
+// replyHeaders returns Reply-To and Cc headers of request message to email, if set.
+// With InboundAddress, Reply-To is it with token of the comment and the recipient.
+func (e *Email) replyHeaders(req Request, email string) (headers string) {
+	replyTo := e.sender(req.Comment.Locator.SiteID).ReplyTo
+	if e.InboundAddress != "" && req.Comment.ID != "" {
+		replyTo = inboundAddress(e.InboundAddress, InboundReplyToken(e.InboundSecret, req.Comment.Locator.SiteID, req.Comment.ID, email))
+	}
+	if replyTo != "" {
+		headers = addHeader(headers, "Reply-To", replyTo)
+	}
+	if cc := e.ccFor(req); len(cc) > 0 {
+		headers = addHeader(headers, "Cc", strings.Join(cc, ", "))
+	}
+	return headers
+}
+
+// threadHeaders returns Message-ID, In-Reply-To and References headers for the comment,
+// so mail clients group notifications about the same discussion into one conversation.
+// Message IDs are synthetic and derived from comment IDs, so they stay the same for the same request.
+func (e *Email) threadHeaders(req Request) (headers string) {
+	site := req.Comment.Locator.SiteID
+	headers = addHeader(headers, "Message-ID", e.messageID(req.Comment.ID, site))
+	if req.Comment.ParentID == "" {
+		return headers
+	}
+	refs := []string{e.messageID(req.Comment.ParentID, site)}
+	if req.parent.ID == req.Comment.ParentID && req.parent.ParentID != "" {
+		refs = append([]string{e.messageID(req.parent.ParentID, site)}, refs...)
+	}
+	headers = addHeader(headers, "In-Reply-To", refs[len(refs)-1])
+	return addHeader(headers, "References", strings.Join(refs, " "))
+}
+
+// priorityHeaders flags notifications to admins and about PriorityForEvents events as high priority,
+// other notifications have no priority headers
+func (e *Email) priorityHeaders(req Request, forAdmin bool) (headers string) {
+	if !(forAdmin && e.PriorityForAdmin) && !e.PriorityForEvents[req.Event] {
+		return ""
+	}
+	headers = addHeader(headers, "X-Priority", "1")
+	return addHeader(headers, "Importance", "high")
+}
+
+// branding returns title and absolute logo URL of the site, title falls back to the site id
+func (e *Email) branding(siteID string) (title, logoURL string) {
+	b := e.SiteBrandings[siteID]
+	title = b.Title
+	if title == "" {
+		title = siteID
+	}
+	return title, absoluteURL(e.BaseURL, b.LogoURL)
+}
+
+// sender returns sender of the site messages, SiteSenders fields override default ones if set
+func (e *Email) sender(siteID string) EmailSender {
+	res := EmailSender{From: e.From, FromName: e.FromName, ReplyTo: e.ReplyTo}
+	override, ok := e.SiteSenders[siteID]
+	if !ok {
+		return res
+	}
+	if override.From != "" {
+		res.From, res.FromName = override.From, "" // display name of the default sender doesn't belong to the site's address
+	}
+	if override.FromName != "" {
+		res.FromName = override.FromName
+	}
+	if override.ReplyTo != "" {
+		res.ReplyTo = override.ReplyTo
+	}
+	return res
+}
+
+// reservedHeaders can't be set by EmailParams.ExtraHeaders as they are made by Email and define message structure
+var reservedHeaders = map[string]bool{"From": true, "To": true, "Cc": true, "Subject": true, "Date": true,
+	"Message-Id": true, "Mime-Version": true, "Content-Type": true, "Content-Transfer-Encoding": true}
+
+var headerNameRe = regexp.MustCompile("^[!#$%&'*+\\-.^_`|~0-9A-Za-z]+$")
+
+// extraHeaders validates custom headers, returns them with canonical names and without reserved ones
+func extraHeaders(headers map[string]string) (map[string]string, error) {
+	if len(headers) == 0 {
+		return nil, nil
+	}
+	res := make(map[string]string, len(headers))
+	for name, value := range headers {
+		if !headerNameRe.MatchString(name) {
+			return nil, errors.Errorf("invalid extra header name %q", name)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, errors.Errorf("invalid value of extra header %s, line breaks are not allowed", name)
+		}
+		name = textproto.CanonicalMIMEHeaderKey(name)
+		if reservedHeaders[name] {
+			log.Printf("[WARN] extra header %s ignored, it can't be overridden", name)
+			continue
+		}
+		res[name] = value
+	}
+	return res, nil
+}
+
+// customHeaders returns ExtraHeaders sorted by name
+func (e *Email) customHeaders() (headers string) {
+	names := make([]string, 0, len(e.ExtraHeaders))
+	for name := range e.ExtraHeaders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		headers += foldHeader(name, e.ExtraHeaders[name])
+	}
+	return headers
+}
+
+// foldHeader makes header line, folding long value at spaces to keep lines within 78 characters where possible.
+// Non-ASCII value is encoded as RFC 2047 encoded-words.
+func foldHeader(name, value string) string {
+	const maxLineLen = 78
+	for _, r := range value {
+		if r >= utf8.RuneSelf {
+			value = mime.BEncoding.Encode("utf-8", value)
+			break
+		}
+	}
+	res := strings.Builder{}
+	res.WriteString(name + ":")
+	lineLen := len(name) + 1
+	for i, word := range strings.Fields(value) {
+		if i > 0 && lineLen+1+len(word) > maxLineLen {
+			res.WriteString("\n")
+			lineLen = 0
+		}
+		res.WriteString(" " + word)
+		lineLen += 1 + len(word)
+	}
+	res.WriteString("\n")
+	return res.String()
+}
+
+// requestSender returns sender of request message to the recipient. From is taken from FromPool if it's set,
+// round-robin or by the recipient with FromPoolSticky, unless the site has its own From
+func (e *Email) requestSender(siteID, to string) EmailSender {
+	res := e.sender(siteID)
+	if len(e.FromPool) == 0 {
+		return res
+	}
+	if override, ok := e.SiteSenders[siteID]; ok && override.From != "" {
+		return res
+	}
+	var idx uint32
+	if e.FromPoolSticky {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(strings.ToLower(to)))
+		idx = h.Sum32()
+	} else {
+		idx = atomic.AddUint32(&e.fromPoolNext, 1) - 1
+	}
+	res.From = e.FromPool[idx%uint32(len(e.FromPool))]
+	return res
+}
+
+// onBehalfSender returns sender with From replaced by Request.From if it's allowed by AllowRequestFrom,
+// the original From is kept as the actual sender. Invalid Request.From is ignored.
+func (e *Email) onBehalfSender(req Request, sender EmailSender) EmailSender {
+	if !e.AllowRequestFrom || req.From == "" {
+		return sender
+	}
+	addr, err := mail.ParseAddress(req.From)
+	if err != nil {
+		log.Printf("[WARN] request from address %q ignored, %v", req.From, err)
+		return sender
+	}
+	actual := sender.From
+	if a, err := mail.ParseAddress(sender.From); err == nil {
+		actual = a.Address
+	}
+	sender.sender, sender.From, sender.FromName = actual, addr.Address, addr.Name
+	return sender
+}
+
+// envelope returns envelope sender address, the actual sender if From is on behalf of someone else
+func (s EmailSender) envelope() string {
+	if s.sender != "" {
+		return s.sender
+	}
+	return s.From
+}
+
+// fromHeader returns From header value, with FromName as display name if set.
+// Non-ASCII display name is encoded as RFC 2047 encoded-word.
+func (s EmailSender) fromHeader() string {
+	if s.FromName == "" {
+		return s.From
+	}
+	address := s.From
+	if addr, err := mail.ParseAddress(s.From); err == nil {
+		address = addr.Address
+	}
+	for _, r := range s.FromName {
+		if r >= utf8.RuneSelf {
+			return mime.BEncoding.Encode("UTF-8", s.FromName) + " <" + address + ">"
+		}
+	}
+	return (&mail.Address{Name: s.FromName, Address: address}).String()
+}
+
+// messageID makes synthetic message id for the comment, using domain of the site's From address.
+// Comment and site IDs are kept as is if possible, or encoded reversibly with msgIDPart otherwise,
+// so both can be restored from the id of inbound reply, see inboundParent.
+func (e *Email) messageID(commentID, site string) string {
+	domain := "remark42"
+	if addr, err := mail.ParseAddress(e.sender(site).From); err == nil && strings.Contains(addr.Address, "@") {
+		domain = addr.Address[strings.LastIndex(addr.Address, "@")+1:]
+	}
+	id := msgIDPart(commentID)
+	if site != "" {
+		id += "." + msgIDPart(site)
+	}
+	return "<" + id + "@" + domain + ">"
+}
+
+// msgIDEncoding encodes message id parts with characters not allowed in the id, upper case letters and digits only
+var msgIDEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// msgIDPart returns s as is if all its characters are allowed in message id, otherwise "=" followed by
+// base32 of s. Dots separate parts of the id, so they are not allowed in the part.
+func msgIDPart(s string) string {
+	if s != "" && !msgIDUnsafeRe.MatchString(s) && !strings.HasPrefix(s, "=") {
+		return s
+	}
+	return "=" + msgIDEncoding.EncodeToString([]byte(s))
+}
+
+// parseMsgIDPart restores the part of message id made by msgIDPart
+func parseMsgIDPart(s string) (string, error) {
+	if !strings.HasPrefix(s, "=") {
+		return s, nil
+	}
+	b, err := msgIDEncoding.DecodeString(strings.ToUpper(s[1:]))
+	return string(b), err
+}
+
+// buildMessage generates email message to send using net/smtp.Data()
+// extraHeaders, if any, are added right after the Subject. Zero date means current time.
+func (e *Email) buildMessage(sender EmailSender, subject, body, to, contentType, unsubscribeLink, extraHeaders string,
+	date time.Time) (message string, err error) {
+	message = addHeader(message, "From", sender.fromHeader())
+	if sender.sender != "" {
+		message = addHeader(message, "Sender", sender.sender)
+	}
+	message = addHeader(message, "To", e.toHeader(to))
+	message = addHeader(message, "Subject", mime.BEncoding.Encode("utf-8", subject))
+	message += extraHeaders
+	message += e.archiveHeaders(to)
+	message = addHeader(message, "Content-Transfer-Encoding", "quoted-printable")
+
+	if contentType != "" {
+		message = addHeader(message, "MIME-version", "1.0")
+		message = addHeader(message, "Content-Type", contentType+`; charset="UTF-8"`)
+	}
+
+	message += e.trailingHeaders(unsubscribeLink, date)
+
+	m, err := quotedPrintable(body)
+	if err != nil {
+		return "", err
 	}
-	m := buff.String()
 	message += "\n" + m
 	return message, nil
 }
 
-// sendMessage sends messages to server in a new connection, closing the connection after finishing.
-// Thread safe.
+// buildMultipartMessage generates multipart/alternative email message with plain text and html parts,
+// and AMP one after them if amp is not empty.
+// Boundary is derived from the parts content, so the same content always produces the same message body.
+// extraHeaders, if any, are added right after the Subject. Zero date means current time.
+func (e *Email) buildMultipartMessage(sender EmailSender, subject, plain, htmlBody, amp, to, unsubscribeLink, extraHeaders string,
+	date time.Time) (message string, err error) {
+	boundary := fmt.Sprintf("remark42-%x", sha1.Sum([]byte(plain+htmlBody+amp))) //nolint:gosec // not used for security
+	message = addHeader(message, "From", sender.fromHeader())
+	if sender.sender != "" {
+		message = addHeader(message, "Sender", sender.sender)
+	}
+	message = addHeader(message, "To", e.toHeader(to))
+	message = addHeader(message, "Subject", mime.BEncoding.Encode("utf-8", subject))
+	message += extraHeaders
+	message += e.archiveHeaders(to)
+	message = addHeader(message, "MIME-version", "1.0")
+	message = addHeader(message, "Content-Type", fmt.Sprintf("multipart/alternative; boundary=%q", boundary))
+	message += e.trailingHeaders(unsubscribeLink, date)
+	message += "\n"
+
+	// parts order matters, the last one is the most preferred by mail clients
+	parts := []struct{ contentType, body string }{{"text/plain", plain}, {"text/html", htmlBody}}
+	if amp != "" {
+		parts = append(parts, struct{ contentType, body string }{"text/x-amp-html", amp})
+	}
+	for _, part := range parts {
+		m, err := quotedPrintable(part.body)
+		if err != nil {
+			return "", err
+		}
+		message += "--" + boundary + "\n"
+		message = addHeader(message, "Content-Type", part.contentType+`; charset="UTF-8"`)
+		message = addHeader(message, "Content-Transfer-Encoding", "quoted-printable")
+		message += "\n" + m + "\n"
+	}
+	message += "--" + boundary + "--\n"
+	return message, nil
+}
+
+// toHeader returns To header value for the message to the recipient, ToHeaderOverride if it's set
+func (e *Email) toHeader(to string) string {
+	if e.ToHeaderOverride != "" {
+		return e.ToHeaderOverride
+	}
+	return to
+}
+
+// envelopeFrom returns envelope sender of the message from the address, ReturnPath if it's set
+func (e *Email) envelopeFrom(from string) string {
+	if e.ReturnPath != "" {
+		return e.ReturnPath
+	}
+	return from
+}
+
+// archiveHeaders returns X-Original-Recipient header, identifying recipient of the archive copy, if ArchiveEmail is set
+func (e *Email) archiveHeaders(to string) string {
+	if e.ArchiveEmail == "" {
+		return ""
+	}
+	return addHeader("", "X-Original-Recipient", to)
+}
+
+// trailingHeaders returns headers common for all messages which go after content headers.
+// Date header is set to the given date, current time used if it's zero.
+func (e *Email) trailingHeaders(unsubscribeLink string, date time.Time) (headers string) {
+	if unsubscribeLink != "" {
+		// https://support.google.com/mail/answer/81126 -> "Include option to unsubscribe"
+		headers = addHeader(headers, "List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
+		headers = addHeader(headers, "List-Unsubscribe", "<"+unsubscribeLink+">")
+	}
+	if date.IsZero() {
+		date = time.Now()
+	}
+	return addHeader(headers, "Date", date.Format(time.RFC1123Z))
+}
+
+// sendMessage sends single message, see sendMessages for details. Thread safe.
 func (e *Email) sendMessage(m emailMessage) error {
+	return e.sendMessages(context.Background(), []emailMessage{m})[0]
+}
+
+// dryRun logs messages and writes them to DryRunSink instead of sending
+func (e *Email) dryRun(msgs []emailMessage) []error {
+	errs := make([]error, len(msgs))
+	e.dryRunLock.Lock()
+	defer e.dryRunLock.Unlock()
+	for i, m := range msgs {
+		log.Printf("[DEBUG] dry run, email from %q to %q, cid %s:\n%s", m.from, m.to, m.cid, m.message)
+		if e.DryRunSink == nil {
+			continue
+		}
+		rcpts := append([]string{m.to}, m.cc...)
+		if e.ArchiveEmail != "" {
+			rcpts = append(rcpts, e.ArchiveEmail)
+		}
+		rcpt := strings.Join(rcpts, ", ")
+		if _, err := fmt.Fprintf(e.DryRunSink, "MAIL FROM: %s\nRCPT TO: %s\n%s\n", e.envelopeFrom(m.from), rcpt, m.message); err != nil {
+			errs[i] = errors.Wrapf(err, "failed to write dry run message to %q", m.to)
+		}
+	}
+	return errs
+}
+
+// sendMessages sends messages to server in a new connection, closing the connection after finishing.
+// With KeepAlive the connection is reused between calls instead. Returns error for each message,
+// nil ones for delivered. Thread safe.
+func (e *Email) sendMessages(ctx context.Context, msgs []emailMessage) []error {
+	if e.DryRun {
+		return e.dryRun(msgs)
+	}
 	if e.smtp == nil {
-		return errors.New("sendMessage called without client set")
+		return repeatError(errors.New("sendMessage called without client set"), len(msgs))
 	}
-	client, err := e.smtp.Create(e.SMTPParams)
+	defer e.metrics.observeFlush(time.Now())
+	if e.KeepAlive {
+		return e.sendPooled(ctx, msgs)
+	}
+	client, err := e.connect()
 	if err != nil {
-		return errors.Wrap(err, "failed to make smtp Create")
+		return repeatError(err, len(msgs))
 	}
+	defer e.quit(client)
 
-	defer func() {
-		if err = client.Quit(); err != nil {
-			log.Printf("[WARN] failed to send quit command to %s:%d, %v", e.Host, e.Port, err)
-			if err = client.Close(); err != nil {
-				log.Printf("[WARN] can't close smtp connection, %v", err)
-			}
+	return e.writeMessages(ctx, client, msgs)
+}
+
+// Ping checks SMTP server is reachable by connecting with NOOP command, nothing is sent.
+// Circuit breaker and the kept alive connection are not used. Thread safe.
+func (e *Email) Ping(ctx context.Context) error {
+	done := make(chan error, 1) // buffered to let abandoned ping finish
+	go func() {
+		client, err := e.smtp.Create(e.SMTPParams)
+		if err != nil {
+			done <- errors.Wrapf(err, "can't connect to %s:%d", e.Host, e.Port)
+			return
 		}
+		if err = client.Noop(); err != nil {
+			_ = client.Close()
+			done <- errors.Wrapf(err, "noop command to %s:%d failed", e.Host, e.Port)
+			return
+		}
+		e.quit(client)
+		done <- nil
 	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return errors.Wrapf(ctx.Err(), "ping of %s:%d aborted", e.Host, e.Port)
+	}
+}
 
-	if err = client.Mail(m.from); err != nil {
-		return errors.Wrapf(err, "bad from address %q", m.from)
+// connect makes new smtp client. With circuit breaker enabled, fails right away while the circuit is open.
+func (e *Email) connect() (smtpClient, error) {
+	if e.breaker != nil {
+		if err := e.breaker.allow(); err != nil {
+			return nil, errors.Wrapf(err, "skip connection to %s:%d", e.Host, e.Port)
+		}
+	}
+	client, err := e.smtp.Create(e.SMTPParams)
+	if err != nil {
+		e.metrics.incFailed(failReasonCreate)
+		if e.breaker != nil {
+			e.breaker.failure()
+		}
+		return nil, errors.Wrap(err, "failed to make smtp Create")
 	}
-	if err = client.Rcpt(m.to); err != nil {
-		return errors.Wrapf(err, "bad to address %q", m.to)
+	if e.breaker != nil && e.breaker.success() && e.ramp != nil {
+		log.Printf("[INFO] connection to %s:%d recovered, send rate ramps up within %v", e.Host, e.Port, e.RampDuration)
+		e.ramp.restart()
 	}
+	return client, nil
+}
 
+// sendPooled sends messages using kept alive connection, making a new one if there is no connection yet,
+// it's idle for too long or the previous send failed. Connection state is reset with RSET before each reuse.
+func (e *Email) sendPooled(ctx context.Context, msgs []emailMessage) []error {
+	e.poolLock.Lock()
+	defer e.poolLock.Unlock()
+
+	if e.pooled != nil {
+		if err := e.pooled.Reset(); err != nil {
+			log.Printf("[DEBUG] can't reuse smtp connection to %s:%d, %v", e.Host, e.Port, err)
+			e.dropPooled()
+		}
+	}
+	if e.pooled == nil {
+		client, err := e.connect()
+		if err != nil {
+			return repeatError(err, len(msgs))
+		}
+		e.pooled = client
+	}
+
+	errs := e.writeMessages(ctx, e.pooled, msgs)
+	for _, err := range errs {
+		if err != nil {
+			e.dropPooled()
+			return errs
+		}
+	}
+
+	if e.idleTimer != nil {
+		e.idleTimer.Stop()
+	}
+	e.idleTimer = time.AfterFunc(e.IdleTimeout, e.closePooled)
+	return errs
+}
+
+// closePooled closes kept alive connection, if any. Thread safe.
+func (e *Email) closePooled() {
+	e.poolLock.Lock()
+	defer e.poolLock.Unlock()
+	e.dropPooled()
+}
+
+// dropPooled closes kept alive connection, must be called under poolLock
+func (e *Email) dropPooled() {
+	if e.idleTimer != nil {
+		e.idleTimer.Stop()
+		e.idleTimer = nil
+	}
+	if e.pooled != nil {
+		e.quit(e.pooled)
+		e.pooled = nil
+	}
+}
+
+// quit sends QUIT command to the server, closing the connection forcibly if it fails
+func (e *Email) quit(client smtpClient) {
+	if err := client.Quit(); err != nil {
+		e.metrics.incFailed(failReasonQuit)
+		log.Printf("[WARN] failed to send quit command to %s:%d, %v", e.Host, e.Port, err)
+		if err = client.Close(); err != nil {
+			log.Printf("[WARN] can't close smtp connection, %v", err)
+		}
+	}
+}
+
+// writeMessages sends messages over established connection. Messages with the same sender and body
+// are sent in a single transaction with multiple recipients. Failure of one recipient doesn't affect others.
+// With MaxPerSecond set, waits for the rate limiter before each recipient.
+func (e *Email) writeMessages(ctx context.Context, client smtpClient, msgs []emailMessage) []error {
+	errs := make([]error, len(msgs))
+
+	// group messages by sender and body, keeping the original order
+	var groups [][]int
+	groupIdx := map[string]int{}
+	for i, m := range msgs {
+		key := m.from + "\x00" + m.message
+		gi, ok := groupIdx[key]
+		if !ok {
+			gi = len(groups)
+			groupIdx[key] = gi
+			groups = append(groups, nil)
+		}
+		groups[gi] = append(groups[gi], i)
+	}
+
+	// connection is lost, messages not sent yet are left for the next attempt instead of failing on the dead connection
+	abort := func(err error, gi int, unsent []int) []error {
+		err = errors.Wrap(err, "not sent, smtp connection lost")
+		for _, idx := range unsent {
+			errs[idx] = err
+		}
+		for _, g := range groups[gi+1:] {
+			for _, idx := range g {
+				errs[idx] = err
+			}
+		}
+		return errs
+	}
+
+	for gi, group := range groups {
+		if err := ctx.Err(); err != nil { // messages not sent yet are left for the caller to retry or queue
+			for _, g := range groups[gi:] {
+				for _, idx := range g {
+					errs[idx] = errors.Wrap(err, "not sent, aborted due to canceled context")
+				}
+			}
+			return errs
+		}
+		if gi > 0 {
+			if err := client.Reset(); err != nil {
+				e.metrics.incFailed(failReasonReset)
+				for _, g := range groups[gi:] {
+					for _, idx := range g {
+						errs[idx] = errors.Wrap(err, "can't reset smtp session")
+					}
+				}
+				return errs
+			}
+		}
+
+		m := msgs[group[0]]
+		from := e.envelopeFrom(m.from)
+		if err := client.Mail(from); err != nil {
+			e.metrics.incFailed(failReasonMail)
+			if connectionLost(err) {
+				return abort(err, gi, group)
+			}
+			for _, idx := range group {
+				errs[idx] = errors.Wrapf(err, "bad from address %q", from)
+			}
+			continue
+		}
+
+		var accepted []int
+		for i, idx := range group {
+			if e.limiter != nil {
+				if e.ramp != nil {
+					e.ramp.adjust()
+				}
+				if err := e.limiter.Wait(ctx); err != nil {
+					e.metrics.incFailed(failReasonRateLimit)
+					errs[idx] = errors.Wrapf(err, "can't wait for rate limit to send to %q", msgs[idx].to)
+					continue
+				}
+			}
+			if err := client.Rcpt(msgs[idx].to); err != nil {
+				e.metrics.incFailed(failReasonRcpt)
+				if connectionLost(err) {
+					return abort(err, gi, append(accepted, group[i:]...))
+				}
+				errs[idx] = errors.Wrapf(err, "bad to address %q", msgs[idx].to)
+				continue
+			}
+			accepted = append(accepted, idx)
+			for _, cc := range msgs[idx].cc {
+				// failed copy recipient doesn't prevent delivery to the main one
+				if err := client.Rcpt(cc); err != nil {
+					e.metrics.incFailed(failReasonRcpt)
+					log.Printf("[WARN] bad cc address %q, %v", cc, err)
+				}
+			}
+		}
+		if len(accepted) == 0 {
+			continue
+		}
+		if e.ArchiveEmail != "" {
+			// archive copy is blind, the address is never listed in message headers
+			if err := client.Rcpt(e.ArchiveEmail); err != nil {
+				e.metrics.incFailed(failReasonRcpt)
+				log.Printf("[WARN] bad archive address %q, %v", e.ArchiveEmail, err)
+			}
+		}
+
+		if err := writeData(client, m.message); err != nil {
+			e.metrics.incFailed(failReasonData)
+			for _, idx := range accepted {
+				errs[idx] = err
+			}
+			if connectionLost(err) {
+				return abort(err, gi, nil)
+			}
+			continue
+		}
+		for _, idx := range accepted {
+			log.Printf("[DEBUG] sent email to %q, cid %s", msgs[idx].to, msgs[idx].cid)
+		}
+	}
+	return errs
+}
+
+// connectionLost checks if the error of smtp command is caused by broken connection, not by the server reply
+func connectionLost(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr)
+}
+
+// writeData sends message body with DATA command
+func writeData(client smtpClient, message string) error {
 	writer, err := client.Data()
 	if err != nil {
 		return errors.Wrap(err, "can't make email writer")
 	}
 
-	defer func() {
-		if err = writer.Close(); err != nil {
-			log.Printf("[WARN] can't close smtp body writer, %v", err)
-		}
-	}()
-
-	buf := bytes.NewBufferString(m.message)
+	buf := bytes.NewBufferString(message)
 	if _, err = buf.WriteTo(writer); err != nil {
-		return errors.Wrapf(err, "failed to send email body to %q", m.to)
+		_ = writer.Close()
+		return errors.Wrap(err, "failed to send email body")
+	}
+	if err = writer.Close(); err != nil {
+		return errors.Wrap(err, "can't close smtp body writer")
 	}
-
 	return nil
 }
 
+// repeatError returns slice of n copies of err
+func repeatError(err error, n int) []error {
+	res := make([]error, n)
+	for i := range res {
+		res[i] = err
+	}
+	return res
+}
+
+// VerifyUnsubscribeToken checks unsubscribe token made for the notification email sent on siteID
+// and returns user ID and email address the token was issued for.
+func (e *Email) VerifyUnsubscribeToken(token, siteID string) (userID, email string, err error) {
+	if e.TokenParseFn == nil {
+		return "", "", errors.New("unsubscribe token parsing is not configured")
+	}
+	userID, email, site, err := e.TokenParseFn(token)
+	if err != nil {
+		return "", "", errors.Wrap(err, "can't parse unsubscribe token")
+	}
+	if site != siteID {
+		return "", "", errors.Errorf("unsubscribe token issued for site %q, not %q", site, siteID)
+	}
+	if userID == "" || email == "" {
+		return "", "", errors.New("unsubscribe token has no user or email")
+	}
+	return userID, email, nil
+}
+
+// Name of Email destination
+func (e *Email) Name() string {
+	return "email"
+}
+
 // String representation of Email object
 func (e *Email) String() string {
+	if e.Backend == EmailBackendHTTP {
+		return fmt.Sprintf("email: from %q via %s api", e.From, e.HTTPMail.Provider)
+	}
 	return fmt.Sprintf("email: from %q with username '%s' at server %s:%d", e.From, e.Username, e.Host, e.Port)
 }
 
 // Create establish SMTP connection with server using credentials in smtpClientWithCreator.SMTPParams
 // and returns pointer to it. Thread safe.
 func (s *emailClient) Create(params SMTPParams) (smtpClient, error) {
-	authenticate := func(c *smtp.Client) error {
-		if params.Username == "" || params.Password == "" {
-			return nil
-		}
-		auth := smtp.PlainAuth("", params.Username, params.Password, params.Host)
-		if err := c.Auth(auth); err != nil {
-			return errors.Wrapf(err, "failed to auth to smtp %s:%d", params.Host, params.Port)
-		}
-		return nil
+	srvAddress := net.JoinHostPort(params.Host, strconv.Itoa(params.Port))
+	tlsConf := params.tlsConfig()
+
+	connectTimeout, sendTimeout := params.ConnectTimeout, params.SendTimeout
+	if connectTimeout <= 0 {
+		connectTimeout = params.TimeOut
+	}
+	if sendTimeout <= 0 {
+		sendTimeout = params.TimeOut
 	}
 
-	var c *smtp.Client
-	srvAddress := fmt.Sprintf("%s:%d", params.Host, params.Port)
-	if params.TLS {
-		tlsConf := &tls.Config{
-			InsecureSkipVerify: false,
-			ServerName:         params.Host,
-			MinVersion:         tls.VersionTLS12,
+	var conn net.Conn
+	var err error
+	switch {
+	case s.dial != nil:
+		if conn, err = s.dialProxy(srvAddress, connectTimeout, params.TLS, tlsConf); err != nil {
+			return nil, err
 		}
-		conn, err := tls.Dial("tcp", srvAddress, tlsConf)
-		if err != nil {
+	case params.TLS:
+		if conn, err = tls.DialWithDialer(&net.Dialer{Timeout: connectTimeout}, "tcp", srvAddress, tlsConf); err != nil {
 			return nil, errors.Wrapf(err, "failed to dial smtp tls to %s", srvAddress)
 		}
-		if c, err = smtp.NewClient(conn, params.Host); err != nil {
-			return nil, errors.Wrapf(err, "failed to make smtp client for %s", srvAddress)
+	default:
+		if conn, err = net.DialTimeout("tcp", srvAddress, connectTimeout); err != nil {
+			return nil, errors.Wrapf(err, "timeout connecting to %s", srvAddress)
 		}
-		return c, authenticate(c)
+	}
+	// greeting, TLS negotiation and auth limited by connection timeout as well
+	if connectTimeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(connectTimeout))
 	}
 
-	conn, err := net.DialTimeout("tcp", srvAddress, params.TimeOut)
+	c, err := smtp.NewClient(conn, params.Host)
 	if err != nil {
-		return nil, errors.Wrapf(err, "timeout connecting to %s", srvAddress)
+		_ = conn.Close()
+		return nil, errors.Wrapf(err, "failed to make smtp client for %s", srvAddress)
 	}
 
-	c, err = smtp.NewClient(conn, params.Host)
+	if err = initClient(c, params, tlsConf); err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	if sendTimeout <= 0 {
+		_ = conn.SetDeadline(time.Time{})
+		return c, nil
+	}
+	return &deadlineClient{Client: c, conn: conn, timeout: sendTimeout}, nil
+}
+
+// dialProxy connects to the server with s.dial, for implicit TLS the handshake is made over the proxied connection
+func (s *emailClient) dialProxy(addr string, timeout time.Duration, useTLS bool, tlsConf *tls.Config) (net.Conn, error) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	conn, err := s.dial(ctx, "tcp", addr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to connect to %s through proxy", addr)
+	}
+	if !useTLS {
+		return conn, nil
+	}
+	if timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(timeout))
+	}
+	tlsConn := tls.Client(conn, tlsConf)
+	if err = tlsConn.Handshake(); err != nil {
+		_ = conn.Close()
+		return nil, errors.Wrapf(err, "failed to dial smtp tls to %s", addr)
+	}
+	return tlsConn, nil
+}
+
+// tlsConfig makes config for implicit TLS and STARTTLS, verifying server certificate for TLS 1.2+ by default
+func (p SMTPParams) tlsConfig() *tls.Config {
+	res := &tls.Config{
+		InsecureSkipVerify: p.InsecureSkipVerify, //nolint:gosec // explicitly requested for relays with self-signed certificates
+		ServerName:         p.Host,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if p.TLSServerName != "" {
+		res.ServerName = p.TLSServerName
+	}
+	if p.MinTLSVersion != 0 {
+		res.MinVersion = p.MinTLSVersion
+	}
+	return res
+}
+
+// deadlineClient is smtp.Client setting deadline on the connection before each command and body write,
+// so a stalled server can't block sending forever
+type deadlineClient struct {
+	*smtp.Client
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (c *deadlineClient) extendDeadline() {
+	_ = c.conn.SetDeadline(time.Now().Add(c.timeout))
+}
+
+// Mail issues MAIL command with deadline
+func (c *deadlineClient) Mail(from string) error {
+	c.extendDeadline()
+	return c.Client.Mail(from)
+}
+
+// Rcpt issues RCPT command with deadline
+func (c *deadlineClient) Rcpt(to string) error {
+	c.extendDeadline()
+	return c.Client.Rcpt(to)
+}
+
+// Reset issues RSET command with deadline
+func (c *deadlineClient) Reset() error {
+	c.extendDeadline()
+	return c.Client.Reset()
+}
+
+// Data issues DATA command with deadline, returned writer extends the deadline on each write and close
+func (c *deadlineClient) Data() (io.WriteCloser, error) {
+	c.extendDeadline()
+	w, err := c.Client.Data()
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to dial")
+		return nil, err
+	}
+	return &deadlineWriter{WriteCloser: w, client: c}, nil
+}
+
+// Noop issues NOOP command with deadline
+func (c *deadlineClient) Noop() error {
+	c.extendDeadline()
+	return c.Client.Noop()
+}
+
+// Quit issues QUIT command with deadline
+func (c *deadlineClient) Quit() error {
+	c.extendDeadline()
+	return c.Client.Quit()
+}
+
+// deadlineWriter is message body writer of deadlineClient
+type deadlineWriter struct {
+	io.WriteCloser
+	client *deadlineClient
+}
+
+func (w *deadlineWriter) Write(p []byte) (int, error) {
+	w.client.extendDeadline()
+	return w.WriteCloser.Write(p)
+}
+
+// Close finishes the message and waits for server reply with deadline
+func (w *deadlineWriter) Close() error {
+	w.client.extendDeadline()
+	return w.WriteCloser.Close()
+}
+
+// initClient greets the server with LocalName if it's set, negotiates STARTTLS if it's requested
+// and authenticates the client if credentials are set
+func initClient(c smtpClient, params SMTPParams, tlsConf *tls.Config) error {
+	if params.LocalName != "" {
+		if err := c.Hello(params.LocalName); err != nil {
+			return errors.Wrapf(err, "failed to greet smtp %s:%d as %s", params.Host, params.Port, params.LocalName)
+		}
+	}
+	if params.StartTLS {
+		if err := c.StartTLS(tlsConf); err != nil {
+			return errors.Wrapf(err, "failed to start tls with smtp %s:%d", params.Host, params.Port)
+		}
+	}
+
+	var auth smtp.Auth
+	switch params.AuthMethod {
+	case AuthMethodXOAuth2:
+		if params.Username == "" || params.AccessTokenFn == nil {
+			return nil
+		}
+		token, err := params.AccessTokenFn()
+		if err != nil {
+			return errors.Wrap(err, "failed to get access token for smtp")
+		}
+		auth = &xoauth2Auth{username: params.Username, token: token}
+	case AuthMethodLogin:
+		if params.Username == "" || params.Password == "" {
+			return nil
+		}
+		auth = &loginAuth{username: params.Username, password: params.Password, host: params.Host}
+	default:
+		if params.Username == "" || params.Password == "" {
+			return nil
+		}
+		auth = smtp.PlainAuth("", params.Username, params.Password, params.Host)
+	}
+	if err := c.Auth(auth); err != nil {
+		return errors.Wrapf(err, "failed to auth to smtp %s:%d", params.Host, params.Port)
+	}
+	return nil
+}
+
+// loginAuth implements smtp.Auth for LOGIN mechanism
+type loginAuth struct {
+	username, password, host string
+}
+
+// Start begins authentication, refusing to send credentials over unencrypted connection, same as smtp.PlainAuth
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+// Next responds to server challenges with username and password
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	}
+	return nil, errors.Errorf("unexpected server challenge %q", fromServer)
+}
+
+// xoauth2Auth implements smtp.Auth for XOAUTH2 SASL mechanism
+// https://developers.google.com/gmail/imap/xoauth2-protocol
+type xoauth2Auth struct {
+	username, token string
+}
+
+// Start begins authentication with initial response containing user name and access token,
+// refusing to send the token over unencrypted connection
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	return "XOAUTH2", []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01"), nil
+}
+
+// Next responds to server error challenge with empty response, as required by the protocol
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		return []byte{}, nil
+	}
+	return nil, nil
+}
+
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
+
+// commentHTML returns comment text as sanitized HTML suitable for the message body.
+// Text of stored comments is already rendered from markdown, Orig is rendered only if Text is missing.
+// Either way the result goes through the same sanitizer as stored comments, stripping scripts and styles.
+func commentHTML(c store.Comment) string {
+	if c.Text == "" && c.Orig != "" {
+		c.Text = store.NewCommentFormatter().FormatText(c.Orig)
 	}
+	c.Sanitize()
+	return c.Text
+}
+
+// renderedHTML returns comment rendered from markdown it was written in, as sanitized HTML.
+// Stored text is used if the comment has no markdown source.
+func renderedHTML(c store.Comment) string {
+	if c.Orig != "" {
+		c.Text = store.NewCommentFormatter().FormatText(c.Orig)
+	}
+	c.Sanitize()
+	return c.Text
+}
+
+// markdown formatting removed by trimMarkdown, in order of application
+var markdownRes = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	{regexp.MustCompile(`!\[([^\]]*)\]\([^)]*\)`), "$1"},             // images
+	{regexp.MustCompile(`\[([^\]]+)\]\([^)]*\)`), "$1"},              // links
+	{regexp.MustCompile("`{3}[^\n]*\n?"), ""},                        // code fences
+	{regexp.MustCompile("`([^`]+)`"), "$1"},                          // inline code
+	{regexp.MustCompile(`\*\*(\S(?:.*?\S)?)\*\*`), "$1"},             // bold
+	{regexp.MustCompile(`__(\S(?:.*?\S)?)__`), "$1"},                 // bold
+	{regexp.MustCompile(`(^|\W)\*(\S(?:.*?\S)?)\*(\W|$)`), "$1$2$3"}, // italic, not inside of words
+	{regexp.MustCompile(`(^|\W)_(\S(?:.*?\S)?)_(\W|$)`), "$1$2$3"},   // italic, not inside of words
+	{regexp.MustCompile(`~~(\S(?:.*?\S)?)~~`), "$1"},                 // strikethrough
+	{regexp.MustCompile(`(?m)^\s{0,3}#{1,6}\s+`), ""},                // headers
+	{regexp.MustCompile(`(?m)^\s{0,3}>\s?`), ""},                     // blockquotes
+}
+
+// trimMarkdown removes markdown formatting from text, leaving text of links and images
+func trimMarkdown(md string) string {
+	for _, r := range markdownRes {
+		md = r.re.ReplaceAllString(md, r.repl)
+	}
+	return strings.TrimSpace(md)
+}
+
+// executeSubject executes subject template with given data, joining multi-line result into a single line
+func executeSubject(tmpl *template.Template, data interface{}) (string, error) {
+	subj := bytes.Buffer{}
+	if err := tmpl.Execute(&subj, data); err != nil {
+		return "", err
+	}
+	return strings.Join(strings.Fields(subj.String()), " "), nil
+}
+
+func addHeader(msg, h, v string) string {
+	msg += fmt.Sprintf("%s: %s\n", h, v)
+	return msg
+}
 
-	return c, authenticate(c)
+// quotedPrintable encodes body with quoted-printable encoding
+func quotedPrintable(body string) (string, error) {
+	buff := &bytes.Buffer{}
+	qp := quotedprintable.NewWriter(buff)
+	if _, err := qp.Write([]byte(body)); err != nil {
+		return "", err
+	}
+	// flush now, must NOT use defer, for small body, defer may cause buff.String() got empty body
+	if err := qp.Close(); err != nil {
+		return "", fmt.Errorf("quotedprintable Write failed: %w", err)
+	}
+	return buff.String(), nil
+}
+
+// htmlToText makes plain text version of html message, dropping tags along with head, style and script content.
+// Block-level elements and line breaks are turned into new lines, links keep their targets in brackets.
+func htmlToText(htmlText string) string {
+	res := strings.Builder{}
+	skip := 0  // depth of elements which content should be dropped
+	href := "" // target of currently open link
+	tokenizer := html.NewTokenizer(strings.NewReader(htmlText))
+	for {
+		tt := tokenizer.Next()
+		switch tt {
+		case html.ErrorToken:
+			lines := strings.Split(res.String(), "\n")
+			for i := range lines {
+				lines[i] = strings.TrimSpace(lines[i])
+			}
+			return strings.TrimSpace(blankLinesRe.ReplaceAllString(strings.Join(lines, "\n"), "\n\n"))
+		case html.TextToken:
+			if skip == 0 {
+				res.WriteString(spacesRe.ReplaceAllString(string(tokenizer.Text()), " "))
+			}
+		case html.StartTagToken, html.SelfClosingTagToken, html.EndTagToken:
+			tok := tokenizer.Token()
+			switch tok.DataAtom {
+			case atom.Head, atom.Style, atom.Script, atom.Title:
+				if tt == html.StartTagToken {
+					skip++
+				}
+				if tt == html.EndTagToken && skip > 0 {
+					skip--
+				}
+			case atom.A:
+				if tt == html.StartTagToken {
+					href = ""
+					for _, attr := range tok.Attr {
+						if attr.Key == "href" && !strings.HasPrefix(attr.Val, "mailto:") {
+							href = attr.Val
+						}
+					}
+				}
+				if tt == html.EndTagToken && href != "" && skip == 0 {
+					res.WriteString(" (" + href + ")")
+					href = ""
+				}
+			case atom.Br, atom.P, atom.Div, atom.Blockquote, atom.H1, atom.H2, atom.H3, atom.Li, atom.Pre, atom.Tr:
+				res.WriteString("\n")
+			}
+		}
+	}
 }
@@ -0,0 +1,388 @@
+package notify
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+)
+
+// fullFlushesToGrow is number of consecutive flushes of the full buffer doubling its size, with MaxBufferSize set
+const fullFlushesToGrow = 3
+
+// bufferedMessage is request message waiting in the buffer, with everything needed to report its result
+type bufferedMessage struct {
+	emailMessage
+	req       Request
+	errPrefix string    // error description of the message
+	key       string    // idempotency key of the message
+	coalesce  string    // recipient and parent comment of the reply, replies with the same key are sent as one message
+	queued    time.Time // time the message is added to the buffer
+}
+
+// coalesceKey returns key of the reply message grouping it with other replies to the same parent comment
+// for the same recipient, empty for other messages
+func coalesceKey(req Request, email string, forAdmin bool) string {
+	if forAdmin || req.Event != EventReply || req.parent.ID == "" {
+		return ""
+	}
+	return email + "|" + req.Comment.Locator.SiteID + "|" + req.parent.ID
+}
+
+// startBuffer starts flushing of request messages collected for BufferSize or FlushDuration,
+// until Stop or stopBuffer is called. Does nothing if BufferSize is not set.
+//
+// Buffer is batching of request messages sent by Email itself, to deliver them in a single SMTP session.
+// It's configured with BufferSize, MaxBufferSize, FlushDuration, MaxQueueAge and FlushJitter only: the buffer
+// is sent every FlushDuration, or earlier once its oldest message waits longer than MaxQueueAge, and it's always
+// sent on Close. With FlushJitter set, each period is FlushDuration shortened by random value within
+// [0, 2*FlushJitter], i.e. FlushDuration-FlushJitter ±FlushJitter, so instances sharing SMTP server don't flush
+// at the same moment and messages still wait no longer than FlushDuration. Buffered messages are persisted
+// with EmailParams.Queue if it's set. Digest schedules its own messages with DigestParams and sends them
+// bypassing the buffer, so neither set of settings applies to the other mode.
+func (e *Email) startBuffer() {
+	if e.BufferSize <= 0 {
+		return
+	}
+	e.bufSize = e.BufferSize
+	e.metrics.setBufferLimit(e.bufSize)
+	e.bufQuit = make(chan struct{})
+	e.bufCtx, e.bufCancel = context.WithCancel(context.Background())
+	e.bufDone = make(chan struct{})
+	e.bufAdded = make(chan struct{}, 1)
+	e.bufRand = rand.New(rand.NewSource(time.Now().UnixNano())) //nolint:gosec // not used for security
+	go e.runBuffer()
+}
+
+// Stop stops sending the buffer by FlushDuration and MaxQueueAge, flush in progress is completed
+// unless it's aborted by the deadline of Close.
+// Send still adds messages to the buffer, they are sent once it's full or on Close.
+// Doesn't wait for termination, see Stopped. Thread safe.
+func (e *Email) Stop() {
+	if e.bufQuit == nil {
+		return
+	}
+	e.bufStop.Do(func() { close(e.bufQuit) })
+	// drain pending signal of added message, nobody is going to reschedule sending anymore
+	select {
+	case <-e.bufAdded:
+	default:
+	}
+}
+
+// Stopped returns channel closed once sending the buffer by timer is terminated after Stop,
+// the channel is closed already if buffering is disabled
+func (e *Email) Stopped() <-chan struct{} {
+	if e.bufDone == nil {
+		done := make(chan struct{})
+		close(done)
+		return done
+	}
+	return e.bufDone
+}
+
+// runBuffer sends the buffer every FlushDuration, shifted with FlushJitter, until Stop is called. With MaxQueueAge
+// set, the buffer is sent in between as soon as its oldest message waits longer than MaxQueueAge.
+func (e *Email) runBuffer() {
+	defer close(e.bufDone)
+	next := time.Now().Add(e.flushInterval())
+	for {
+		wake := next
+		if aged := e.nextAgedFlush(); !aged.IsZero() && aged.Before(wake) {
+			wake = aged
+		}
+		timer := time.NewTimer(time.Until(wake))
+		select {
+		case <-e.bufQuit:
+			timer.Stop()
+			return
+		case <-e.bufAdded:
+			timer.Stop()
+			continue
+		case <-timer.C:
+		}
+		if !time.Now().Before(next) {
+			next = time.Now().Add(e.flushInterval())
+		}
+		if err := e.autoFlush(); err != nil && e.bufCtx.Err() != nil {
+			e.bufAborted = err // flush aborted by Close deadline, reported by stopBuffer
+		}
+	}
+}
+
+// flushInterval returns the next period of flushing by timer, FlushDuration shortened by random
+// value up to 2*FlushJitter
+func (e *Email) flushInterval() time.Duration {
+	if e.FlushJitter <= 0 {
+		return e.FlushDuration
+	}
+	return e.FlushDuration - time.Duration(e.bufRand.Int63n(int64(2*e.FlushJitter)+1))
+}
+
+// nextAgedFlush returns time the oldest buffered message exceeds MaxQueueAge,
+// zero if MaxQueueAge is not set or the buffer is empty
+func (e *Email) nextAgedFlush() time.Time {
+	if e.MaxQueueAge <= 0 {
+		return time.Time{}
+	}
+	e.bufLock.Lock()
+	defer e.bufLock.Unlock()
+	if len(e.buffer) == 0 {
+		return time.Time{}
+	}
+	return e.buffer[0].queued.Add(e.MaxQueueAge)
+}
+
+// stopBuffer stops flushing by timer and sends messages left in the buffer till the context is done.
+// Flush by timer in progress is aborted once the context is done. Messages not sent in time are reported
+// in returned error, with EmailParams.Queue set they are kept in it for redelivery after restart.
+func (e *Email) stopBuffer(ctx context.Context) error {
+	if e.bufQuit == nil {
+		return nil
+	}
+	e.Stop()
+	select {
+	case <-e.Stopped():
+	case <-ctx.Done():
+		e.bufCancel()
+		<-e.Stopped()
+	}
+	e.bufCancel()
+	e.bufLock.Lock()
+	batch := e.buffer
+	e.buffer = nil
+	e.bufLock.Unlock()
+
+	errs := new(multierror.Error)
+	if e.bufAborted != nil {
+		errs = multierror.Append(errs, e.bufAborted)
+	}
+	if err := e.flushBuffer(ctx, batch); err != nil {
+		errs = multierror.Append(errs, err)
+	}
+	if errs.ErrorOrNil() == nil {
+		return nil
+	}
+	if e.Queue != nil {
+		return errors.Wrap(errs, "buffered email messages not sent on close, kept in the queue")
+	}
+	return errors.Wrap(errs, "buffered email messages not sent on close")
+}
+
+// bufferMessages adds request messages to the buffer and sends the buffer once it's full.
+// Messages are put to EmailParams.Queue first, so ones waiting in the buffer are redelivered after restart.
+func (e *Email) bufferMessages(ctx context.Context, msgs []bufferedMessage) {
+	persisted := make([]emailMessage, len(msgs))
+	for i := range msgs {
+		persisted[i] = msgs[i].emailMessage
+	}
+	persisted = e.enqueue(persisted)
+	now := time.Now()
+	for i := range msgs {
+		msgs[i].emailMessage, msgs[i].queued = persisted[i], now
+	}
+	e.bufLock.Lock()
+	e.buffer = append(e.buffer, msgs...)
+	if len(e.buffer) < e.bufSize {
+		if e.MaxQueueAge > 0 && len(e.buffer) == len(msgs) { // the oldest message changed, reschedule aged flush
+			select {
+			case e.bufAdded <- struct{}{}:
+			default:
+			}
+		}
+		e.bufLock.Unlock()
+		return
+	}
+	batch := e.buffer
+	e.buffer = nil
+	e.adaptBuffer(true)
+	e.bufLock.Unlock()
+	_ = e.flushBuffer(ctx, batch) // failures are reported to Request.Results and logged
+}
+
+// autoFlush sends messages waiting in the buffer for FlushDuration or MaxQueueAge, sending is limited
+// with the time messages can be retried in and aborted by Close deadline. Returns failures of sent messages.
+func (e *Email) autoFlush() error {
+	e.bufLock.Lock()
+	batch := e.buffer
+	e.buffer = nil
+	if len(batch) > 0 {
+		e.adaptBuffer(false)
+	}
+	e.bufLock.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+	parent := context.Background()
+	if e.bufCtx != nil {
+		parent = e.bufCtx
+	}
+	ctx, cancel := context.WithTimeout(parent, e.SendTimeout*time.Duration(e.MaxRetries+1))
+	defer cancel()
+	return e.flushBuffer(ctx, batch)
+}
+
+// adaptBuffer changes buffer size between BufferSize and MaxBufferSize, doubling it after consecutive
+// flushes of the full buffer and halving on flush of partially filled one by timer. Called under bufLock.
+func (e *Email) adaptBuffer(full bool) {
+	if e.MaxBufferSize <= e.BufferSize {
+		return
+	}
+	size := e.bufSize
+	if full {
+		if e.fullFlushes++; e.fullFlushes >= fullFlushesToGrow {
+			e.fullFlushes = 0
+			if size *= 2; size > e.MaxBufferSize {
+				size = e.MaxBufferSize
+			}
+		}
+	} else {
+		e.fullFlushes = 0
+		if size /= 2; size < e.BufferSize {
+			size = e.BufferSize
+		}
+	}
+	if size != e.bufSize {
+		log.Printf("[DEBUG] email buffer size changed from %d to %d", e.bufSize, size)
+		e.bufSize = size
+		e.metrics.setBufferLimit(size)
+	}
+}
+
+// EffectiveBufferSize returns current number of request messages collected before sending,
+// changed under load with MaxBufferSize set. Zero if buffering is disabled. Thread safe.
+func (e *Email) EffectiveBufferSize() int {
+	e.bufLock.Lock()
+	defer e.bufLock.Unlock()
+	return e.bufSize
+}
+
+// BufferLen returns number of request messages waiting in the buffer, zero if buffering is disabled. Thread safe.
+func (e *Email) BufferLen() int {
+	e.bufLock.Lock()
+	defer e.bufLock.Unlock()
+	return len(e.buffer)
+}
+
+// OldestAge returns how long the oldest request message waits in the buffer, zero if the buffer is empty. Thread safe.
+func (e *Email) OldestAge() time.Duration {
+	e.bufLock.Lock()
+	defer e.bufLock.Unlock()
+	if len(e.buffer) == 0 {
+		return 0
+	}
+	return time.Since(e.buffer[0].queued)
+}
+
+// flushBuffer sends buffered messages in a single SMTP session and reports their results,
+// as Send has already returned for them failures are logged and returned. Replies to the same parent comment
+// for the same recipient are sent as a single message listing all of them.
+func (e *Email) flushBuffer(ctx context.Context, batch []bufferedMessage) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	groups := e.coalesceGroups(batch)
+	msgs := make([]emailMessage, len(groups))
+	for i, group := range groups {
+		msgs[i] = batch[group[0]].emailMessage
+		if len(group) == 1 {
+			continue
+		}
+		replies := make([]bufferedMessage, len(group))
+		for j, idx := range group {
+			replies[j] = batch[idx]
+		}
+		msg, err := e.buildCoalescedMessage(replies)
+		if err != nil {
+			log.Printf("[WARN] can't coalesce %d replies to %q, sent separately, %v", len(group), replies[0].to, err)
+			groups[i] = group[:1]
+			for _, idx := range group[1:] { // rest of the group is sent with messages of its own
+				groups = append(groups, []int{idx})
+			}
+			continue
+		}
+		// coalesced message replaces the replies in the queue, it's queued first to keep them persisted
+		msgs[i] = e.enqueue([]emailMessage{msg})[0]
+		ids := make([]string, len(replies))
+		for j, r := range replies {
+			ids[j] = r.id
+		}
+		e.removeQueued(ids)
+	}
+	for i := len(msgs); i < len(groups); i++ {
+		msgs = append(msgs, batch[groups[i][0]].emailMessage)
+	}
+	errs := new(multierror.Error)
+	for i, err := range e.sendWithRetries(ctx, msgs) {
+		for _, idx := range groups[i] {
+			m, mErr := batch[idx], err
+			if mErr != nil {
+				e.release(m.key)
+				mErr = errors.Wrap(mErr, m.errPrefix)
+				log.Printf("[WARN] %v", mErr)
+				errs = multierror.Append(errs, mErr)
+			}
+			e.report(ctx, m.req, m.to, mErr)
+		}
+	}
+	return errs.ErrorOrNil()
+}
+
+// coalesceGroups returns indexes of buffered messages grouped by coalesce key, in order of the first message
+// of each group. Messages without the key are groups of their own.
+func (e *Email) coalesceGroups(batch []bufferedMessage) [][]int {
+	res := make([][]int, 0, len(batch))
+	groupOf := map[string]int{} // coalesce key -> index in res
+	for i, m := range batch {
+		if m.coalesce != "" {
+			if g, ok := groupOf[m.coalesce]; ok {
+				res[g] = append(res[g], i)
+				continue
+			}
+			groupOf[m.coalesce] = len(res)
+		}
+		res = append(res, []int{i})
+	}
+	return res
+}
+
+// buildCoalescedMessage makes single message to the recipient listing replies to the same parent comment,
+// rendered with message templates with Count and Replies set and the rest of data of the last reply
+func (e *Email) buildCoalescedMessage(replies []bufferedMessage) (emailMessage, error) {
+	last := replies[len(replies)-1]
+	req, email := last.req, last.to
+	data, err := e.requestTmplData(req, email, false)
+	if err != nil {
+		return emailMessage{}, err
+	}
+	data.Count = len(replies)
+	seq := last.seq
+	for _, r := range replies {
+		data.Replies = append(data.Replies, replyTmplData{
+			UserName:    r.req.Comment.User.Name,
+			CommentText: e.LinkSanitizer.Sanitize(commentHTML(r.req.Comment)),
+			CommentLink: r.req.Comment.Locator.URL + uiNav + r.req.Comment.ID,
+			CommentDate: r.req.Comment.Timestamp,
+			PostTitle:   r.req.Comment.PostTitle,
+		})
+		if r.seq > seq {
+			seq = r.seq
+		}
+	}
+
+	sender := e.requestSender(req.Comment.Locator.SiteID, email)
+	extraHeaders := e.threadHeaders(req) + e.replyHeaders(req, email) + e.customHeaders()
+	msg, err := e.renderMessage(sender, data, extraHeaders, req.Comment.Timestamp)
+	if err != nil {
+		return emailMessage{}, errors.Wrapf(err, "error building coalesced replies message")
+	}
+	if msg, err = e.encryptMessage(msg, email); err != nil {
+		return emailMessage{}, err
+	}
+	log.Printf("[DEBUG] coalesced %d replies to %q, parent comment id %s", len(replies), email, req.parent.ID)
+	return emailMessage{from: sender.envelope(), to: email, cc: last.cc, message: msg, cid: last.cid,
+		thread: last.thread, seq: seq}, nil
+}
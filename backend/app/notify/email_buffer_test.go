@@ -0,0 +1,425 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime/quotedprintable"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/remark42/backend/app/store"
+)
+
+func TestEmail_SendBuffered(t *testing.T) {
+	email, err := NewEmail(EmailParams{From: "from@example.org", MsgTemplatePath: "testdata/msg.html.tmpl",
+		VerificationTemplatePath: "testdata/verification.html.tmpl", TokenGenFn: TokenGenFn,
+		BufferSize: 2, FlushDuration: time.Hour}, SMTPParams{})
+	require.NoError(t, err)
+	fakeSMTP := &fakeTestSMTP{}
+	email.smtp = fakeSMTP
+	assert.Equal(t, 2, email.EffectiveBufferSize())
+
+	send := func(id, to string) {
+		req := Request{Comment: store.Comment{ID: id, Locator: store.Locator{SiteID: "remark"}}, Emails: []string{to}}
+		require.NoError(t, email.Send(context.Background(), req))
+	}
+	send("1", "u1@example.org")
+	assert.Empty(t, fakeSMTP.rcpts, "waits in the buffer")
+	send("2", "u2@example.org")
+	assert.Equal(t, []string{"u1@example.org", "u2@example.org"}, fakeSMTP.rcpts, "full buffer sent")
+	assert.Equal(t, 1, fakeSMTP.readQuitCount(), "in a single session")
+
+	send("3", "u3@example.org")
+	email.autoFlush()
+	assert.Equal(t, []string{"u1@example.org", "u2@example.org", "u3@example.org"}, fakeSMTP.rcpts, "sent by flush duration")
+
+	send("4", "u4@example.org")
+	require.NoError(t, email.Close(context.Background()))
+	assert.Equal(t, []string{"u1@example.org", "u2@example.org", "u3@example.org", "u4@example.org"}, fakeSMTP.rcpts,
+		"sent on close")
+	assert.Equal(t, 2, email.EffectiveBufferSize(), "fixed size without MaxBufferSize")
+}
+
+func TestEmail_SendBufferedResults(t *testing.T) {
+	email, err := NewEmail(EmailParams{From: "from@example.org", MsgTemplatePath: "testdata/msg.html.tmpl",
+		VerificationTemplatePath: "testdata/verification.html.tmpl", TokenGenFn: TokenGenFn,
+		BufferSize: 10, FlushDuration: 10 * time.Millisecond, MaxRetries: 1, RetryBaseDelay: time.Millisecond}, SMTPParams{})
+	require.NoError(t, err)
+	defer email.Close(context.Background())
+	email.smtp = &fakeTestSMTP{fail: map[string]bool{"rcpt": true}}
+
+	results := make(chan SendResult, 1)
+	req := Request{Comment: store.Comment{ID: "1", Locator: store.Locator{SiteID: "remark"}},
+		Emails: []string{"u1@example.org"}, Results: results}
+	require.NoError(t, email.Send(context.Background(), req), "failure is not known yet")
+	select {
+	case res := <-results:
+		assert.Equal(t, "u1@example.org", res.To)
+		assert.Error(t, res.Err)
+	case <-time.After(time.Second):
+		t.Fatal("no result of buffered message")
+	}
+}
+
+func TestEmail_BufferAdaptive(t *testing.T) {
+	email, err := NewEmail(EmailParams{From: "from@example.org", MsgTemplatePath: "testdata/msg.html.tmpl",
+		VerificationTemplatePath: "testdata/verification.html.tmpl", TokenGenFn: TokenGenFn,
+		BufferSize: 2, MaxBufferSize: 6, FlushDuration: time.Hour}, SMTPParams{})
+	require.NoError(t, err)
+	defer email.Close(context.Background())
+	fakeSMTP := &fakeTestSMTP{}
+	email.smtp = fakeSMTP
+
+	id := 0
+	send := func(n int) {
+		for i := 0; i < n; i++ {
+			id++
+			req := Request{Comment: store.Comment{ID: fmt.Sprintf("c%d", id)}, Emails: []string{"u@example.org"}}
+			require.NoError(t, email.Send(context.Background(), req))
+		}
+	}
+
+	// sustained full flushes
+	send(2 * (fullFlushesToGrow - 1))
+	assert.Equal(t, 2, email.EffectiveBufferSize(), "not grown before enough full flushes")
+	send(2)
+	assert.Equal(t, 4, email.EffectiveBufferSize(), "doubled")
+	send(4 * fullFlushesToGrow)
+	assert.Equal(t, 6, email.EffectiveBufferSize(), "doubled up to max")
+	send(6 * fullFlushesToGrow)
+	assert.Equal(t, 6, email.EffectiveBufferSize(), "max kept")
+	assert.Equal(t, id, len(fakeSMTP.rcpts), "all sent")
+
+	// flushes of partially filled buffer by flush duration
+	send(1)
+	email.autoFlush()
+	assert.Equal(t, 3, email.EffectiveBufferSize(), "halved")
+	email.autoFlush()
+	assert.Equal(t, 3, email.EffectiveBufferSize(), "not changed without messages")
+	send(1)
+	email.autoFlush()
+	assert.Equal(t, 2, email.EffectiveBufferSize(), "shrunk to the configured size")
+	assert.Equal(t, id, len(fakeSMTP.rcpts), "all sent")
+}
+
+func TestEmail_SendBufferedCoalesced(t *testing.T) {
+	email, err := NewEmail(EmailParams{From: "from@example.org", MsgTemplatePath: "testdata/msg.html.tmpl",
+		VerificationTemplatePath: "testdata/verification.html.tmpl", TokenGenFn: TokenGenFn,
+		UnsubscribeURL: "https://remark42.com/api/v1/email/unsubscribe", BufferSize: 10, FlushDuration: time.Hour}, SMTPParams{})
+	require.NoError(t, err)
+	fakeSMTP := &fakeTestSMTP{}
+	email.smtp = fakeSMTP
+
+	parent := store.Comment{ID: "p1", Text: "parent text", User: store.User{ID: "u1", Name: "parent user"},
+		Locator: store.Locator{SiteID: "remark", URL: "https://example.org/post"}}
+	results := make(chan SendResult, 10)
+	reply := func(id, name, text, parentID string) Request {
+		return Request{Event: EventReply, Comment: store.Comment{ID: id, ParentID: parentID, Text: text,
+			User: store.User{Name: name}, Locator: parent.Locator, Timestamp: time.Unix(1600000000, 0)},
+			parent: store.Comment{ID: parentID, User: parent.User, Text: parent.Text, Locator: parent.Locator},
+			Emails: []string{"u1@example.org"}, Results: results}
+	}
+	require.NoError(t, email.Send(context.Background(), reply("r1", "first", "reply one", "p1")))
+	require.NoError(t, email.Send(context.Background(), reply("r2", "second", "reply two", "p1")))
+	require.NoError(t, email.Send(context.Background(), reply("o1", "other", "reply other", "p2")))
+	require.NoError(t, email.Send(context.Background(), reply("r3", "third", "reply three", "p1")))
+	email.autoFlush()
+
+	assert.Equal(t, []string{"u1@example.org", "u1@example.org"}, fakeSMTP.rcpts,
+		"three replies to the same parent coalesced, reply to another parent sent separately")
+	msgs := fakeSMTP.buff.String()
+	assert.Equal(t, 1, strings.Count(msgs, "Subject: 3 new replies to your comment\n"))
+	first := strings.Index(msgs, "Subject:")
+	second := first + 1 + strings.Index(msgs[first+1:], "Subject:")
+	require.True(t, second > first+1, "two messages sent")
+	coalesced := msgs[:second]
+	dec, err := ioutil.ReadAll(quotedprintable.NewReader(strings.NewReader(coalesced[strings.Index(coalesced, "text/html"):])))
+	require.NoError(t, err)
+	body := string(dec)
+	for _, s := range []string{"3 new replies to your comment", "parent text", "<b>first</b>", "reply one", "<b>second</b>",
+		"reply two", "<b>third</b>", "reply three", "https://example.org/post#remark42__comment-r3", "Unsubscribe"} {
+		assert.Contains(t, body, s)
+	}
+	assert.NotContains(t, coalesced, "reply other")
+	assert.Contains(t, msgs[second:], "reply other", "single reply sent with the normal template")
+
+	for i := 0; i < 4; i++ {
+		res := <-results
+		assert.NoError(t, res.Err, "each reply reported")
+	}
+}
+
+func TestEmail_CoalescedTemplates(t *testing.T) {
+	email, err := NewEmail(EmailParams{From: "from@example.org", MsgTemplatePath: "../../templates/email_reply.html.tmpl",
+		VerificationTemplatePath: "testdata/verification.html.tmpl", TokenGenFn: TokenGenFn,
+		SubjectTemplate:   `{{.Count}} replies on {{.SiteTitle}}`,
+		PreheaderTemplate: `{{range .Replies}}{{.UserName}} {{end}}replied`,
+		SiteBrandings:     map[string]SiteBranding{"remark": {Title: "Remark Blog"}},
+		UnsubscribeURL:    "https://remark42.com/api/v1/email/unsubscribe"}, SMTPParams{})
+	require.NoError(t, err)
+
+	parent := store.Comment{ID: "p1", Text: "parent text", User: store.User{ID: "u1", Name: "parent user"},
+		Locator: store.Locator{SiteID: "remark", URL: "https://example.org/post"}}
+	var replies []bufferedMessage
+	for _, id := range []string{"r1", "r2"} {
+		req := Request{Event: EventReply, Comment: store.Comment{ID: id, ParentID: "p1", Text: "text of " + id,
+			User: store.User{Name: "user " + id}, Locator: parent.Locator, Timestamp: time.Unix(1600000000, 0)},
+			parent: parent}
+		replies = append(replies, bufferedMessage{emailMessage: emailMessage{to: "u1@example.org"}, req: req})
+	}
+	msg, err := email.buildCoalescedMessage(replies)
+	require.NoError(t, err)
+	assert.Contains(t, msg.message, "Subject: 2 replies on Remark Blog\n")
+	dec, err := ioutil.ReadAll(quotedprintable.NewReader(strings.NewReader(msg.message[strings.Index(msg.message, "text/html"):])))
+	require.NoError(t, err)
+	body := string(dec)
+	for _, s := range []string{"user r1 user r2 replied</span>", "2 new replies to your comment", "parent text",
+		"text of r1", "text of r2", `href="https://example.org/post#remark42__comment-r2"`,
+		`href="https://remark42.com/api/v1/email/unsubscribe?site=remark&tkn=token"`} {
+		assert.Contains(t, body, s)
+	}
+}
+
+func TestEmail_BufferLen(t *testing.T) {
+	email, err := NewEmail(EmailParams{From: "from@example.org", MsgTemplatePath: "testdata/msg.html.tmpl",
+		VerificationTemplatePath: "testdata/verification.html.tmpl", TokenGenFn: TokenGenFn,
+		BufferSize: 3, FlushDuration: time.Hour}, SMTPParams{})
+	require.NoError(t, err)
+	fakeSMTP := &fakeTestSMTP{}
+	email.smtp = fakeSMTP
+	assert.Equal(t, 0, email.BufferLen())
+	assert.Equal(t, time.Duration(0), email.OldestAge())
+
+	send := func(id string) {
+		req := Request{Comment: store.Comment{ID: id, Locator: store.Locator{SiteID: "remark"}}, Emails: []string{id + "@example.org"}}
+		require.NoError(t, email.Send(context.Background(), req))
+	}
+	send("u1")
+	time.Sleep(10 * time.Millisecond)
+	send("u2")
+	assert.Equal(t, 2, email.BufferLen(), "enqueued messages not sent yet")
+	assert.True(t, email.OldestAge() >= 10*time.Millisecond, "age of the first message")
+	assert.Empty(t, fakeSMTP.rcpts)
+
+	email.autoFlush()
+	assert.Equal(t, 0, email.BufferLen(), "flushed")
+	assert.Equal(t, time.Duration(0), email.OldestAge())
+	assert.Equal(t, 2, len(fakeSMTP.rcpts))
+
+	// accessors are safe to call while messages are sent and flushed
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			send(fmt.Sprintf("c%d", i))
+			email.autoFlush()
+		}(i)
+		go func() {
+			defer wg.Done()
+			assert.True(t, email.BufferLen() <= 3)
+			assert.True(t, email.OldestAge() >= 0)
+		}()
+	}
+	wg.Wait()
+	require.NoError(t, email.Close(context.Background()))
+	assert.Equal(t, 0, email.BufferLen())
+}
+
+func TestEmail_BufferPersisted(t *testing.T) {
+	q := &memEmailQueue{}
+	params := EmailParams{From: "from@example.org", MsgTemplatePath: "testdata/msg.html.tmpl",
+		VerificationTemplatePath: "testdata/verification.html.tmpl", TokenGenFn: TokenGenFn,
+		BufferSize: 10, FlushDuration: time.Hour, Queue: q}
+	email, err := NewEmail(params, SMTPParams{})
+	require.NoError(t, err)
+	fakeSMTP := &fakeTestSMTP{}
+	email.smtp = fakeSMTP
+
+	parent := store.Comment{ID: "p1", User: store.User{ID: "u1", Name: "parent user"},
+		Locator: store.Locator{SiteID: "remark", URL: "https://example.org/post"}}
+	reply := func(id string) Request {
+		return Request{Event: EventReply, Comment: store.Comment{ID: id, ParentID: "p1", Text: "text of " + id,
+			Locator: parent.Locator}, parent: parent, Emails: []string{"u1@example.org"}}
+	}
+	require.NoError(t, email.Send(context.Background(), reply("r1")))
+	require.NoError(t, email.Send(context.Background(), reply("r2")))
+	assert.Equal(t, 2, len(q.all()), "buffered messages persisted")
+	assert.Empty(t, fakeSMTP.rcpts)
+
+	// coalesced replies replace buffered ones in the queue and removed once sent
+	email.autoFlush()
+	assert.Equal(t, []string{"u1@example.org"}, fakeSMTP.rcpts)
+	assert.Empty(t, q.all())
+	assert.Equal(t, 3, q.puts, "two replies and the coalesced message")
+
+	// restart with non-empty buffer, messages redelivered by the next instance
+	require.NoError(t, email.Send(context.Background(), reply("r3")))
+	req := reply("c1")
+	req.Event, req.Comment.ParentID, req.parent = EventNewComment, "", store.Comment{}
+	require.NoError(t, email.Send(context.Background(), req))
+	assert.Equal(t, 2, email.BufferLen())
+	email.Stop() // crash, the buffer is lost
+	<-email.Stopped()
+	require.Equal(t, 2, len(q.all()))
+
+	restartedSMTP := &fakeTestSMTP{}
+	restarted := Email{smtp: restartedSMTP, EmailParams: EmailParams{MaxRetries: 1, RetryBaseDelay: time.Millisecond, Queue: q}}
+	require.NoError(t, restarted.redeliver())
+	require.NoError(t, restarted.Close(context.Background()))
+	assert.Equal(t, []string{"u1@example.org", "u1@example.org"}, restartedSMTP.rcpts)
+	assert.Contains(t, restartedSMTP.buff.String(), "text of r3")
+	assert.Empty(t, q.all())
+}
+
+func TestEmail_BufferMaxQueueAge(t *testing.T) {
+	email, err := NewEmail(EmailParams{From: "from@example.org", MsgTemplatePath: "testdata/msg.html.tmpl",
+		VerificationTemplatePath: "testdata/verification.html.tmpl", TokenGenFn: TokenGenFn,
+		BufferSize: 10, FlushDuration: time.Hour, MaxQueueAge: 50 * time.Millisecond}, SMTPParams{})
+	require.NoError(t, err)
+	fakeSMTP := &fakeTestSMTP{}
+	email.smtp = fakeSMTP
+
+	st := time.Now()
+	req := Request{Comment: store.Comment{ID: "1", Locator: store.Locator{SiteID: "remark"}}, Emails: []string{"u1@example.org"}}
+	require.NoError(t, email.Send(context.Background(), req))
+	for i := 0; i < 100 && fakeSMTP.readQuitCount() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, 1, fakeSMTP.readQuitCount(), "single message sent long before flush duration")
+	assert.True(t, time.Since(st) >= 50*time.Millisecond, "not before max queue age")
+	assert.Equal(t, "u1@example.org", fakeSMTP.readRcpt())
+	assert.Equal(t, 0, email.BufferLen())
+	require.NoError(t, email.Close(context.Background()))
+}
+
+func TestEmail_BufferStop(t *testing.T) {
+	email, err := NewEmail(EmailParams{From: "from@example.org", MsgTemplatePath: "testdata/msg.html.tmpl",
+		VerificationTemplatePath: "testdata/verification.html.tmpl", TokenGenFn: TokenGenFn,
+		BufferSize: 10, FlushDuration: 10 * time.Millisecond, MaxQueueAge: time.Millisecond}, SMTPParams{})
+	require.NoError(t, err)
+	fakeSMTP := &fakeTestSMTP{}
+	email.smtp = fakeSMTP
+
+	email.Stop()
+	select {
+	case <-email.Stopped():
+	case <-time.After(time.Second):
+		t.Fatal("buffer flushing is not stopped")
+	}
+	email.Stop() // stopped already
+
+	req := Request{Comment: store.Comment{ID: "1", Locator: store.Locator{SiteID: "remark"}}, Emails: []string{"u1@example.org"}}
+	require.NoError(t, email.Send(context.Background(), req))
+	assert.Equal(t, 1, email.BufferLen(), "buffered, not sent by timer after stop")
+	require.NoError(t, email.Close(context.Background()))
+	assert.Equal(t, 0, email.BufferLen())
+	assert.Equal(t, "u1@example.org", fakeSMTP.readRcpt(), "sent on close")
+
+	// buffering disabled
+	email, err = NewEmail(EmailParams{From: "from@example.org", MsgTemplatePath: "testdata/msg.html.tmpl",
+		VerificationTemplatePath: "testdata/verification.html.tmpl", TokenGenFn: TokenGenFn}, SMTPParams{})
+	require.NoError(t, err)
+	email.Stop()
+	select {
+	case <-email.Stopped():
+	default:
+		t.Fatal("stopped without buffering")
+	}
+	require.NoError(t, email.Close(context.Background()))
+}
+
+func TestEmail_BufferFlushJitter(t *testing.T) {
+	params := EmailParams{From: "from@example.org", MsgTemplatePath: "testdata/msg.html.tmpl",
+		VerificationTemplatePath: "testdata/verification.html.tmpl", TokenGenFn: TokenGenFn,
+		BufferSize: 10, FlushDuration: time.Minute, FlushJitter: 10 * time.Second}
+	email, err := NewEmail(params, SMTPParams{})
+	require.NoError(t, err)
+	defer email.Close(context.Background())
+	email.Stop() // random source is used by flushing goroutine only
+	<-email.Stopped()
+
+	seen := map[time.Duration]bool{}
+	for i := 0; i < 100; i++ {
+		interval := email.flushInterval()
+		assert.True(t, interval >= 40*time.Second && interval <= time.Minute, "within 50s±10s, %v", interval)
+		seen[interval] = true
+	}
+	assert.True(t, len(seen) > 10, "intervals vary between cycles, %d different", len(seen))
+
+	email.FlushJitter = 0
+	assert.Equal(t, time.Minute, email.flushInterval(), "fixed period without jitter")
+
+	params.FlushJitter = 30 * time.Second
+	_, err = NewEmail(params, SMTPParams{})
+	assert.EqualError(t, err, "email flush jitter 30s should be less than half of flush duration 1m0s")
+	params.FlushJitter = -time.Second
+	_, err = NewEmail(params, SMTPParams{})
+	assert.EqualError(t, err, "email flush jitter -1s should be less than half of flush duration 1m0s")
+}
+
+func TestEmail_BufferCloseDeadline(t *testing.T) {
+	q := &memEmailQueue{}
+	params := EmailParams{From: "from@example.org", MsgTemplatePath: "testdata/msg.html.tmpl",
+		VerificationTemplatePath: "testdata/verification.html.tmpl", TokenGenFn: TokenGenFn,
+		BufferSize: 10, FlushDuration: time.Hour, MaxRetries: 5, RetryBaseDelay: time.Second, Queue: q}
+	send := func(email *Email, id string) {
+		req := Request{Comment: store.Comment{ID: id, Locator: store.Locator{SiteID: "remark"}}, Emails: []string{id + "@example.org"}}
+		require.NoError(t, email.Send(context.Background(), req))
+	}
+
+	// buffered message delivered on close
+	email, err := NewEmail(params, SMTPParams{})
+	require.NoError(t, err)
+	fakeSMTP := &fakeTestSMTP{}
+	email.smtp = fakeSMTP
+	send(email, "u1")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, email.Close(ctx))
+	assert.Equal(t, "u1@example.org", fakeSMTP.readRcpt())
+	assert.Empty(t, q.all())
+
+	// message can't be sent till the deadline, close doesn't wait for retries and reports it
+	email, err = NewEmail(params, SMTPParams{})
+	require.NoError(t, err)
+	email.smtp = &flakySMTPCreator{failures: 100, err: errors.New("connection reset by peer"), smtp: fakeSMTP}
+	send(email, "u2")
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	st := time.Now()
+	err = email.Close(ctx)
+	assert.True(t, time.Since(st) < 500*time.Millisecond, "close doesn't wait for retry after deadline")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "buffered email messages not sent on close, kept in the queue")
+	assert.Contains(t, err.Error(), `"u2@example.org"`)
+	require.Equal(t, 1, len(q.all()), "kept in the queue")
+	assert.Equal(t, "u2@example.org", q.all()[0].To)
+
+	// flush by timer in progress is aborted by the deadline and reported as well
+	params.MaxQueueAge, params.Queue = time.Millisecond, nil
+	email, err = NewEmail(params, SMTPParams{})
+	require.NoError(t, err)
+	flaky := &flakySMTPCreator{failures: 100, err: errors.New("connection reset by peer"), smtp: fakeSMTP}
+	email.smtp = flaky
+	send(email, "u3")
+	for i := 0; i < 100 && flaky.readAttempts() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, 1, flaky.readAttempts(), "flush by timer started")
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	st = time.Now()
+	err = email.Close(ctx)
+	assert.True(t, time.Since(st) < 500*time.Millisecond, "close doesn't wait for flush by timer after deadline")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "buffered email messages not sent on close: ")
+	assert.Contains(t, err.Error(), `"u3@example.org"`)
+}
@@ -0,0 +1,379 @@
+package notify
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// HTTPMailParams contain settings for sending email via HTTP mail API instead of SMTP
+type HTTPMailParams struct {
+	Provider string // mail API provider, MailAPISendGrid or MailAPIMailgun
+	APIKey   string // API key of the provider
+	Domain   string // sending domain, required for Mailgun
+	URL      string // API base URL, provider's default used if empty
+}
+
+// Email sending backends
+const (
+	EmailBackendSMTP = "smtp" // send via SMTP server set by SMTPParams
+	EmailBackendHTTP = "http" // send via HTTP mail API set by HTTPMailParams
+)
+
+// HTTP mail API providers
+const (
+	MailAPISendGrid = "sendgrid"
+	MailAPIMailgun  = "mailgun"
+)
+
+const (
+	defaultSendGridURL = "https://api.sendgrid.com"
+	defaultMailgunURL  = "https://api.mailgun.net"
+)
+
+// validate checks provider and its required settings, sets default URL
+func (p *HTTPMailParams) validate() error {
+	switch p.Provider {
+	case MailAPISendGrid:
+		if p.URL == "" {
+			p.URL = defaultSendGridURL
+		}
+	case MailAPIMailgun:
+		if p.Domain == "" {
+			return errors.New("domain is required for mailgun api")
+		}
+		if p.URL == "" {
+			p.URL = defaultMailgunURL
+		}
+	default:
+		return errors.Errorf("unsupported mail api provider %q", p.Provider)
+	}
+	if p.APIKey == "" {
+		return errors.Errorf("api key is required for %s api", p.Provider)
+	}
+	p.URL = strings.TrimSuffix(p.URL, "/")
+	return nil
+}
+
+// mailAPIError is unsuccessful response of HTTP mail API
+type mailAPIError struct {
+	Code int
+	Body string
+}
+
+func (e *mailAPIError) Error() string {
+	return fmt.Sprintf("mail api responded with status %d: %s", e.Code, e.Body)
+}
+
+// transient checks if the request can succeed on retry
+func (e *mailAPIError) transient() bool {
+	return e.Code == http.StatusTooManyRequests || e.Code >= 500
+}
+
+// httpMailCreator implements smtpClientCreator making clients sending messages via HTTP mail API
+type httpMailCreator struct {
+	HTTPMailParams
+	dial DialFunc // makes connections through the proxy, direct connection made if nil
+}
+
+// Create makes new HTTP mail API client, no connection is made until message is sent
+func (c *httpMailCreator) Create(params SMTPParams) (smtpClient, error) {
+	return &httpMailClient{params: c.HTTPMailParams, client: &http.Client{Timeout: params.SendTimeout, Transport: proxyTransport(c.dial)}}, nil
+}
+
+// httpMailClient implements smtpClient collecting envelope of the message and posting it to HTTP mail API
+// once message body is written, so the messages are built and sent the same way as with SMTP
+type httpMailClient struct {
+	params HTTPMailParams
+	client *http.Client
+	from   string
+	rcpts  []string
+}
+
+// Mail sets envelope sender and resets recipients
+func (c *httpMailClient) Mail(from string) error {
+	c.from, c.rcpts = from, nil
+	return nil
+}
+
+// Rcpt adds envelope recipient
+func (c *httpMailClient) Rcpt(to string) error {
+	c.rcpts = append(c.rcpts, to)
+	return nil
+}
+
+// Data returns writer of the message, message is sent on writer's Close
+func (c *httpMailClient) Data() (io.WriteCloser, error) {
+	if len(c.rcpts) == 0 {
+		return nil, errors.New("no recipients")
+	}
+	return &httpMailWriter{client: c}, nil
+}
+
+// Reset clears the envelope
+func (c *httpMailClient) Reset() error {
+	c.from, c.rcpts = "", nil
+	return nil
+}
+
+// Hello does nothing, there is no SMTP session
+func (c *httpMailClient) Hello(string) error { return nil }
+
+// Auth does nothing, API key is used for authentication
+func (c *httpMailClient) Auth(smtp.Auth) error { return nil }
+
+// StartTLS does nothing, API is called over https
+func (c *httpMailClient) StartTLS(*tls.Config) error { return nil }
+
+// Noop does nothing, there is no SMTP session
+func (c *httpMailClient) Noop() error { return nil }
+
+// Quit does nothing, there is no connection to close
+func (c *httpMailClient) Quit() error { return nil }
+
+// Close does nothing, there is no connection to close
+func (c *httpMailClient) Close() error { return nil }
+
+// send posts message to the provider's API
+func (c *httpMailClient) send(message []byte) error {
+	var req *http.Request
+	var err error
+	switch c.params.Provider {
+	case MailAPIMailgun:
+		req, err = c.mailgunRequest(message)
+	default:
+		req, err = c.sendGridRequest(message)
+	}
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "failed to post message to %s api", c.params.Provider)
+	}
+	defer resp.Body.Close() // nolint
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &mailAPIError{Code: resp.StatusCode, Body: strings.TrimSpace(string(body))}
+	}
+	return nil
+}
+
+// mailgunRequest makes request to Mailgun API sending ready MIME message as is
+// https://documentation.mailgun.com/en/latest/api-sending.html#sending
+func (c *httpMailClient) mailgunRequest(message []byte) (*http.Request, error) {
+	body := bytes.Buffer{}
+	w := multipart.NewWriter(&body)
+	if err := w.WriteField("to", strings.Join(c.rcpts, ",")); err != nil {
+		return nil, errors.Wrap(err, "can't write recipients field")
+	}
+	fw, err := w.CreateFormFile("message", "message.mime")
+	if err != nil {
+		return nil, errors.Wrap(err, "can't make message field")
+	}
+	if _, err = fw.Write(message); err != nil {
+		return nil, errors.Wrap(err, "can't write message field")
+	}
+	if err = w.Close(); err != nil {
+		return nil, errors.Wrap(err, "can't close multipart writer")
+	}
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/v3/%s/messages.mime", c.params.URL, c.params.Domain), &body)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't make mailgun request")
+	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	req.SetBasicAuth("api", c.params.APIKey)
+	return req, nil
+}
+
+// sendGridAddress is email address in SendGrid API request
+type sendGridAddress struct {
+	Email string `json:"email"`
+	Name  string `json:"name,omitempty"`
+}
+
+// sendGridMessage is SendGrid v3 API mail send request
+// https://sendgrid.com/docs/api-reference/ -> Mail Send
+type sendGridMessage struct {
+	Personalizations []sendGridPersonalization `json:"personalizations"`
+	From             sendGridAddress           `json:"from"`
+	ReplyTo          *sendGridAddress          `json:"reply_to,omitempty"`
+	Subject          string                    `json:"subject"`
+	Content          []sendGridContent         `json:"content"`
+	Headers          map[string]string         `json:"headers,omitempty"`
+}
+
+type sendGridPersonalization struct {
+	To  []sendGridAddress `json:"to"`
+	CC  []sendGridAddress `json:"cc,omitempty"`
+	BCC []sendGridAddress `json:"bcc,omitempty"`
+}
+
+type sendGridContent struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// sendGridHeaders are custom message headers passed to SendGrid as is, others are set by the API itself
+var sendGridHeaders = []string{"Message-ID", "In-Reply-To", "References", "List-Unsubscribe", "List-Unsubscribe-Post"}
+
+// sendGridRequest makes request to SendGrid API, which doesn't accept MIME message, so it's parsed
+// back to subject, addresses and content parts. Envelope recipients not listed in To and Cc headers sent as Bcc.
+func (c *httpMailClient) sendGridRequest(message []byte) (*http.Request, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(message))
+	if err != nil {
+		return nil, errors.Wrap(err, "can't parse message")
+	}
+
+	dec := mime.WordDecoder{}
+	subject, err := dec.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		return nil, errors.Wrap(err, "can't decode subject")
+	}
+	sgMsg := sendGridMessage{Subject: subject, From: sendGridAddress{Email: c.from}, Headers: map[string]string{}}
+	if from, e := mail.ParseAddress(msg.Header.Get("From")); e == nil {
+		sgMsg.From = sendGridAddress{Email: from.Address, Name: from.Name}
+	}
+	if replyTo, e := mail.ParseAddress(msg.Header.Get("Reply-To")); e == nil {
+		sgMsg.ReplyTo = &sendGridAddress{Email: replyTo.Address, Name: replyTo.Name}
+	}
+	for _, h := range sendGridHeaders {
+		if v := msg.Header.Get(h); v != "" {
+			sgMsg.Headers[h] = v
+		}
+	}
+
+	// envelope recipients are split to To, Cc and Bcc by message headers
+	rcpts, listed := map[string]bool{}, map[string]bool{}
+	for _, rcpt := range c.rcpts {
+		rcpts[rcpt] = true
+	}
+	headerAddresses := func(name string) []sendGridAddress {
+		var res []sendGridAddress
+		list, _ := msg.Header.AddressList(name)
+		for _, addr := range list {
+			if rcpts[addr.Address] && !listed[addr.Address] {
+				listed[addr.Address] = true
+				res = append(res, sendGridAddress{Email: addr.Address, Name: addr.Name})
+			}
+		}
+		return res
+	}
+	p := sendGridPersonalization{To: headerAddresses("To"), CC: headerAddresses("Cc")}
+	for _, rcpt := range c.rcpts {
+		if !listed[rcpt] {
+			listed[rcpt] = true
+			p.BCC = append(p.BCC, sendGridAddress{Email: rcpt})
+		}
+	}
+	if len(p.To) == 0 { // SendGrid requires at least one To address
+		p.To, p.BCC = p.BCC[:1], p.BCC[1:]
+	}
+	sgMsg.Personalizations = []sendGridPersonalization{p}
+
+	if sgMsg.Content, err = messageContent(msg); err != nil {
+		return nil, err
+	}
+
+	body, err := json.Marshal(sgMsg)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't marshal sendgrid message")
+	}
+	req, err := http.NewRequest("POST", c.params.URL+"/v3/mail/send", bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "can't make sendgrid request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.params.APIKey)
+	return req, nil
+}
+
+// messageContent extracts decoded text/plain and text/html parts of the message, plain one goes first
+func messageContent(msg *mail.Message) ([]sendGridContent, error) {
+	contentType := msg.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't parse message content type")
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		body, e := decodeBody(msg.Body, msg.Header.Get("Content-Transfer-Encoding"))
+		if e != nil {
+			return nil, e
+		}
+		return []sendGridContent{{Type: mediaType, Value: body}}, nil
+	}
+
+	var res []sendGridContent
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, e := mr.NextPart()
+		if e == io.EOF {
+			break
+		}
+		if e != nil {
+			return nil, errors.Wrap(e, "can't read message part")
+		}
+		partType, _, e := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if e != nil {
+			return nil, errors.Wrap(e, "can't parse message part content type")
+		}
+		// quoted-printable parts are decoded by multipart reader itself
+		body, e := decodeBody(part, part.Header.Get("Content-Transfer-Encoding"))
+		if e != nil {
+			return nil, e
+		}
+		if partType == "text/plain" {
+			res = append([]sendGridContent{{Type: partType, Value: body}}, res...)
+			continue
+		}
+		res = append(res, sendGridContent{Type: partType, Value: body})
+	}
+	if len(res) == 0 {
+		return nil, errors.New("no content in message")
+	}
+	return res, nil
+}
+
+// decodeBody reads body decoding it according to transfer encoding
+func decodeBody(r io.Reader, encoding string) (string, error) {
+	if strings.EqualFold(encoding, "quoted-printable") {
+		r = quotedprintable.NewReader(r)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", errors.Wrap(err, "can't read message body")
+	}
+	return string(b), nil
+}
+
+// httpMailWriter buffers message body and sends it on Close
+type httpMailWriter struct {
+	client *httpMailClient
+	buf    bytes.Buffer
+}
+
+func (w *httpMailWriter) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+// Close sends buffered message
+func (w *httpMailWriter) Close() error {
+	return w.client.send(w.buf.Bytes())
+}
@@ -0,0 +1,189 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/remark42/backend/app/store"
+)
+
+func TestEmail_HTTPSendGrid(t *testing.T) {
+	var payloads []sendGridMessage
+	var lock sync.Mutex
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "POST", r.Method)
+		assert.Equal(t, "/v3/mail/send", r.URL.Path)
+		assert.Equal(t, "Bearer secret-key", r.Header.Get("Authorization"))
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		msg := sendGridMessage{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&msg))
+		lock.Lock()
+		payloads = append(payloads, msg)
+		lock.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer ts.Close()
+
+	email, err := NewEmail(EmailParams{
+		From:                     "noreply@example.org",
+		FromName:                 "Remark42",
+		ReplyTo:                  "support@example.org",
+		CC:                       []string{"cc@example.org"},
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "testdata/msg.html.tmpl",
+		TokenGenFn:               TokenGenFn,
+		UnsubscribeURL:           "https://remark42.com/api/v1/email/unsubscribe",
+		Backend:                  EmailBackendHTTP,
+		HTTPMail:                 HTTPMailParams{Provider: MailAPISendGrid, APIKey: "secret-key", URL: ts.URL + "/"},
+	}, SMTPParams{})
+	require.NoError(t, err)
+	assert.Equal(t, `email: from "noreply@example.org" via sendgrid api`, email.String())
+
+	req := Request{Comment: store.Comment{ID: "999", User: store.User{ID: "1", Name: "test_user"}, ParentID: "1",
+		PostTitle: "Привет"}, parent: store.Comment{ID: "1", User: store.User{ID: "2", Name: "parent_user"}},
+		Emails: []string{"test@example.org"}}
+	require.NoError(t, email.Send(context.Background(), req))
+
+	require.Equal(t, 1, len(payloads))
+	p := payloads[0]
+	assert.Equal(t, sendGridAddress{Email: "noreply@example.org", Name: "Remark42"}, p.From)
+	assert.Equal(t, &sendGridAddress{Email: "support@example.org"}, p.ReplyTo)
+	assert.Equal(t, `New reply to your comment for "Привет"`, p.Subject)
+	assert.Equal(t, []sendGridPersonalization{{To: []sendGridAddress{{Email: "test@example.org"}},
+		CC: []sendGridAddress{{Email: "cc@example.org"}}}}, p.Personalizations)
+	require.Equal(t, 2, len(p.Content))
+	assert.Equal(t, "text/plain", p.Content[0].Type)
+	assert.Equal(t, "text/html", p.Content[1].Type)
+	assert.Contains(t, p.Content[1].Value, "test_user")
+	assert.NotContains(t, p.Content[1].Value, "=\r\n", "quoted-printable decoded")
+	assert.Contains(t, p.Headers["List-Unsubscribe"], "https://remark42.com/api/v1/email/unsubscribe")
+	assert.Equal(t, "<1@example.org>", p.Headers["In-Reply-To"])
+	assert.NotContains(t, p.Headers, "Content-Type")
+
+	// verification message is a single part one
+	require.NoError(t, email.SendVerification(context.Background(),
+		VerificationRequest{SiteID: "remark", User: "u", Email: "u@example.org", Token: "tkn"}))
+	require.Equal(t, 2, len(payloads))
+	p = payloads[1]
+	assert.Equal(t, []sendGridPersonalization{{To: []sendGridAddress{{Email: "u@example.org"}}}}, p.Personalizations)
+	require.Equal(t, 1, len(p.Content))
+	assert.Equal(t, "text/html", p.Content[0].Type)
+	assert.Contains(t, p.Content[0].Value, "tkn")
+}
+
+func TestEmail_HTTPMailgun(t *testing.T) {
+	var to, message []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v3/mg.example.org/messages.mime", r.URL.Path)
+		user, pass, ok := r.BasicAuth()
+		assert.True(t, ok)
+		assert.Equal(t, "api", user)
+		assert.Equal(t, "secret-key", pass)
+		require.NoError(t, r.ParseMultipartForm(1024*1024))
+		to = append(to, r.FormValue("to"))
+		f, _, err := r.FormFile("message")
+		require.NoError(t, err)
+		b, err := ioutil.ReadAll(f)
+		require.NoError(t, err)
+		message = append(message, string(b))
+	}))
+	defer ts.Close()
+
+	email, err := NewEmail(EmailParams{
+		From:                     "noreply@example.org",
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "testdata/msg.html.tmpl",
+		TokenGenFn:               TokenGenFn,
+		Backend:                  EmailBackendHTTP,
+		HTTPMail:                 HTTPMailParams{Provider: MailAPIMailgun, APIKey: "secret-key", Domain: "mg.example.org", URL: ts.URL},
+	}, SMTPParams{})
+	require.NoError(t, err)
+
+	req := Request{Comment: store.Comment{ID: "999", User: store.User{ID: "1", Name: "test_user"}, ParentID: "1"},
+		parent: store.Comment{ID: "1", User: store.User{ID: "2", Name: "parent_user"}},
+		Emails: []string{"test@example.org"}, CC: []string{"cc@example.org"}}
+	require.NoError(t, email.Send(context.Background(), req))
+
+	require.Equal(t, 1, len(to))
+	assert.Equal(t, "test@example.org,cc@example.org", to[0])
+	expected, err := email.buildMessageFromRequest(email.sender(req.Comment.Locator.SiteID), req, "test@example.org", false)
+	require.NoError(t, err)
+	// message id and multipart boundary differ between builds
+	assert.True(t, strings.HasPrefix(message[0], "From: noreply@example.org\nTo: test@example.org\n"), message[0])
+	assert.Contains(t, message[0], "Cc: cc@example.org\n")
+	assert.Equal(t, len(expected), len(message[0]))
+}
+
+func TestEmail_HTTPErrors(t *testing.T) {
+	var calls int
+	var lock sync.Mutex
+	status := http.StatusBadRequest
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		calls++
+		lock.Unlock()
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(`{"errors":[{"message":"bad request"}]}`))
+	}))
+	defer ts.Close()
+
+	params := EmailParams{
+		From:                     "noreply@example.org",
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "testdata/msg.html.tmpl",
+		MaxRetries:               3,
+		RetryBaseDelay:           time.Millisecond,
+		Backend:                  EmailBackendHTTP,
+		HTTPMail:                 HTTPMailParams{Provider: MailAPISendGrid, APIKey: "secret-key", URL: ts.URL},
+	}
+	email, err := NewEmail(params, SMTPParams{})
+	require.NoError(t, err)
+
+	vReq := VerificationRequest{SiteID: "remark", User: "u", Email: "u@example.org", Token: "tkn"}
+	err = email.SendVerification(context.Background(), vReq)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `mail api responded with status 400: {"errors":[{"message":"bad request"}]}`)
+	assert.Equal(t, 1, calls, "bad request is not retried")
+
+	calls, status = 0, http.StatusServiceUnavailable
+	require.Error(t, email.SendVerification(context.Background(), vReq))
+	assert.Equal(t, 4, calls, "server error retried")
+
+	// invalid settings
+	tbl := []struct {
+		backend string
+		mail    HTTPMailParams
+		err     string
+	}{
+		{"pigeon", HTTPMailParams{}, `unsupported email backend "pigeon"`},
+		{EmailBackendHTTP, HTTPMailParams{Provider: "postmark", APIKey: "key"},
+			`invalid http mail api settings: unsupported mail api provider "postmark"`},
+		{EmailBackendHTTP, HTTPMailParams{Provider: MailAPISendGrid},
+			"invalid http mail api settings: api key is required for sendgrid api"},
+		{EmailBackendHTTP, HTTPMailParams{Provider: MailAPIMailgun, APIKey: "key"},
+			"invalid http mail api settings: domain is required for mailgun api"},
+	}
+	for i, tt := range tbl {
+		params.Backend, params.HTTPMail = tt.backend, tt.mail
+		_, err = NewEmail(params, SMTPParams{})
+		assert.EqualError(t, err, tt.err, "case #%d", i)
+	}
+
+	// default urls
+	p := HTTPMailParams{Provider: MailAPISendGrid, APIKey: "key"}
+	require.NoError(t, p.validate())
+	assert.Equal(t, "https://api.sendgrid.com", p.URL)
+	p = HTTPMailParams{Provider: MailAPIMailgun, APIKey: "key", Domain: "example.org"}
+	require.NoError(t, p.validate())
+	assert.Equal(t, "https://api.mailgun.net", p.URL)
+}
@@ -0,0 +1,103 @@
+package notify
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+// EmailQueue persists email messages pending delivery, so they survive restarts.
+// Messages are put before sending and removed once delivered or failed permanently.
+type EmailQueue interface {
+	Put(msgs ...QueuedEmail) error
+	Remove(ids ...string) error
+	List() ([]QueuedEmail, error)
+}
+
+// QueuedEmail is email message pending delivery
+type QueuedEmail struct {
+	ID      string    `json:"id"`
+	From    string    `json:"from"`
+	To      string    `json:"to"`
+	CC      []string  `json:"cc,omitempty"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// BoltEmailQueue implements EmailQueue with bolt db
+type BoltEmailQueue struct {
+	db *bolt.DB
+}
+
+var emailQueueBucket = []byte("queue") // message id -> json of QueuedEmail
+
+// NewBoltEmailQueue makes persistent email queue in bolt file
+func NewBoltEmailQueue(path string) (*BoltEmailQueue, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 30 * time.Second}) //nolint:gocritic //octalLiteral is OK as FileMode
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open email queue db %s", path)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, e := tx.CreateBucketIfNotExists(emailQueueBucket)
+		return errors.Wrapf(e, "failed to create bucket %s", string(emailQueueBucket))
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &BoltEmailQueue{db: db}, nil
+}
+
+// Put stores messages
+func (q *BoltEmailQueue) Put(msgs ...QueuedEmail) error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(emailQueueBucket)
+		for _, m := range msgs {
+			b, err := json.Marshal(m)
+			if err != nil {
+				return errors.Wrapf(err, "failed to marshal queued email %s", m.ID)
+			}
+			if err = bkt.Put([]byte(m.ID), b); err != nil {
+				return errors.Wrapf(err, "failed to put queued email %s", m.ID)
+			}
+		}
+		return nil
+	})
+}
+
+// Remove deletes messages by ids, unknown ids ignored
+func (q *BoltEmailQueue) Remove(ids ...string) error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(emailQueueBucket)
+		for _, id := range ids {
+			if err := bkt.Delete([]byte(id)); err != nil {
+				return errors.Wrapf(err, "failed to remove queued email %s", id)
+			}
+		}
+		return nil
+	})
+}
+
+// List returns all stored messages, oldest first
+func (q *BoltEmailQueue) List() (res []QueuedEmail, err error) {
+	err = q.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(emailQueueBucket).ForEach(func(k, v []byte) error {
+			m := QueuedEmail{}
+			if e := json.Unmarshal(v, &m); e != nil {
+				return errors.Wrapf(e, "failed to unmarshal queued email %s", string(k))
+			}
+			res = append(res, m)
+			return nil
+		})
+	})
+	sort.Slice(res, func(i, j int) bool { return res[i].Time.Before(res[j].Time) })
+	return res, err
+}
+
+// Close queue db
+func (q *BoltEmailQueue) Close() error {
+	return q.db.Close()
+}
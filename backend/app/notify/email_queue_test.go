@@ -0,0 +1,338 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/textproto"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBoltEmailQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "email_queue")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	q, err := NewBoltEmailQueue(dir + "/queue.db")
+	require.NoError(t, err)
+
+	res, err := q.List()
+	require.NoError(t, err)
+	assert.Empty(t, res)
+
+	ts := time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC)
+	require.NoError(t, q.Put(QueuedEmail{ID: "2", To: "to2@example.org", Message: "msg2", Time: ts.Add(time.Minute)},
+		QueuedEmail{ID: "1", From: "from@example.org", To: "to1@example.org", CC: []string{"cc@example.org"}, Message: "msg1", Time: ts}))
+	require.NoError(t, q.Put(QueuedEmail{ID: "3", To: "to3@example.org", Time: ts.Add(time.Hour)}))
+	require.NoError(t, q.Close())
+
+	q, err = NewBoltEmailQueue(dir + "/queue.db")
+	require.NoError(t, err, "reopen")
+	defer q.Close()
+	res, err = q.List()
+	require.NoError(t, err)
+	require.Equal(t, 3, len(res))
+	assert.Equal(t, QueuedEmail{ID: "1", From: "from@example.org", To: "to1@example.org", CC: []string{"cc@example.org"},
+		Message: "msg1", Time: ts}, res[0])
+	assert.Equal(t, "2", res[1].ID, "ordered by time")
+	assert.Equal(t, "3", res[2].ID)
+
+	require.NoError(t, q.Remove("1", "3", "unknown"))
+	res, err = q.List()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res))
+	assert.Equal(t, "2", res[0].ID)
+
+	_, err = NewBoltEmailQueue("/dev/null/queue.db")
+	assert.Error(t, err)
+}
+
+func TestEmail_SendQueued(t *testing.T) {
+	q := &memEmailQueue{}
+	fakeSMTP := &fakeTestSMTP{}
+	e := Email{smtp: fakeSMTP, EmailParams: EmailParams{MaxRetries: 1, RetryBaseDelay: time.Millisecond, Queue: q}}
+
+	// delivered messages removed from the queue
+	errs := e.sendWithRetries(context.Background(), []emailMessage{{to: "to1@example.org"}, {to: "to2@example.org"}})
+	assert.Equal(t, []error{nil, nil}, errs)
+	assert.Equal(t, 2, q.puts)
+	assert.Empty(t, q.all())
+
+	// permanent failure removed, transient one kept for redelivery
+	e.smtp = &fakeTestSMTP{fail: map[string]bool{"rcpt": true}, failErr: &textproto.Error{Code: 550, Msg: "no such user"}}
+	errs = e.sendWithRetries(context.Background(), []emailMessage{{to: "to1@example.org"}})
+	require.Error(t, errs[0])
+	assert.Empty(t, q.all(), "permanent failure")
+
+	e.smtp = &flakySMTPCreator{failures: 10, err: errors.New("connection reset by peer"), smtp: fakeSMTP}
+	errs = e.sendWithRetries(context.Background(), []emailMessage{{from: "from@example.org", to: "to3@example.org", message: "msg"}})
+	require.Error(t, errs[0])
+	queued := q.all()
+	require.Equal(t, 1, len(queued), "transient failure")
+	assert.Equal(t, "to3@example.org", queued[0].To)
+	assert.Equal(t, "from@example.org", queued[0].From)
+	assert.Equal(t, "msg", queued[0].Message)
+	assert.NotEmpty(t, queued[0].ID)
+
+	// queue failure doesn't prevent delivery
+	q.fail = true
+	e.smtp = fakeSMTP
+	errs = e.sendWithRetries(context.Background(), []emailMessage{{to: "to4@example.org"}})
+	assert.NoError(t, errs[0])
+	assert.Equal(t, "to4@example.org", fakeSMTP.readRcpt())
+}
+
+func TestEmail_SendPartialBatch(t *testing.T) {
+	q := &memEmailQueue{}
+	dying := &dyingTestSMTP{rejectMsg: "msg2"}
+	e := Email{smtp: dying, EmailParams: EmailParams{MaxRetries: 1, RetryBaseDelay: time.Millisecond, Queue: q}}
+
+	errs := e.sendWithRetries(context.Background(), []emailMessage{
+		{from: "from@example.org", to: "to1@example.org", message: "msg1"},
+		{from: "from@example.org", to: "to2@example.org", message: "msg2"},
+		{from: "from@example.org", to: "to3@example.org", message: "msg3"},
+		{from: "from@example.org", to: "to4@example.org", message: "msg4"},
+	})
+	require.Len(t, errs, 4)
+	assert.NoError(t, errs[0])
+	require.Error(t, errs[1])
+	assert.Contains(t, errs[1].Error(), `550 "mailbox unavailable"`)
+	for _, err := range errs[2:] {
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "failed after 2 attempt(s)")
+	}
+	assert.Equal(t, []string{"msg1", "msg2"}, dying.sent, "delivered and rejected messages are not sent again")
+	assert.Equal(t, 2, dying.cmdsAfterLoss, "only reset and quit attempted after connection loss")
+
+	queued := q.all()
+	require.Len(t, queued, 2, "tail of the batch kept in the queue")
+	tos := []string{queued[0].To, queued[1].To}
+	sort.Strings(tos)
+	assert.Equal(t, []string{"to3@example.org", "to4@example.org"}, tos)
+
+	// connection lost on recipient of the transaction fails it and the rest of messages without sending them
+	dying = &dyingTestSMTP{loseAtRcpt: "to3@example.org"}
+	e = Email{smtp: dying}
+	errs = e.sendMessages(context.Background(), []emailMessage{
+		{from: "from@example.org", to: "to1@example.org", message: "msg1"},
+		{from: "from@example.org", to: "to2@example.org", message: "msg2"},
+		{from: "from@example.org", to: "to3@example.org", message: "msg2"},
+		{from: "from@example.org", to: "to4@example.org", message: "msg3"},
+	})
+	require.Len(t, errs, 4)
+	assert.NoError(t, errs[0])
+	for _, err := range errs[1:] {
+		assert.EqualError(t, err, "not sent, smtp connection lost: EOF")
+	}
+	assert.Equal(t, []string{"msg1"}, dying.sent)
+	assert.Equal(t, 1, dying.cmdsAfterLoss, "only quit attempted after connection loss")
+}
+
+func TestEmail_Redeliver(t *testing.T) {
+	q := &memEmailQueue{}
+	require.NoError(t, q.Put(QueuedEmail{ID: "1", From: "from@example.org", To: "to1@example.org", Message: "msg1"},
+		QueuedEmail{ID: "2", From: "from@example.org", To: "to2@example.org", Message: "msg2"}))
+	fakeSMTP := &fakeTestSMTP{}
+	e := Email{smtp: fakeSMTP, EmailParams: EmailParams{MaxRetries: 1, RetryBaseDelay: time.Millisecond, Queue: q}}
+	require.NoError(t, e.redeliver())
+	require.NoError(t, e.Close(context.Background()), "waits for redelivery")
+
+	assert.Equal(t, []string{"to1@example.org", "to2@example.org"}, fakeSMTP.rcpts)
+	assert.Empty(t, q.all())
+	assert.Equal(t, 2, q.puts, "redelivered messages are not queued again")
+
+	// nothing to redeliver
+	e = Email{smtp: fakeSMTP, EmailParams: EmailParams{Queue: q}}
+	require.NoError(t, e.redeliver())
+	require.NoError(t, e.Close(context.Background()))
+
+	// queue can't be loaded, goroutines started for template dir and buffer are not left running
+	q.fail = true
+	dir, err := ioutil.TempDir("", "remark42_email_queue")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	goroutines := runtime.NumGoroutine()
+	_, err = NewEmail(EmailParams{Queue: q, VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath: "testdata/msg.html.tmpl", TemplateDir: dir, BufferSize: 10}, SMTPParams{})
+	assert.EqualError(t, err, "can't load queued email messages: queue failure")
+	for i := 0; i < 100 && runtime.NumGoroutine() > goroutines; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, goroutines, runtime.NumGoroutine(), "no goroutines left after error")
+}
+
+func TestEmail_CloseFlushesQueue(t *testing.T) {
+	q := &memEmailQueue{}
+	require.NoError(t, q.Put(QueuedEmail{ID: "1", From: "from@example.org", To: "to1@example.org", Message: "msg1"},
+		QueuedEmail{ID: "2", From: "from@example.org", To: "to2@example.org", Message: "msg2"}))
+	fakeSMTP := &fakeTestSMTP{}
+	// the first attempt fails, so the messages are delivered with retry only
+	flaky := &flakySMTPCreator{failures: 1, err: errors.New("connection reset by peer"), smtp: fakeSMTP}
+	e := Email{smtp: flaky, EmailParams: EmailParams{MaxRetries: 3, RetryBaseDelay: 100 * time.Millisecond, Queue: q}}
+	require.NoError(t, e.redeliver())
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, e.Close(ctx))
+	assert.Equal(t, []string{"to1@example.org", "to2@example.org"}, fakeSMTP.rcpts, "pending messages delivered before close")
+	assert.Empty(t, q.all())
+
+	// redelivery interrupted by close deadline, messages kept in the queue
+	require.NoError(t, q.Put(QueuedEmail{ID: "3", From: "from@example.org", To: "to3@example.org", Message: "msg3"}))
+	flaky = &flakySMTPCreator{failures: 1, err: errors.New("connection reset by peer"), smtp: fakeSMTP}
+	e = Email{smtp: flaky, EmailParams: EmailParams{MaxRetries: 3, RetryBaseDelay: time.Second, Queue: q}}
+	require.NoError(t, e.redeliver())
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	st := time.Now()
+	require.NoError(t, e.Close(ctx))
+	assert.True(t, time.Since(st) < 500*time.Millisecond, "close doesn't wait for retry after deadline")
+	assert.Equal(t, 1, len(q.all()), "undelivered message kept")
+}
+
+func TestEmail_NewWithQueue(t *testing.T) {
+	q := &memEmailQueue{}
+	require.NoError(t, q.Put(QueuedEmail{ID: "1", To: "to1@example.org", Message: "msg1"}))
+	e, err := NewEmail(EmailParams{Queue: q, MaxRetries: 1, RetryBaseDelay: time.Millisecond,
+		VerificationTemplatePath: "testdata/verification.html.tmpl", MsgTemplatePath: "testdata/msg.html.tmpl"},
+		SMTPParams{Host: "127.0.0.1", Port: 1, TimeOut: 100 * time.Millisecond})
+	require.NoError(t, err)
+	require.NoError(t, e.Close(context.Background()))
+	assert.Equal(t, 1, len(q.all()), "undelivered message kept in the queue")
+}
+
+// memEmailQueue is in-memory EmailQueue
+type memEmailQueue struct {
+	msgs map[string]QueuedEmail
+	puts int
+	fail bool
+	lock sync.Mutex
+}
+
+func (q *memEmailQueue) Put(msgs ...QueuedEmail) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.fail {
+		return errors.New("queue failure")
+	}
+	if q.msgs == nil {
+		q.msgs = map[string]QueuedEmail{}
+	}
+	for _, m := range msgs {
+		q.msgs[m.ID] = m
+	}
+	q.puts += len(msgs)
+	return nil
+}
+
+func (q *memEmailQueue) Remove(ids ...string) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.fail {
+		return errors.New("queue failure")
+	}
+	for _, id := range ids {
+		delete(q.msgs, id)
+	}
+	return nil
+}
+
+func (q *memEmailQueue) List() ([]QueuedEmail, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.fail {
+		return nil, errors.New("queue failure")
+	}
+	res := []QueuedEmail{}
+	for _, m := range q.msgs {
+		res = append(res, m)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res, nil
+}
+
+func (q *memEmailQueue) all() []QueuedEmail {
+	q.lock.Lock()
+	fail := q.fail
+	q.fail = false
+	q.lock.Unlock()
+	res, _ := q.List()
+	q.lock.Lock()
+	q.fail = fail
+	q.lock.Unlock()
+	return res
+}
+
+// dyingTestSMTP delivers messages till the one with rejectMsg body, rejects it and loses the connection.
+// Reconnection fails afterwards.
+type dyingTestSMTP struct {
+	fakeTestSMTP
+	rejectMsg     string
+	loseAtRcpt    string   // recipient the connection is lost at
+	sent          []string // bodies of messages passed to DATA
+	lost          bool
+	cmdsAfterLoss int
+}
+
+func (d *dyingTestSMTP) Create(SMTPParams) (smtpClient, error) {
+	if d.lost {
+		return nil, errors.New("connection refused")
+	}
+	return d, nil
+}
+
+func (d *dyingTestSMTP) Reset() error { return d.cmd() }
+
+func (d *dyingTestSMTP) Mail(string) error { return d.cmd() }
+
+func (d *dyingTestSMTP) Rcpt(to string) error {
+	if to == d.loseAtRcpt {
+		d.lost = true
+		return io.EOF
+	}
+	return d.cmd()
+}
+
+func (d *dyingTestSMTP) Noop() error { return d.cmd() }
+
+func (d *dyingTestSMTP) Quit() error { return d.cmd() }
+
+func (d *dyingTestSMTP) Data() (io.WriteCloser, error) {
+	if err := d.cmd(); err != nil {
+		return nil, err
+	}
+	return &dyingWriter{d: d}, nil
+}
+
+func (d *dyingTestSMTP) cmd() error {
+	if d.lost {
+		d.cmdsAfterLoss++
+		return io.EOF
+	}
+	return nil
+}
+
+type dyingWriter struct {
+	d   *dyingTestSMTP
+	buf bytes.Buffer
+}
+
+func (w *dyingWriter) Write(p []byte) (int, error) { return w.buf.Write(p) }
+
+func (w *dyingWriter) Close() error {
+	w.d.sent = append(w.d.sent, w.buf.String())
+	if w.buf.String() == w.d.rejectMsg {
+		w.d.lost = true
+		return &textproto.Error{Code: 550, Msg: "mailbox unavailable"}
+	}
+	return nil
+}
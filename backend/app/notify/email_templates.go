@@ -0,0 +1,145 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"text/template"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/pkg/errors"
+)
+
+// template files looked up in EmailParams.TemplateDir, missing ones are replaced by templates set by other params
+const (
+	dirMsgTemplate     = "email_reply.html.tmpl"
+	dirVerifyTemplate  = "email_confirmation_subscription.html.tmpl"
+	dirSubjectTemplate = "email_subject.tmpl"
+)
+
+const defaultTemplateReloadInterval = 5 * time.Second
+
+// dirTemplate is template file in EmailParams.TemplateDir reloaded on change
+type dirTemplate struct {
+	name     string
+	dst      **template.Template
+	fallback *template.Template
+	validate func(*template.Template) error
+}
+
+// watchTemplateDir loads templates from EmailParams.TemplateDir and starts reloading them on change
+// until stopTemplateDir is called
+func (e *Email) watchTemplateDir() error {
+	if e.TemplateDir == "" {
+		return nil
+	}
+	if info, err := os.Stat(e.TemplateDir); err != nil || !info.IsDir() {
+		return errors.Errorf("template dir %s is not a directory", e.TemplateDir)
+	}
+	if e.TemplateReloadInterval <= 0 {
+		e.TemplateReloadInterval = defaultTemplateReloadInterval
+	}
+
+	execute := func(data interface{}) func(*template.Template) error {
+		return func(t *template.Template) error { return t.Execute(ioutil.Discard, data) }
+	}
+	e.dirTmpls = []dirTemplate{
+		{name: dirMsgTemplate, dst: &e.msgTmpl, fallback: e.msgTmpl, validate: execute(msgTmplData{})},
+		{name: dirVerifyTemplate, dst: &e.verifyTmpl, fallback: e.verifyTmpl, validate: execute(verifyTmplData{})},
+		{name: dirSubjectTemplate, dst: &e.subjectTmpl, fallback: e.subjectTmpl, validate: execute(msgTmplData{})},
+	}
+	e.dirTmplStamps = map[string]string{}
+	e.reloadTemplateDir()
+
+	var ctx context.Context
+	ctx, e.dirTmplCancel = context.WithCancel(context.Background())
+	e.dirTmplDone = make(chan struct{})
+	go func() {
+		defer close(e.dirTmplDone)
+		ticker := time.NewTicker(e.TemplateReloadInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				e.reloadTemplateDir()
+			}
+		}
+	}()
+	log.Printf("[INFO] email templates loaded from %s, reload check every %v", e.TemplateDir, e.TemplateReloadInterval)
+	return nil
+}
+
+// stopTemplateDir stops reloading of templates from EmailParams.TemplateDir
+func (e *Email) stopTemplateDir() {
+	if e.dirTmplCancel == nil {
+		return
+	}
+	e.dirTmplCancel()
+	<-e.dirTmplDone
+}
+
+// reloadTemplateDir loads templates from EmailParams.TemplateDir changed since the previous call.
+// Broken template is rejected keeping the last good one, removed template is replaced by its fallback.
+func (e *Email) reloadTemplateDir() {
+	for _, dt := range e.dirTmpls {
+		path := filepath.Join(e.TemplateDir, dt.name)
+		stamp := ""
+		if info, err := os.Stat(path); err == nil {
+			stamp = fmt.Sprintf("%d:%d", info.ModTime().UnixNano(), info.Size())
+		}
+		prev, seen := e.dirTmplStamps[dt.name]
+		if seen && stamp == prev {
+			continue
+		}
+		e.dirTmplStamps[dt.name] = stamp
+		if stamp == "" {
+			if seen {
+				e.setTemplate(dt.dst, dt.fallback)
+				log.Printf("[INFO] email template %s removed, default one used", path)
+			}
+			continue
+		}
+		tmpl, err := loadDirTemplate(path, dt.validate)
+		if err != nil {
+			log.Printf("[ERROR] email template %s not reloaded, last good one kept, %v", path, err)
+			continue
+		}
+		e.setTemplate(dt.dst, tmpl)
+		log.Printf("[INFO] email template %s loaded", path)
+	}
+}
+
+// loadDirTemplate reads and parses template file, checking it executes with empty data
+func loadDirTemplate(path string, validate func(*template.Template) error) (*template.Template, error) {
+	data, err := ioutil.ReadFile(path) //nolint:gosec // path is made from configured dir and fixed name
+	if err != nil {
+		return nil, errors.Wrap(err, "can't read template")
+	}
+	tmpl, err := template.New(filepath.Base(path)).Funcs(templateFuncs).Parse(string(data))
+	if err != nil {
+		return nil, errors.Wrap(err, "can't parse template")
+	}
+	if err = validate(tmpl); err != nil {
+		return nil, errors.Wrap(err, "can't execute template")
+	}
+	return tmpl, nil
+}
+
+func (e *Email) setTemplate(dst **template.Template, tmpl *template.Template) {
+	e.tmplLock.Lock()
+	*dst = tmpl
+	e.tmplLock.Unlock()
+}
+
+// baseTemplates returns request message, its subject and verification message templates,
+// which are replaced by reload from EmailParams.TemplateDir. Thread safe.
+func (e *Email) baseTemplates() (msg, subject, verify *template.Template) {
+	e.tmplLock.RLock()
+	defer e.tmplLock.RUnlock()
+	return e.msgTmpl, e.subjectTmpl, e.verifyTmpl
+}
@@ -0,0 +1,96 @@
+package notify
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/remark42/backend/app/store"
+)
+
+func TestEmail_TemplateDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "remark42_email_tmpl")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	msgFile := filepath.Join(dir, dirMsgTemplate)
+	writeTmpl := func(file, content string, mtime time.Time) {
+		require.NoError(t, ioutil.WriteFile(file, []byte(content), 0600))
+		require.NoError(t, os.Chtimes(file, mtime, mtime))
+	}
+	now := time.Now()
+	writeTmpl(msgFile, "first {{.UserName}}", now.Add(-time.Hour))
+	writeTmpl(filepath.Join(dir, dirSubjectTemplate), "subj {{.PostTitle}}", now.Add(-time.Hour))
+
+	email, err := NewEmail(EmailParams{From: "from@example.org", MsgTemplatePath: "testdata/msg.html.tmpl",
+		VerificationTemplatePath: "testdata/verification.html.tmpl", TemplateDir: dir, TemplateReloadInterval: time.Hour,
+		TokenGenFn: TokenGenFn}, SMTPParams{})
+	require.NoError(t, err)
+	defer email.Close(context.Background())
+
+	req := Request{
+		Comment: store.Comment{ID: "999", User: store.User{ID: "1", Name: "test_user"}, ParentID: "1", PostTitle: "post"},
+		parent:  store.Comment{ID: "1", User: store.User{ID: "999", Name: "parent_user"}},
+	}
+	build := func() string {
+		msg, err := email.buildMessageFromRequest(email.sender(""), req, "test@example.org", false)
+		require.NoError(t, err)
+		return msg
+	}
+	msg := build()
+	assert.Contains(t, msg, "first test_user")
+	assert.Contains(t, msg, "Subject: subj post")
+
+	// edited template reloaded
+	writeTmpl(msgFile, "second {{.UserName}}", now.Add(-time.Minute))
+	email.reloadTemplateDir()
+	assert.Contains(t, build(), "second test_user")
+
+	// broken templates rejected, last good one kept
+	writeTmpl(msgFile, "broken {{.UserName", now.Add(-time.Second))
+	email.reloadTemplateDir()
+	assert.Contains(t, build(), "second test_user")
+	writeTmpl(msgFile, "broken {{.NoSuchField}}", now)
+	email.reloadTemplateDir()
+	assert.Contains(t, build(), "second test_user")
+
+	// removed template replaced by the default one
+	require.NoError(t, os.Remove(msgFile))
+	email.reloadTemplateDir()
+	msg = build()
+	assert.NotContains(t, msg, "second test_user")
+	assert.Contains(t, msg, "New reply from test_user on your comment")
+	assert.Contains(t, msg, "Subject: subj post", "subject template not changed")
+}
+
+func TestEmail_TemplateDirWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "remark42_email_tmpl")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	email, err := NewEmail(EmailParams{From: "from@example.org", MsgTemplatePath: "testdata/msg.html.tmpl",
+		VerificationTemplatePath: "testdata/verification.html.tmpl", TemplateDir: dir, TemplateReloadInterval: 10 * time.Millisecond,
+		TokenGenFn: TokenGenFn}, SMTPParams{})
+	require.NoError(t, err)
+	defer email.Close(context.Background())
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, dirVerifyTemplate), []byte("confirm {{.Token}}"), 0600))
+	assert.Eventually(t, func() bool {
+		msg, err := email.buildVerificationMessage("user", "test@example.org", "tkn", "site")
+		require.NoError(t, err)
+		return strings.Contains(msg, "confirm tkn")
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestEmail_TemplateDirInvalid(t *testing.T) {
+	_, err := NewEmail(EmailParams{From: "from@example.org", MsgTemplatePath: "testdata/msg.html.tmpl",
+		VerificationTemplatePath: "testdata/verification.html.tmpl", TemplateDir: "/no-such-dir"}, SMTPParams{})
+	assert.EqualError(t, err, "template dir /no-such-dir is not a directory")
+}
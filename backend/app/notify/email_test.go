@@ -3,14 +3,31 @@ package notify
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
 	"net/smtp"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"text/template"
 	"time"
 
+	"github.com/go-pkgz/lgr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
@@ -44,6 +61,8 @@ func TestEmailNew(t *testing.T) {
 	} else {
 		assert.Equal(t, smtpParams.TimeOut, email.TimeOut, "emailParams.TimOut unchanged after creation")
 	}
+	assert.Equal(t, email.TimeOut, email.ConnectTimeout, "empty ConnectTimeout set to TimeOut")
+	assert.Equal(t, email.TimeOut, email.SendTimeout, "empty SendTimeout set to TimeOut")
 	assert.Equal(t, smtpParams.Host, email.Host, "emailParams.Host unchanged after creation")
 	assert.Equal(t, smtpParams.Username, email.Username, "emailParams.Username unchanged after creation")
 	assert.Equal(t, smtpParams.Password, email.Password, "emailParams.Password unchanged after creation")
@@ -51,6 +70,22 @@ func TestEmailNew(t *testing.T) {
 	assert.Equal(t, smtpParams.TLS, email.TLS, "emailParams.TLS unchanged after creation")
 }
 
+func TestEmail_Accepts(t *testing.T) {
+	e := Email{}
+	assert.True(t, e.Accepts(EventNewComment))
+	assert.True(t, e.Accepts(EventReply))
+	assert.False(t, e.Accepts(EventEdit), "edits skipped by default")
+	assert.False(t, e.Accepts(EventDelete))
+	assert.False(t, e.Accepts(EventVerification))
+	assert.True(t, e.Accepts(EventMention))
+
+	e.NotifyOnEdit = true
+	assert.True(t, e.Accepts(EventEdit))
+	assert.False(t, e.Accepts(EventDelete))
+	e.NotifyOnDelete = true
+	assert.True(t, e.Accepts(EventDelete))
+}
+
 func Test_initTemplatesErr(t *testing.T) {
 	testSet := []struct {
 		name        string
@@ -81,6 +116,51 @@ func Test_initTemplatesErr(t *testing.T) {
 				MsgTemplatePath:          "testdata/msg.html.tmpl",
 			},
 		},
+		{
+			name:    "with error on parse subject template",
+			errText: "can't parse subject template: template: subjectTmpl",
+			emailParams: EmailParams{
+				VerificationTemplatePath: "testdata/verification.html.tmpl",
+				MsgTemplatePath:          "testdata/msg.html.tmpl",
+				SubjectTemplate:          "{{",
+			},
+		},
+		{
+			name:    "with error on parse verification subject template",
+			errText: "can't parse verification subject template: template: verifySubjTmpl",
+			emailParams: EmailParams{
+				VerificationTemplatePath:    "testdata/verification.html.tmpl",
+				MsgTemplatePath:             "testdata/msg.html.tmpl",
+				VerificationSubjectTemplate: "{{.User",
+			},
+		},
+		{
+			name:    "with wrong path to plain message template",
+			errText: "can't read plain message template: open notfount.tmpl: no such file or directory",
+			emailParams: EmailParams{
+				VerificationTemplatePath: "testdata/verification.html.tmpl",
+				MsgTemplatePath:          "testdata/msg.html.tmpl",
+				PlainMsgTemplatePath:     "notfount.tmpl",
+			},
+		},
+		{
+			name:    "with wrong path to admin message template",
+			errText: "can't read admin message template: open notfount.tmpl: no such file or directory",
+			emailParams: EmailParams{
+				VerificationTemplatePath: "testdata/verification.html.tmpl",
+				MsgTemplatePath:          "testdata/msg.html.tmpl",
+				AdminMsgTemplatePath:     "notfount.tmpl",
+			},
+		},
+		{
+			name:    "with error on parse admin message template",
+			errText: "can't parse admin message template: template: adminMsgTmpl",
+			emailParams: EmailParams{
+				VerificationTemplatePath: "testdata/verification.html.tmpl",
+				MsgTemplatePath:          "testdata/msg.html.tmpl",
+				AdminMsgTemplatePath:     "testdata/bad.html.tmpl",
+			},
+		},
 		{
 			name:    "with error on read message template",
 			errText: "can't parse message template: template: msgTmpl",
@@ -91,163 +171,1900 @@ func Test_initTemplatesErr(t *testing.T) {
 		},
 	}
 
-	for _, d := range testSet {
-		d := d
-		t.Run(d.name, func(t *testing.T) {
-			e := Email{EmailParams: d.emailParams}
-			err := e.setTemplates()
-			require.Error(t, err)
-			assert.Contains(t, err.Error(), d.errText)
-		})
+	for _, d := range testSet {
+		d := d
+		t.Run(d.name, func(t *testing.T) {
+			e := Email{EmailParams: d.emailParams}
+			err := e.setTemplates()
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), d.errText)
+		})
+	}
+}
+
+func TestEmailSendErrors(t *testing.T) {
+	var err error
+	e := Email{}
+	e.TokenGenFn = TokenGenFn
+
+	e.verifyTmpl, err = template.New("test").Parse("{{.Test}}")
+	assert.NoError(t, err)
+	assert.EqualError(t, e.SendVerification(context.Background(), VerificationRequest{Email: "bad@example.org", Token: "some"}),
+		"error executing template to build verification message: template: test:1:2: executing \"test\" at <.Test>: can't evaluate field Test in type notify.verifyTmplData")
+
+	e.msgTmpl, err = template.New("test").Parse("{{.Test}}")
+	assert.NoError(t, err)
+	cidCtx := WithCorrelationID(context.Background(), "cid-1")
+	assert.EqualError(t, e.Send(cidCtx, Request{Comment: store.Comment{ID: "999"}, parent: store.Comment{User: store.User{ID: "test"}}, Emails: []string{"bad@example.org"}}),
+		"1 error occurred:\n\t* problem sending user email notification to \"bad@example.org\", cid cid-1: "+
+			"error executing template to build comment reply message: "+
+			"template: test:1:2: executing \"test\" at <.Test>: "+
+			"can't evaluate field Test in type notify.msgTmplData\n\n")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.EqualError(t, e.Send(ctx, Request{Comment: store.Comment{ID: "999"}, parent: store.Comment{User: store.User{ID: "test"}}, Emails: []string{"bad@example.org"}}),
+		"sending email messages about comment \"999\" aborted due to canceled context")
+
+	e.smtp = &fakeTestSMTP{}
+	assert.EqualError(t, e.Send(cidCtx, Request{Comment: store.Comment{ID: "999"}, parent: store.Comment{User: store.User{ID: "error"}}, Emails: []string{"bad@example.org"}}),
+		"1 error occurred:\n\t* problem sending user email notification to \"bad@example.org\", cid cid-1:"+
+			" error creating token for unsubscribe link: token generation error\n\n")
+}
+
+func TestEmailSend_ExitConditions(t *testing.T) {
+	email, err := NewEmail(EmailParams{
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "testdata/msg.html.tmpl",
+	}, SMTPParams{})
+	assert.NoError(t, err)
+	assert.NotNil(t, email, "expecting email returned")
+	// prevent triggering e.autoFlush creation
+	emptyRequest := Request{Comment: store.Comment{ID: "999"}}
+	assert.NoError(t, email.Send(context.Background(), emptyRequest),
+		"Message without Emails and AdminEmails is not sent and returns nil")
+}
+
+func TestEmail_SendInvalidRecipient(t *testing.T) {
+	q := &memEmailQueue{}
+	email, err := NewEmail(EmailParams{
+		From:                     "from@example.org",
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "testdata/msg.html.tmpl",
+		TokenGenFn:               TokenGenFn,
+		Queue:                    q,
+	}, SMTPParams{})
+	require.NoError(t, err)
+	fakeSMTP := &fakeTestSMTP{}
+	email.smtp = fakeSMTP
+
+	tbl := []struct {
+		email string
+		err   string
+	}{
+		{"notanemail", `invalid recipient address "notanemail": mail: missing '@' or angle-addr`},
+		{"a@", `invalid recipient address "a@": mail: missing '@' or angle-addr`},
+		{"test@example.org", ""},
+	}
+	for _, tt := range tbl {
+		req := Request{Comment: store.Comment{ID: "999"}, Emails: []string{tt.email}}
+		err = email.Send(context.Background(), req)
+		verifyErr := email.SendVerification(context.Background(), VerificationRequest{User: "user", Email: tt.email, Token: "token"})
+		if tt.err == "" {
+			assert.NoError(t, err, tt.email)
+			assert.NoError(t, verifyErr, tt.email)
+			continue
+		}
+		require.Error(t, err, tt.email)
+		assert.Contains(t, err.Error(), tt.err)
+		assert.EqualError(t, verifyErr, tt.err)
+	}
+	assert.Equal(t, []string{"test@example.org", "test@example.org"}, fakeSMTP.rcpts, "only valid address used")
+	assert.Equal(t, 2, q.puts, "invalid addresses not queued")
+
+	// empty verification address is skipped
+	assert.NoError(t, email.SendVerification(context.Background(), VerificationRequest{User: "user"}))
+}
+
+func TestEmailSendClientError(t *testing.T) {
+	var testSet = []struct {
+		name   string
+		smtp   *fakeTestSMTP
+		err    string
+		reason string
+	}{
+		{name: "failed to verify receiver", smtp: &fakeTestSMTP{fail: map[string]bool{"mail": true}},
+			err: "bad from address \"\": failed to verify sender", reason: "mail"},
+		{name: "failed to verify sender", smtp: &fakeTestSMTP{fail: map[string]bool{"rcpt": true}},
+			err: "bad to address \"\": failed to verify receiver", reason: "rcpt"},
+		{name: "failed to close connection", smtp: &fakeTestSMTP{fail: map[string]bool{"quit": true, "close": true}}, reason: "quit"},
+		{name: "failed to make email writer", smtp: &fakeTestSMTP{fail: map[string]bool{"data": true}},
+			err: "can't make email writer: failed to send", reason: "data"},
+	}
+	for _, d := range testSet {
+		d := d
+		t.Run(d.name, func(t *testing.T) {
+			metrics, err := newEmailMetrics(prometheus.NewRegistry())
+			require.NoError(t, err)
+			e := Email{smtp: d.smtp, metrics: metrics}
+			if d.err != "" {
+				assert.EqualError(t, e.sendMessage(emailMessage{}), d.err,
+					"expected error for e.sendMessage")
+			} else {
+				assert.NoError(t, e.sendMessage(emailMessage{}),
+					"expected no error for e.sendMessage")
+			}
+			assert.Equal(t, 1.0, testutil.ToFloat64(metrics.failed.WithLabelValues(d.reason)))
+			assert.Equal(t, 1, testutil.CollectAndCount(metrics.failed), "only one failure reason")
+		})
+	}
+	e := Email{}
+	e.smtp = nil
+	assert.Error(t, e.sendMessage(emailMessage{}),
+		"nil e.smtp should return error")
+	e.smtp = &fakeTestSMTP{}
+	assert.NoError(t, e.sendMessage(emailMessage{}), "",
+		"no error expected for e.sendMessage in normal flow")
+	e.smtp = &fakeTestSMTP{fail: map[string]bool{"quit": true}}
+	assert.NoError(t, e.sendMessage(emailMessage{}), "",
+		"no error expected for e.sendMessage with failed smtpClient.Quit but successful smtpClient.Close")
+	e.smtp = &fakeTestSMTP{fail: map[string]bool{"create": true}}
+	assert.EqualError(t, e.sendMessage(emailMessage{}), "failed to make smtp Create: failed to create client",
+		"e.send called without smtpClient set returns error")
+}
+
+func TestEmail_SendMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	fakeSMTP := &fakeTestSMTP{badRcpt: "bad@example.org"}
+	e, err := NewEmail(EmailParams{
+		From:                     "from@example.org",
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "testdata/msg.html.tmpl",
+		AdminEmails:              []string{"admin@example.org", "bad@example.org"},
+		TokenGenFn:               TokenGenFn,
+		MaxRetries:               1,
+		RetryBaseDelay:           time.Millisecond,
+		MetricsRegisterer:        reg,
+	}, SMTPParams{})
+	require.NoError(t, err)
+	e.smtp = fakeSMTP
+
+	req := Request{Comment: store.Comment{ID: "999"}, Emails: []string{"test@example.org"}}
+	assert.Error(t, e.Send(context.Background(), req))
+	assert.Equal(t, 2.0, testutil.ToFloat64(e.metrics.sent))
+	assert.Equal(t, 2.0, testutil.ToFloat64(e.metrics.failed.WithLabelValues("rcpt")), "initial attempt and retry")
+	assert.Equal(t, 0.0, testutil.ToFloat64(e.metrics.bufferSize), "nothing left to send")
+	assert.Equal(t, 1, testutil.CollectAndCount(e.metrics.flushDuration))
+
+	// second email registered with the same registry shares metrics
+	e2, err := NewEmail(EmailParams{
+		From:                     "from@example.org",
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "testdata/msg.html.tmpl",
+		TokenGenFn:               TokenGenFn,
+		MetricsRegisterer:        reg,
+	}, SMTPParams{})
+	require.NoError(t, err)
+	e2.smtp = fakeSMTP
+	assert.NoError(t, e2.Send(context.Background(), req))
+	assert.Equal(t, 3.0, testutil.ToFloat64(e.metrics.sent))
+
+	// no metrics without registerer
+	e2.metrics = nil
+	assert.NoError(t, e2.Send(context.Background(), req))
+}
+
+func TestEmail_SendWithRetries(t *testing.T) {
+	// transient failures on connection are retried
+	fakeSMTP := &fakeTestSMTP{}
+	flaky := &flakySMTPCreator{failures: 2, err: &textproto.Error{Code: 421, Msg: "service not available"}, smtp: fakeSMTP}
+	e := Email{smtp: flaky, EmailParams: EmailParams{MaxRetries: 3, RetryBaseDelay: 10 * time.Millisecond}}
+	st := time.Now()
+	assert.NoError(t, e.sendWithRetries(context.Background(), []emailMessage{{from: "from@example.org", to: "to@example.org"}})[0])
+	assert.True(t, time.Since(st) >= 30*time.Millisecond, "two retries with 10ms and 20ms delays")
+	assert.Equal(t, 3, flaky.attempts)
+	assert.Equal(t, "to@example.org", fakeSMTP.readRcpt())
+
+	// retries exhausted
+	flaky = &flakySMTPCreator{failures: 10, err: errors.New("connection reset by peer"), smtp: &fakeTestSMTP{}}
+	e.smtp = flaky
+	err := e.sendWithRetries(context.Background(), []emailMessage{{to: "to@example.org"}})[0]
+	assert.EqualError(t, err, "failed after 4 attempt(s): failed to make smtp Create: connection reset by peer")
+	assert.Equal(t, 4, flaky.attempts)
+
+	// permanent failure is not retried
+	fakeSMTP = &fakeTestSMTP{fail: map[string]bool{"rcpt": true}, failErr: &textproto.Error{Code: 550, Msg: "no such user"}}
+	e.smtp = fakeSMTP
+	err = e.sendWithRetries(context.Background(), []emailMessage{{to: "to@example.org"}})[0]
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `failed after 1 attempt(s): bad to address "to@example.org": 550`)
+	assert.Equal(t, 1, fakeSMTP.readQuitCount())
+
+	// canceled context stops retries
+	flaky = &flakySMTPCreator{failures: 10, err: &textproto.Error{Code: 451, Msg: "try again later"}, smtp: &fakeTestSMTP{}}
+	e.smtp = flaky
+	e.RetryBaseDelay = time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = e.sendWithRetries(ctx, []emailMessage{{to: "to@example.org"}})[0]
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "aborted due to canceled context after 1 attempt(s): failed to make smtp Create: 451")
+}
+
+func Test_isTransientError(t *testing.T) {
+	assert.True(t, isTransientError(errors.New("connection reset by peer")))
+	assert.True(t, isTransientError(&textproto.Error{Code: 421}))
+	assert.True(t, isTransientError(fmt.Errorf("wrapped: %w", &textproto.Error{Code: 452})))
+	assert.False(t, isTransientError(&textproto.Error{Code: 550}))
+	assert.False(t, isTransientError(fmt.Errorf("wrapped: %w", &textproto.Error{Code: 535})))
+}
+
+func TestEmail_SendKeepAlive(t *testing.T) {
+	fakeSMTP := &fakeTestSMTP{}
+	e := Email{smtp: fakeSMTP, SMTPParams: SMTPParams{KeepAlive: true, IdleTimeout: time.Minute}}
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second) // per-send context, as made by Service
+		require.NoError(t, e.sendWithRetries(ctx, []emailMessage{{from: "from@example.org", to: fmt.Sprintf("to%d@example.org", i)}})[0])
+		cancel()
+	}
+	assert.Equal(t, "to2@example.org", fakeSMTP.readRcpt())
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, 0, fakeSMTP.readQuitCount(), "connection kept open after context of the send is done")
+	assert.Equal(t, 2, fakeSMTP.readResetCount(), "connection reset before each reuse")
+
+	require.NoError(t, e.Close(context.Background()))
+	assert.Equal(t, 1, fakeSMTP.readQuitCount(), "kept alive connection closed on close")
+
+	// compare with regular mode, one connection per message
+	fakeSMTP = &fakeTestSMTP{}
+	eNoKeepAlive := Email{smtp: fakeSMTP}
+	for i := 0; i < 3; i++ {
+		require.NoError(t, eNoKeepAlive.sendWithRetries(context.Background(), []emailMessage{{from: "from@example.org", to: "to@example.org"}})[0])
+	}
+	assert.Equal(t, 3, fakeSMTP.readQuitCount())
+	assert.Equal(t, 0, fakeSMTP.readResetCount())
+}
+
+func TestEmail_SendKeepAliveReconnect(t *testing.T) {
+	fakeSMTP := &fakeTestSMTP{}
+	creator := &flakySMTPCreator{smtp: fakeSMTP}
+	e := Email{smtp: creator, SMTPParams: SMTPParams{KeepAlive: true, IdleTimeout: 20 * time.Millisecond}}
+
+	// idle connection is closed and a new one made for the next message
+	require.NoError(t, e.sendMessage(emailMessage{to: "to@example.org"}))
+	require.Eventually(t, func() bool { return fakeSMTP.readQuitCount() == 1 }, time.Second, 5*time.Millisecond)
+	require.NoError(t, e.sendMessage(emailMessage{to: "to@example.org"}))
+	assert.Equal(t, 2, creator.attempts)
+	assert.Equal(t, 0, fakeSMTP.readResetCount())
+
+	// failed reset leads to reconnect
+	e.IdleTimeout = time.Minute
+	fakeSMTP.fail = map[string]bool{"reset": true}
+	require.NoError(t, e.sendMessage(emailMessage{to: "to@example.org"}))
+	assert.Equal(t, 3, creator.attempts)
+	assert.Equal(t, 2, fakeSMTP.readQuitCount())
+
+	// failed send drops the connection
+	fakeSMTP.fail = map[string]bool{"data": true}
+	require.Error(t, e.sendMessage(emailMessage{to: "to@example.org"}))
+	assert.Equal(t, 3, fakeSMTP.readQuitCount())
+	fakeSMTP.fail = nil
+	require.NoError(t, e.sendMessage(emailMessage{to: "to@example.org"}))
+	assert.Equal(t, 4, creator.attempts)
+	e.closePooled()
+	assert.Equal(t, 4, fakeSMTP.readQuitCount())
+}
+
+func TestEmail_SendMessagesBatch(t *testing.T) {
+	fakeSMTP := &fakeTestSMTP{}
+	e := Email{smtp: fakeSMTP}
+	errs := e.sendMessages(context.Background(), []emailMessage{
+		{from: "from@example.org", to: "to1@example.org", message: "msg1"},
+		{from: "from@example.org", to: "to2@example.org", message: "msg2"},
+		{from: "from@example.org", to: "to3@example.org", message: "msg1"},
+		{from: "from@example.org", to: "to4@example.org", message: "msg1"},
+	})
+	assert.Equal(t, []error{nil, nil, nil, nil}, errs)
+	assert.Equal(t, 1, fakeSMTP.readQuitCount(), "single session for all messages")
+	assert.Equal(t, 2, fakeSMTP.dataCount, "identical messages sent in one transaction")
+	assert.Equal(t, 1, fakeSMTP.readResetCount(), "session reset between transactions")
+	assert.Equal(t, []string{"to1@example.org", "to3@example.org", "to4@example.org", "to2@example.org"}, fakeSMTP.rcpts)
+	assert.Equal(t, "msg1msg2", fakeSMTP.buff.String())
+
+	// one bad recipient doesn't fail others
+	fakeSMTP = &fakeTestSMTP{badRcpt: "to3@example.org"}
+	e = Email{smtp: fakeSMTP}
+	errs = e.sendMessages(context.Background(), []emailMessage{
+		{from: "from@example.org", to: "to1@example.org", message: "msg1"},
+		{from: "from@example.org", to: "to3@example.org", message: "msg1"},
+		{from: "from@example.org", to: "to2@example.org", message: "msg2"},
+	})
+	require.Len(t, errs, 3)
+	assert.NoError(t, errs[0])
+	assert.EqualError(t, errs[1], `bad to address "to3@example.org": no such recipient`)
+	assert.NoError(t, errs[2])
+	assert.Equal(t, 2, fakeSMTP.dataCount)
+
+	// transaction with all recipients rejected skips DATA
+	fakeSMTP = &fakeTestSMTP{badRcpt: "to1@example.org"}
+	e = Email{smtp: fakeSMTP}
+	errs = e.sendMessages(context.Background(), []emailMessage{{from: "from@example.org", to: "to1@example.org", message: "msg1"}})
+	assert.EqualError(t, errs[0], `bad to address "to1@example.org": no such recipient`)
+	assert.Equal(t, 0, fakeSMTP.dataCount)
+
+	// failed reset fails the rest of messages
+	fakeSMTP = &fakeTestSMTP{fail: map[string]bool{"reset": true}}
+	e = Email{smtp: fakeSMTP}
+	errs = e.sendMessages(context.Background(), []emailMessage{
+		{from: "from@example.org", to: "to1@example.org", message: "msg1"},
+		{from: "from@example.org", to: "to2@example.org", message: "msg2"},
+	})
+	assert.NoError(t, errs[0])
+	assert.EqualError(t, errs[1], "can't reset smtp session: failed to reset")
+}
+
+func TestEmail_SendRateLimited(t *testing.T) {
+	email, err := NewEmail(EmailParams{
+		From:                     "from@example.org",
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "testdata/msg.html.tmpl",
+		MaxPerSecond:             10,
+	}, SMTPParams{})
+	require.NoError(t, err)
+	fakeSMTP := &fakeTestSMTP{}
+	email.smtp = fakeSMTP
+
+	msgs := make([]emailMessage, 20)
+	for i := range msgs {
+		msgs[i] = emailMessage{from: "from@example.org", to: fmt.Sprintf("to%d@example.org", i), message: fmt.Sprintf("msg%d", i)}
+	}
+	st := time.Now()
+	for _, err = range email.sendWithRetries(context.Background(), msgs) {
+		assert.NoError(t, err)
+	}
+	assert.True(t, time.Since(st) >= time.Second, "20 messages with 10 per second limit, took %s", time.Since(st))
+	assert.Equal(t, 20, len(fakeSMTP.rcpts))
+
+	// waiting for limit respects context cancellation
+	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+	errs := email.sendMessages(ctx, msgs)
+	delivered := 0
+	for _, err = range errs {
+		if err == nil {
+			delivered++
+		}
+	}
+	assert.True(t, delivered > 0 && delivered < 20, "only part of messages delivered before cancellation, %d", delivered)
+	assert.Contains(t, errs[19].Error(), `can't wait for rate limit to send to "to19@example.org"`)
+}
+
+func TestEmail_SendDedup(t *testing.T) {
+	fakeSMTP := &fakeTestSMTP{}
+	e, err := NewEmail(EmailParams{
+		From:                     "from@example.org",
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "testdata/msg.html.tmpl",
+		TokenGenFn:               TokenGenFn,
+		DedupWindow:              100 * time.Millisecond,
+	}, SMTPParams{})
+	require.NoError(t, err)
+	e.smtp = fakeSMTP
+
+	req := Request{Comment: store.Comment{ID: "999"}, Emails: []string{"test@example.org"}}
+	require.NoError(t, e.Send(context.Background(), req))
+	require.NoError(t, e.Send(context.Background(), req))
+	assert.Equal(t, 1, fakeSMTP.dataCount, "second notification within the window suppressed")
+
+	req2 := Request{Comment: store.Comment{ID: "999"}, Emails: []string{"test2@example.org"}}
+	require.NoError(t, e.Send(context.Background(), req2))
+	assert.Equal(t, 2, fakeSMTP.dataCount, "other recipient notified")
+
+	time.Sleep(150 * time.Millisecond)
+	require.NoError(t, e.Send(context.Background(), req))
+	assert.Equal(t, 3, fakeSMTP.dataCount, "notification after the window sent")
+
+	// failed delivery is not remembered
+	fakeSMTP.fail = map[string]bool{"data": true}
+	e.MaxRetries = 1
+	e.RetryBaseDelay = time.Millisecond
+	req3 := Request{Comment: store.Comment{ID: "1000"}, Emails: []string{"test@example.org"}}
+	assert.Error(t, e.Send(context.Background(), req3))
+	fakeSMTP.fail = nil
+	require.NoError(t, e.Send(context.Background(), req3))
+	assert.Equal(t, 6, fakeSMTP.dataCount, "two failed attempts and successful one")
+}
+
+func TestEmail_SendIdempotency(t *testing.T) {
+	fakeSMTP := &fakeTestSMTP{}
+	e, err := NewEmail(EmailParams{
+		From:                     "from@example.org",
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "testdata/msg.html.tmpl",
+		TokenGenFn:               TokenGenFn,
+		IdempotencyKeys:          2,
+	}, SMTPParams{})
+	require.NoError(t, err)
+	e.smtp = fakeSMTP
+
+	// the same request sent concurrently is delivered once
+	req := Request{Comment: store.Comment{ID: "999"}, Emails: []string{"test@example.org"}}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, e.Send(context.Background(), req))
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, fakeSMTP.dataCount)
+
+	// other event of the same comment is a separate notification
+	req.Event = EventEdit
+	require.NoError(t, e.Send(context.Background(), req))
+	assert.Equal(t, 2, fakeSMTP.dataCount)
+
+	// the least recently used key is evicted once the limit is reached
+	require.NoError(t, e.Send(context.Background(), Request{Comment: store.Comment{ID: "1000"}, Emails: []string{"test@example.org"}}))
+	assert.Equal(t, 3, fakeSMTP.dataCount)
+	req.Event = EventNewComment
+	require.NoError(t, e.Send(context.Background(), req))
+	assert.Equal(t, 4, fakeSMTP.dataCount, "key of the first notification evicted")
+
+	assert.Equal(t, "new_comment::999::test@example.org", idempotencyKey(req, "test@example.org"))
+}
+
+func TestEmail_DefaultTemplates(t *testing.T) {
+	email, err := NewEmail(EmailParams{}, SMTPParams{})
+	assert.Error(t, err)
+	assert.Nil(t, email)
+	email, err = NewEmail(EmailParams{VerificationTemplatePath: "testdata/verification.html.tmpl"}, SMTPParams{})
+	assert.Error(t, err)
+	assert.Nil(t, email)
+}
+
+func TestEmail_Send(t *testing.T) {
+	email, err := NewEmail(EmailParams{
+		From:                     "from@example.org",
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "testdata/msg.html.tmpl",
+	}, SMTPParams{})
+	assert.NoError(t, err)
+	assert.NotNil(t, email)
+	fakeSMTP := fakeTestSMTP{}
+	email.smtp = &fakeSMTP
+	email.TokenGenFn = TokenGenFn
+	email.UnsubscribeURL = "https://remark42.com/api/v1/email/unsubscribe"
+	req := Request{
+		Comment: store.Comment{ID: "999", User: store.User{ID: "1", Name: "test_user"}, ParentID: "1", PostTitle: "test_title",
+			Timestamp: time.Date(2020, 5, 1, 10, 20, 30, 0, time.FixedZone("MSK", 3*60*60))},
+		parent: store.Comment{ID: "1", User: store.User{ID: "999", Name: "parent_user"}},
+		Emails: []string{"test@example.org"},
+	}
+	assert.NoError(t, email.Send(context.TODO(), req))
+	assert.Equal(t, "from@example.org", fakeSMTP.readMail())
+	assert.Equal(t, 1, fakeSMTP.readQuitCount())
+	assert.Equal(t, "test@example.org", fakeSMTP.readRcpt())
+	// test buildMessageFromRequest separately for message text
+	res, err := email.buildMessageFromRequest(email.sender(req.Comment.Locator.SiteID), req, req.Emails[0], false)
+	assert.NoError(t, err)
+	assert.Contains(t, res, `From: from@example.org
+To: test@example.org
+Subject: New reply to your comment for "test_title"
+Message-ID: <999@example.org>
+In-Reply-To: <1@example.org>
+References: <1@example.org>
+MIME-version: 1.0
+Content-Type: multipart/alternative; boundary="remark42-`)
+	assert.Contains(t, res, `List-Unsubscribe-Post: List-Unsubscribe=One-Click
+List-Unsubscribe: <https://remark42.com/api/v1/email/unsubscribe?site=&tkn=token>
+Date: Fri, 01 May 2020 10:20:30 +0300
+
+--remark42-`, "date of the comment in its timezone, right before the body")
+	assert.Contains(t, res, "Content-Type: text/plain; charset=\"UTF-8\"\nContent-Transfer-Encoding: quoted-printable\n")
+	assert.Contains(t, res, "Content-Type: text/html; charset=\"UTF-8\"\nContent-Transfer-Encoding: quoted-printable\n")
+	assert.True(t, strings.Index(res, "text/plain") < strings.Index(res, "text/html; charset"), "html part is the last one")
+	res2, err := email.buildMessageFromRequest(email.sender(req.Comment.Locator.SiteID), req, req.Emails[0], false)
+	assert.NoError(t, err)
+	boundary := regexp.MustCompile(`boundary="(.+?)"`).FindStringSubmatch(res)[1]
+	assert.Equal(t, boundary, regexp.MustCompile(`boundary="(.+?)"`).FindStringSubmatch(res2)[1], "boundary is deterministic")
+	assert.Equal(t, 3, strings.Count(res, "--"+boundary), "two parts and closing delimiter")
+	assert.Contains(t, res, "--"+boundary+"--\n")
+
+	// send email to both user and admin, without parent set
+	email.AdminEmails = []string{"admin@example.org"}
+	req = Request{
+		Comment: store.Comment{ID: "999", User: store.User{ID: "1", Name: "test_user"}, PostTitle: "test_title"},
+		Emails:  []string{"test@example.org"},
+	}
+	assert.NoError(t, email.Send(context.TODO(), req))
+	assert.Equal(t, "from@example.org", fakeSMTP.readMail())
+	assert.Equal(t, 2, fakeSMTP.readQuitCount(), "plus one session for two emails: one for user and one for admin")
+	assert.Equal(t, "admin@example.org", fakeSMTP.readRcpt())
+	res, err = email.buildMessageFromRequest(email.sender(req.Comment.Locator.SiteID), req, email.AdminEmails[0], true)
+	assert.NoError(t, err)
+	assert.Contains(t, res, `From: from@example.org
+To: admin@example.org
+Subject: New comment to your site for "test_title"
+Message-ID: <999@example.org>
+MIME-version: 1.0
+Content-Type: multipart/alternative; boundary="remark42-`)
+	assert.NotContains(t, res, "List-Unsubscribe")
+	assert.NotContains(t, res, "In-Reply-To")
+
+	// plain text only mode
+	email.Format = EmailFormatText
+	req = Request{
+		Comment: store.Comment{ID: "999", User: store.User{ID: "1", Name: "test_user"}, ParentID: "1", PostTitle: "test_title",
+			Text: "<p>some <b>bold</b> text</p>"},
+		parent: store.Comment{ID: "1", User: store.User{ID: "999", Name: "parent_user"}},
+		Emails: []string{"test@example.org"},
+	}
+	res, err = email.buildMessageFromRequest(email.sender(req.Comment.Locator.SiteID), req, req.Emails[0], false)
+	assert.NoError(t, err)
+	assert.Contains(t, res, `From: from@example.org
+To: test@example.org
+Subject: New reply to your comment for "test_title"
+Message-ID: <999@example.org>
+In-Reply-To: <1@example.org>
+References: <1@example.org>
+Content-Transfer-Encoding: quoted-printable
+MIME-version: 1.0
+Content-Type: text/plain; charset="UTF-8"
+List-Unsubscribe-Post: List-Unsubscribe=One-Click
+List-Unsubscribe: <https://remark42.com/api/v1/email/unsubscribe?site=&tkn=token>
+Date: `)
+	assert.NotContains(t, res, "multipart")
+	assert.NotContains(t, res, "text/html")
+	assert.NotRegexp(t, `<[a-zA-Z/][^>]*>`, res[strings.Index(res, "\n\n"):], "no html tags in the body")
+	assert.Contains(t, res, "some bold text")
+}
+
+func TestEmail_SendCorrelationID(t *testing.T) {
+	logs := bytes.Buffer{}
+	lgr.Setup(lgr.Out(&logs), lgr.Debug)
+
+	email, err := NewEmail(EmailParams{
+		From:                     "from@example.org",
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "testdata/msg.html.tmpl",
+		TokenGenFn:               TokenGenFn,
+	}, SMTPParams{})
+	require.NoError(t, err)
+	req := Request{Comment: store.Comment{ID: "999", User: store.User{ID: "1", Name: "test_user"}, ParentID: "1"},
+		parent: store.Comment{ID: "1", User: store.User{ID: "2", Name: "parent_user"}},
+		Emails: []string{"test@example.org", "bad@example.org"}}
+	email.smtp = &fakeTestSMTP{badRcpt: "bad@example.org"}
+	err = email.Send(WithCorrelationID(context.Background(), "cid-123"), req)
+	lgr.Setup() // logs are not written to the buffer anymore, safe to read
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `problem sending user email notification to "bad@example.org", cid cid-123`)
+	assert.Contains(t, logs.String(), `enqueue email to "test@example.org", comment id 999, cid cid-123`)
+	assert.Contains(t, logs.String(), `sent email to "test@example.org", cid cid-123`)
+	assert.NotContains(t, logs.String(), `sent email to "bad@example.org"`)
+
+	// correlation id generated if not set in context
+	assert.Equal(t, "", CorrelationID(context.Background()))
+	assert.NotEqual(t, correlationID(context.Background()), correlationID(context.Background()))
+	assert.Equal(t, "cid-1", correlationID(WithCorrelationID(context.Background(), "cid-1")))
+}
+
+func TestEmail_SendAdminCopies(t *testing.T) {
+	email, err := NewEmail(EmailParams{
+		From:                     "from@example.org",
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "testdata/msg.html.tmpl",
+		TokenGenFn:               TokenGenFn,
+		AdminEmails:              []string{"admin1@example.org", "admin2@example.org"},
+		MaxRetries:               1,
+		RetryBaseDelay:           time.Millisecond,
+	}, SMTPParams{})
+	require.NoError(t, err)
+	fakeSMTP := &fakeTestSMTP{}
+	email.smtp = fakeSMTP
+
+	req := Request{Comment: store.Comment{ID: "999", User: store.User{ID: "1", Name: "test_user"}, ParentID: "1", PostTitle: "test_title"},
+		parent: store.Comment{ID: "1", User: store.User{ID: "2", Name: "parent_user"}}, Emails: []string{"test@example.org"}}
+	require.NoError(t, email.Send(context.Background(), req))
+	assert.Equal(t, []string{"test@example.org", "admin1@example.org", "admin2@example.org"}, fakeSMTP.rcpts)
+	assert.Equal(t, 3, fakeSMTP.dataCount, "separate message for each admin")
+
+	res, err := email.buildMessageFromRequest(email.sender(req.Comment.Locator.SiteID), req, "admin1@example.org", true)
+	require.NoError(t, err)
+	assert.Contains(t, res, "To: admin1@example.org\nSubject: New comment to your site for \"test_title\"\n", "admin copy")
+	assert.NotContains(t, res, "List-Unsubscribe")
+
+	// failed admin copy doesn't prevent delivery to the primary recipient and other admin
+	fakeSMTP.rcpts, fakeSMTP.dataCount = nil, 0
+	fakeSMTP.badRcpt = "admin1@example.org"
+	err = email.Send(context.Background(), req)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `problem sending admin email notification to "admin1@example.org"`)
+	assert.NotContains(t, err.Error(), "test@example.org")
+	assert.Equal(t, []string{"test@example.org", "admin1@example.org", "admin2@example.org", "admin1@example.org"}, fakeSMTP.rcpts,
+		"failed admin retried")
+	assert.Equal(t, 2, fakeSMTP.dataCount, "primary and second admin delivered")
+}
+
+func TestEmail_SendAvatar(t *testing.T) {
+	email, err := NewEmail(EmailParams{
+		From:                     "from@example.org",
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "testdata/msg.html.tmpl",
+		TokenGenFn:               TokenGenFn,
+		BaseURL:                  "https://remark42.example.com",
+	}, SMTPParams{})
+	require.NoError(t, err)
+
+	req := Request{Comment: store.Comment{ID: "999", ParentID: "1", Text: "reply",
+		User: store.User{ID: "1", Name: "test_user", Picture: "/api/v1/avatar/a1.image"}},
+		parent: store.Comment{ID: "1", Text: "parent", User: store.User{ID: "2", Name: "parent_user", Picture: "https://cdn.example.com/a2.png"}},
+		Emails: []string{"test@example.org"}}
+	htmlPart := func(msg string) string {
+		body, e := ioutil.ReadAll(quotedprintable.NewReader(strings.NewReader(msg[strings.Index(msg, "text/html"):])))
+		require.NoError(t, e)
+		return string(body)
+	}
+	res, err := email.buildMessageFromRequest(email.sender(req.Comment.Locator.SiteID), req, "test@example.org", false)
+	require.NoError(t, err)
+	body := htmlPart(res)
+	assert.Contains(t, body, `Avatar: <img src="https://remark42.example.com/api/v1/avatar/a1.image"/>`, "relative avatar resolved")
+	assert.Contains(t, body, "https://cdn.example.com/a2.png", "absolute avatar kept as is")
+
+	// no avatar, no image
+	req.Comment.User.Picture = ""
+	res, err = email.buildMessageFromRequest(email.sender(req.Comment.Locator.SiteID), req, "test@example.org", false)
+	require.NoError(t, err)
+	assert.NotContains(t, htmlPart(res), "<img")
+}
+
+func TestEmail_SendAdminTemplate(t *testing.T) {
+	email, err := NewEmail(EmailParams{
+		From:                     "from@example.org",
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "testdata/msg.html.tmpl",
+		AdminMsgTemplatePath:     "testdata/msg_admin.html.tmpl",
+		TokenGenFn:               TokenGenFn,
+		UnsubscribeURL:           "https://remark42.com/api/v1/email/unsubscribe",
+	}, SMTPParams{})
+	require.NoError(t, err)
+
+	req := Request{Comment: store.Comment{ID: "999", ParentID: "1", User: store.User{ID: "1", Name: "test_user"},
+		Locator: store.Locator{SiteID: "remark", URL: "https://example.com/post"}, PostTitle: "test_title"},
+		parent: store.Comment{ID: "1", User: store.User{ID: "2", Name: "parent_user"}}, Emails: []string{"test@example.org"}}
+	htmlPart := func(msg string) string {
+		body, e := ioutil.ReadAll(quotedprintable.NewReader(strings.NewReader(msg[strings.Index(msg, "text/html"):])))
+		require.NoError(t, e)
+		return string(body)
+	}
+
+	res, err := email.buildMessageFromRequest(email.sender(req.Comment.Locator.SiteID), req, "admin@example.org", true)
+	require.NoError(t, err)
+	body := htmlPart(res)
+	assert.Contains(t, body, "Moderate comment from test_user to «test_title»")
+	assert.Contains(t, body, "Moderation link: https://example.com/post#remark42__comment-999")
+	assert.NotContains(t, body, "Unsubscribe link")
+
+	res, err = email.buildMessageFromRequest(email.sender(req.Comment.Locator.SiteID), req, "test@example.org", false)
+	require.NoError(t, err)
+	body = htmlPart(res)
+	assert.Contains(t, body, "New reply from test_user on your comment to «test_title»", "default template for users")
+	assert.Contains(t, body, "Unsubscribe link: https://remark42.com/api/v1/email/unsubscribe?site=remark&tkn=token")
+	assert.NotContains(t, body, "Moderat")
+
+	// default template used for admins as well if admin one is not set
+	email.adminMsgTmpl = nil
+	res, err = email.buildMessageFromRequest(email.sender(req.Comment.Locator.SiteID), req, "admin@example.org", true)
+	require.NoError(t, err)
+	assert.Contains(t, htmlPart(res), "New comment from test_user on your site")
+}
+
+func TestEmail_SendMaxBodyBytes(t *testing.T) {
+	email, err := NewEmail(EmailParams{
+		From:                     "from@example.org",
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "testdata/msg.html.tmpl",
+		TokenGenFn:               TokenGenFn,
+		MaxBodyBytes:             3000,
+	}, SMTPParams{})
+	require.NoError(t, err)
+	htmlPart := func(msg string) string {
+		body, e := ioutil.ReadAll(quotedprintable.NewReader(strings.NewReader(msg[strings.Index(msg, "text/html"):])))
+		require.NoError(t, e)
+		return string(body)
+	}
+
+	req := Request{Comment: store.Comment{ID: "999", User: store.User{ID: "1", Name: "test_user"},
+		Locator: store.Locator{SiteID: "remark", URL: "https://example.com/post"},
+		Text:    "<p>" + strings.Repeat("<b>Wall</b> of text & more, ", 500) + "</p>"}, Emails: []string{"test@example.org"}}
+	res, err := email.buildMessageFromRequest(email.sender(req.Comment.Locator.SiteID), req, "test@example.org", false)
+	require.NoError(t, err)
+	part := res[strings.Index(res, "text/html"):]
+	part = part[strings.Index(part, "\n\n")+2 : strings.Index(part, "\n--remark42-")]
+	dec, err := ioutil.ReadAll(quotedprintable.NewReader(strings.NewReader(part)))
+	require.NoError(t, err)
+	body := strings.ReplaceAll(string(dec), "\r\n", "\n")
+	assert.True(t, len(res) <= 3000, "message size %d is over the limit", len(res))
+	assert.True(t, len(res) > 2900, "message size %d is cut too much", len(res))
+	assert.Contains(t, body, `Comment: Wall of text &amp; more, Wall`)
+	assert.Contains(t, body, ` <a href="https://example.com/post#remark42__comment-999">…(truncated, view full comment)</a>`)
+	assert.NotContains(t, body, "<b>", "comment cut as plain text")
+	assert.NotRegexp(t, `&[a-z]*\s<a href`, body, "entity is not broken")
+
+	// short comment is not truncated
+	req.Comment.Text = "<p>short</p>"
+	res, err = email.buildMessageFromRequest(email.sender(req.Comment.Locator.SiteID), req, "test@example.org", false)
+	require.NoError(t, err)
+	assert.Contains(t, htmlPart(res), "Comment: <p>short</p>")
+	assert.NotContains(t, htmlPart(res), "truncated")
+
+	// the rest of the message is over the limit, only the link left
+	email.MaxBodyBytes = 10
+	req.Comment.Text = "<p>long enough comment</p>"
+	res, err = email.buildMessageFromRequest(email.sender(req.Comment.Locator.SiteID), req, "test@example.org", false)
+	require.NoError(t, err)
+	assert.Contains(t, htmlPart(res), `Comment:  <a href="https://example.com/post#remark42__comment-999">…(truncated, view full comment)</a>`)
+	assert.NotContains(t, htmlPart(res), "long enough")
+}
+
+func Test_cutEscaped(t *testing.T) {
+	tbl := []struct {
+		s   string
+		n   int
+		res string
+	}{
+		{"abc", 5, "abc"},
+		{"abc", 2, "ab"},
+		{"abc", 0, ""},
+		{"a &amp; b", 4, "a "},
+		{"a &amp; b", 7, "a &amp;"},
+		{"привет", 3, "п"},
+	}
+	for i, tt := range tbl {
+		assert.Equal(t, tt.res, cutEscaped(tt.s, tt.n), "case #%d", i)
+	}
+}
+
+func TestEmail_SendArchive(t *testing.T) {
+	params := EmailParams{
+		From:                     "from@example.org",
+		CC:                       []string{"cc@example.org"},
+		ArchiveEmail:             "archive@example.org",
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "testdata/msg.html.tmpl",
+		TokenGenFn:               TokenGenFn,
+		MaxRetries:               1,
+	}
+	email, err := NewEmail(params, SMTPParams{})
+	require.NoError(t, err)
+	fakeSMTP := &fakeTestSMTP{}
+	email.smtp = fakeSMTP
+
+	req := Request{Comment: store.Comment{ID: "999", User: store.User{ID: "1", Name: "test_user"}, ParentID: "1"},
+		parent: store.Comment{ID: "1", User: store.User{ID: "2", Name: "parent_user"}}, Emails: []string{"test@example.org"}}
+	require.NoError(t, email.Send(context.Background(), req))
+	assert.Equal(t, []string{"test@example.org", "cc@example.org", "archive@example.org"}, fakeSMTP.rcpts)
+	assert.Equal(t, 1, fakeSMTP.dataCount, "archive copy sent in the same transaction")
+	msg := fakeSMTP.buff.String()
+	assert.Contains(t, msg, "To: test@example.org\n")
+	assert.Contains(t, msg, "Cc: cc@example.org\n")
+	assert.Contains(t, msg, "X-Original-Recipient: test@example.org\n")
+	assert.NotContains(t, msg, "archive@example.org", "archive address is not in headers")
+
+	// verification is archived as well
+	fakeSMTP.rcpts = nil
+	require.NoError(t, email.SendVerification(context.Background(),
+		VerificationRequest{SiteID: "remark", User: "u", Email: "u@example.org", Token: "tkn"}))
+	assert.Equal(t, []string{"u@example.org", "archive@example.org"}, fakeSMTP.rcpts)
+
+	// rejected archive address doesn't prevent delivery
+	fakeSMTP.rcpts, fakeSMTP.dataCount, fakeSMTP.badRcpt = nil, 0, "archive@example.org"
+	require.NoError(t, email.Send(context.Background(), req))
+	assert.Equal(t, 1, fakeSMTP.dataCount)
+
+	params.ArchiveEmail = "bad"
+	_, err = NewEmail(params, SMTPParams{})
+	assert.EqualError(t, err, `invalid archive address: invalid recipient address "bad": mail: missing '@' or angle-addr`)
+}
+
+func TestEmail_SendReturnPath(t *testing.T) {
+	send := func(returnPath string) *fakeTestSMTP {
+		email, err := NewEmail(EmailParams{From: "from@example.org", ReturnPath: returnPath,
+			VerificationTemplatePath: "testdata/verification.html.tmpl", MsgTemplatePath: "testdata/msg.html.tmpl",
+			TokenGenFn: TokenGenFn}, SMTPParams{})
+		require.NoError(t, err)
+		fakeSMTP := &fakeTestSMTP{}
+		email.smtp = fakeSMTP
+		req := Request{Comment: store.Comment{ID: "999", User: store.User{ID: "1", Name: "test_user"}, ParentID: "1"},
+			parent: store.Comment{ID: "1", User: store.User{ID: "2", Name: "parent_user"}}, Emails: []string{"test@example.org"}}
+		require.NoError(t, email.Send(context.Background(), req))
+		return fakeSMTP
+	}
+
+	fakeSMTP := send("bounces@example.org")
+	assert.Equal(t, "bounces@example.org", fakeSMTP.readMail(), "envelope sender is the return path")
+	assert.Contains(t, fakeSMTP.buff.String(), "From: from@example.org\n", "from header is not changed")
+	assert.NotContains(t, fakeSMTP.buff.String(), "bounces@example.org")
+
+	fakeSMTP = send("")
+	assert.Equal(t, "from@example.org", fakeSMTP.readMail(), "envelope sender is from without return path")
+	assert.Contains(t, fakeSMTP.buff.String(), "From: from@example.org\n")
+
+	_, err := NewEmail(EmailParams{From: "from@example.org", ReturnPath: "bad address"}, SMTPParams{})
+	assert.EqualError(t, err, "invalid return path: invalid recipient address \"bad address\": mail: no angle-addr")
+}
+
+func TestEmail_SendDryRun(t *testing.T) {
+	sink := bytes.Buffer{}
+	email, err := NewEmail(EmailParams{
+		From:                     "from@example.org",
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "testdata/msg.html.tmpl",
+		TokenGenFn:               TokenGenFn,
+		AdminEmails:              []string{"admin@example.org"},
+		DryRun:                   true,
+		DryRunSink:               &sink,
+	}, SMTPParams{})
+	require.NoError(t, err)
+	fakeSMTP := &fakeTestSMTP{}
+	creator := &flakySMTPCreator{smtp: fakeSMTP}
+	email.smtp = creator
+
+	req := Request{Comment: store.Comment{ID: "999", User: store.User{ID: "1", Name: "test_user"}, PostTitle: "test_title"},
+		Emails: []string{"test@example.org"}}
+	require.NoError(t, email.Send(context.Background(), req))
+	require.NoError(t, email.SendVerification(context.Background(),
+		VerificationRequest{SiteID: "remark", User: "user", Email: "user@example.org", Token: "secret_"}))
+
+	assert.Equal(t, 0, creator.attempts, "smtp client never created")
+	assert.Equal(t, "", fakeSMTP.readMail())
+	assert.Equal(t, 0, fakeSMTP.readQuitCount())
+
+	res := sink.String()
+	assert.Contains(t, res, "MAIL FROM: from@example.org\nRCPT TO: test@example.org\nFrom: from@example.org\nTo: test@example.org\n"+
+		`Subject: New reply to your comment for "test_title"`)
+	assert.NotContains(t, res, "admin@example.org", "admin copy skipped")
+	assert.Contains(t, res, "MAIL FROM: from@example.org\nRCPT TO: user@example.org\nFrom: from@example.org\nTo: user@example.org\n"+
+		"Subject: Email verification")
+	assert.Contains(t, res, "secret_")
+	assert.Equal(t, 2, strings.Count(res, "MAIL FROM: "))
+
+	// without sink messages are only logged
+	email.DryRunSink = nil
+	require.NoError(t, email.Send(context.Background(), req))
+	assert.Equal(t, 0, creator.attempts)
+}
+
+func TestEmail_SendLocalized(t *testing.T) {
+	email, err := NewEmail(EmailParams{
+		From:                     "from@example.org",
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "testdata/msg.html.tmpl",
+		PlainMsgTemplatePath:     "testdata/msg.txt.tmpl",
+		LangMsgTemplatePaths:     map[string]string{"de": "testdata/msg_de.html.tmpl", "RU": "testdata/msg_ru.html.tmpl"},
+		LangSubjectTemplates:     map[string]string{"de": "Neue Antwort auf Ihren Kommentar", "ru": "Новый ответ на ваш комментарий"},
+		TokenGenFn:               TokenGenFn,
+	}, SMTPParams{})
+	require.NoError(t, err)
+
+	req := Request{
+		Comment: store.Comment{ID: "999", User: store.User{ID: "1", Name: "test_user"}, ParentID: "1", Text: "some text"},
+		parent:  store.Comment{ID: "1", User: store.User{ID: "999", Name: "parent_user"}},
+	}
+	tbl := []struct {
+		lang, subject, body string
+	}{
+		{"de", "Neue Antwort auf Ihren Kommentar", "Neue Antwort von test_user auf Ihren Kommentar (de)"},
+		{"ru", "Новый ответ на ваш комментарий", "Новый ответ от test_user на ваш комментарий (ru)"},
+		{"de-AT", "Neue Antwort auf Ihren Kommentar", "Neue Antwort von test_user auf Ihren Kommentar (de-AT)"},
+		{"RU_ru", "Новый ответ на ваш комментарий", "Новый ответ от test_user на ваш комментарий (RU_ru)"},
+		{"fr", "New reply to your comment", "New reply from test_user on your comment"},
+		{"", "New reply to your comment", "New reply from test_user on your comment"},
+	}
+	for _, tt := range tbl {
+		req.Lang = tt.lang
+		res, err := email.buildMessageFromRequest(email.sender(req.Comment.Locator.SiteID), req, "test@example.org", false)
+		require.NoError(t, err, tt.lang)
+		assert.Contains(t, res, "Subject: "+mime.BEncoding.Encode("utf-8", tt.subject)+"\n", tt.lang)
+		dec, err := ioutil.ReadAll(quotedprintable.NewReader(strings.NewReader(res)))
+		require.NoError(t, err)
+		assert.Contains(t, string(dec), tt.body, tt.lang)
+	}
+
+	_, err = NewEmail(EmailParams{
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "testdata/msg.html.tmpl",
+		LangMsgTemplatePaths:     map[string]string{"de": "testdata/msg_xx.html.tmpl"},
+	}, SMTPParams{})
+	assert.EqualError(t, err, `can't set templates: can't read message template for "de": open testdata/msg_xx.html.tmpl: no such file or directory`)
+	_, err = NewEmail(EmailParams{
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "testdata/msg.html.tmpl",
+		LangSubjectTemplates:     map[string]string{"de": "{{.Bad"},
+	}, SMTPParams{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `can't set templates: can't parse subject template for "de"`)
+}
+
+func TestEmail_TemplateFuncs(t *testing.T) {
+	email, err := NewEmail(EmailParams{
+		From:                     "from@example.org",
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "testdata/msg_funcs.html.tmpl",
+		SubjectTemplate:          `Reply on {{.CommentDate | formatDate "02 Jan"}} to {{.PostTitle | truncate 10}}`,
+		TokenGenFn:               TokenGenFn,
+	}, SMTPParams{})
+	require.NoError(t, err, "templates with helper functions parsed")
+
+	req := Request{Comment: store.Comment{ID: "999", User: store.User{ID: "1", Name: "test_user"},
+		Timestamp: time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC), PostTitle: "Very long post title",
+		Orig: "**bold** and [link](https://example.com)"}}
+	res, err := email.buildMessageFromRequest(email.sender(req.Comment.Locator.SiteID), req, "test@example.org", true)
+	require.NoError(t, err)
+	assert.Contains(t, res, "Subject: "+mime.BEncoding.Encode("utf-8", "Reply on 01 May to Very long…")+"\n")
+	dec, err := ioutil.ReadAll(quotedprintable.NewReader(strings.NewReader(res)))
+	require.NoError(t, err)
+	assert.Contains(t, string(dec), "Date: 2020-05-01")
+	assert.Contains(t, string(dec), "Text: bold and li…")
+}
+
+func Test_trimMarkdown(t *testing.T) {
+	tbl := []struct {
+		md, res string
+	}{
+		{"plain text", "plain text"},
+		{"**bold** __bold__ *italic* _italic_ ~~strike~~", "bold bold italic italic strike"},
+		{"snake_case_name and 2*3*4", "snake_case_name and 2*3*4"},
+		{"[link](https://example.com) and ![image](https://example.com/img.png)", "link and image"},
+		{"# Header\n> quote\n`code`", "Header\nquote\ncode"},
+		{"```go\nfmt.Println()\n```", "fmt.Println()"},
+	}
+	for _, tt := range tbl {
+		assert.Equal(t, tt.res, trimMarkdown(tt.md), tt.md)
+	}
+}
+
+func TestEmail_SendReplyToAndCC(t *testing.T) {
+	email, err := NewEmail(EmailParams{
+		From:                     "from@example.org",
+		ReplyTo:                  "Support <support@example.org>",
+		CC:                       []string{"cc1@example.org", "cc2@example.org"},
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "testdata/msg.html.tmpl",
+		TokenGenFn:               TokenGenFn,
+	}, SMTPParams{})
+	require.NoError(t, err)
+	fakeSMTP := &fakeTestSMTP{}
+	email.smtp = fakeSMTP
+
+	req := Request{Comment: store.Comment{ID: "999", User: store.User{ID: "1", Name: "test_user"}, PostTitle: "test_title"},
+		Emails: []string{"test@example.org"}}
+	require.NoError(t, email.Send(context.Background(), req))
+	assert.Equal(t, "from@example.org", fakeSMTP.readMail())
+	assert.Equal(t, []string{"test@example.org", "cc1@example.org", "cc2@example.org"}, fakeSMTP.rcpts)
+	res, err := email.buildMessageFromRequest(email.sender(req.Comment.Locator.SiteID), req, "test@example.org", false)
+	require.NoError(t, err)
+	assert.Contains(t, res, `From: from@example.org
+To: test@example.org
+Subject: New reply to your comment for "test_title"
+Message-ID: <999@example.org>
+Reply-To: Support <support@example.org>
+Cc: cc1@example.org, cc2@example.org
+MIME-version: 1.0
+`)
+
+	// per-request cc override, invalid address skipped
+	fakeSMTP.rcpts = nil
+	req.CC = []string{"cc3@example.org", "bad"}
+	err = email.Send(context.Background(), req)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `problem with cc address: invalid recipient address "bad"`)
+	assert.Equal(t, []string{"test@example.org", "cc3@example.org"}, fakeSMTP.rcpts)
+	res, err = email.buildMessageFromRequest(email.sender(req.Comment.Locator.SiteID),
+		Request{Comment: req.Comment, CC: []string{"cc3@example.org"}}, "test@example.org", false)
+	require.NoError(t, err)
+	assert.Contains(t, res, "Cc: cc3@example.org\n")
+
+	// empty per-request cc disables copies
+	fakeSMTP.rcpts = nil
+	req.CC = []string{}
+	require.NoError(t, email.Send(context.Background(), req))
+	assert.Equal(t, []string{"test@example.org"}, fakeSMTP.rcpts)
+
+	// failed copy recipient doesn't affect the main one
+	fakeSMTP.rcpts = nil
+	fakeSMTP.badRcpt = "cc1@example.org"
+	req.CC = nil
+	require.NoError(t, email.Send(context.Background(), req))
+	assert.Equal(t, []string{"test@example.org", "cc1@example.org", "cc2@example.org"}, fakeSMTP.rcpts)
+	assert.Equal(t, 4, fakeSMTP.dataCount, "message sent")
+
+	// verification message has no cc
+	fakeSMTP.rcpts = nil
+	require.NoError(t, email.SendVerification(context.Background(), VerificationRequest{User: "user", Email: "user@example.org", Token: "t"}))
+	assert.Equal(t, []string{"user@example.org"}, fakeSMTP.rcpts)
+
+	_, err = NewEmail(EmailParams{ReplyTo: "bad"}, SMTPParams{})
+	assert.EqualError(t, err, `invalid reply-to address "bad": mail: missing '@' or angle-addr`)
+	_, err = NewEmail(EmailParams{InboundAddress: "bad", InboundSecret: "secret"}, SMTPParams{})
+	assert.EqualError(t, err, `invalid inbound address "bad": mail: missing '@' or angle-addr`)
+	_, err = NewEmail(EmailParams{InboundAddress: "reply@example.org"}, SMTPParams{})
+	assert.EqualError(t, err, "inbound secret is required with inbound address")
+	_, err = NewEmail(EmailParams{CC: []string{"bad"}}, SMTPParams{})
+	assert.EqualError(t, err, `invalid recipient address "bad": mail: missing '@' or angle-addr`)
+}
+
+func TestEmail_SendSiteSenders(t *testing.T) {
+	email, err := NewEmail(EmailParams{
+		From:     "from@example.org",
+		FromName: "Remark42",
+		ReplyTo:  "support@example.org",
+		SiteSenders: map[string]EmailSender{
+			"brand1": {From: "noreply@brand1.com", FromName: "Brand One", ReplyTo: "help@brand1.com"},
+			"brand2": {From: "noreply@brand2.com"},
+		},
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "testdata/msg.html.tmpl",
+		TokenGenFn:               TokenGenFn,
+	}, SMTPParams{})
+	require.NoError(t, err)
+	fakeSMTP := &fakeTestSMTP{}
+	email.smtp = fakeSMTP
+
+	req := Request{Comment: store.Comment{ID: "999", User: store.User{ID: "1", Name: "test_user"},
+		Locator: store.Locator{SiteID: "brand1"}}, Emails: []string{"test@example.org"}}
+	require.NoError(t, email.Send(context.Background(), req))
+	assert.Equal(t, "noreply@brand1.com", fakeSMTP.readMail())
+	msg := fakeSMTP.buff.String()
+	assert.Contains(t, msg, "From: \"Brand One\" <noreply@brand1.com>\n")
+	assert.Contains(t, msg, "Message-ID: <999.brand1@brand1.com>\nReply-To: help@brand1.com\n")
+
+	fakeSMTP.buff.Reset()
+	req.Comment.Locator.SiteID = "brand2"
+	require.NoError(t, email.Send(context.Background(), req))
+	assert.Equal(t, "noreply@brand2.com", fakeSMTP.readMail())
+	msg = fakeSMTP.buff.String()
+	assert.Contains(t, msg, "From: noreply@brand2.com\n", "default display name is not used with site's address")
+	assert.Contains(t, msg, "Reply-To: support@example.org\n", "default reply-to used")
+
+	// unknown site uses defaults
+	fakeSMTP.buff.Reset()
+	req.Comment.Locator.SiteID = "other"
+	require.NoError(t, email.Send(context.Background(), req))
+	assert.Equal(t, "from@example.org", fakeSMTP.readMail())
+	assert.Contains(t, fakeSMTP.buff.String(), "From: \"Remark42\" <from@example.org>\n")
+
+	// verification sent with site's sender
+	fakeSMTP.buff.Reset()
+	require.NoError(t, email.SendVerification(context.Background(),
+		VerificationRequest{SiteID: "brand1", User: "user", Email: "user@example.org", Token: "t"}))
+	assert.Equal(t, "noreply@brand1.com", fakeSMTP.readMail())
+	assert.Contains(t, fakeSMTP.buff.String(), "From: \"Brand One\" <noreply@brand1.com>\n")
+
+	_, err = NewEmail(EmailParams{SiteSenders: map[string]EmailSender{"site": {ReplyTo: "bad"}}}, SMTPParams{})
+	assert.EqualError(t, err, `invalid sender address "bad" for site "site": mail: missing '@' or angle-addr`)
+}
+
+func TestEmail_SendCircuitBreaker(t *testing.T) {
+	now := time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC)
+	email, err := NewEmail(EmailParams{
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "testdata/msg.html.tmpl",
+		BreakerThreshold:         2,
+	}, SMTPParams{Host: "example.org", Port: 25})
+	require.NoError(t, err)
+	assert.Equal(t, defaultEmailBreakerCooldown, email.BreakerCooldown)
+	email.breaker.now = func() time.Time { return now }
+	fakeSMTP := &fakeTestSMTP{fail: map[string]bool{"create": true}}
+	creator := &flakySMTPCreator{smtp: fakeSMTP}
+	email.smtp = creator
+
+	msg := emailMessage{from: "from@example.org", to: "to@example.org"}
+	for i := 0; i < 2; i++ {
+		assert.EqualError(t, email.sendMessage(msg), "failed to make smtp Create: failed to create client")
+	}
+	assert.Equal(t, circuitOpen, email.breaker.state())
+	assert.EqualError(t, email.sendMessage(msg), "skip connection to example.org:25: circuit open")
+	assert.Equal(t, 2, creator.attempts, "no connection attempts while circuit is open")
+
+	// half-open, the single attempt fails and opens circuit again
+	now = now.Add(defaultEmailBreakerCooldown)
+	assert.Equal(t, circuitHalfOpen, email.breaker.state())
+	assert.EqualError(t, email.sendMessage(msg), "failed to make smtp Create: failed to create client")
+	assert.Equal(t, 3, creator.attempts)
+	assert.Equal(t, circuitOpen, email.breaker.state())
+	assert.EqualError(t, email.sendMessage(msg), "skip connection to example.org:25: circuit open")
+
+	// half-open, server is back and circuit closed
+	now = now.Add(defaultEmailBreakerCooldown)
+	fakeSMTP.fail = nil
+	assert.NoError(t, email.sendMessage(msg))
+	assert.Equal(t, circuitClosed, email.breaker.state())
+	assert.NoError(t, email.sendMessage(msg))
+	assert.Equal(t, 5, creator.attempts)
+	assert.Equal(t, 2, fakeSMTP.dataCount)
+
+	// kept alive connection goes through circuit breaker as well
+	email.KeepAlive = true
+	fakeSMTP.fail = map[string]bool{"create": true}
+	email.closePooled()
+	for i := 0; i < 2; i++ {
+		assert.Error(t, email.sendMessage(msg))
+	}
+	assert.EqualError(t, email.sendMessage(msg), "skip connection to example.org:25: circuit open")
+}
+
+func TestEmail_NewWithFormat(t *testing.T) {
+	params := EmailParams{VerificationTemplatePath: "testdata/verification.html.tmpl", MsgTemplatePath: "testdata/msg.html.tmpl"}
+	email, err := NewEmail(params, SMTPParams{})
+	require.NoError(t, err)
+	assert.Equal(t, EmailFormatHTML, email.Format, "html by default")
+
+	params.Format = EmailFormatText
+	email, err = NewEmail(params, SMTPParams{})
+	require.NoError(t, err)
+	assert.Equal(t, EmailFormatText, email.Format)
+
+	params.Format = "rtf"
+	_, err = NewEmail(params, SMTPParams{})
+	assert.EqualError(t, err, `unsupported email format "rtf"`)
+}
+
+func TestEmail_fromHeader(t *testing.T) {
+	tbl := []struct {
+		from, name, res string
+	}{
+		{"noreply@acme.com", "", "noreply@acme.com"},
+		{"Remark42 <noreply@acme.com>", "", "Remark42 <noreply@acme.com>"},
+		{"noreply@acme.com", "Acme Comments", `"Acme Comments" <noreply@acme.com>`},
+		{"noreply@acme.com", "Acme", `"Acme" <noreply@acme.com>`},
+		{"Remark42 <noreply@acme.com>", "Acme, Inc.", `"Acme, Inc." <noreply@acme.com>`},
+		{"noreply@acme.com", "Комментарии Acme", "=?UTF-8?b?0JrQvtC80LzQtdC90YLQsNGA0LjQuCBBY21l?= <noreply@acme.com>"},
+	}
+	for _, tt := range tbl {
+		s := EmailSender{From: tt.from, FromName: tt.name}
+		assert.Equal(t, tt.res, s.fromHeader(), tt.from+" "+tt.name)
+		addr, err := mail.ParseAddress(tt.res)
+		require.NoError(t, err, tt.res)
+		assert.Equal(t, "noreply@acme.com", addr.Address)
+		if tt.name != "" {
+			assert.Equal(t, tt.name, addr.Name, "name decoded back")
+		}
+	}
+
+	email, err := NewEmail(EmailParams{
+		From:                     "noreply@acme.com",
+		FromName:                 "Комментарии",
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "testdata/msg.html.tmpl",
+		TokenGenFn:               TokenGenFn,
+	}, SMTPParams{})
+	require.NoError(t, err)
+	req := Request{Comment: store.Comment{ID: "999", User: store.User{ID: "1", Name: "test_user"}}}
+	res, err := email.buildMessageFromRequest(email.sender(req.Comment.Locator.SiteID), req, "test@example.org", true)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(res, "From: =?UTF-8?b?0JrQvtC80LzQtdC90YLQsNGA0LjQuA==?= <noreply@acme.com>\n"), res)
+	res, err = email.buildVerificationMessage("user", "test@example.org", "token", "remark")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(res, "From: =?UTF-8?b?0JrQvtC80LzQtdC90YLQsNGA0LjQuA==?= <noreply@acme.com>\n"), res)
+}
+
+func TestEmail_threadHeaders(t *testing.T) {
+	e := Email{EmailParams: EmailParams{From: "Remark42 <noreply@remark42.com>"}}
+	// site id with space is encoded in message id, to be restored from inbound reply
+	loc := store.Locator{SiteID: "my site", URL: "https://example.com/post"}
+
+	req := Request{Comment: store.Comment{ID: "c3", ParentID: "c2", Locator: loc},
+		parent: store.Comment{ID: "c2", ParentID: "c1", Locator: loc}}
+	assert.Equal(t, "Message-ID: <c3.=NV4SA43JORSQ@remark42.com>\n"+
+		"In-Reply-To: <c2.=NV4SA43JORSQ@remark42.com>\n"+
+		"References: <c1.=NV4SA43JORSQ@remark42.com> <c2.=NV4SA43JORSQ@remark42.com>\n", e.threadHeaders(req))
+	assert.Equal(t, e.threadHeaders(req), e.threadHeaders(req), "headers are deterministic")
+
+	req.parent = store.Comment{}
+	assert.Equal(t, "Message-ID: <c3.=NV4SA43JORSQ@remark42.com>\n"+
+		"In-Reply-To: <c2.=NV4SA43JORSQ@remark42.com>\n"+
+		"References: <c2.=NV4SA43JORSQ@remark42.com>\n", e.threadHeaders(req), "no parent comment loaded")
+
+	req = Request{Comment: store.Comment{ID: "c1", Locator: loc}}
+	assert.Equal(t, "Message-ID: <c1.=NV4SA43JORSQ@remark42.com>\n", e.threadHeaders(req), "top level comment")
+
+	e.From = "bad address"
+	assert.Equal(t, "Message-ID: <c1.=NV4SA43JORSQ@remark42>\n", e.threadHeaders(req), "fallback domain")
+}
+
+func TestEmail_SendPlainTemplate(t *testing.T) {
+	email, err := NewEmail(EmailParams{
+		From:                     "from@example.org",
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "testdata/msg.html.tmpl",
+		PlainMsgTemplatePath:     "testdata/msg.txt.tmpl",
+	}, SMTPParams{})
+	require.NoError(t, err)
+	email.TokenGenFn = TokenGenFn
+	req := Request{
+		Comment: store.Comment{ID: "999", User: store.User{ID: "1", Name: "test_user"}, ParentID: "1", Text: "<p>some <b>text</b></p>"},
+		parent:  store.Comment{ID: "1", User: store.User{ID: "999", Name: "parent_user"}},
+		Emails:  []string{"test@example.org"},
+	}
+	res, err := email.buildMessageFromRequest(email.sender(req.Comment.Locator.SiteID), req, req.Emails[0], false)
+	require.NoError(t, err)
+	assert.Contains(t, res, "Content-Type: text/plain; charset=\"UTF-8\"\nContent-Transfer-Encoding: quoted-printable\n\n"+
+		"Plain reply from test_user to parent_user\r\n")
+	assert.Contains(t, res, "Comment: <p>some <b>text</b></p>")
+
+	_, err = NewEmail(EmailParams{
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "testdata/msg.html.tmpl",
+		PlainMsgTemplatePath:     "testdata/bad.html.tmpl",
+	}, SMTPParams{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "can't parse plain message template")
+}
+
+func TestEmail_SendAmpTemplate(t *testing.T) {
+	email, err := NewEmail(EmailParams{
+		From:                     "from@example.org",
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "testdata/msg.html.tmpl",
+		AmpMsgTemplatePath:       "testdata/msg.amp.html.tmpl",
+		LangMsgTemplatePaths:     map[string]string{"de": "testdata/msg_de.html.tmpl"},
+		TokenGenFn:               TokenGenFn,
+	}, SMTPParams{})
+	require.NoError(t, err)
+	req := Request{
+		Comment: store.Comment{ID: "999", User: store.User{ID: "1", Name: "test_user"}, ParentID: "1", Text: "<p>some text</p>"},
+		parent:  store.Comment{ID: "1", User: store.User{ID: "999", Name: "parent_user"}},
+	}
+	res, err := email.buildMessageFromRequest(email.sender(""), req, "test@example.org", false)
+	require.NoError(t, err)
+	msg, err := mail.ReadMessage(strings.NewReader(res))
+	require.NoError(t, err)
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	assert.Equal(t, "multipart/alternative", mediaType)
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	var types []string
+	var ampBody string
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		types = append(types, part.Header.Get("Content-Type"))
+		body, err := ioutil.ReadAll(part)
+		require.NoError(t, err)
+		if strings.HasPrefix(part.Header.Get("Content-Type"), "text/x-amp-html") {
+			ampBody = string(body)
+		}
+	}
+	assert.Equal(t, []string{`text/plain; charset="UTF-8"`, `text/html; charset="UTF-8"`, `text/x-amp-html; charset="UTF-8"`}, types,
+		"amp part is the last, most preferred one")
+	assert.Contains(t, ampBody, "<html ⚡4email data-css-strict>")
+	assert.Contains(t, ampBody, "AMP reply from test_user to parent_user")
+
+	// localized message has no amp part
+	req.Lang = "de"
+	res, err = email.buildMessageFromRequest(email.sender(""), req, "test@example.org", false)
+	require.NoError(t, err)
+	assert.NotContains(t, res, "text/x-amp-html")
+
+	tbl := []struct {
+		params EmailParams
+		err    string
+	}{
+		{EmailParams{AmpMsgTemplatePath: "testdata/msg.html.tmpl"},
+			"amp message template testdata/msg.html.tmpl should have <html ⚡4email> or <html amp4email> tag"},
+		{EmailParams{AmpMsgTemplatePath: "testdata/no-such-file.tmpl"}, "can't read amp message template"},
+		{EmailParams{AmpMsgTemplatePath: "testdata/msg.amp.html.tmpl", Format: EmailFormatText},
+			"amp message template can't be used with text format"},
+	}
+	for i, tt := range tbl {
+		tt.params.VerificationTemplatePath = "testdata/verification.html.tmpl"
+		tt.params.MsgTemplatePath = "testdata/msg.html.tmpl"
+		_, err = NewEmail(tt.params, SMTPParams{})
+		require.Error(t, err, "case #%d", i)
+		assert.Contains(t, err.Error(), tt.err, "case #%d", i)
+	}
+}
+
+func TestEmail_SendPreheader(t *testing.T) {
+	email, err := NewEmail(EmailParams{
+		From:                     "from@example.org",
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "testdata/msg.html.tmpl",
+		PreheaderTemplate:        "{{.UserName}} replied: {{.CommentText | trimMarkdown | truncate 20}}",
+		TokenGenFn:               TokenGenFn,
+	}, SMTPParams{})
+	require.NoError(t, err)
+	req := Request{
+		Comment: store.Comment{ID: "999", User: store.User{ID: "1", Name: "<test_user>"}, ParentID: "1", Text: "some long comment text"},
+		parent:  store.Comment{ID: "1", User: store.User{ID: "999", Name: "parent_user"}},
+	}
+	res, err := email.buildMessageFromRequest(email.sender(req.Comment.Locator.SiteID), req, "test@example.org", false)
+	require.NoError(t, err)
+	htmlPart, err := ioutil.ReadAll(quotedprintable.NewReader(strings.NewReader(res[strings.Index(res, "text/html"):])))
+	require.NoError(t, err)
+	assert.Contains(t, string(htmlPart), "quoted-printable\n\n"+`<span style="display:none !important;visibility:hidden;mso-hide:all;`+
+		`font-size:1px;line-height:1px;max-height:0;max-width:0;opacity:0;overflow:hidden;">`+
+		"&lt;test_user&gt; replied: some long comment t…</span>\r\n\tNew reply from", "preheader at the top of html part")
+	plainPart := res[strings.Index(res, "text/plain"):strings.Index(res, "text/html")]
+	assert.NotContains(t, plainPart, "replied:", "no preheader in plain part")
+
+	// no preheader without template
+	email.preheaderTmpl = nil
+	res, err = email.buildMessageFromRequest(email.sender(req.Comment.Locator.SiteID), req, "test@example.org", false)
+	require.NoError(t, err)
+	assert.NotContains(t, res, "display:none")
+
+	_, err = NewEmail(EmailParams{
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "testdata/msg.html.tmpl",
+		PreheaderTemplate:        "{{.UserName",
+	}, SMTPParams{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "can't parse preheader template")
+}
+
+func TestEmail_PriorityHeaders(t *testing.T) {
+	email, err := NewEmail(EmailParams{
+		From:                     "from@example.org",
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "testdata/msg.html.tmpl",
+		PriorityForAdmin:         true,
+		PriorityForEvents:        map[Event]bool{EventReply: true},
+		TokenGenFn:               TokenGenFn,
+	}, SMTPParams{})
+	require.NoError(t, err)
+	req := Request{Comment: store.Comment{ID: "999", User: store.User{ID: "1", Name: "test_user"}, Text: "some text"}}
+	headers := func(msg string) string {
+		return msg[:strings.Index(msg, "\n\n")]
+	}
+
+	res, err := email.buildMessageFromRequest(email.sender(req.Comment.Locator.SiteID), req, "admin@example.org", true)
+	require.NoError(t, err)
+	assert.Contains(t, headers(res), "\nX-Priority: 1\nImportance: high\n", "admin message is high priority")
+
+	res, err = email.buildMessageFromRequest(email.sender(req.Comment.Locator.SiteID), req, "user@example.org", false)
+	require.NoError(t, err)
+	assert.NotContains(t, res, "X-Priority", "regular message has no priority")
+	assert.NotContains(t, res, "Importance")
+
+	req.Event, req.Comment.ParentID = EventReply, "1"
+	req.parent = store.Comment{ID: "1", User: store.User{ID: "2", Name: "parent_user"}}
+	res, err = email.buildMessageFromRequest(email.sender(req.Comment.Locator.SiteID), req, "user@example.org", false)
+	require.NoError(t, err)
+	assert.Contains(t, headers(res), "\nX-Priority: 1\nImportance: high\n", "reply is high priority")
+
+	email.PriorityForAdmin, email.PriorityForEvents = false, nil
+	res, err = email.buildMessageFromRequest(email.sender(req.Comment.Locator.SiteID), req, "admin@example.org", true)
+	require.NoError(t, err)
+	assert.NotContains(t, res, "X-Priority", "no priority headers by default")
+}
+
+func TestEmail_RenderedParent(t *testing.T) {
+	email, err := NewEmail(EmailParams{
+		From:                     "from@example.org",
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "../../templates/email_reply.html.tmpl",
+		TokenGenFn:               TokenGenFn,
+	}, SMTPParams{})
+	require.NoError(t, err)
+	htmlPart := func(msg string) string {
+		body, e := ioutil.ReadAll(quotedprintable.NewReader(strings.NewReader(msg[strings.Index(msg, "text/html"):])))
+		require.NoError(t, e)
+		return string(body)
+	}
+
+	req := Request{
+		Comment: store.Comment{ID: "999", User: store.User{ID: "1", Name: "test_user"}, ParentID: "1", Text: "<p>reply</p>"},
+		parent: store.Comment{ID: "1", User: store.User{ID: "2", Name: "parent_user"}, Text: "<p>stored</p>",
+			Orig: "parent **text** <script>alert(1)</script>"},
+	}
+	res, err := email.buildMessageFromRequest(email.sender(req.Comment.Locator.SiteID), req, "test@example.org", false)
+	require.NoError(t, err)
+	body := htmlPart(res)
+	assert.Contains(t, body, "<details open>")
+	assert.Regexp(t, `<blockquote [^>]+><p>parent <strong>text</strong> </p>\s*</blockquote>`, body)
+	assert.NotContains(t, body, "<script>")
+
+	// top-level comment has no quote
+	req.Comment.ParentID, req.parent = "", store.Comment{}
+	res, err = email.buildMessageFromRequest(email.sender(req.Comment.Locator.SiteID), req, "test@example.org", true)
+	require.NoError(t, err)
+	body = htmlPart(res)
+	assert.Contains(t, body, "<p>reply</p>")
+	assert.NotContains(t, body, "<details")
+	assert.NotContains(t, body, "<blockquote")
+
+	assert.Equal(t, "<p>stored</p>", renderedHTML(store.Comment{Text: "<p>stored</p>"}), "stored text used without markdown")
+}
+
+func TestEmail_IsReply(t *testing.T) {
+	email, err := NewEmail(EmailParams{
+		From:                     "from@example.org",
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "../../templates/email_reply.html.tmpl",
+		TokenGenFn:               TokenGenFn,
+	}, SMTPParams{})
+	require.NoError(t, err)
+	htmlPart := func(msg string) string {
+		body, e := ioutil.ReadAll(quotedprintable.NewReader(strings.NewReader(msg[strings.Index(msg, "text/html"):])))
+		require.NoError(t, e)
+		return string(body)
+	}
+
+	req := Request{
+		Comment: store.Comment{ID: "999", User: store.User{ID: "1", Name: "test_user"}, ParentID: "1", PostTitle: "test_title"},
+		parent:  store.Comment{ID: "1", User: store.User{ID: "2", Name: "parent_user"}},
+	}
+	res, err := email.buildMessageFromRequest(email.sender(req.Comment.Locator.SiteID), req, "test@example.org", false)
+	require.NoError(t, err)
+	assert.Contains(t, htmlPart(res), "New reply from test_user on your comment to «test_title»")
+
+	req.Comment.ParentID, req.parent = "", store.Comment{}
+	res, err = email.buildMessageFromRequest(email.sender(req.Comment.Locator.SiteID), req, "test@example.org", false)
+	require.NoError(t, err)
+	body := htmlPart(res)
+	assert.Contains(t, body, "New comment from test_user to «test_title»")
+	assert.NotContains(t, body, "New reply")
+
+	// IsReply is available in custom templates
+	email.msgTmpl = template.Must(template.New("msg").Parse(`{{if .IsReply}}reply{{else}}top-level{{end}} comment`))
+	res, err = email.buildMessageFromRequest(email.sender(req.Comment.Locator.SiteID), req, "test@example.org", false)
+	require.NoError(t, err)
+	assert.Contains(t, htmlPart(res), "top-level comment")
+}
+
+func TestEmail_Mention(t *testing.T) {
+	email, err := NewEmail(EmailParams{
+		From:                     "from@example.org",
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "../../templates/email_reply.html.tmpl",
+		AdminEmails:              []string{"admin@example.org"},
+		TokenGenFn: func(user, _, _ string) (string, error) {
+			return "token-" + user, nil
+		},
+		UnsubscribeURL: "https://remark42.com/email/unsubscribe",
+	}, SMTPParams{})
+	require.NoError(t, err)
+	fakeSMTP := &fakeTestSMTP{}
+	email.smtp = fakeSMTP
+
+	req := Request{
+		Event:   EventMention,
+		Comment: store.Comment{ID: "999", User: store.User{ID: "1", Name: "test_user"}, ParentID: "1", Text: "<p>hi @bob</p>"},
+		parent:  store.Comment{ID: "1", User: store.User{ID: "2", Name: "parent_user"}, Text: "<p>parent</p>"},
+		mention: store.User{ID: "3", Name: "bob"},
+		Emails:  []string{"bob@example.org"},
+	}
+	require.NoError(t, email.Send(context.Background(), req))
+	assert.Equal(t, []string{"bob@example.org"}, fakeSMTP.rcpts, "no admin copy for mention")
+	msg := fakeSMTP.buff.String()
+	assert.Contains(t, msg, "Subject: You were mentioned in a comment\n")
+	assert.Contains(t, msg, "tkn=token-3", "unsubscribe token made for mentioned user")
+	body, err := ioutil.ReadAll(quotedprintable.NewReader(strings.NewReader(msg[strings.Index(msg, "text/html"):])))
+	require.NoError(t, err)
+	assert.Contains(t, string(body), "test_user mentioned you in a comment")
+	assert.Contains(t, string(body), "</a> for bob</i>")
+}
+
+func TestEmail_FromPool(t *testing.T) {
+	email, err := NewEmail(EmailParams{
+		From:                     "default@example.org",
+		FromPool:                 []string{"n1@example.org", "n2@example.net", "n3@example.com"},
+		SiteSenders:              map[string]EmailSender{"own": {From: "own@example.org"}, "named": {FromName: "Named"}},
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "testdata/msg.html.tmpl",
+		TokenGenFn:               TokenGenFn,
+	}, SMTPParams{})
+	require.NoError(t, err)
+	fakeSMTP := &fakeTestSMTP{}
+	email.smtp = fakeSMTP
+
+	req := Request{Comment: store.Comment{ID: "999", Locator: store.Locator{SiteID: "remark"}},
+		Emails: []string{"u1@example.org", "u2@example.org", "u3@example.org", "u4@example.org"}}
+	require.NoError(t, email.Send(context.Background(), req))
+	assert.Equal(t, []string{"n1@example.org", "n2@example.net", "n3@example.com", "n1@example.org"}, fakeSMTP.mails)
+	msgs := strings.Split(fakeSMTP.buff.String(), "From: ")[1:]
+	require.Equal(t, 4, len(msgs))
+	for i, msg := range msgs {
+		assert.True(t, strings.HasPrefix(msg, fakeSMTP.mails[i]+"\n"), "From header matches envelope sender, %s", msg)
+	}
+
+	assert.Equal(t, "n2@example.net", email.requestSender("remark", "u@example.org").From, "rotation continues")
+	assert.Equal(t, "own@example.org", email.requestSender("own", "u@example.org").From, "site's own From not rotated")
+	named := email.requestSender("named", "u@example.org")
+	assert.Equal(t, EmailSender{From: "n3@example.com", FromName: "Named"}, named, "pool used for site without own From")
+
+	// sticky
+	email.FromPoolSticky = true
+	first := email.requestSender("remark", "user@example.org").From
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, first, email.requestSender("remark", "User@Example.org").From, "the same address for the recipient")
+	}
+	senders := map[string]bool{}
+	for i := 0; i < 20; i++ {
+		senders[email.requestSender("remark", fmt.Sprintf("user%d@example.org", i)).From] = true
+	}
+	assert.Equal(t, 3, len(senders), "recipients spread over the pool")
+}
+
+func TestEmail_SendRequestFrom(t *testing.T) {
+	email, err := NewEmail(EmailParams{
+		From:                     "Site <default@example.org>",
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "testdata/msg.html.tmpl",
+		TokenGenFn:               TokenGenFn,
+		AllowRequestFrom:         true,
+	}, SMTPParams{})
+	require.NoError(t, err)
+	fakeSMTP := &fakeTestSMTP{}
+	email.smtp = fakeSMTP
+
+	req := Request{Comment: store.Comment{ID: "999", Locator: store.Locator{SiteID: "remark"}},
+		Emails: []string{"u1@example.org"}, From: "Commenter <commenter@example.com>"}
+	require.NoError(t, email.Send(context.Background(), req))
+	assert.Equal(t, "default@example.org", fakeSMTP.readMail(), "envelope sender is the actual one")
+	assert.Contains(t, fakeSMTP.buff.String(), "From: \"Commenter\" <commenter@example.com>\nSender: default@example.org\nTo: u1@example.org\n")
+
+	// invalid request from ignored
+	assert.Equal(t, EmailSender{From: "Site <default@example.org>"},
+		email.onBehalfSender(Request{From: "bad address"}, EmailSender{From: "Site <default@example.org>"}))
+
+	// not allowed
+	email.AllowRequestFrom = false
+	fakeSMTP = &fakeTestSMTP{}
+	email.smtp = fakeSMTP
+	req.Comment.ID = "1000"
+	require.NoError(t, email.Send(context.Background(), req))
+	assert.Equal(t, "Site <default@example.org>", fakeSMTP.readMail())
+	assert.Contains(t, fakeSMTP.buff.String(), "From: Site <default@example.org>\nTo: u1@example.org\n")
+	assert.NotContains(t, fakeSMTP.buff.String(), "commenter@example.com")
+	assert.NotContains(t, fakeSMTP.buff.String(), "Sender:")
+}
+
+func TestEmail_SendToHeaderOverride(t *testing.T) {
+	email, err := NewEmail(EmailParams{
+		From:                     "from@example.org",
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "testdata/msg.html.tmpl",
+		TokenGenFn:               TokenGenFn,
+		ToHeaderOverride:         "undisclosed-recipients:;",
+	}, SMTPParams{})
+	require.NoError(t, err)
+	fakeSMTP := &fakeTestSMTP{}
+	email.smtp = fakeSMTP
+
+	req := Request{Comment: store.Comment{ID: "999", Locator: store.Locator{SiteID: "remark"}},
+		Emails: []string{"test@example.org"}}
+	require.NoError(t, email.Send(context.Background(), req))
+	assert.Equal(t, "test@example.org", fakeSMTP.readRcpt(), "envelope recipient is the real one")
+	msg := fakeSMTP.buff.String()
+	assert.Contains(t, msg, "From: from@example.org\nTo: undisclosed-recipients:;\nSubject:")
+	assert.NotContains(t, msg, "To: test@example.org")
+
+	_, err = NewEmail(EmailParams{From: "from@example.org", ToHeaderOverride: "x\r\nBcc: a@example.org"}, SMTPParams{})
+	assert.EqualError(t, err, "invalid to header override, line breaks are not allowed")
+}
+
+func TestEmail_SendTest(t *testing.T) {
+	q := &memEmailQueue{}
+	email, err := NewEmail(EmailParams{
+		From:                     "from@example.org",
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "../../templates/email_reply.html.tmpl",
+		AdminEmails:              []string{"admin@example.org"},
+		DedupWindow:              time.Minute,
+		Queue:                    q,
+		TokenGenFn:               TokenGenFn,
+	}, SMTPParams{})
+	require.NoError(t, err)
+	fakeSMTP := &fakeTestSMTP{}
+	email.smtp = fakeSMTP
+
+	msg, err := email.SendTest(context.Background(), "test@example.org")
+	require.NoError(t, err)
+	assert.Contains(t, msg, "From: from@example.org\nTo: test@example.org\n")
+	assert.Contains(t, msg, "Subject: New reply to your comment for \"Test post\"\n")
+	assert.Contains(t, msg, "Sample Replier")
+	assert.Equal(t, msg, fakeSMTP.buff.String(), "rendered message is sent")
+	assert.Equal(t, []string{"test@example.org"}, fakeSMTP.rcpts, "no admin copy")
+	assert.Equal(t, "from@example.org", fakeSMTP.readMail())
+	assert.Equal(t, 0, q.puts, "test message is not queued")
+
+	_, err = email.SendTest(context.Background(), "test@example.org")
+	require.NoError(t, err, "test message is not deduplicated")
+	assert.Equal(t, 2, fakeSMTP.dataCount)
+
+	_, err = email.SendTest(context.Background(), "bad")
+	assert.EqualError(t, err, `invalid recipient address "bad": mail: missing '@' or angle-addr`)
+
+	email.smtp = &fakeTestSMTP{fail: map[string]bool{"rcpt": true}}
+	_, err = email.SendTest(context.Background(), "test@example.org")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `problem sending test message to "test@example.org"`)
+	assert.Contains(t, err.Error(), "failed to verify receiver")
+}
+
+func TestEmail_Ping(t *testing.T) {
+	fakeSMTP := &fakeTestSMTP{}
+	e := Email{smtp: fakeSMTP, SMTPParams: SMTPParams{Host: "example.org", Port: 25}}
+	require.NoError(t, e.Ping(context.Background()))
+	assert.Equal(t, 1, fakeSMTP.readQuitCount())
+	assert.Empty(t, fakeSMTP.readMail(), "nothing sent")
+
+	fakeSMTP.fail = map[string]bool{"noop": true}
+	assert.EqualError(t, e.Ping(context.Background()), "noop command to example.org:25 failed: failed to noop")
+
+	fakeSMTP.fail = map[string]bool{"create": true}
+	assert.EqualError(t, e.Ping(context.Background()), "can't connect to example.org:25: failed to create client")
+
+	// unreachable server not answering till the end of context
+	blocked := &blockingTestSMTP{release: make(chan struct{})}
+	defer close(blocked.release)
+	e.smtp = blocked
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.EqualError(t, e.Ping(ctx), "ping of example.org:25 aborted: context deadline exceeded")
+}
+
+func TestEmail_ExtraHeaders(t *testing.T) {
+	params := EmailParams{
+		From:                     "from@example.org",
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "testdata/msg.html.tmpl",
+		TokenGenFn:               TokenGenFn,
+		ExtraHeaders: map[string]string{
+			"x-mailgun-tag":           "comments",
+			"X-SES-CONFIGURATION-SET": "remark42",
+			"subject":                 "overridden",
+			"Content-Type":            "text/plain",
+			"X-Long": "first-segment-of-the-value second-segment-of-the-value " +
+				"third-segment-of-the-value fourth",
+			"X-Unicode": "Комментарии",
+		},
+	}
+	email, err := NewEmail(params, SMTPParams{})
+	require.NoError(t, err)
+	assert.Equal(t, 4, len(email.ExtraHeaders), "reserved headers dropped")
+
+	req := Request{Comment: store.Comment{ID: "999", User: store.User{ID: "1", Name: "test_user"}, Text: "<p>test</p>"}}
+	msg, err := email.buildMessageFromRequest(email.sender(""), req, "test@example.org", false)
+	require.NoError(t, err)
+	headers := msg[:strings.Index(msg, "\n\n")]
+	assert.Contains(t, headers, "\nX-Mailgun-Tag: comments\n")
+	assert.Contains(t, headers, "\nX-Ses-Configuration-Set: remark42\n")
+	assert.Contains(t, headers, "\nX-Long: first-segment-of-the-value second-segment-of-the-value\n "+
+		"third-segment-of-the-value fourth\n", "long value folded")
+	assert.Contains(t, headers, "\nX-Unicode: =?utf-8?b?0JrQvtC80LzQtdC90YLQsNGA0LjQuA==?=\n")
+	assert.Contains(t, headers, "\nSubject: New reply to your comment\n", "reserved header is not overridden")
+	assert.NotContains(t, msg, "overridden")
+	assert.NotContains(t, headers, "text/plain")
+	assert.Equal(t, 1, strings.Count(headers, "\nSubject:"))
+
+	params.ExtraHeaders = map[string]string{"Bad Name": "v"}
+	_, err = NewEmail(params, SMTPParams{})
+	assert.EqualError(t, err, `invalid extra header name "Bad Name"`)
+	params.ExtraHeaders = map[string]string{"X-Tag": "v\r\nBcc: someone@example.com"}
+	_, err = NewEmail(params, SMTPParams{})
+	assert.EqualError(t, err, "invalid value of extra header X-Tag, line breaks are not allowed")
+}
+
+func TestEmail_SendResults(t *testing.T) {
+	email, err := NewEmail(EmailParams{
+		From:                     "from@example.org",
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "testdata/msg.html.tmpl",
+		TokenGenFn:               TokenGenFn,
+		RetryBaseDelay:           time.Millisecond,
+	}, SMTPParams{})
+	require.NoError(t, err)
+	email.smtp = &fakeTestSMTP{}
+
+	results := make(chan SendResult, 10)
+	req := Request{Comment: store.Comment{ID: "999", Locator: store.Locator{SiteID: "remark"}},
+		Emails: []string{"u1@example.org", "bad"}, Results: results}
+	require.Error(t, email.Send(context.Background(), req))
+	require.Equal(t, 2, len(results))
+	res := <-results
+	assert.Equal(t, "<999.remark@example.org>", res.MessageID)
+	assert.Equal(t, "bad", res.To)
+	assert.EqualError(t, res.Err, `invalid recipient address "bad": mail: missing '@' or angle-addr`)
+	assert.Equal(t, SendResult{MessageID: "<999.remark@example.org>", To: "u1@example.org"}, <-results, "success")
+
+	// failed data write
+	email.smtp = &fakeTestSMTP{fail: map[string]bool{"data": true}}
+	req.Emails = []string{"u2@example.org"}
+	require.Error(t, email.Send(context.Background(), req))
+	require.Equal(t, 1, len(results))
+	res = <-results
+	assert.Equal(t, "<999.remark@example.org>", res.MessageID)
+	assert.Equal(t, "u2@example.org", res.To)
+	require.Error(t, res.Err)
+	assert.Contains(t, res.Err.Error(), "failed to send")
+
+	// unread results don't block the send beyond its context
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	email.smtp = &fakeTestSMTP{}
+	req.Comment.ID, req.Results = "1000", make(chan SendResult)
+	assert.NoError(t, email.Send(ctx, req))
+}
+
+func TestEmail_SiteBranding(t *testing.T) {
+	email, err := NewEmail(EmailParams{
+		From:                     "from@example.org",
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "testdata/msg_site.html.tmpl",
+		BaseURL:                  "https://remark42.example.com",
+		SiteBrandings: map[string]SiteBranding{
+			"blog": {Title: "My Blog", LogoURL: "/static/logo.png"},
+			"news": {LogoURL: "https://news.example.com/logo.png"},
+		},
+		TokenGenFn: TokenGenFn,
+	}, SMTPParams{})
+	require.NoError(t, err)
+	htmlPart := func(msg string) string {
+		body, e := ioutil.ReadAll(quotedprintable.NewReader(strings.NewReader(msg[strings.Index(msg, "text/html"):])))
+		require.NoError(t, e)
+		return string(body)
+	}
+
+	tbl := []struct {
+		site, res string
+	}{
+		{"blog", `<p>New comment on My Blog <img src="https://remark42.example.com/static/logo.png"/> (blog)</p>`},
+		{"news", `<p>New comment on news <img src="https://news.example.com/logo.png"/> (news)</p>`},
+		{"unknown", `<p>New comment on unknown (unknown)</p>`},
+	}
+	for _, tt := range tbl {
+		req := Request{Comment: store.Comment{ID: "999", Locator: store.Locator{SiteID: tt.site}}}
+		msg, err := email.buildMessageFromRequest(email.sender(tt.site), req, "test@example.org", false)
+		require.NoError(t, err)
+		assert.Contains(t, htmlPart(msg), tt.res, tt.site)
 	}
 }
 
-func TestEmailSendErrors(t *testing.T) {
-	var err error
-	e := Email{}
-	e.TokenGenFn = TokenGenFn
+func Test_insertPreheader(t *testing.T) {
+	span := func(s string) string {
+		return `<span style="display:none !important;visibility:hidden;mso-hide:all;font-size:1px;line-height:1px;` +
+			`max-height:0;max-width:0;opacity:0;overflow:hidden;">` + s + "</span>"
+	}
+	tbl := []struct {
+		body, preheader, res string
+	}{
+		{"<p>text</p>", "", "<p>text</p>"},
+		{"<p>text</p>", "preview", span("preview") + "<p>text</p>"},
+		{`<html><BODY class="x"><p>text</p></BODY></html>`, "a & b", `<html><BODY class="x">` + span("a &amp; b") + "<p>text</p></BODY></html>"},
+		{"<body", "preview", span("preview") + "<body"},
+	}
+	for i, tt := range tbl {
+		assert.Equal(t, tt.res, insertPreheader(tt.body, tt.preheader), "case #%d", i)
+	}
+}
 
-	e.verifyTmpl, err = template.New("test").Parse("{{.Test}}")
-	assert.NoError(t, err)
-	assert.EqualError(t, e.SendVerification(context.Background(), VerificationRequest{Email: "bad@example.org", Token: "some"}),
-		"error executing template to build verification message: template: test:1:2: executing \"test\" at <.Test>: can't evaluate field Test in type notify.verifyTmplData")
+func TestEmail_SubjectTemplates(t *testing.T) {
+	email, err := NewEmail(EmailParams{
+		From:                        "from@example.org",
+		VerificationTemplatePath:    "testdata/verification.html.tmpl",
+		MsgTemplatePath:             "testdata/msg.html.tmpl",
+		SubjectTemplate:             "{{.UserName}} ответил{{if .PostTitle}} в «{{.PostTitle}}»{{end}}\n",
+		VerificationSubjectTemplate: "Confirm {{.Email}} for {{.Site}}",
+	}, SMTPParams{})
+	require.NoError(t, err)
+	email.TokenGenFn = TokenGenFn
+	req := Request{
+		Comment: store.Comment{ID: "999", User: store.User{ID: "1", Name: "test_user"}, ParentID: "1", PostTitle: "title"},
+		parent:  store.Comment{ID: "1", User: store.User{ID: "999", Name: "parent_user"}},
+	}
+	res, err := email.buildMessageFromRequest(email.sender(req.Comment.Locator.SiteID), req, "test@example.org", false)
+	require.NoError(t, err)
+	assert.Contains(t, res, "\nSubject: "+mime.BEncoding.Encode("utf-8", "test_user ответил в «title»")+"\n")
 
-	e.msgTmpl, err = template.New("test").Parse("{{.Test}}")
-	assert.NoError(t, err)
-	assert.EqualError(t, e.Send(context.Background(), Request{Comment: store.Comment{ID: "999"}, parent: store.Comment{User: store.User{ID: "test"}}, Emails: []string{"bad@example.org"}}),
-		"1 error occurred:\n\t* problem sending user email notification to \"bad@example.org\": "+
-			"error executing template to build comment reply message: "+
-			"template: test:1:2: executing \"test\" at <.Test>: "+
-			"can't evaluate field Test in type notify.msgTmplData\n\n")
+	res, err = email.buildVerificationMessage("user", "test@example.org", "token", "remark")
+	require.NoError(t, err)
+	assert.Contains(t, res, "\nSubject: Confirm test@example.org for remark\n")
 
-	ctx, cancel := context.WithCancel(context.Background())
-	cancel()
-	assert.EqualError(t, e.Send(ctx, Request{Comment: store.Comment{ID: "999"}, parent: store.Comment{User: store.User{ID: "test"}}, Emails: []string{"bad@example.org"}}),
-		"sending email messages about comment \"999\" aborted due to canceled context")
+	email.subjectTmpl, err = template.New("test").Parse("{{.Test}}")
+	require.NoError(t, err)
+	_, err = email.buildMessageFromRequest(email.sender(req.Comment.Locator.SiteID), req, "test@example.org", false)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "error executing template to build comment reply message subject")
 
-	e.smtp = &fakeTestSMTP{}
-	assert.EqualError(t, e.Send(context.Background(), Request{Comment: store.Comment{ID: "999"}, parent: store.Comment{User: store.User{ID: "error"}}, Emails: []string{"bad@example.org"}}),
-		"1 error occurred:\n\t* problem sending user email notification to \"bad@example.org\":"+
-			" error creating token for unsubscribe link: token generation error\n\n")
+	email.verifySubjTmpl, err = template.New("test").Parse("{{.Test}}")
+	require.NoError(t, err)
+	_, err = email.buildVerificationMessage("user", "test@example.org", "token", "remark")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "error executing template to build verification message subject")
 }
 
-func TestEmailSend_ExitConditions(t *testing.T) {
-	email, err := NewEmail(EmailParams{
-		VerificationTemplatePath: "testdata/verification.html.tmpl",
-		MsgTemplatePath:          "testdata/msg.html.tmpl",
-	}, SMTPParams{})
+func TestEmail_VerifyUnsubscribeToken(t *testing.T) {
+	e := Email{}
+	_, _, err := e.VerifyUnsubscribeToken("token", "remark")
+	assert.EqualError(t, err, "unsubscribe token parsing is not configured")
+
+	e.TokenParseFn = func(token string) (userID, email, site string, err error) {
+		switch token {
+		case "good":
+			return "user1", "user1@example.org", "remark", nil
+		case "no-user":
+			return "", "user1@example.org", "remark", nil
+		}
+		return "", "", "", errors.New("bad token")
+	}
+	userID, email, err := e.VerifyUnsubscribeToken("good", "remark")
 	assert.NoError(t, err)
-	assert.NotNil(t, email, "expecting email returned")
-	// prevent triggering e.autoFlush creation
-	emptyRequest := Request{Comment: store.Comment{ID: "999"}}
-	assert.NoError(t, email.Send(context.Background(), emptyRequest),
-		"Message without Emails and AdminEmails is not sent and returns nil")
+	assert.Equal(t, "user1", userID)
+	assert.Equal(t, "user1@example.org", email)
+
+	_, _, err = e.VerifyUnsubscribeToken("good", "other-site")
+	assert.EqualError(t, err, `unsubscribe token issued for site "remark", not "other-site"`)
+	_, _, err = e.VerifyUnsubscribeToken("no-user", "remark")
+	assert.EqualError(t, err, "unsubscribe token has no user or email")
+	_, _, err = e.VerifyUnsubscribeToken("bad", "remark")
+	assert.EqualError(t, err, "can't parse unsubscribe token: bad token")
 }
 
-func TestEmailSendClientError(t *testing.T) {
-	var testSet = []struct {
+func Test_commentHTML(t *testing.T) {
+	tbl := []struct {
 		name string
-		smtp *fakeTestSMTP
-		err  string
+		c    store.Comment
+		res  string
 	}{
-		{name: "failed to verify receiver", smtp: &fakeTestSMTP{fail: map[string]bool{"mail": true}},
-			err: "bad from address \"\": failed to verify sender"},
-		{name: "failed to verify sender", smtp: &fakeTestSMTP{fail: map[string]bool{"rcpt": true}},
-			err: "bad to address \"\": failed to verify receiver"},
-		{name: "failed to close connection", smtp: &fakeTestSMTP{fail: map[string]bool{"quit": true, "close": true}}},
-		{name: "failed to make email writer", smtp: &fakeTestSMTP{fail: map[string]bool{"data": true}},
-			err: "can't make email writer: failed to send"},
+		{"markdown rendered from orig", store.Comment{Orig: "**bold** and [link](https://example.com)"},
+			"<p><strong>bold</strong> and <a href=\"https://example.com\" rel=\"nofollow\">link</a></p>\n"},
+		{"rendered text preferred", store.Comment{Orig: "**orig**", Text: "<p><em>text</em></p>"}, "<p><em>text</em></p>"},
+		{"script and style stripped", store.Comment{Text: `<p>hi<script>alert(1)</script><style>p{}</style></p>`}, "<p>hi</p>"},
+		{"empty", store.Comment{}, ""},
 	}
-	for _, d := range testSet {
-		d := d
-		t.Run(d.name, func(t *testing.T) {
-			e := Email{smtp: d.smtp}
-			if d.err != "" {
-				assert.EqualError(t, e.sendMessage(emailMessage{}), d.err,
-					"expected error for e.sendMessage")
-			} else {
-				assert.NoError(t, e.sendMessage(emailMessage{}),
-					"expected no error for e.sendMessage")
-			}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.res, commentHTML(tt.c))
 		})
 	}
-	e := Email{}
-	e.smtp = nil
-	assert.Error(t, e.sendMessage(emailMessage{}),
-		"nil e.smtp should return error")
-	e.smtp = &fakeTestSMTP{}
-	assert.NoError(t, e.sendMessage(emailMessage{}), "",
-		"no error expected for e.sendMessage in normal flow")
-	e.smtp = &fakeTestSMTP{fail: map[string]bool{"quit": true}}
-	assert.NoError(t, e.sendMessage(emailMessage{}), "",
-		"no error expected for e.sendMessage with failed smtpClient.Quit but successful smtpClient.Close")
-	e.smtp = &fakeTestSMTP{fail: map[string]bool{"create": true}}
-	assert.EqualError(t, e.sendMessage(emailMessage{}), "failed to make smtp Create: failed to create client",
-		"e.send called without smtpClient set returns error")
-}
-
-func TestEmail_DefaultTemplates(t *testing.T) {
-	email, err := NewEmail(EmailParams{}, SMTPParams{})
-	assert.Error(t, err)
-	assert.Nil(t, email)
-	email, err = NewEmail(EmailParams{VerificationTemplatePath: "testdata/verification.html.tmpl"}, SMTPParams{})
-	assert.Error(t, err)
-	assert.Nil(t, email)
 }
 
-func TestEmail_Send(t *testing.T) {
+func TestEmail_SendMarkdownComment(t *testing.T) {
 	email, err := NewEmail(EmailParams{
 		From:                     "from@example.org",
 		VerificationTemplatePath: "testdata/verification.html.tmpl",
 		MsgTemplatePath:          "testdata/msg.html.tmpl",
 	}, SMTPParams{})
-	assert.NoError(t, err)
-	assert.NotNil(t, email)
-	fakeSMTP := fakeTestSMTP{}
-	email.smtp = &fakeSMTP
+	require.NoError(t, err)
 	email.TokenGenFn = TokenGenFn
-	email.UnsubscribeURL = "https://remark42.com/api/v1/email/unsubscribe"
 	req := Request{
-		Comment: store.Comment{ID: "999", User: store.User{ID: "1", Name: "test_user"}, ParentID: "1", PostTitle: "test_title"},
-		parent:  store.Comment{ID: "1", User: store.User{ID: "999", Name: "parent_user"}},
+		Comment: store.Comment{ID: "999", User: store.User{ID: "1", Name: "test_user"}, Orig: "**bold** [link](https://example.com)"},
 		Emails:  []string{"test@example.org"},
 	}
-	assert.NoError(t, email.Send(context.TODO(), req))
-	assert.Equal(t, "from@example.org", fakeSMTP.readMail())
-	assert.Equal(t, 1, fakeSMTP.readQuitCount())
-	assert.Equal(t, "test@example.org", fakeSMTP.readRcpt())
-	// test buildMessageFromRequest separately for message text
-	res, err := email.buildMessageFromRequest(req, req.Emails[0], false)
-	assert.NoError(t, err)
-	assert.Contains(t, res, `From: from@example.org
-To: test@example.org
-Subject: New reply to your comment for "test_title"
-Content-Transfer-Encoding: quoted-printable
-MIME-version: 1.0
-Content-Type: text/html; charset="UTF-8"
-List-Unsubscribe-Post: List-Unsubscribe=One-Click
-List-Unsubscribe: <https://remark42.com/api/v1/email/unsubscribe?site=&tkn=token>
-Date: `)
+	res, err := email.buildMessageFromRequest(email.sender(req.Comment.Locator.SiteID), req, req.Emails[0], false)
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(quotedprintable.NewReader(strings.NewReader(res[strings.Index(res, "text/html"):])))
+	require.NoError(t, err)
+	assert.Contains(t, string(body), `Comment: <p><strong>bold</strong> <a href="https://example.com" rel="nofollow">link</a></p>`)
+	assert.NotContains(t, res, "**bold**")
+}
 
-	// send email to both user and admin, without parent set
-	email.AdminEmails = []string{"admin@example.org"}
-	req = Request{
-		Comment: store.Comment{ID: "999", User: store.User{ID: "1", Name: "test_user"}, PostTitle: "test_title"},
-		Emails:  []string{"test@example.org"},
+func Test_htmlToText(t *testing.T) {
+	tbl := []struct {
+		inp, out string
+	}{
+		{"", ""},
+		{"plain text", "plain text"},
+		{"<p>some <b>bold</b> text</p><p>second\n   paragraph</p>", "some bold text\n\nsecond paragraph"},
+		{"<html><head><title>t</title><style>a {color: #0aa;}</style></head><body><div>body</div></body></html>", "body"},
+		{`<div>see <a href="https://example.com">link</a></div><br/><div>and <a href="mailto:a@example.com">mail</a></div>`,
+			"see link (https://example.com)\n\nand mail"},
+		{"<div>a</div>\n\n\n\n<div></div><div></div><div>b &amp; c</div>", "a\n\nb & c"},
+	}
+	for i, tt := range tbl {
+		tt := tt
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			assert.Equal(t, tt.out, htmlToText(tt.inp))
+		})
 	}
-	assert.NoError(t, email.Send(context.TODO(), req))
-	assert.Equal(t, "from@example.org", fakeSMTP.readMail())
-	assert.Equal(t, 3, fakeSMTP.readQuitCount(), "plus two emails: one for user and one for admin")
-	assert.Equal(t, "admin@example.org", fakeSMTP.readRcpt())
-	res, err = email.buildMessageFromRequest(req, email.AdminEmails[0], true)
-	assert.NoError(t, err)
-	assert.Contains(t, res, `From: from@example.org
-To: admin@example.org
-Subject: New comment to your site for "test_title"
-Content-Transfer-Encoding: quoted-printable
-MIME-version: 1.0
-Content-Type: text/html; charset="UTF-8"
-Date: `)
 }
 
 func TestEmail_SendWithUnicodeInSubject(t *testing.T) {
@@ -268,18 +2085,17 @@ func TestEmail_SendWithUnicodeInSubject(t *testing.T) {
 		Emails:  []string{"test@example.org"},
 	}
 	// test buildMessageFromRequest separately for message text
-	res, err := email.buildMessageFromRequest(req, req.Emails[0], false)
+	res, err := email.buildMessageFromRequest(email.sender(req.Comment.Locator.SiteID), req, req.Emails[0], false)
 	assert.NoError(t, err)
 	// `=?utf-8?b?TmV3IHJlcGx5IHRvIHlvdXIgY29tbWVudCBmb3IgItCf0YDQuNCy0LXRgiI=?=` -> `New reply to your comment for "Привет"` in base64 + required prefix and suffix
 	assert.Contains(t, res, `From: from@example.org
 To: test@example.org
 Subject: =?utf-8?b?TmV3IHJlcGx5IHRvIHlvdXIgY29tbWVudCBmb3IgItCf0YDQuNCy0LXRgiI=?=
-Content-Transfer-Encoding: quoted-printable
+Message-ID: <999@example.org>
+In-Reply-To: <1@example.org>
+References: <1@example.org>
 MIME-version: 1.0
-Content-Type: text/html; charset="UTF-8"
-List-Unsubscribe-Post: List-Unsubscribe=One-Click
-List-Unsubscribe: <https://remark42.com/api/v1/email/unsubscribe?site=&tkn=token>
-Date: `)
+Content-Type: multipart/alternative; boundary="remark42-`)
 }
 
 func TestEmail_SendVerification(t *testing.T) {
@@ -326,8 +2142,15 @@ Content-Transfer-Encoding: quoted-printable
 MIME-version: 1.0
 Content-Type: text/html; charset="UTF-8"
 Date: `)
+	date := regexp.MustCompile(`\nDate: (.+)\n\n`).FindStringSubmatch(res)
+	require.Equal(t, 2, len(date), "date header before the body")
+	ts, err := time.Parse(time.RFC1123Z, date[1])
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), ts, 2*time.Second, "current time used for verification message")
 	assert.Contains(t, res, `secret_`)
+	assert.Contains(t, res, `Expires in 30 minutes`, "default verification TTL")
 	assert.NotContains(t, res, `https://example.org/`)
+	assert.NotContains(t, res, "List-Unsubscribe", "verification email has no unsubscribe headers")
 	email.SubscribeURL = "https://example.org/subscribe.html?token="
 	res, err = email.buildVerificationMessage(req.User, req.Email, req.Token, req.SiteID)
 	assert.NoError(t, err)
@@ -341,6 +2164,171 @@ Date: `)
 	assert.Contains(t, res, `https://example.org/subscribe.html?token=3Dsecret_`)
 }
 
+func TestEmail_CheckVerificationExpiry(t *testing.T) {
+	email, err := NewEmail(EmailParams{
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "testdata/msg.html.tmpl",
+		VerificationTTL:          2 * time.Hour,
+	}, SMTPParams{})
+	require.NoError(t, err)
+
+	res, err := email.buildVerificationMessage("user", "test@example.org", "token", "remark")
+	require.NoError(t, err)
+	assert.Contains(t, res, "Expires in 2 hours")
+
+	assert.NoError(t, email.CheckVerificationExpiry(time.Now().Add(time.Minute)))
+	assert.NoError(t, email.CheckVerificationExpiry(time.Now().Add(-30*time.Second)), "within clock skew grace period")
+	expiredAt := time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC)
+	assert.EqualError(t, email.CheckVerificationExpiry(expiredAt), "verification token expired at 2020-05-01T10:00:00Z")
+	assert.Error(t, email.CheckVerificationExpiry(time.Now().Add(-2*time.Minute)))
+}
+
+func Test_humanDuration(t *testing.T) {
+	tbl := []struct {
+		d   time.Duration
+		res string
+	}{
+		{30 * time.Minute, "30 minutes"},
+		{time.Minute, "1 minute"},
+		{time.Hour, "1 hour"},
+		{48 * time.Hour, "48 hours"},
+		{90 * time.Minute, "90 minutes"},
+		{100 * time.Second, "2 minutes"},
+	}
+	for _, tt := range tbl {
+		assert.Equal(t, tt.res, humanDuration(tt.d), tt.d.String())
+	}
+}
+
+func TestEmail_NewWithStartTLS(t *testing.T) {
+	emailParams := EmailParams{VerificationTemplatePath: "testdata/verification.html.tmpl", MsgTemplatePath: "testdata/msg.html.tmpl"}
+	email, err := NewEmail(emailParams, SMTPParams{Host: "example.org", Port: 587, StartTLS: true})
+	require.NoError(t, err)
+	assert.True(t, email.StartTLS)
+
+	_, err = NewEmail(emailParams, SMTPParams{Host: "example.org", Port: 587, TLS: true, StartTLS: true})
+	assert.EqualError(t, err, "can't use TLS and StartTLS at the same time")
+}
+
+func Test_initClient(t *testing.T) {
+	tlsConf := &tls.Config{ServerName: "example.org", MinVersion: tls.VersionTLS12}
+
+	// plain connection, no credentials
+	fake := &fakeTestSMTP{}
+	assert.NoError(t, initClient(fake, SMTPParams{Host: "example.org", Port: 25}, tlsConf))
+	assert.Nil(t, fake.startTLS, "no STARTTLS for plain connection")
+	assert.False(t, fake.auth)
+
+	// implicit TLS connection is already encrypted, no STARTTLS needed
+	fake = &fakeTestSMTP{}
+	assert.NoError(t, initClient(fake, SMTPParams{Host: "example.org", Port: 465, TLS: true, Username: "u", Password: "p"}, tlsConf))
+	assert.Nil(t, fake.startTLS, "no STARTTLS for implicit TLS connection")
+	assert.True(t, fake.auth)
+
+	// STARTTLS upgrade before authentication
+	fake = &fakeTestSMTP{}
+	assert.NoError(t, initClient(fake, SMTPParams{Host: "example.org", Port: 587, StartTLS: true, Username: "u", Password: "p"}, tlsConf))
+	assert.Equal(t, tlsConf, fake.startTLS)
+	assert.True(t, fake.auth)
+
+	// failed STARTTLS prevents authentication
+	fake = &fakeTestSMTP{fail: map[string]bool{"starttls": true}}
+	err := initClient(fake, SMTPParams{Host: "example.org", Port: 587, StartTLS: true, Username: "u", Password: "p"}, tlsConf)
+	assert.EqualError(t, err, "failed to start tls with smtp example.org:587: failed to start tls")
+	assert.False(t, fake.auth, "no auth over plain connection")
+}
+
+func Test_initClientAuthMethods(t *testing.T) {
+	tlsConf := &tls.Config{ServerName: "example.org", MinVersion: tls.VersionTLS12}
+	params := SMTPParams{Host: "example.org", Port: 587, Username: "u", Password: "p"}
+
+	fake := &fakeTestSMTP{}
+	assert.NoError(t, initClient(fake, params, tlsConf))
+	assert.Equal(t, "PLAIN", fake.authMech, "plain is default")
+	assert.Equal(t, "\x00u\x00p", string(fake.authResp))
+
+	fake = &fakeTestSMTP{}
+	params.AuthMethod = AuthMethodLogin
+	assert.NoError(t, initClient(fake, params, tlsConf))
+	assert.Equal(t, "LOGIN", fake.authMech)
+	assert.Nil(t, fake.authResp)
+
+	fake = &fakeTestSMTP{}
+	params.AuthMethod = AuthMethodXOAuth2
+	params.Password = ""
+	params.AccessTokenFn = func() (string, error) { return "token123", nil }
+	assert.NoError(t, initClient(fake, params, tlsConf))
+	assert.Equal(t, "XOAUTH2", fake.authMech)
+	assert.Equal(t, "user=u\x01auth=Bearer token123\x01\x01", string(fake.authResp))
+
+	fake = &fakeTestSMTP{}
+	params.AccessTokenFn = func() (string, error) { return "", errors.New("token expired") }
+	err := initClient(fake, params, tlsConf)
+	assert.EqualError(t, err, "failed to get access token for smtp: token expired")
+	assert.False(t, fake.auth)
+}
+
+func Test_initClientLocalName(t *testing.T) {
+	tlsConf := &tls.Config{ServerName: "example.org", MinVersion: tls.VersionTLS12}
+
+	fake := &fakeTestSMTP{}
+	assert.NoError(t, initClient(fake, SMTPParams{Host: "example.org", Port: 25}, tlsConf))
+	assert.Equal(t, "", fake.hello, "default greeting without LocalName")
+
+	fake = &fakeTestSMTP{}
+	params := SMTPParams{Host: "example.org", Port: 587, StartTLS: true, Username: "u", Password: "p", LocalName: "mail.remark42.com"}
+	assert.NoError(t, initClient(fake, params, tlsConf))
+	assert.Equal(t, "mail.remark42.com", fake.hello)
+	assert.True(t, fake.auth)
+
+	fake = &fakeTestSMTP{fail: map[string]bool{"hello": true}}
+	err := initClient(fake, params, tlsConf)
+	assert.EqualError(t, err, "failed to greet smtp example.org:587 as mail.remark42.com: failed to greet")
+	assert.Nil(t, fake.startTLS)
+	assert.False(t, fake.auth)
+}
+
+func Test_loginAuth(t *testing.T) {
+	a := &loginAuth{username: "u", password: "p", host: "example.org"}
+	_, _, err := a.Start(&smtp.ServerInfo{Name: "example.org"})
+	assert.EqualError(t, err, "unencrypted connection")
+	_, _, err = a.Start(&smtp.ServerInfo{Name: "other.org", TLS: true})
+	assert.EqualError(t, err, "wrong host name")
+
+	resp, err := a.Next([]byte("Username:"), true)
+	assert.NoError(t, err)
+	assert.Equal(t, "u", string(resp))
+	resp, err = a.Next([]byte("Password:"), true)
+	assert.NoError(t, err)
+	assert.Equal(t, "p", string(resp))
+	_, err = a.Next([]byte("Something:"), true)
+	assert.EqualError(t, err, `unexpected server challenge "Something:"`)
+	resp, err = a.Next(nil, false)
+	assert.NoError(t, err)
+	assert.Nil(t, resp)
+}
+
+func Test_xoauth2Auth(t *testing.T) {
+	a := &xoauth2Auth{username: "u", token: "token123"}
+	_, _, err := a.Start(&smtp.ServerInfo{Name: "example.org"})
+	assert.EqualError(t, err, "unencrypted connection", "token is not sent over plain connection")
+
+	mech, resp, err := a.Start(&smtp.ServerInfo{Name: "example.org", TLS: true})
+	require.NoError(t, err)
+	assert.Equal(t, "XOAUTH2", mech)
+	assert.Equal(t, "user=u\x01auth=Bearer token123\x01\x01", string(resp))
+
+	_, _, err = a.Start(&smtp.ServerInfo{Name: "localhost"})
+	assert.NoError(t, err, "plain connection to localhost allowed")
+}
+
+func TestEmail_NewWithAuthMethod(t *testing.T) {
+	_, err := NewEmail(EmailParams{}, SMTPParams{AuthMethod: "cram-md5"})
+	assert.EqualError(t, err, `unsupported smtp authentication method "cram-md5"`)
+	_, err = NewEmail(EmailParams{}, SMTPParams{AuthMethod: AuthMethodXOAuth2})
+	assert.EqualError(t, err, "access token provider is required for xoauth2 authentication")
+}
+
 func Test_emailClient_Create(t *testing.T) {
 	creator := emailClient{}
 	client, err := creator.Create(SMTPParams{})
@@ -348,12 +2336,184 @@ func Test_emailClient_Create(t *testing.T) {
 	assert.Nil(t, client, "no client returned in case of error")
 }
 
+func Test_emailClient_SendTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	// server accepts message body, but never replies to its end
+	go func() {
+		conn, e := ln.Accept()
+		if e != nil {
+			return
+		}
+		defer conn.Close()
+		tp := textproto.NewConn(conn)
+		_ = tp.PrintfLine("220 localhost ESMTP")
+		inData := false
+		for {
+			line, e := tp.ReadLine()
+			if e != nil {
+				return
+			}
+			switch {
+			case inData:
+			case strings.HasPrefix(line, "EHLO"):
+				_ = tp.PrintfLine("250 localhost")
+			case strings.HasPrefix(line, "DATA"):
+				_ = tp.PrintfLine("354 go ahead")
+				inData = true
+			default:
+				_ = tp.PrintfLine("250 ok")
+			}
+		}
+	}()
+
+	port := ln.Addr().(*net.TCPAddr).Port
+	client, err := (&emailClient{}).Create(SMTPParams{Host: "127.0.0.1", Port: port, ConnectTimeout: time.Second,
+		SendTimeout: 100 * time.Millisecond})
+	require.NoError(t, err)
+	defer client.Close()
+
+	require.NoError(t, client.Mail("from@example.org"))
+	require.NoError(t, client.Rcpt("to@example.org"))
+	st := time.Now()
+	err = writeData(client, "Subject: test\n\nbody")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "i/o timeout")
+	assert.True(t, time.Since(st) < time.Second, "stalled write aborted after send timeout, took %v", time.Since(st))
+}
+
+func Test_emailClient_CreateTLS(t *testing.T) {
+	// httptest TLS server provides self-signed certificate for 127.0.0.1
+	hts := httptest.NewTLSServer(http.NotFoundHandler())
+	certs := hts.TLS.Certificates
+	hts.Close()
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: certs, MinVersion: tls.VersionTLS12})
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, e := ln.Accept()
+			if e != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				tp := textproto.NewConn(conn)
+				if e := tp.PrintfLine("220 localhost ESMTP"); e != nil {
+					return
+				}
+				for {
+					line, e := tp.ReadLine()
+					if e != nil {
+						return
+					}
+					if strings.HasPrefix(line, "QUIT") {
+						_ = tp.PrintfLine("221 bye")
+						return
+					}
+					_ = tp.PrintfLine("250 localhost")
+				}
+			}()
+		}
+	}()
+
+	port := ln.Addr().(*net.TCPAddr).Port
+	params := SMTPParams{Host: "127.0.0.1", Port: port, TLS: true, ConnectTimeout: time.Second, SendTimeout: time.Second}
+	_, err = (&emailClient{}).Create(params)
+	require.Error(t, err, "self-signed certificate rejected by default")
+	assert.Contains(t, err.Error(), "failed to dial smtp tls")
+
+	params.InsecureSkipVerify = true
+	client, err := (&emailClient{}).Create(params)
+	require.NoError(t, err, "self-signed certificate allowed with InsecureSkipVerify")
+	assert.NoError(t, client.Quit())
+}
+
+func Test_emailClient_CreateProxy(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		conn, e := ln.Accept()
+		if e != nil {
+			return
+		}
+		defer conn.Close()
+		tp := textproto.NewConn(conn)
+		_ = tp.PrintfLine("220 localhost ESMTP")
+		for {
+			line, e := tp.ReadLine()
+			if e != nil {
+				return
+			}
+			if strings.HasPrefix(line, "QUIT") {
+				_ = tp.PrintfLine("221 bye")
+				return
+			}
+			_ = tp.PrintfLine("250 localhost")
+		}
+	}()
+	proxy := startConnectProxy(t, "")
+	defer proxy.close()
+
+	var forwarded []string
+	dial, err := ProxyDialer("http://"+proxy.addr, func(ctx context.Context, network, addr string) (net.Conn, error) {
+		forwarded = append(forwarded, addr)
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	})
+	require.NoError(t, err)
+
+	port := ln.Addr().(*net.TCPAddr).Port
+	client, err := (&emailClient{dial: dial}).Create(SMTPParams{Host: "127.0.0.1", Port: port, ConnectTimeout: time.Second})
+	require.NoError(t, err)
+	require.NoError(t, client.Mail("from@example.org"))
+	assert.NoError(t, client.Quit())
+	assert.Equal(t, []string{proxy.addr}, forwarded)
+	assert.Equal(t, []string{ln.Addr().String()}, proxy.targets())
+
+	emailParams := EmailParams{VerificationTemplatePath: "testdata/verification.html.tmpl", MsgTemplatePath: "testdata/msg.html.tmpl"}
+	_, err = NewEmail(emailParams, SMTPParams{Host: "127.0.0.1", Port: port, Proxy: "ftp://" + proxy.addr})
+	assert.EqualError(t, err, `can't make smtp proxy dialer: unsupported proxy scheme "ftp", socks5 or http expected`)
+	e, err := NewEmail(emailParams, SMTPParams{Host: "127.0.0.1", Port: port, Proxy: "socks5://" + proxy.addr})
+	require.NoError(t, err)
+	assert.NotNil(t, e.smtp.(*emailClient).dial)
+}
+
+func TestSMTPParams_tlsConfig(t *testing.T) {
+	conf := SMTPParams{Host: "smtp.example.org"}.tlsConfig()
+	assert.Equal(t, "smtp.example.org", conf.ServerName)
+	assert.Equal(t, uint16(tls.VersionTLS12), conf.MinVersion)
+	assert.False(t, conf.InsecureSkipVerify)
+
+	conf = SMTPParams{Host: "10.0.0.1", TLSServerName: "relay.internal", MinTLSVersion: tls.VersionTLS13,
+		InsecureSkipVerify: true}.tlsConfig()
+	assert.Equal(t, "relay.internal", conf.ServerName)
+	assert.Equal(t, uint16(tls.VersionTLS13), conf.MinVersion)
+	assert.True(t, conf.InsecureSkipVerify)
+
+	_, err := NewEmail(EmailParams{}, SMTPParams{Host: "example.org", MinTLSVersion: 0x0200})
+	assert.EqualError(t, err, "unsupported minimal tls version 0x200")
+}
+
 type fakeTestSMTP struct {
-	fail map[string]bool
+	fail    map[string]bool
+	failErr error // error returned on failure, default one used if nil
 
 	buff       bytes.Buffer
 	mail, rcpt string
+	hello      string // name sent with Hello
 	auth       bool
+	authMech   string // mechanism used for authentication
+	authResp   []byte // initial authentication response
+	startTLS   *tls.Config
+	resetCount int
+	rcpts      []string // all recipients
+	mails      []string // all senders
+	badRcpt    string   // recipient failing Rcpt
+	dataCount  int
 	close      bool
 	quitCount  int
 	lock       sync.RWMutex
@@ -366,11 +2526,37 @@ func (f *fakeTestSMTP) Create(SMTPParams) (smtpClient, error) {
 	return f, nil
 }
 
-func (f *fakeTestSMTP) Auth(smtp.Auth) error { f.auth = true; return nil }
+func (f *fakeTestSMTP) Hello(name string) error {
+	f.lock.Lock()
+	f.hello = name
+	f.lock.Unlock()
+	if f.fail["hello"] {
+		return errors.New("failed to greet")
+	}
+	return nil
+}
+
+func (f *fakeTestSMTP) Auth(a smtp.Auth) error {
+	mech, resp, err := a.Start(&smtp.ServerInfo{Name: "example.org", TLS: true})
+	if err != nil {
+		return err
+	}
+	f.auth, f.authMech, f.authResp = true, mech, resp
+	return nil
+}
+
+func (f *fakeTestSMTP) StartTLS(conf *tls.Config) error {
+	f.startTLS = conf
+	if f.fail["starttls"] {
+		return errors.New("failed to start tls")
+	}
+	return nil
+}
 
 func (f *fakeTestSMTP) Mail(m string) error {
 	f.lock.Lock()
 	f.mail = m
+	f.mails = append(f.mails, m)
 	f.lock.Unlock()
 	if f.fail["mail"] {
 		return errors.New("failed to verify sender")
@@ -381,13 +2567,43 @@ func (f *fakeTestSMTP) Mail(m string) error {
 func (f *fakeTestSMTP) Rcpt(r string) error {
 	f.lock.Lock()
 	f.rcpt = r
+	f.rcpts = append(f.rcpts, r)
 	f.lock.Unlock()
+	if f.badRcpt != "" && f.badRcpt == r {
+		return errors.New("no such recipient")
+	}
 	if f.fail["rcpt"] {
+		if f.failErr != nil {
+			return f.failErr
+		}
 		return errors.New("failed to verify receiver")
 	}
 	return nil
 }
 
+func (f *fakeTestSMTP) Reset() error {
+	f.lock.Lock()
+	f.resetCount++
+	f.lock.Unlock()
+	if f.fail["reset"] {
+		return errors.New("failed to reset")
+	}
+	return nil
+}
+
+func (f *fakeTestSMTP) readResetCount() int {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	return f.resetCount
+}
+
+func (f *fakeTestSMTP) Noop() error {
+	if f.fail["noop"] {
+		return errors.New("failed to noop")
+	}
+	return nil
+}
+
 func (f *fakeTestSMTP) Quit() error {
 	f.lock.Lock()
 	f.quitCount++
@@ -407,6 +2623,9 @@ func (f *fakeTestSMTP) Close() error {
 }
 
 func (f *fakeTestSMTP) Data() (io.WriteCloser, error) {
+	f.lock.Lock()
+	f.dataCount++
+	f.lock.Unlock()
 	if f.fail["data"] {
 		return nil, errors.New("failed to send")
 	}
@@ -431,6 +2650,32 @@ func (f *fakeTestSMTP) readQuitCount() int {
 	return f.quitCount
 }
 
+// flakySMTPCreator fails to create client given number of times before succeeding
+type flakySMTPCreator struct {
+	failures int
+	err      error
+	smtp     smtpClientCreator
+	attempts int
+	lock     sync.Mutex
+}
+
+func (f *flakySMTPCreator) Create(params SMTPParams) (smtpClient, error) {
+	f.lock.Lock()
+	f.attempts++
+	failed := f.attempts <= f.failures
+	f.lock.Unlock()
+	if failed {
+		return nil, f.err
+	}
+	return f.smtp.Create(params)
+}
+
+func (f *flakySMTPCreator) readAttempts() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.attempts
+}
+
 func TokenGenFn(user, _, _ string) (string, error) {
 	if user == "error" {
 		return "", errors.New("token generation error")
@@ -445,3 +2690,13 @@ type nopCloser struct {
 func (nopCloser) Close() error {
 	return nil
 }
+
+// blockingTestSMTP is smtp client creator blocked till release is closed
+type blockingTestSMTP struct {
+	release chan struct{}
+}
+
+func (b *blockingTestSMTP) Create(SMTPParams) (smtpClient, error) {
+	<-b.release
+	return nil, errors.New("connection timed out")
+}
@@ -0,0 +1,50 @@
+package notify
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// footerSeparator separates footer from the text of plain message, same as signature separator
+// so mail clients can leave the footer out of quoted text on reply
+const footerSeparator = "\n\n-- \n"
+
+// footerTmplData store data for EmailParams.FooterTemplate execution
+type footerTmplData struct {
+	SiteID          string
+	SiteTitle       string // site name from SiteBrandings, SiteID if not set
+	SiteLogoURL     string // absolute URL of site logo from SiteBrandings, empty if not set
+	Email           string // recipient of the message
+	UnsubscribeLink string // empty for verification and admin messages
+}
+
+// footer renders EmailParams.FooterTemplate for the message to the recipient, empty if the template is not set
+func (e *Email) footer(siteID, email, unsubscribeLink string) (string, error) {
+	if e.footerTmpl == nil {
+		return "", nil
+	}
+	data := footerTmplData{SiteID: siteID, Email: email, UnsubscribeLink: unsubscribeLink}
+	data.SiteTitle, data.SiteLogoURL = e.branding(siteID)
+	res := bytes.Buffer{}
+	if err := e.footerTmpl.Execute(&res, data); err != nil {
+		return "", errors.Wrapf(err, "error executing template to build footer for %q", email)
+	}
+	return strings.TrimSpace(res.String()), nil
+}
+
+// withFooter returns html body with the footer inserted before the closing body tag (or at the end without it)
+// and plain text with the footer text appended after the separator
+func withFooter(htmlBody, plain, footer string) (resHTML, resPlain string) {
+	if footer == "" {
+		return htmlBody, plain
+	}
+	pos := len(htmlBody)
+	if end := strings.LastIndex(strings.ToLower(htmlBody), "</body"); end >= 0 {
+		pos = end
+	}
+	resHTML = htmlBody[:pos] + footer + "\n" + htmlBody[pos:]
+	resPlain = strings.TrimRight(plain, "\n") + footerSeparator + htmlToText(footer)
+	return resHTML, resPlain
+}
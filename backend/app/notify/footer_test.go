@@ -0,0 +1,92 @@
+package notify
+
+import (
+	"io/ioutil"
+	"mime/quotedprintable"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/remark42/backend/app/store"
+)
+
+func TestEmail_Footer(t *testing.T) {
+	email, err := NewEmail(EmailParams{
+		From:                     "from@example.org",
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "testdata/msg.html.tmpl",
+		FooterTemplate: `<p class="footer">{{.SiteTitle}}, 1 Main St. <a href="https://example.com/privacy">Privacy</a>` +
+			`{{if .UnsubscribeLink}} <a href="{{.UnsubscribeLink}}">Unsubscribe</a>{{end}}</p>`,
+		SiteBrandings:  map[string]SiteBranding{"remark": {Title: "Example Blog"}},
+		UnsubscribeURL: "https://remark42.com/api/v1/email/unsubscribe",
+		TokenGenFn:     TokenGenFn,
+	}, SMTPParams{})
+	require.NoError(t, err)
+	req := Request{
+		Comment: store.Comment{ID: "999", User: store.User{ID: "1", Name: "test_user"}, ParentID: "1", Text: "some comment",
+			Locator: store.Locator{SiteID: "remark", URL: "https://example.com/post"}},
+		parent: store.Comment{ID: "1", User: store.User{ID: "999", Name: "parent_user"}},
+	}
+	decode := func(part string) string {
+		res, err := ioutil.ReadAll(quotedprintable.NewReader(strings.NewReader(part)))
+		require.NoError(t, err)
+		return string(res)
+	}
+
+	// html format, footer at the end of html part as test template has no body tag, and after separator in plain part
+	res, err := email.buildMessageFromRequest(email.sender("remark"), req, "test@example.org", false)
+	require.NoError(t, err)
+	htmlPart := decode(res[strings.Index(res, "text/html"):])
+	assert.Contains(t, htmlPart, `<p class="footer">Example Blog, 1 Main St. <a href="https://example.com/privacy">Privacy</a>`+
+		` <a href="https://remark42.com/api/v1/email/unsubscribe?site=remark&tkn=token">Unsubscribe</a></p>`)
+	plainPart := decode(res[strings.Index(res, "text/plain"):strings.Index(res, "text/html")])
+	assert.Contains(t, plainPart, "\r\n-- \r\nExample Blog, 1 Main St. Privacy (https://example.com/privacy)")
+
+	// text format
+	email.Format = EmailFormatText
+	res, err = email.buildMessageFromRequest(email.sender("remark"), req, "test@example.org", false)
+	require.NoError(t, err)
+	assert.Contains(t, decode(res), "\r\n-- \r\nExample Blog, 1 Main St. Privacy (https://example.com/privacy)")
+	assert.NotContains(t, res, `<p class="footer">`)
+
+	// verification message, without unsubscribe link
+	res, err = email.buildVerificationMessage("user", "test@example.org", "token", "remark")
+	require.NoError(t, err)
+	verification := decode(res)
+	assert.Contains(t, verification, `<p class="footer">Example Blog, 1 Main St. <a href="https://example.com/privacy">Privacy</a></p>`)
+	assert.NotContains(t, verification, "Unsubscribe")
+
+	// no footer without template
+	email.footerTmpl = nil
+	res, err = email.buildVerificationMessage("user", "test@example.org", "token", "remark")
+	require.NoError(t, err)
+	assert.NotContains(t, res, "footer")
+
+	_, err = NewEmail(EmailParams{
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "testdata/msg.html.tmpl",
+		FooterTemplate:           "{{.SiteTitle",
+	}, SMTPParams{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "can't parse footer template")
+}
+
+func TestWithFooter(t *testing.T) {
+	tbl := []struct {
+		html, plain, footer string
+		resHTML, resPlain   string
+	}{
+		{"<html><body><p>msg</p></body></html>", "msg\n", "<p>footer</p>",
+			"<html><body><p>msg</p><p>footer</p>\n</body></html>", "msg\n\n-- \nfooter"},
+		{"<p>msg</p>", "msg", "<b>footer</b>", "<p>msg</p><b>footer</b>\n", "msg\n\n-- \nfooter"},
+		{"<BODY>msg</BODY>", "msg", "f", "<BODY>msgf\n</BODY>", "msg\n\n-- \nf"},
+		{"<p>msg</p>", "msg", "", "<p>msg</p>", "msg"},
+	}
+	for i, tt := range tbl {
+		resHTML, resPlain := withFooter(tt.html, tt.plain, tt.footer)
+		assert.Equal(t, tt.resHTML, resHTML, "html #%d", i)
+		assert.Equal(t, tt.resPlain, resPlain, "plain #%d", i)
+	}
+}
@@ -0,0 +1,108 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/pkg/errors"
+)
+
+// defaults of destinations posting to webhooks and HTTP APIs: discord, mattermost, pushover and slack
+const (
+	hookTimeOut    = 5000 * time.Millisecond
+	hookMaxRetries = 3
+)
+
+// hookRequest is a single POST request of destination to webhook or HTTP API
+type hookRequest struct {
+	name        string      // destination name used in errors, i.e. "slack"
+	url         string      // request URL
+	contentType string      // content type of the body
+	header      http.Header // additional headers, optional
+	body        []byte      // request body
+	timeout     time.Duration
+	// check is called with response of any status but 429 to check its body, optional.
+	// Non-2xx status is an error if check doesn't return one.
+	check func(resp *http.Response) error
+}
+
+// postHook makes the request and checks its response, returns delay requested for rate limited one,
+// so it can be retried with retryAttempts. The delay is taken from Retry-After header or retry_after field
+// of JSON body in seconds, 1s if neither is set. Response body is drained and closed.
+func postHook(ctx context.Context, req hookRequest) (retryAfter time.Duration, err error) {
+	ctx, cancel := context.WithTimeout(ctx, req.timeout)
+	defer cancel()
+	r, err := http.NewRequest("POST", req.url, bytes.NewReader(req.body))
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to make %s request", req.name)
+	}
+	for k, v := range req.header {
+		r.Header[k] = v
+	}
+	r.Header.Set("Content-Type", req.contentType)
+
+	resp, err := http.DefaultClient.Do(r.WithContext(ctx))
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to get %s response", req.name)
+	}
+	defer func() {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		if err := resp.Body.Close(); err != nil {
+			log.Printf("[WARN] can't close response body, %s", err)
+		}
+	}()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return hookRetryAfter(resp), errors.Errorf("%s rate limit exceeded", req.name)
+	}
+	if req.check != nil {
+		if err = req.check(resp); err != nil {
+			return 0, err
+		}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return 0, errors.Errorf("unexpected %s status code %d", req.name, resp.StatusCode)
+	}
+	return 0, nil
+}
+
+// hookRetryAfter returns delay requested by rate limited response
+func hookRetryAfter(resp *http.Response) time.Duration {
+	if sec, err := strconv.ParseFloat(resp.Header.Get("Retry-After"), 64); err == nil && sec > 0 {
+		return time.Duration(sec * float64(time.Second))
+	}
+	rateResp := struct {
+		RetryAfter float64 `json:"retry_after"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&rateResp); err == nil && rateResp.RetryAfter > 0 {
+		return time.Duration(rateResp.RetryAfter * float64(time.Second))
+	}
+	return time.Second
+}
+
+// hookDestination implements Ping, SendVerification and Close doing nothing, for destinations posting
+// to webhooks and HTTP APIs. They can't be checked without posting a message, don't verify users
+// and have no pending notifications or resources to release.
+type hookDestination struct{}
+
+// Ping does nothing
+func (hookDestination) Ping(context.Context) error {
+	return nil
+}
+
+// SendVerification does nothing
+func (hookDestination) SendVerification(context.Context, VerificationRequest) error {
+	return nil
+}
+
+// Close does nothing
+func (hookDestination) Close(context.Context) error {
+	return nil
+}
@@ -0,0 +1,94 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPostHook(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "POST", r.Method)
+		assert.Equal(t, "text/plain", r.Header.Get("Content-Type"))
+		assert.Equal(t, "value", r.Header.Get("X-Test"))
+		b, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "body", string(b))
+		switch r.URL.Path {
+		case "/created":
+			w.WriteHeader(http.StatusCreated)
+		case "/bad":
+			w.WriteHeader(http.StatusBadRequest)
+		case "/limited-header":
+			w.Header().Set("Retry-After", "1.5")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case "/limited-body":
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = w.Write([]byte(`{"message":"You are being rate limited.","retry_after":0.3}`))
+		case "/limited":
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer ts.Close()
+
+	req := func(path string) hookRequest {
+		return hookRequest{name: "test", url: ts.URL + path, contentType: "text/plain",
+			header: http.Header{"X-Test": {"value"}}, body: []byte("body"), timeout: time.Second}
+	}
+
+	retryAfter, err := postHook(context.Background(), req("/created"))
+	assert.NoError(t, err, "any 2xx status accepted")
+	assert.Equal(t, time.Duration(0), retryAfter)
+
+	_, err = postHook(context.Background(), req("/bad"))
+	assert.EqualError(t, err, "unexpected test status code 400")
+
+	retryAfter, err = postHook(context.Background(), req("/limited-header"))
+	assert.EqualError(t, err, "test rate limit exceeded")
+	assert.Equal(t, 1500*time.Millisecond, retryAfter)
+	retryAfter, err = postHook(context.Background(), req("/limited-body"))
+	assert.EqualError(t, err, "test rate limit exceeded")
+	assert.Equal(t, 300*time.Millisecond, retryAfter)
+	retryAfter, err = postHook(context.Background(), req("/limited"))
+	assert.EqualError(t, err, "test rate limit exceeded")
+	assert.Equal(t, time.Second, retryAfter, "default delay")
+
+	// check gets responses of any status but 429, its error is returned
+	hr := req("/bad")
+	var checked []int
+	hr.check = func(resp *http.Response) error {
+		checked = append(checked, resp.StatusCode)
+		return errors.New("check failed")
+	}
+	_, err = postHook(context.Background(), hr)
+	assert.EqualError(t, err, "check failed")
+	hr.url = ts.URL + "/limited"
+	_, err = postHook(context.Background(), hr)
+	assert.EqualError(t, err, "test rate limit exceeded")
+	assert.Equal(t, []int{http.StatusBadRequest}, checked)
+
+	hr = req("/")
+	hr.url = ts.URL + "/\x7f"
+	_, err = postHook(context.Background(), hr)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to make test request")
+
+	hr.url = "http://127.0.0.1:1"
+	_, err = postHook(context.Background(), hr)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to get test response")
+}
+
+func TestHookDestination(t *testing.T) {
+	var d hookDestination
+	assert.NoError(t, d.Ping(context.Background()))
+	assert.NoError(t, d.SendVerification(context.Background(), VerificationRequest{}))
+	assert.NoError(t, d.Close(context.Background()))
+}
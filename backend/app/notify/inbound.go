@@ -0,0 +1,243 @@
+package notify
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/umputun/remark42/backend/app/store"
+)
+
+// maxInboundParts limits number of parts checked in inbound multipart message, including nested ones
+const maxInboundParts = 32
+
+var (
+	// attribution line added by mail clients above the quote, i.e. "On Mon, 2 Jan 2006 at 15:04, Name <a@b.c> wrote:"
+	replyAttributionRe = regexp.MustCompile(`(?i)^on\s.+\swrote:$`)
+	replyOutlookRe     = regexp.MustCompile(`(?i)^-{2,}\s*original message\s*-{2,}$`)
+)
+
+// ParseInboundReply parses raw MIME message sent as a reply to the notification email and makes
+// EventReply request with the reply comment. Parent comment and site are taken from In-Reply-To header
+// (or the last References entry) made by Email for the notification, Orig of the comment is the reply body
+// above the quoted notification. Reply should be sent to the address with token of InboundReplyToken
+// for the parent comment and the sender, signed with the secret, as set to Reply-To by Email with
+// EmailParams.InboundAddress, so the spoofable From header is not the only proof of the sender.
+// Text of the comment is not set, it should be rendered from Orig with store.CommentFormatter and sanitized,
+// same as for comments posted with API. Sender of the reply is set to Comment.User.Name and Emails, mapping it
+// to remark42 user, as well as setting Locator.URL of the comment is up to the caller.
+func ParseInboundReply(raw []byte, secret string) (Request, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return Request{}, errors.Wrap(err, "can't read inbound message")
+	}
+
+	parentID, siteID, err := inboundParent(msg.Header)
+	if err != nil {
+		return Request{}, err
+	}
+
+	from, err := msg.Header.AddressList("From")
+	if err != nil || len(from) == 0 {
+		return Request{}, errors.Errorf("no sender in inbound reply to %s", parentID)
+	}
+	if !signedInbound(msg.Header, secret, siteID, parentID, from[0].Address) {
+		return Request{}, errors.Errorf("inbound reply to %s from %s is not sent to signed address", parentID, from[0].Address)
+	}
+
+	body, err := inboundText(msg.Header, msg.Body, 0)
+	if err != nil {
+		return Request{}, errors.Wrapf(err, "can't read body of inbound reply to %s", parentID)
+	}
+	text := stripQuotedReply(body)
+	if text == "" {
+		return Request{}, errors.Errorf("empty inbound reply to %s", parentID)
+	}
+
+	locator := store.Locator{SiteID: siteID}
+	req := Request{
+		Event: EventReply,
+		Comment: store.Comment{
+			ParentID: parentID,
+			Locator:  locator,
+			Orig:     text,
+			User:     store.User{Name: from[0].Name, SiteID: siteID},
+		},
+		parent:  store.Comment{ID: parentID, Locator: locator},
+		locator: locator,
+		Emails:  []string{from[0].Address},
+	}
+	if ts, err := msg.Header.Date(); err == nil {
+		req.Comment.Timestamp = ts
+	}
+	return req, nil
+}
+
+// InboundReplyToken returns token of the inbound reply address for the notification about the comment
+// sent to email, signed with the secret
+func InboundReplyToken(secret, siteID, commentID, email string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write([]byte(siteID + "\x00" + commentID + "\x00" + strings.ToLower(email)))
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+// inboundAddress adds token to the local part of the address, i.e. reply+token@example.com
+func inboundAddress(address, token string) string {
+	addr, err := mail.ParseAddress(address)
+	if err != nil {
+		return address
+	}
+	at := strings.LastIndex(addr.Address, "@")
+	addr.Address = addr.Address[:at] + "+" + token + addr.Address[at:]
+	return addr.String()
+}
+
+// signedInbound checks if any of recipients of the inbound message is the address with token
+// of the comment and the sender, signed with the secret. Never true without the secret.
+func signedInbound(h mail.Header, secret, siteID, commentID, from string) bool {
+	if secret == "" {
+		return false
+	}
+	expected := []byte(InboundReplyToken(secret, siteID, commentID, from))
+	for _, key := range []string{"To", "Cc", "Delivered-To"} {
+		addrs, err := h.AddressList(key)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			local := addr.Address
+			if at := strings.LastIndex(local, "@"); at >= 0 {
+				local = local[:at]
+			}
+			plus := strings.LastIndex(local, "+")
+			if plus >= 0 && hmac.Equal([]byte(strings.ToLower(local[plus+1:])), expected) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// inboundParent returns comment and site IDs from the message id the inbound message replies to.
+// Message ID is made by Email.messageID as <commentID.siteID@domain>, with IDs encoded by msgIDPart if needed.
+func inboundParent(h mail.Header) (commentID, siteID string, err error) {
+	ref := strings.TrimSpace(h.Get("In-Reply-To"))
+	if ref == "" {
+		if refs := strings.Fields(h.Get("References")); len(refs) > 0 {
+			ref = refs[len(refs)-1]
+		}
+	}
+	if ref == "" {
+		return "", "", errors.New("no In-Reply-To or References in inbound reply")
+	}
+
+	id := strings.TrimSuffix(strings.TrimPrefix(strings.Fields(ref)[0], "<"), ">")
+	at := strings.LastIndex(id, "@")
+	if at <= 0 {
+		return "", "", errors.Errorf("invalid message id %q in inbound reply", ref)
+	}
+	elems := strings.SplitN(id[:at], ".", 2)
+	if commentID, err = parseMsgIDPart(elems[0]); err != nil || commentID == "" {
+		return "", "", errors.Errorf("invalid message id %q in inbound reply", ref)
+	}
+	if len(elems) == 2 {
+		if siteID, err = parseMsgIDPart(elems[1]); err != nil {
+			return "", "", errors.Errorf("invalid message id %q in inbound reply", ref)
+		}
+	}
+	return commentID, siteID, nil
+}
+
+// inboundText returns decoded text of the message part with the header h, preferring text/plain over text/html
+// in multipart messages. Html only message is converted to plain text.
+func inboundText(h mail.Header, body io.Reader, depth int) (string, error) {
+	mediaType, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain" // RFC 2045 default for missing or broken content type
+	}
+
+	switch strings.ToLower(h.Get("Content-Transfer-Encoding")) {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/"):
+		if depth >= maxInboundParts {
+			return "", errors.New("too deep multipart nesting")
+		}
+		var htmlText string
+		mr := multipart.NewReader(body, params["boundary"])
+		for i := 0; i < maxInboundParts; i++ {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return "", errors.Wrap(err, "can't read multipart message")
+			}
+			partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+			if strings.HasPrefix(part.Header.Get("Content-Disposition"), "attachment") {
+				continue
+			}
+			text, err := inboundText(mail.Header(part.Header), part, depth+1)
+			if err != nil {
+				return "", err
+			}
+			if partType == "text/html" {
+				if htmlText == "" {
+					htmlText = text
+				}
+				continue
+			}
+			if text != "" {
+				return text, nil
+			}
+		}
+		return htmlText, nil
+	case mediaType == "text/plain":
+		b, err := ioutil.ReadAll(body)
+		return string(b), errors.Wrap(err, "can't read text part")
+	case mediaType == "text/html":
+		b, err := ioutil.ReadAll(body)
+		return htmlToText(string(b)), errors.Wrap(err, "can't read html part")
+	}
+	return "", nil
+}
+
+// stripQuotedReply returns reply text above the quoted message, without the attribution line,
+// quoted lines and the signature
+func stripQuotedReply(text string) string {
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	res := make([]string, 0, len(lines))
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		if strings.HasPrefix(line, ">") || replyOutlookRe.MatchString(line) || lines[i] == "-- " {
+			break
+		}
+		if replyAttributionRe.MatchString(line) {
+			break
+		}
+		// attribution line wrapped by the mail client, "On ... <a@b.c>" followed by "wrote:"
+		if strings.HasPrefix(strings.ToLower(line), "on ") && i+1 < len(lines) &&
+			replyAttributionRe.MatchString(line+" "+strings.TrimSpace(lines[i+1])) {
+			break
+		}
+		res = append(res, strings.TrimRight(lines[i], " \t"))
+	}
+	return strings.TrimSpace(strings.Join(res, "\n"))
+}
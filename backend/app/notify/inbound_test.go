@@ -0,0 +1,198 @@
+package notify
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/remark42/backend/app/store"
+)
+
+func TestParseInboundReply(t *testing.T) {
+	email := &Email{EmailParams: EmailParams{From: "noreply@example.com", InboundAddress: "Remark42 <reply@example.com>",
+		InboundSecret: "secret"}}
+	msgID := email.messageID("a1b2c3d4-1234-5678-9abc-def012345678", "remark")
+	replyTo := strings.TrimPrefix(email.replyHeaders(Request{Comment: store.Comment{ID: "a1b2c3d4-1234-5678-9abc-def012345678",
+		Locator: store.Locator{SiteID: "remark"}}}, "Jane@example.org"), "Reply-To: ")
+	assert.Equal(t, `"Remark42" <reply+`+InboundReplyToken("secret", "remark", "a1b2c3d4-1234-5678-9abc-def012345678",
+		"jane@example.org")+"@example.com>\n", replyTo)
+
+	raw := strings.Join([]string{
+		"Return-Path: <jane@example.org>",
+		"From: Jane Doe <jane@example.org>",
+		"To: " + strings.TrimSpace(replyTo),
+		"Subject: Re: New reply to your comment",
+		"Date: Mon, 02 Jan 2006 15:04:05 +0000",
+		"Message-ID: <CAF=abc123@mail.example.org>",
+		"In-Reply-To: " + msgID,
+		"References: <a1b2c3d4-0000.remark@example.com> " + msgID,
+		"MIME-Version: 1.0",
+		`Content-Type: multipart/alternative; boundary="000000000000b1"`,
+		"",
+		"--000000000000b1",
+		`Content-Type: text/plain; charset="UTF-8"`,
+		"Content-Transfer-Encoding: quoted-printable",
+		"",
+		"Thanks for the link, it works =E2=80=94 see the second example.",
+		"",
+		"Jane",
+		"",
+		"On Mon, Jan 2, 2006 at 3:00 PM Remark42 <noreply@example.com>",
+		"wrote:",
+		"",
+		"> John replied to your comment",
+		"> Try https://example.com/docs",
+		"",
+		"--000000000000b1",
+		`Content-Type: text/html; charset="UTF-8"`,
+		"",
+		"<div>Thanks for the link, html version</div>",
+		"--000000000000b1--",
+		"",
+	}, "\r\n")
+
+	req, err := ParseInboundReply([]byte(raw), "secret")
+	require.NoError(t, err)
+	assert.Equal(t, EventReply, req.Event)
+	assert.Equal(t, "a1b2c3d4-1234-5678-9abc-def012345678", req.Comment.ParentID)
+	assert.Equal(t, store.Locator{SiteID: "remark"}, req.Comment.Locator)
+	assert.Equal(t, "a1b2c3d4-1234-5678-9abc-def012345678", req.parent.ID)
+	assert.Equal(t, "Thanks for the link, it works — see the second example.\n\nJane", req.Comment.Orig)
+	assert.Empty(t, req.Comment.Text, "rendered by the caller")
+	assert.Equal(t, "Jane Doe", req.Comment.User.Name)
+	assert.Equal(t, []string{"jane@example.org"}, req.Emails)
+	assert.Equal(t, time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC), req.Comment.Timestamp.UTC())
+}
+
+func TestParseInboundReply_HTMLOnly(t *testing.T) {
+	raw := strings.Join([]string{
+		"From: jane@example.org",
+		"To: reply+" + InboundReplyToken("secret", "remark", "c2", "jane@example.org") + "@example.com",
+		"References: <c1.remark@example.com> <c2.remark@example.com>",
+		"Content-Type: text/html; charset=UTF-8",
+		"Content-Transfer-Encoding: base64",
+		"",
+		"PHA+R3JlYXQgcG9zdCE8L3A+Cjxicj4KLS0tLS1PcmlnaW5hbCBNZXNzYWdlLS0tLS0KPHA+b2xkPC9wPg==",
+		"",
+	}, "\r\n")
+	req, err := ParseInboundReply([]byte(raw), "secret")
+	require.NoError(t, err)
+	assert.Equal(t, "c2", req.Comment.ParentID, "last references entry used")
+	assert.Equal(t, "remark", req.Comment.Locator.SiteID)
+	assert.Equal(t, "Great post!", req.Comment.Orig)
+	assert.Equal(t, []string{"jane@example.org"}, req.Emails)
+}
+
+func TestParseInboundReply_Errors(t *testing.T) {
+	tbl := []struct {
+		raw string
+		err string
+	}{
+		{"garbage", "can't read inbound message"},
+		{"From: a@example.org\r\n\r\nhi", "no In-Reply-To or References in inbound reply"},
+		{"From: a@example.org\r\nIn-Reply-To: <nodomain>\r\n\r\nhi", `invalid message id "<nodomain>" in inbound reply`},
+		{"From: a@example.org\r\nIn-Reply-To: <.remark@example.com>\r\n\r\nhi",
+			`invalid message id "<.remark@example.com>" in inbound reply`},
+		{"In-Reply-To: <c1.remark@example.com>\r\n\r\nhi", "no sender in inbound reply to c1"},
+		{"From: a@example.org\r\nTo: r+" + InboundReplyToken("secret", "remark", "c1", "a@example.org") + "@example.com\r\n" +
+			"In-Reply-To: <c1.remark@example.com>\r\n\r\n> quoted only\r\n", "empty inbound reply to c1"},
+		{"From: a@example.org\r\nTo: r@example.com\r\nIn-Reply-To: <c1.remark@example.com>\r\n\r\nhi",
+			"inbound reply to c1 from a@example.org is not sent to signed address"},
+		{"From: b@example.org\r\nTo: r+" + InboundReplyToken("secret", "remark", "c1", "a@example.org") + "@example.com\r\n" +
+			"In-Reply-To: <c1.remark@example.com>\r\n\r\nhi", "not sent to signed address", // token of another recipient
+		},
+		{"From: a@example.org\r\nTo: r+" + InboundReplyToken("secret", "remark", "c1", "a@example.org") + "@example.com\r\n" +
+			"In-Reply-To: <c2.remark@example.com>\r\n\r\nhi", "not sent to signed address", // token of another comment
+		},
+		{"From: a@example.org\r\nTo: r+" + InboundReplyToken("other", "remark", "c1", "a@example.org") + "@example.com\r\n" +
+			"In-Reply-To: <c1.remark@example.com>\r\n\r\nhi", "not sent to signed address", // signed with another secret
+		},
+	}
+	for i, tt := range tbl {
+		_, err := ParseInboundReply([]byte(tt.raw), "secret")
+		require.Error(t, err, "case #%d", i)
+		assert.Contains(t, err.Error(), tt.err, "case #%d", i)
+	}
+}
+
+func TestStripQuotedReply(t *testing.T) {
+	tbl := []struct {
+		in, out string
+	}{
+		{"plain reply", "plain reply"},
+		{"reply\n\nOn Tue, Jan 3, 2006, John <j@example.com> wrote:\n> quote", "reply"},
+		{"reply  \r\nsecond line\r\n\r\n> quote\r\n", "reply\nsecond line"},
+		{"reply\n-- \nJane, sent from phone", "reply"},
+		{"He wrote: hello\nthere", "He wrote: hello\nthere"},
+		{"> all quoted", ""},
+	}
+	for i, tt := range tbl {
+		assert.Equal(t, tt.out, stripQuotedReply(tt.in), "case #%d", i)
+	}
+}
+
+func TestParseInboundReply_Untrusted(t *testing.T) {
+	raw := strings.Join([]string{
+		"From: Mallory <m@example.org>",
+		"Cc: reply+" + InboundReplyToken("secret", "remark", "c1", "m@example.org") + "@example.com",
+		"In-Reply-To: <c1.remark@example.com>",
+		"",
+		`<script>alert("x")</script> <img src=x onerror=alert(1)> **bold**`,
+		"",
+	}, "\r\n")
+	req, err := ParseInboundReply([]byte(raw), "secret")
+	require.NoError(t, err)
+	assert.Empty(t, req.Comment.Text, "raw reply is not used as html")
+
+	// rendered and sanitized by the caller, same as comment posted with API
+	req.Comment.Text = store.NewCommentFormatter().FormatText(req.Comment.Orig)
+	req.Comment.Sanitize()
+	assert.NotContains(t, req.Comment.Text, "<script")
+	assert.NotContains(t, req.Comment.Text, "onerror")
+	assert.Contains(t, req.Comment.Text, "<strong>bold</strong>")
+
+	_, err = ParseInboundReply([]byte(raw), "")
+	assert.EqualError(t, err, "inbound reply to c1 from m@example.org is not sent to signed address", "no secret")
+}
+
+func TestParseInboundReply_DottedSite(t *testing.T) {
+	email := &Email{EmailParams: EmailParams{From: "noreply@example.com", InboundAddress: "reply@example.com",
+		InboundSecret: "secret"}}
+	req := Request{Comment: store.Comment{ID: "c1", Locator: store.Locator{SiteID: "blog.example.com"}}}
+	msgID := email.messageID("c1", "blog.example.com")
+	assert.Equal(t, "<c1.=MJWG6ZZOMV4GC3LQNRSS4Y3PNU@example.com>", msgID)
+	replyTo := strings.TrimSpace(strings.TrimPrefix(email.replyHeaders(req, "jane@example.org"), "Reply-To: "))
+
+	raw := strings.Join([]string{
+		"From: jane@example.org",
+		"To: " + replyTo,
+		"In-Reply-To: " + msgID,
+		"",
+		"reply to dotted site",
+		"",
+	}, "\r\n")
+	res, err := ParseInboundReply([]byte(raw), "secret")
+	require.NoError(t, err)
+	assert.Equal(t, "c1", res.Comment.ParentID)
+	assert.Equal(t, "blog.example.com", res.Comment.Locator.SiteID)
+	assert.Equal(t, "blog.example.com", res.Comment.User.SiteID)
+	assert.Equal(t, "reply to dotted site", res.Comment.Orig)
+}
+
+func TestMsgIDPart(t *testing.T) {
+	for _, s := range []string{"remark", "my-site", "a1b2c3d4-1234-5678-9abc-def012345678", "example.com", "=x", "site name",
+		"сайт", "a@b", ""} {
+		part := msgIDPart(s)
+		assert.NotContains(t, part, ".", s)
+		assert.False(t, msgIDUnsafeRe.MatchString(part), s)
+		res, err := parseMsgIDPart(part)
+		require.NoError(t, err, s)
+		assert.Equal(t, s, res)
+	}
+	assert.Equal(t, "remark", msgIDPart("remark"), "kept as is")
+	_, err := parseMsgIDPart("=not-base32")
+	assert.Error(t, err)
+}
@@ -0,0 +1,117 @@
+package notify
+
+import (
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// LinkSanitizer cleans links in comment html of notifications, i.e. removes tracking parameters
+type LinkSanitizer struct {
+	StripParams []string // query parameters removed from links, trailing * matches any suffix, i.e. utm_*
+	ForceHTTPS  bool     // rewrite http links to https
+}
+
+// Enabled tells if sanitizer changes anything
+func (s LinkSanitizer) Enabled() bool {
+	return len(s.StripParams) > 0 || s.ForceHTTPS
+}
+
+// Sanitize cleans href of all links in html, the rest of html including link text is kept as is
+func (s LinkSanitizer) Sanitize(htmlText string) string {
+	if !s.Enabled() || !strings.Contains(htmlText, "<") {
+		return htmlText
+	}
+	res := strings.Builder{}
+	tokenizer := html.NewTokenizer(strings.NewReader(htmlText))
+	for {
+		tt := tokenizer.Next()
+		if tt == html.ErrorToken {
+			return res.String()
+		}
+		raw := string(tokenizer.Raw())
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+			res.WriteString(raw)
+			continue
+		}
+		tok := tokenizer.Token()
+		if tok.DataAtom != atom.A {
+			res.WriteString(raw)
+			continue
+		}
+		changed := false
+		for i, attr := range tok.Attr {
+			if attr.Key != "href" {
+				continue
+			}
+			if link := s.cleanURL(attr.Val); link != attr.Val {
+				tok.Attr[i].Val, changed = link, true
+			}
+		}
+		if !changed {
+			res.WriteString(raw)
+			continue
+		}
+		res.WriteString(tok.String())
+	}
+}
+
+// cleanURL removes StripParams from the query of http(s) or relative link and upgrades http scheme with ForceHTTPS.
+// Other links, like mailto, and unparsable ones are returned as is.
+func (s LinkSanitizer) cleanURL(link string) string {
+	u, err := url.Parse(link)
+	if err != nil {
+		return link
+	}
+	changed := false
+	switch strings.ToLower(u.Scheme) {
+	case "http":
+		if s.ForceHTTPS {
+			u.Scheme, changed = "https", true
+		}
+	case "https", "":
+	default:
+		return link
+	}
+	if u.RawQuery != "" && len(s.StripParams) > 0 {
+		// query is filtered as is instead of url.Values round trip, to keep order and encoding of other params
+		params := strings.Split(u.RawQuery, "&")
+		kept := params[:0]
+		for _, p := range params {
+			key := p
+			if i := strings.Index(p, "="); i >= 0 {
+				key = p[:i]
+			}
+			if k, err := url.QueryUnescape(key); err == nil {
+				key = k
+			}
+			if !s.strip(key) {
+				kept = append(kept, p)
+			}
+		}
+		if len(kept) != len(params) {
+			u.RawQuery, changed = strings.Join(kept, "&"), true
+		}
+	}
+	if !changed {
+		return link
+	}
+	return u.String()
+}
+
+// strip checks if query parameter should be removed, case-insensitive
+func (s LinkSanitizer) strip(param string) bool {
+	param = strings.ToLower(param)
+	for _, p := range s.StripParams {
+		p = strings.ToLower(p)
+		if strings.HasSuffix(p, "*") && strings.HasPrefix(param, strings.TrimSuffix(p, "*")) {
+			return true
+		}
+		if p == param {
+			return true
+		}
+	}
+	return false
+}
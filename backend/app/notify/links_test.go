@@ -0,0 +1,59 @@
+package notify
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/remark42/backend/app/store"
+)
+
+func TestLinkSanitizer_Sanitize(t *testing.T) {
+	s := LinkSanitizer{StripParams: []string{"utm_*", "fbclid"}, ForceHTTPS: true}
+	tbl := []struct {
+		in, out string
+	}{
+		{`<p>no links</p>`, `<p>no links</p>`},
+		{`plain text`, `plain text`},
+		{`<a href="https://example.com/post?utm_source=news&amp;utm_medium=email">the <b>post</b></a>`,
+			`<a href="https://example.com/post">the <b>post</b></a>`},
+		{`<a href="https://example.com/?id=1&amp;UTM_Campaign=x&amp;fbclid=abc&amp;q=a%20b#top" rel="nofollow">link</a>`,
+			`<a href="https://example.com/?id=1&amp;q=a%20b#top" rel="nofollow">link</a>`},
+		{`<a href="https://example.com/normal?id=1">normal</a>`, `<a href="https://example.com/normal?id=1">normal</a>`},
+		{`<a href="http://example.com/page">page</a>`, `<a href="https://example.com/page">page</a>`},
+		{`<a href="mailto:user@example.com?utm_source=x">mail me</a>`, `<a href="mailto:user@example.com?utm_source=x">mail me</a>`},
+		{`<a href="/relative?utm_source=x&amp;a=1">rel</a>`, `<a href="/relative?a=1">rel</a>`},
+		{`<p>text <img src="http://example.com/i.png?utm_source=x"/> <a>no href</a></p>`,
+			`<p>text <img src="http://example.com/i.png?utm_source=x"/> <a>no href</a></p>`},
+	}
+	for i, tt := range tbl {
+		assert.Equal(t, tt.out, s.Sanitize(tt.in), "case #%d", i)
+	}
+
+	disabled := LinkSanitizer{}
+	assert.False(t, disabled.Enabled())
+	in := `<a href="http://example.com/?utm_source=x">link</a>`
+	assert.Equal(t, in, disabled.Sanitize(in))
+	assert.Equal(t, `<a href="http://example.com/">link</a>`, LinkSanitizer{StripParams: []string{"utm_source"}}.Sanitize(in),
+		"http kept without ForceHTTPS")
+}
+
+func TestEmail_LinkSanitizer(t *testing.T) {
+	email, err := NewEmail(EmailParams{
+		From:                     "from@example.org",
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "testdata/msg.html.tmpl",
+		TokenGenFn:               TokenGenFn,
+		LinkSanitizer:            LinkSanitizer{StripParams: []string{"utm_*"}},
+	}, SMTPParams{})
+	require.NoError(t, err)
+
+	req := Request{Comment: store.Comment{ID: "999", User: store.User{ID: "1", Name: "test_user"},
+		Text: `<p>see <a href="https://example.com/post?utm_source=newsletter">post</a> and <a href="https://example.com/x?id=2">x</a></p>`}}
+	msg, err := email.buildMessageFromRequest(email.sender(""), req, "test@example.org", false)
+	require.NoError(t, err)
+	assert.Contains(t, msg, `href=3D"https://example.com/post"`)
+	assert.Contains(t, msg, `href=3D"https://example.com/x?id=3D2"`)
+	assert.NotContains(t, msg, "utm_source")
+}
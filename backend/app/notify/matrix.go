@@ -0,0 +1,187 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1" //nolint:gosec // used for transaction id only
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/pkg/errors"
+	"golang.org/x/net/html"
+)
+
+// MatrixParams contain settings for matrix destination
+type MatrixParams struct {
+	Homeserver  string        // homeserver base URL, i.e. https://matrix.org
+	AccessToken string        // access token of the user sending messages
+	RoomID      string        // room id to send messages to, i.e. !abcdef:matrix.org
+	Timeout     time.Duration // request timeout
+}
+
+// Matrix implements notify.Destination sending m.room.message events via matrix client-server API
+type Matrix struct {
+	MatrixParams
+}
+
+const (
+	matrixTimeOut             = 5000 * time.Millisecond
+	matrixSendPath            = "/_matrix/client/r0/rooms/%s/send/m.room.message/%s"
+	matrixErrorBodyLimitBytes = 1024
+)
+
+// matrixPolicy allows only tags and attributes from org.matrix.custom.html subset recommended by matrix spec.
+// Images are dropped as matrix clients show only mxc:// sources.
+var matrixPolicy = func() *bluemonday.Policy {
+	p := bluemonday.NewPolicy()
+	p.AllowElements("del", "h1", "h2", "h3", "h4", "h5", "h6", "blockquote", "p", "ul", "ol", "sup", "sub", "li",
+		"b", "i", "u", "strong", "em", "strike", "s", "code", "hr", "br", "div", "table", "thead", "tbody", "tr",
+		"th", "td", "caption", "pre", "span")
+	p.AllowAttrs("href").OnElements("a")
+	p.AllowURLSchemes("http", "https", "mailto")
+	p.RequireParseableURLs(true)
+	p.AllowAttrs("start").Matching(bluemonday.Integer).OnElements("ol")
+	p.AllowAttrs("class").Matching(bluemonday.SpaceSeparatedTokens).OnElements("code")
+	return p
+}()
+
+// NewMatrix makes matrix destination
+func NewMatrix(params MatrixParams) (*Matrix, error) {
+	if params.Homeserver == "" {
+		return nil, errors.New("matrix homeserver URL is required")
+	}
+	if params.AccessToken == "" {
+		return nil, errors.New("matrix access token is required")
+	}
+	if params.RoomID == "" {
+		return nil, errors.New("matrix room id is required")
+	}
+	res := Matrix{MatrixParams: params}
+	res.Homeserver = strings.TrimSuffix(res.Homeserver, "/")
+	if res.Timeout <= 0 {
+		res.Timeout = matrixTimeOut
+	}
+	log.Printf("[DEBUG] create new matrix notifier for room %s on %s, timeout=%s", res.RoomID, res.Homeserver, res.Timeout)
+	return &res, nil
+}
+
+// Send comment to matrix room. Transaction id is derived from the notification, so the homeserver
+// ignores repeated sends of the same notification instead of posting a duplicate message
+func (m *Matrix) Send(ctx context.Context, req Request) error {
+	txnID := m.txnID(req)
+	log.Printf("[DEBUG] send matrix notification to %s, comment id %s, txn %s", m.RoomID, req.Comment.ID, txnID)
+
+	b, err := json.Marshal(m.message(req))
+	if err != nil {
+		return errors.Wrap(err, "failed to make matrix body")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+	u := m.Homeserver + fmt.Sprintf(matrixSendPath, url.PathEscape(m.RoomID), url.PathEscape(txnID))
+	r, err := http.NewRequest("PUT", u, bytes.NewReader(b))
+	if err != nil {
+		return errors.Wrap(err, "failed to make matrix request")
+	}
+	r.Header.Set("Content-Type", "application/json; charset=utf-8")
+	r.Header.Set("Authorization", "Bearer "+m.AccessToken)
+
+	resp, err := http.DefaultClient.Do(r.WithContext(ctx))
+	if err != nil {
+		return errors.Wrap(err, "failed to get matrix response")
+	}
+	defer func() {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		if err := resp.Body.Close(); err != nil {
+			log.Printf("[WARN] can't close response body, %s", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		// matrix errors are reported as {"errcode": "M_FORBIDDEN", "error": "description"}
+		mxErr := struct {
+			ErrCode string `json:"errcode"`
+			Error   string `json:"error"`
+		}{}
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, matrixErrorBodyLimitBytes))
+		if err := json.Unmarshal(body, &mxErr); err == nil && mxErr.ErrCode != "" {
+			return errors.Errorf("matrix error, status code %d: %s %s", resp.StatusCode, mxErr.ErrCode, mxErr.Error)
+		}
+		return errors.Errorf("unexpected matrix status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// txnID makes transaction id unique for the room, event and content of the comment
+func (m *Matrix) txnID(req Request) string {
+	key := strings.Join([]string{m.RoomID, req.Event.String(), req.Comment.ID, req.Comment.Text}, "\x00")
+	return fmt.Sprintf("remark42-%x", sha1.Sum([]byte(key))) //nolint:gosec // not used for security
+}
+
+// message makes m.room.message event content with plain text body and formatted html body
+func (m *Matrix) message(req Request) interface{} {
+	from := req.Comment.User.Name
+	if req.Comment.ParentID != "" {
+		from += " → " + req.parent.User.Name
+	}
+	text := req.Comment.Orig
+	if text == "" {
+		text = htmlToText(req.Comment.Text)
+	}
+	title := "original comment"
+	if req.Comment.PostTitle != "" {
+		title = req.Comment.PostTitle
+	}
+	link := req.Comment.Locator.URL + uiNav + req.Comment.ID
+
+	return struct {
+		MsgType       string `json:"msgtype"`
+		Body          string `json:"body"`
+		Format        string `json:"format"`
+		FormattedBody string `json:"formatted_body"`
+	}{
+		MsgType: "m.text",
+		Body:    fmt.Sprintf("%s\n\n%s\n\n↦ %s: %s", from, text, title, link),
+		Format:  "org.matrix.custom.html",
+		FormattedBody: fmt.Sprintf(`<p><b>%s</b></p>%s<p>↦ <a href="%s">%s</a></p>`, html.EscapeString(from),
+			matrixHTML(req.Comment.Text), html.EscapeString(link), html.EscapeString(title)),
+	}
+}
+
+// Ping does nothing, matrix room is checked on message sending only
+func (m *Matrix) Ping(context.Context) error {
+	return nil
+}
+
+// SendVerification is not implemented for matrix
+func (m *Matrix) SendVerification(_ context.Context, _ VerificationRequest) error {
+	return nil
+}
+
+// Close does nothing, matrix has no pending notifications or resources to release
+func (m *Matrix) Close(_ context.Context) error {
+	return nil
+}
+
+// Name of Matrix destination
+func (m *Matrix) Name() string {
+	return "matrix"
+}
+
+// String representation of Matrix object
+func (m *Matrix) String() string {
+	return fmt.Sprintf("matrix: %s on %s", m.RoomID, m.Homeserver)
+}
+
+// matrixHTML converts comment html to org.matrix.custom.html, dropping tags and attributes not supported by matrix
+func matrixHTML(htmlText string) string {
+	return strings.TrimSpace(matrixPolicy.Sanitize(htmlText))
+}
@@ -0,0 +1,125 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/remark42/backend/app/store"
+)
+
+func TestMatrix_New(t *testing.T) {
+	_, err := NewMatrix(MatrixParams{AccessToken: "token", RoomID: "!room:example.com"})
+	assert.EqualError(t, err, "matrix homeserver URL is required")
+	_, err = NewMatrix(MatrixParams{Homeserver: "https://matrix.example.com", RoomID: "!room:example.com"})
+	assert.EqualError(t, err, "matrix access token is required")
+	_, err = NewMatrix(MatrixParams{Homeserver: "https://matrix.example.com", AccessToken: "token"})
+	assert.EqualError(t, err, "matrix room id is required")
+
+	m, err := NewMatrix(MatrixParams{Homeserver: "https://matrix.example.com/", AccessToken: "token", RoomID: "!room:example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, matrixTimeOut, m.Timeout)
+	assert.Equal(t, "https://matrix.example.com", m.Homeserver)
+	assert.Equal(t, "matrix: !room:example.com on https://matrix.example.com", m.String())
+	assert.NoError(t, m.SendVerification(context.Background(), VerificationRequest{}))
+	assert.NoError(t, m.Close(context.Background()))
+}
+
+func TestMatrix_Send(t *testing.T) {
+	var body, path string
+	txns := map[string]int{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "PUT", r.Method)
+		assert.Equal(t, "application/json; charset=utf-8", r.Header.Get("Content-Type"))
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"errcode":"M_UNKNOWN_TOKEN","error":"Invalid macaroon passed."}`))
+			return
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		body, path = string(b), r.URL.Path
+		txns[path[strings.LastIndex(path, "/")+1:]]++
+		_, _ = w.Write([]byte(`{"event_id":"$event1"}`))
+	}))
+	defer ts.Close()
+
+	m, err := NewMatrix(MatrixParams{Homeserver: ts.URL, AccessToken: "token", RoomID: "!room:example.com"})
+	require.NoError(t, err)
+	req := Request{
+		Comment: store.Comment{ID: "c2", ParentID: "c1", Orig: "**bold** <reply>",
+			Text: `<p><strong>bold</strong> &lt;reply&gt;<img src="https://example.com/pic.png"/><script>alert(1)</script></p>`,
+			User: store.User{Name: "user2"}, PostTitle: "Post <title>",
+			Locator: store.Locator{SiteID: "remark", URL: "https://example.com/post"}},
+		parent: store.Comment{ID: "c1", User: store.User{Name: "user1"}},
+		Event:  EventReply,
+	}
+	require.NoError(t, m.Send(context.Background(), req))
+	assert.True(t, strings.HasPrefix(path, "/_matrix/client/r0/rooms/!room:example.com/send/m.room.message/remark42-"), path)
+	assert.JSONEq(t, `{"msgtype":"m.text","body":"user2 → user1\n\n**bold** <reply>\n\n↦ Post <title>: https://example.com/post#remark42__comment-c2",
+		"format":"org.matrix.custom.html",
+		"formatted_body":"<p><b>user2 → user1</b></p><p><strong>bold</strong> &lt;reply&gt;</p><p>↦ <a href=\"https://example.com/post#remark42__comment-c2\">Post &lt;title&gt;</a></p>"}`, body)
+
+	// repeated send of the same notification reuses transaction id, changed comment gets new one
+	require.NoError(t, m.Send(context.Background(), req))
+	req.Comment.Text = "<p>edited</p>"
+	require.NoError(t, m.Send(context.Background(), req))
+	require.Equal(t, 2, len(txns))
+	counts := []int{}
+	for _, c := range txns {
+		counts = append(counts, c)
+	}
+	assert.ElementsMatch(t, []int{2, 1}, counts)
+
+	resp := struct {
+		FormattedBody string `json:"formatted_body"`
+	}{}
+	require.NoError(t, json.Unmarshal([]byte(body), &resp))
+	assert.Contains(t, resp.FormattedBody, "<p>edited</p>")
+
+	m.AccessToken = "bad"
+	assert.EqualError(t, m.Send(context.Background(), req), "matrix error, status code 401: M_UNKNOWN_TOKEN Invalid macaroon passed.")
+
+	m.Homeserver = "http://127.0.0.1:1"
+	err = m.Send(context.Background(), req)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to get matrix response")
+}
+
+func TestMatrix_SendUnexpectedStatus(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write([]byte(`bad gateway`))
+	}))
+	defer ts.Close()
+
+	m, err := NewMatrix(MatrixParams{Homeserver: ts.URL, AccessToken: "token", RoomID: "!room:example.com"})
+	require.NoError(t, err)
+	assert.EqualError(t, m.Send(context.Background(), Request{Comment: store.Comment{ID: "c1"}}),
+		"unexpected matrix status code 502")
+}
+
+func Test_matrixHTML(t *testing.T) {
+	tbl := []struct {
+		in, out string
+	}{
+		{`<p>text</p>`, `<p>text</p>`},
+		{`<p><a href="https://example.com" rel="nofollow">link</a> <a href="javascript:alert(1)">bad</a></p>`,
+			`<p><a href="https://example.com">link</a> bad</p>`},
+		{`<pre><code class="language-go">x := 1</code></pre>`, `<pre><code class="language-go">x := 1</code></pre>`},
+		{`<p><img src="https://example.com/pic.png" alt="pic"/>img</p>`, `<p>img</p>`},
+		{`<ol start="3"><li>three</li></ol>`, `<ol start="3"><li>three</li></ol>`},
+		{`<p style="color:red" onclick="x()">styled</p>`, `<p>styled</p>`},
+		{`<iframe src="https://example.com"></iframe>text`, `text`},
+	}
+	for i, tt := range tbl {
+		assert.Equal(t, tt.out, matrixHTML(tt.in), "case #%d", i)
+	}
+}
@@ -0,0 +1,128 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"regexp"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/pkg/errors"
+)
+
+// MattermostParams contain settings for mattermost destination
+type MattermostParams struct {
+	WebhookURL   string            // incoming webhook URL
+	Channel      string            // channel override, webhook's default channel used if empty
+	SiteChannels map[string]string // channel overrides for sites, site id -> channel
+	Username     string            // username override, optional
+	IconURL      string            // icon override, optional
+	Timeout      time.Duration     // request timeout
+	MaxRetries   int               // max number of retries on rate limit responses
+}
+
+// Mattermost implements notify.Destination for mattermost incoming webhook
+type Mattermost struct {
+	MattermostParams
+	hookDestination
+}
+
+// mattermostMentionRe matches mentions notifying whole channel, they shouldn't be triggered by comments
+var mattermostMentionRe = regexp.MustCompile(`(?i)@(all|channel|here)\b`)
+
+// NewMattermost makes mattermost destination
+func NewMattermost(params MattermostParams) (*Mattermost, error) {
+	if params.WebhookURL == "" {
+		return nil, errors.New("mattermost webhook URL is required")
+	}
+	res := Mattermost{MattermostParams: params}
+	if res.Timeout <= 0 {
+		res.Timeout = hookTimeOut
+	}
+	if res.MaxRetries <= 0 {
+		res.MaxRetries = hookMaxRetries
+	}
+	log.Printf("[DEBUG] create new mattermost notifier for chan %s, timeout=%s", res.Channel, res.Timeout)
+	return &res, nil
+}
+
+// Send comment to mattermost channel of the comment's site
+func (m *Mattermost) Send(ctx context.Context, req Request) error {
+	channel := m.Channel
+	if ch, ok := m.SiteChannels[req.Comment.Locator.SiteID]; ok {
+		channel = ch
+	}
+	log.Printf("[DEBUG] send mattermost notification to %q, comment id %s", channel, req.Comment.ID)
+
+	b, err := json.Marshal(m.message(req, channel))
+	if err != nil {
+		return errors.Wrap(err, "failed to make mattermost body")
+	}
+
+	hr := hookRequest{name: "mattermost", url: m.WebhookURL, contentType: "application/json; charset=utf-8", body: b, timeout: m.Timeout}
+	return retryAttempts(ctx, "mattermost notification", m.MaxRetries, func() (time.Duration, error) { return postHook(ctx, hr) })
+}
+
+// message makes mattermost webhook message with attachment holding comment text and link to the comment
+func (m *Mattermost) message(req Request, channel string) interface{} {
+	type attachment struct {
+		Fallback   string `json:"fallback"`
+		AuthorName string `json:"author_name"`
+		AuthorIcon string `json:"author_icon,omitempty"`
+		Title      string `json:"title"`
+		TitleLink  string `json:"title_link"`
+		Text       string `json:"text"`
+	}
+
+	text := "New comment from " + req.Comment.User.Name
+	if req.Comment.ParentID != "" {
+		text = "New reply from " + req.Comment.User.Name + " to " + req.parent.User.Name
+	}
+	commentText := req.Comment.Orig
+	if commentText == "" {
+		commentText = htmlToText(req.Comment.Text)
+	}
+	title := "original comment"
+	if req.Comment.PostTitle != "" {
+		title = req.Comment.PostTitle
+	}
+
+	return struct {
+		Channel     string       `json:"channel,omitempty"`
+		Username    string       `json:"username,omitempty"`
+		IconURL     string       `json:"icon_url,omitempty"`
+		Text        string       `json:"text"`
+		Attachments []attachment `json:"attachments"`
+	}{
+		Channel:  channel,
+		Username: m.Username,
+		IconURL:  m.IconURL,
+		Text:     text,
+		Attachments: []attachment{{
+			Fallback:   text,
+			AuthorName: req.Comment.User.Name,
+			AuthorIcon: req.Comment.User.Picture,
+			Title:      title,
+			TitleLink:  req.Comment.Locator.URL + uiNav + req.Comment.ID,
+			Text:       markdownToMattermost(commentText),
+		}},
+	}
+}
+
+// Name of Mattermost destination
+func (m *Mattermost) Name() string {
+	return "mattermost"
+}
+
+func (m *Mattermost) String() string {
+	if m.Channel == "" {
+		return "mattermost: webhook"
+	}
+	return "mattermost: " + m.Channel
+}
+
+// markdownToMattermost adapts comment markdown to mattermost flavor. Mattermost renders markdown itself,
+// so only channel-wide mentions are broken with zero-width space to prevent notification of all members
+func markdownToMattermost(md string) string {
+	return mattermostMentionRe.ReplaceAllString(md, "@\u200b$1")
+}
@@ -0,0 +1,120 @@
+package notify
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/remark42/backend/app/store"
+)
+
+func TestMattermost_New(t *testing.T) {
+	_, err := NewMattermost(MattermostParams{})
+	assert.EqualError(t, err, "mattermost webhook URL is required")
+
+	m, err := NewMattermost(MattermostParams{WebhookURL: "https://mm.example.com/hooks/xxx"})
+	require.NoError(t, err)
+	assert.Equal(t, hookTimeOut, m.Timeout)
+	assert.Equal(t, hookMaxRetries, m.MaxRetries)
+	assert.Equal(t, "mattermost: webhook", m.String())
+	assert.NoError(t, m.SendVerification(context.Background(), VerificationRequest{}))
+
+	m.Channel = "town-square"
+	assert.Equal(t, "mattermost: town-square", m.String())
+}
+
+func TestMattermost_Send(t *testing.T) {
+	var body string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/json; charset=utf-8", r.Header.Get("Content-Type"))
+		b, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		body = string(b)
+		switch r.URL.Path {
+		case "/bad":
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		case "/created":
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	m, err := NewMattermost(MattermostParams{WebhookURL: ts.URL, Channel: "town-square", Username: "remark42",
+		SiteChannels: map[string]string{"site2": "site2-comments"}})
+	require.NoError(t, err)
+	req := Request{
+		Comment: store.Comment{ID: "c2", ParentID: "c1", Orig: "**bold**, hey @channel and @all",
+			User: store.User{Name: "user2", Picture: "https://example.com/user2.png"}, PostTitle: "Post title",
+			Locator: store.Locator{SiteID: "remark", URL: "https://example.com/post"}},
+		parent: store.Comment{ID: "c1", User: store.User{Name: "user1"}},
+	}
+	require.NoError(t, m.Send(context.Background(), req))
+	assert.JSONEq(t, `{"channel":"town-square","username":"remark42","text":"New reply from user2 to user1",
+		"attachments":[{"fallback":"New reply from user2 to user1","author_name":"user2",
+		"author_icon":"https://example.com/user2.png","title":"Post title",
+		"title_link":"https://example.com/post#remark42__comment-c2",
+		"text":"**bold**, hey @\u200bchannel and @\u200ball"}]}`, body)
+
+	req.Comment.Locator.SiteID = "site2"
+	require.NoError(t, m.Send(context.Background(), req))
+	assert.Contains(t, body, `"channel":"site2-comments"`, "per-site channel")
+
+	m.Channel, m.Username = "", ""
+	req = Request{Comment: store.Comment{ID: "c1", Text: "<p>html <b>text</b></p>", User: store.User{Name: "user"}}}
+	require.NoError(t, m.Send(context.Background(), req))
+	assert.JSONEq(t, `{"text":"New comment from user","attachments":[{"fallback":"New comment from user",
+		"author_name":"user","title":"original comment","title_link":"#remark42__comment-c1","text":"html text"}]}`, body,
+		"webhook's channel, html text used without orig")
+
+	m.WebhookURL = ts.URL + "/created"
+	assert.NoError(t, m.Send(context.Background(), req), "any 2xx status accepted")
+
+	m.WebhookURL = ts.URL + "/bad"
+	assert.EqualError(t, m.Send(context.Background(), req), "failed after 1 attempt(s): unexpected mattermost status code 400")
+
+	m.WebhookURL = "http://127.0.0.1:1"
+	err = m.Send(context.Background(), req)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to get mattermost response")
+}
+
+func TestMattermost_SendRateLimited(t *testing.T) {
+	var attempts int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	m, err := NewMattermost(MattermostParams{WebhookURL: ts.URL})
+	require.NoError(t, err)
+	st := time.Now()
+	require.NoError(t, m.Send(context.Background(), Request{Comment: store.Comment{ID: "c1"}}))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&attempts))
+	assert.True(t, time.Since(st) >= 2*time.Second, "Retry-After honored")
+
+	atomic.StoreInt32(&attempts, 0)
+	m.MaxRetries = 1
+	assert.EqualError(t, m.Send(context.Background(), Request{Comment: store.Comment{ID: "c1"}}),
+		"failed after 2 attempt(s): mattermost rate limit exceeded")
+}
+
+func Test_markdownToMattermost(t *testing.T) {
+	assert.Equal(t, "**bold** _italic_ [link](https://example.com)", markdownToMattermost("**bold** _italic_ [link](https://example.com)"))
+	assert.Equal(t, "@\u200bhere @\u200bALL @\u200bchannel", markdownToMattermost("@here @ALL @channel"))
+	assert.Equal(t, "@channels @user", markdownToMattermost("@channels @user"), "only channel-wide mentions")
+}
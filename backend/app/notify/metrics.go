@@ -0,0 +1,154 @@
+package notify
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// email failure reasons used as "reason" label of failed_total metric
+const (
+	failReasonCreate    = "create"
+	failReasonReset     = "reset"
+	failReasonMail      = "mail"
+	failReasonRcpt      = "rcpt"
+	failReasonData      = "data"
+	failReasonQuit      = "quit"
+	failReasonRateLimit = "rate_limit"
+)
+
+// emailMetrics keeps prometheus collectors of Email. All methods are no-op for nil receiver,
+// so metrics are collected only if EmailParams.MetricsRegisterer is set.
+type emailMetrics struct {
+	sent          prometheus.Counter
+	failed        *prometheus.CounterVec
+	flushDuration prometheus.Histogram
+	bufferSize    prometheus.Gauge
+	bufferLimit   prometheus.Gauge
+}
+
+// newEmailMetrics makes and registers email metrics, returns nil if registerer is not set.
+// Collectors already registered by another Email are reused.
+func newEmailMetrics(reg prometheus.Registerer) (*emailMetrics, error) {
+	if reg == nil {
+		return nil, nil
+	}
+	res := emailMetrics{
+		sent: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "remark42", Subsystem: "notify_email", Name: "sent_total",
+			Help: "Number of delivered email messages.",
+		}),
+		failed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "remark42", Subsystem: "notify_email", Name: "failed_total",
+			Help: "Number of failed email send attempts by reason.",
+		}, []string{"reason"}),
+		flushDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "remark42", Subsystem: "notify_email", Name: "flush_duration_seconds",
+			Help: "Time spent to send a batch of email messages within one SMTP session.",
+		}),
+		bufferSize: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "remark42", Subsystem: "notify_email", Name: "buffer_size",
+			Help: "Number of email messages waiting for delivery.",
+		}),
+		bufferLimit: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "remark42", Subsystem: "notify_email", Name: "buffer_limit",
+			Help: "Effective number of request messages collected to send them in a single SMTP session.",
+		}),
+	}
+
+	register := func(c prometheus.Collector) (prometheus.Collector, error) {
+		if err := reg.Register(c); err != nil {
+			if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+				return are.ExistingCollector, nil
+			}
+			return nil, errors.Wrap(err, "failed to register email metrics")
+		}
+		return c, nil
+	}
+	var c prometheus.Collector
+	var err error
+	if c, err = register(res.sent); err != nil {
+		return nil, err
+	}
+	res.sent = c.(prometheus.Counter)
+	if c, err = register(res.failed); err != nil {
+		return nil, err
+	}
+	res.failed = c.(*prometheus.CounterVec)
+	if c, err = register(res.flushDuration); err != nil {
+		return nil, err
+	}
+	res.flushDuration = c.(prometheus.Histogram)
+	if c, err = register(res.bufferSize); err != nil {
+		return nil, err
+	}
+	res.bufferSize = c.(prometheus.Gauge)
+	if c, err = register(res.bufferLimit); err != nil {
+		return nil, err
+	}
+	res.bufferLimit = c.(prometheus.Gauge)
+	return &res, nil
+}
+
+func (m *emailMetrics) incSent() {
+	if m != nil {
+		m.sent.Inc()
+	}
+}
+
+func (m *emailMetrics) incFailed(reason string) {
+	if m != nil {
+		m.failed.WithLabelValues(reason).Inc()
+	}
+}
+
+func (m *emailMetrics) observeFlush(start time.Time) {
+	if m != nil {
+		m.flushDuration.Observe(time.Since(start).Seconds())
+	}
+}
+
+func (m *emailMetrics) addBuffer(n int) {
+	if m != nil {
+		m.bufferSize.Add(float64(n))
+	}
+}
+
+func (m *emailMetrics) setBufferLimit(n int) {
+	if m != nil {
+		m.bufferLimit.Set(float64(n))
+	}
+}
+
+// serviceMetrics keeps prometheus collectors of Service. All methods are no-op for nil receiver,
+// so metrics are collected only if ServiceParams.MetricsRegisterer is set.
+type serviceMetrics struct {
+	dropped prometheus.Counter
+}
+
+// newServiceMetrics makes and registers notifier metrics, returns nil if registerer is not set.
+// Collectors already registered by another Service are reused.
+func newServiceMetrics(reg prometheus.Registerer) (*serviceMetrics, error) {
+	if reg == nil {
+		return nil, nil
+	}
+	dropped := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "remark42", Subsystem: "notify", Name: "dropped_total",
+		Help: "Number of notifications dropped because of the full queue.",
+	})
+	if err := reg.Register(dropped); err != nil {
+		are, ok := err.(prometheus.AlreadyRegisteredError)
+		if !ok {
+			return nil, errors.Wrap(err, "failed to register notifier metrics")
+		}
+		dropped = are.ExistingCollector.(prometheus.Counter)
+	}
+	return &serviceMetrics{dropped: dropped}, nil
+}
+
+func (m *serviceMetrics) incDropped() {
+	if m != nil {
+		m.dropped.Inc()
+	}
+}
@@ -4,30 +4,103 @@ package notify
 import (
 	"context"
 	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	log "github.com/go-pkgz/lgr"
+	"github.com/google/uuid"
+	"github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/umputun/remark42/backend/app/store"
 )
 
 // Service delivers notifications to multiple destinations
 type Service struct {
+	ServiceParams
 	dataService       Store
 	destinations      []Destination
 	queue             chan Request
 	verificationQueue chan VerificationRequest
 
-	closed uint32 // non-zero means closed. uses uint instead of bool for atomic
-	ctx    context.Context
-	cancel context.CancelFunc
+	closed     uint32       // non-zero means closed. uses uint instead of bool for atomic
+	submitLock sync.RWMutex // held for reading by senders to queues, for writing by Close closing them
+	ctx        context.Context
+	cancel     context.CancelFunc
+	drained    chan struct{}  // closed once the dispatcher handled requests left in the closed queues
+	done       chan struct{}  // closed on termination of the dispatcher
+	held       sync.WaitGroup // requests held for ScoreDelay and deferred for QuietHours
+	now        func() time.Time
+
+	quietLock sync.Mutex
+	quiet     []Request // requests deferred till the end of QuietHours
+
+	disabledLock sync.RWMutex
+	disabled     map[string]bool // names of destinations disabled at runtime, see Disable
+
+	metrics *serviceMetrics // nil if metrics are not collected
 }
 
-// Destination defines interface for a given destination service, like telegram, email and so on
+// ServiceParams contain settings for notification service
+type ServiceParams struct {
+	QueueSize          int           // size of the queue of requests, requests dropped if it's full
+	DestinationTimeout time.Duration // time given to each destination for a single request
+	Concurrency        int           // max number of destinations contacted at once, unlimited if 0
+	Subscriptions      Subscriptions // users subscriptions to threads, everyone in the reply chain notified if nil
+	// URLRewrite maps stored comment URLs to public ones, i.e. behind reverse proxy with path rewriting.
+	// Key is the URL prefix to replace, value is its replacement, the longest matching prefix is used.
+	URLRewrite map[string]string
+	Mentions   bool // notify users mentioned in new comments and replies by @name
+	// MinScore is the minimal score of the comment to notify about it, checked for new comments, replies and mentions
+	// right before sending. Disabled if 0.
+	MinScore int
+	// ScoreDelay holds notifications checked against MinScore for this period, to let comments gain score.
+	// Held notifications are dropped on shutdown.
+	ScoreDelay time.Duration
+	// OverflowPolicy defines what Submit does with the full queue, OverflowDropNewest by default
+	OverflowPolicy OverflowPolicy
+	// QuietHours defers notifications made during the daily period till its end, disabled if nil.
+	// Up to QueueSize notifications are deferred, the rest handled according to OverflowPolicy.
+	// Deferred notifications are sent on shutdown, within DestinationTimeout.
+	QuietHours *QuietHours
+	// SpamChecker classifies comments before sending, notifications about spam are not sent if it's set
+	SpamChecker       SpamChecker
+	SpamToAdmin       bool                  // send notifications about spam to admins only instead of dropping them, see Request.Spam
+	MetricsRegisterer prometheus.Registerer // registerer for notifier metrics, metrics are not collected if nil
+}
+
+// OverflowPolicy defines handling of requests submitted to the full queue
+type OverflowPolicy int
+
+// OverflowPolicy enum
+const (
+	OverflowDropNewest OverflowPolicy = iota // submitted request dropped
+	OverflowDropOldest                       // the oldest queued request dropped to free space for the submitted one
+	OverflowBlock                            // Submit waits for free space in the queue
+)
+
+// Destination defines interface for a given destination service, like telegram, email and so on.
+// Close is called once on shutdown of the service, it should deliver pending notifications
+// and release resources, giving up on delivery when context is done.
+// Ping checks the destination is reachable without sending anything, it should be cheap and respect context.
+// Name identifies the destination to disable and enable it at runtime, it's the same for destinations of the same type.
 type Destination interface {
 	fmt.Stringer
+	Verifier
+	Name() string
 	Send(context.Context, Request) error
+	Ping(context.Context) error
+	Close(context.Context) error
+}
+
+// Verifier sends verification token to the user via some channel, like email or SMS.
+// Channel is chosen by VerificationRequest fields, verifier does nothing if its one is not set.
+type Verifier interface {
 	SendVerification(context.Context, VerificationRequest) error
 }
 
@@ -35,44 +108,164 @@ type Destination interface {
 type Store interface {
 	Get(locator store.Locator, id string, user store.User) (store.Comment, error)
 	GetUserEmail(siteID string, userID string) (string, error)
+	IsBlocked(siteID string, userID string) bool
+	Find(locator store.Locator, sortMethod string, user store.User) ([]store.Comment, error)
+}
+
+// Event defines kind of notification request
+type Event int
+
+// Event enum, unset event is EventNewComment for backward compatibility
+const (
+	EventNewComment Event = iota
+	EventReply
+	EventEdit
+	EventDelete
+	EventVerification
+	EventMention // comment mentions the user by @name, Request.Emails has the email of the mentioned user
+)
+
+// EventFilter is implemented by destinations handling not only new comments and replies
+type EventFilter interface {
+	Accepts(e Event) bool
+}
+
+// SpamFilter is implemented by destinations able to receive requests about spam, see Request.Spam.
+// Destinations not implementing it don't get such requests.
+type SpamFilter interface {
+	AcceptsSpam() bool
 }
 
 // Request notification for a Comment
 type Request struct {
-	Comment     store.Comment
-	parent      store.Comment
-	Emails      []string
+	Event   Event
+	Comment store.Comment
+	parent  store.Comment
+	mention store.User    // mentioned user, set for EventMention only
+	locator store.Locator // locator of the comment in the store, Comment.Locator.URL might be rewritten to public one
+	Emails  []string
+	Lang    string   // language of notification, i.e. "de" or "pt-BR", default one used if empty or not supported
+	CC      []string // copy recipients of email notifications, overrides EmailParams.CC if not nil
+	// PrevOrig is the text of the edited comment before the edit, set for EventEdit, empty for the first version
+	PrevOrig string
+	From     string // From of email messages sent on behalf of someone, i.e. commenter, used with EmailParams.AllowRequestFrom only
+	// Moderated is set for EventDelete of the comment deleted by moderator, its author is notified about the deletion
+	Moderated    bool
+	DeleteReason string // reason of the deletion by moderator shown to the author, optional
+	// Urgent request is sent right away during QuietHours, i.e. notification for admin
+	Urgent bool
+	// Spam is set for request about comment classified as spam by ServiceParams.SpamChecker and sent to admin emails only,
+	// Emails of users are cleared for it and other destinations skip it
+	Spam bool
+	// Results receives final outcome of each email message made for the request, after retries, optional.
+	// Email waits for the receiver till the end of the send context, so the channel should be buffered or read.
+	Results chan<- SendResult
+}
+
+// SendResult is the final outcome of sending the email message of the request
+type SendResult struct {
+	MessageID string // Message-ID header of the message
+	To        string // recipient address
+	Err       error  // nil if the message is delivered
+}
+
+// String returns event name
+func (e Event) String() string {
+	switch e {
+	case EventNewComment:
+		return "new_comment"
+	case EventReply:
+		return "reply"
+	case EventEdit:
+		return "edit"
+	case EventDelete:
+		return "delete"
+	case EventVerification:
+		return "verification"
+	case EventMention:
+		return "mention"
+	}
+	return fmt.Sprintf("event(%d)", int(e))
 }
 
 // VerificationRequest notification for user
 type VerificationRequest struct {
 	SiteID string
 	User   string
-	Email  string // if set, send email only
+	Email  string // if set, send verification by email
+	Phone  string // if set, send verification by SMS
 	Token  string
 }
 
+// ctxKey is the type of context keys defined by notify package
+type ctxKey string
+
+// correlationIDKey is the context key of correlation id, see WithCorrelationID
+const correlationIDKey ctxKey = "correlation_id"
+
+// WithCorrelationID returns context carrying correlation id, destinations report it in logs and errors
+// to tie them to the request
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationIDKey, id)
+}
+
+// CorrelationID returns correlation id set by WithCorrelationID, empty if not set
+func CorrelationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationIDKey).(string)
+	return id
+}
+
+// correlationID returns correlation id from the context, generating new one if it's not set
+func correlationID(ctx context.Context) string {
+	if id := CorrelationID(ctx); id != "" {
+		return id
+	}
+	return uuid.New().String()
+}
+
 const defaultQueueSize = 100
+const defaultDestinationTimeout = time.Minute
 const uiNav = "#remark42__comment-"
 
 // NewService makes notification service routing comments to all destinations.
 func NewService(dataService Store, size int, destinations ...Destination) *Service {
-	if size <= 0 {
-		size = defaultQueueSize
+	return NewServiceWithParams(dataService, ServiceParams{QueueSize: size}, destinations...)
+}
+
+// NewServiceWithParams makes notification service routing comments to all destinations, with given params
+func NewServiceWithParams(dataService Store, params ServiceParams, destinations ...Destination) *Service {
+	if params.QueueSize <= 0 {
+		params.QueueSize = defaultQueueSize
+	}
+	if params.DestinationTimeout <= 0 {
+		params.DestinationTimeout = defaultDestinationTimeout
+	}
+	metrics, err := newServiceMetrics(params.MetricsRegisterer)
+	if err != nil {
+		log.Printf("[WARN] notifier metrics are not collected, %v", err)
 	}
 	ctx, cancel := context.WithCancel(context.Background())
 	res := Service{
+		ServiceParams:     params,
 		dataService:       dataService,
-		queue:             make(chan Request, size),
-		verificationQueue: make(chan VerificationRequest, size),
+		queue:             make(chan Request, params.QueueSize),
+		verificationQueue: make(chan VerificationRequest, params.QueueSize),
 		destinations:      destinations,
 		ctx:               ctx,
 		cancel:            cancel,
+		drained:           make(chan struct{}),
+		done:              make(chan struct{}),
+		now:               time.Now,
+		metrics:           metrics,
 	}
 	if len(destinations) > 0 {
 		go res.do()
+	} else {
+		close(res.drained)
+		close(res.done)
 	}
-	log.Printf("[INFO] create notifier service, queue size=%d, destinations=%d", size, len(destinations))
+	log.Printf("[INFO] create notifier service, queue size=%d, destinations=%d, timeout=%s",
+		params.QueueSize, len(destinations), params.DestinationTimeout)
 	return &res
 }
 
@@ -84,21 +277,128 @@ func (s *Service) Submit(req Request) {
 	if s.dataService != nil && req.Comment.ParentID != "" {
 		if p, err := s.dataService.Get(req.Comment.Locator, req.Comment.ParentID, store.User{}); err == nil {
 			req.parent = p
-			req.Emails = deduplicateStrings(s.getNotificationEmails(req, p))
+			req.Emails = deduplicateStrings(s.getNotificationEmails(req, p, true))
 		}
 	}
-	select {
-	case s.queue <- req:
+	if req.Event == EventDelete {
+		req.Emails = s.authorEmails(req)
+	}
+	var mentions []Request
+	if s.Mentions && s.dataService != nil && (req.Event == EventNewComment || req.Event == EventReply) {
+		mentions = s.mentionRequests(req)
+	}
+	req.locator = req.Comment.Locator
+	req.Comment.Locator.URL = s.publicURL(req.Comment.Locator.URL)
+	req.parent.Locator.URL = s.publicURL(req.parent.Locator.URL)
+	s.enqueue(req)
+	for _, m := range mentions {
+		m.locator = req.locator
+		m.Comment.Locator.URL, m.parent.Locator.URL = req.Comment.Locator.URL, req.parent.Locator.URL
+		s.enqueue(m)
+	}
+}
+
+// enqueue request, the full queue is handled according to OverflowPolicy
+func (s *Service) enqueue(req Request) {
+	s.submitLock.RLock()
+	defer s.submitLock.RUnlock()
+	if atomic.LoadUint32(&s.closed) != 0 {
+		return
+	}
+	switch s.OverflowPolicy {
+	case OverflowBlock:
+		s.queue <- req // dispatcher is running till the queue is closed, Close waits for the send
+	case OverflowDropOldest:
+		for {
+			select {
+			case s.queue <- req:
+				return
+			default:
+			}
+			select {
+			case old := <-s.queue:
+				s.metrics.incDropped()
+				log.Printf("[WARN] drop the oldest notification from full queue, %+v", old.Comment)
+			default: // drained by dispatcher meanwhile
+			}
+		}
 	default:
-		log.Printf("[WARN] can't send notification to queue, %+v", req.Comment)
+		select {
+		case s.queue <- req:
+		default:
+			s.metrics.incDropped()
+			log.Printf("[WARN] can't send notification to queue, %+v", req.Comment)
+		}
+	}
+}
+
+// mentionRequests makes EventMention request for each user mentioned in the comment. Mentions are resolved
+// against names of the post commenters, case-insensitive. Author of the comment and users already notified
+// about the reply are skipped.
+func (s *Service) mentionRequests(req Request) (res []Request) {
+	names := mentionedNames(req.Comment.Orig)
+	if len(names) == 0 {
+		return nil
+	}
+	comments, err := s.dataService.Find(req.Comment.Locator, "time", store.User{})
+	if err != nil {
+		log.Printf("[WARN] can't get comments of %s to resolve mentions, %v", req.Comment.Locator.URL, err)
+		return nil
+	}
+	users := map[string]store.User{}
+	for _, c := range comments {
+		if c.User.ID != "" && c.User.Name != "" {
+			users[strings.ToLower(c.User.Name)] = c.User
+		}
+	}
+
+	notified := map[string]bool{}
+	for _, email := range req.Emails {
+		notified[strings.ToLower(email)] = true
+	}
+	for _, name := range names {
+		user, ok := users[name]
+		if !ok || user.ID == req.Comment.User.ID {
+			continue
+		}
+		email, err := s.dataService.GetUserEmail(req.Comment.Locator.SiteID, user.ID)
+		if err != nil {
+			log.Printf("[WARN] can't read email for %s, %v", user.ID, err)
+		}
+		if email == "" || notified[strings.ToLower(email)] {
+			continue
+		}
+		notified[strings.ToLower(email)] = true
+		res = append(res, Request{Event: EventMention, Comment: req.Comment, parent: req.parent, mention: user,
+			Emails: []string{email}, Lang: req.Lang})
+	}
+	return res
+}
+
+// mentionRe matches @name not preceded by a word character, so email addresses are not taken as mentions
+var mentionRe = regexp.MustCompile(`(?:^|[^\w@/])@([\p{L}\p{N}_.\-]+)`)
+
+// mentionedNames returns unique lowercase names mentioned in the text by @name, in order of appearance
+func mentionedNames(text string) (res []string) {
+	seen := map[string]bool{}
+	for _, m := range mentionRe.FindAllStringSubmatch(text, -1) {
+		name := strings.ToLower(strings.TrimRight(m[1], ".-"))
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		res = append(res, name)
 	}
+	return res
 }
 
 // getNotificationEmails returns list of emails for notifications for provided comment.
 // Emails is not added to the returned list in case original message is from the same user as the notification receiver.
-func (s *Service) getNotificationEmails(req Request, notifyComment store.Comment) (result []string) {
+// With Subscriptions set, authors of comments up the reply chain are notified only if they are subscribed to the thread,
+// while author of the direct parent comment is always notified.
+func (s *Service) getNotificationEmails(req Request, notifyComment store.Comment, direct bool) (result []string) {
 	// add current user email only if the user is not the one who wrote the original comment
-	if notifyComment.User.ID != req.Comment.User.ID {
+	if notifyComment.User.ID != req.Comment.User.ID && (direct || s.isSubscribed(notifyComment.User.ID, req.Comment.Locator)) {
 		email, err := s.dataService.GetUserEmail(req.Comment.Locator.SiteID, notifyComment.User.ID)
 		if err != nil {
 			log.Printf("[WARN] can't read email for %s, %v", notifyComment.User.ID, err)
@@ -109,17 +409,65 @@ func (s *Service) getNotificationEmails(req Request, notifyComment store.Comment
 	}
 	if notifyComment.ParentID != "" {
 		if p, err := s.dataService.Get(req.Comment.Locator, notifyComment.ParentID, store.User{}); err == nil {
-			result = append(result, s.getNotificationEmails(req, p)...)
+			result = append(result, s.getNotificationEmails(req, p, false)...)
 		}
 	}
 	return result
 }
 
+// authorEmails returns email of the author of the comment deleted by moderator, nothing for deletion by the author
+func (s *Service) authorEmails(req Request) []string {
+	if !req.Moderated || s.dataService == nil || req.Comment.User.ID == "" {
+		return nil
+	}
+	email, err := s.dataService.GetUserEmail(req.Comment.Locator.SiteID, req.Comment.User.ID)
+	if err != nil {
+		log.Printf("[WARN] can't read email for %s, %v", req.Comment.User.ID, err)
+	}
+	if email == "" {
+		return nil
+	}
+	return []string{email}
+}
+
+// isSubscribed checks if user subscribed to the thread, everyone is subscribed without Subscriptions
+func (s *Service) isSubscribed(userID string, locator store.Locator) bool {
+	if s.Subscriptions == nil {
+		return true
+	}
+	ok, err := s.Subscriptions.IsSubscribed(userID, locator)
+	if err != nil {
+		log.Printf("[WARN] can't check subscription of %s to %s, %v", userID, locator.URL, err)
+	}
+	return ok
+}
+
+// Subscribe user to notifications about replies in the thread
+func (s *Service) Subscribe(userID string, locator store.Locator) error {
+	if s.Subscriptions == nil {
+		return errors.New("subscriptions are not enabled")
+	}
+	return errors.Wrapf(s.Subscriptions.Subscribe(userID, locator), "failed to subscribe %s to %s", userID, locator.URL)
+}
+
+// Unsubscribe user from notifications about replies in the thread
+func (s *Service) Unsubscribe(userID string, locator store.Locator) error {
+	if s.Subscriptions == nil {
+		return errors.New("subscriptions are not enabled")
+	}
+	return errors.Wrapf(s.Subscriptions.Unsubscribe(userID, locator), "failed to unsubscribe %s from %s", userID, locator.URL)
+}
+
 // SubmitVerification to internal channel if not busy, drop if can't send
 func (s *Service) SubmitVerification(req VerificationRequest) {
 	if len(s.destinations) == 0 || atomic.LoadUint32(&s.closed) != 0 {
 		return
 	}
+	s.submitLock.RLock()
+	defer s.submitLock.RUnlock()
+	if atomic.LoadUint32(&s.closed) != 0 {
+		return
+	}
 	select {
 	case s.verificationQueue <- req:
 	default:
@@ -127,57 +475,314 @@ func (s *Service) SubmitVerification(req VerificationRequest) {
 	}
 }
 
-// Close queue channel and wait for completion
+// Close queue channel, wait for completion and close destinations. Requests left in the queue are sent
+// within DestinationTimeout, the rest are dropped along with ones held for ScoreDelay.
 func (s *Service) Close() {
 	if s.queue != nil {
 		log.Print("[DEBUG] close notifier")
+		s.submitLock.Lock()
+		atomic.StoreUint32(&s.closed, 1)
 		close(s.queue)
 		close(s.verificationQueue)
+		s.submitLock.Unlock()
+		deadline := time.NewTimer(s.DestinationTimeout)
+		select {
+		case <-s.drained:
+		case <-deadline.C:
+			log.Printf("[WARN] notifier queue is not drained in %s, abandon the rest", s.DestinationTimeout)
+		}
+		deadline.Stop()
 		s.cancel()
-		<-s.ctx.Done()
+		<-s.done
+		if err := s.closeDestinations(); err != nil {
+			log.Printf("[WARN] failed to close notification destinations, %v", err)
+		}
 	}
 	atomic.StoreUint32(&s.closed, 1)
 }
 
+// closeDestinations closes all destinations, giving them DestinationTimeout to finish
+func (s *Service) closeDestinations() error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.DestinationTimeout)
+	defer cancel()
+	errs := new(multierror.Error)
+	for _, d := range s.destinations {
+		if err := d.Close(ctx); err != nil {
+			errs = multierror.Append(errs, errors.Wrapf(err, "failed to close %s", d))
+		}
+	}
+	return errs.ErrorOrNil()
+}
+
+// do dispatches requests till both queues are closed and drained or the service context is canceled
 func (s *Service) do() {
+	defer close(s.done)
+	defer s.held.Wait()
 	defer log.Print("[WARN] terminated notifier")
-	var wg sync.WaitGroup
-	for {
+	defer close(s.drained)
+	defer s.flushQuiet()
+	queue, verificationQueue := s.queue, s.verificationQueue
+	for queue != nil || verificationQueue != nil {
+		if s.ctx.Err() != nil {
+			if n := len(queue) + len(verificationQueue); n > 0 {
+				log.Printf("[WARN] drop %d request(s) left in notifier queue", n)
+			}
+			return
+		}
 		select {
-		case c, ok := <-s.queue:
+		case c, ok := <-queue:
 			if !ok {
-				return
+				queue = nil // closed, keep draining verifications
+				continue
 			}
-			wg.Add(len(s.destinations))
-			for _, dest := range s.destinations {
-				go func(d Destination) {
-					if err := d.Send(s.ctx, c); err != nil {
-						log.Printf("[WARN] failed to send to %s, %s", d, err)
-					}
-					wg.Done()
-				}(dest)
+			if s.deferQuiet(c) {
+				continue
 			}
-			wg.Wait()
-		case v, ok := <-s.verificationQueue:
+			s.dispatch(c)
+		case v, ok := <-verificationQueue:
 			if !ok {
-				return
+				verificationQueue = nil // closed, keep draining requests
+				continue
 			}
-			wg.Add(len(s.destinations))
-			for _, dest := range s.destinations {
-				go func(d Destination) {
-					if err := d.SendVerification(s.ctx, v); err != nil {
-						log.Printf("[WARN] failed to send to %s, %s", d, err)
-					}
-					wg.Done()
-				}(dest)
+			cid := uuid.New().String()
+			err := s.fanOut(s.ctx, func(ctx context.Context, d Destination) error {
+				return d.SendVerification(WithCorrelationID(ctx, cid), v)
+			})
+			if err != nil {
+				log.Printf("[WARN] failed to send verification for %s, cid %s, %v", v.User, cid, err)
 			}
-			wg.Wait()
 		case <-s.ctx.Done():
 			return
 		}
 	}
 }
 
+// send request to all destinations accepting its event, unless the author is blocked or the comment score is too low
+func (s *Service) send(ctx context.Context, c Request) {
+	if s.blocked(c) {
+		log.Printf("[INFO] skip notification for comment %s of blocked user %s", c.Comment.ID, c.Comment.User.ID)
+		return
+	}
+	if score, ok := s.enoughScore(c); !ok {
+		log.Printf("[DEBUG] skip notification for comment %s with score %d below %d", c.Comment.ID, score, s.MinScore)
+		return
+	}
+	c, ok := s.filterSpam(c)
+	if !ok {
+		return
+	}
+	cid := uuid.New().String() // the same for all destinations
+	log.Printf("[DEBUG] send notification for comment %s, cid %s", c.Comment.ID, cid)
+	err := s.fanOut(ctx, func(ctx context.Context, d Destination) error {
+		if !accepts(d, c.Event) {
+			return nil
+		}
+		if c.Spam && !acceptsSpam(d) {
+			return nil // spam goes to admin emails only, other destinations are visible to users or don't tell it apart
+		}
+		return d.Send(WithCorrelationID(ctx, cid), c)
+	})
+	if err != nil {
+		log.Printf("[WARN] failed to send notification for comment %s, cid %s, %v", c.Comment.ID, cid, err)
+	}
+}
+
+// dispatch sends request, holding it for ScoreDelay first if its score is checked
+func (s *Service) dispatch(c Request) {
+	if s.ScoreDelay > 0 && s.scoreChecked(c.Event) {
+		s.hold(c)
+		return
+	}
+	s.send(s.ctx, c)
+}
+
+// hold sends request after ScoreDelay, request is dropped if the service is closed earlier
+func (s *Service) hold(c Request) {
+	s.held.Add(1)
+	go func() {
+		defer s.held.Done()
+		timer := time.NewTimer(s.ScoreDelay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			s.send(s.ctx, c)
+		case <-s.ctx.Done():
+			log.Printf("[WARN] drop held notification for comment %s on shutdown", c.Comment.ID)
+		}
+	}()
+}
+
+// scoreChecked tells if the event is notified only for comments with MinScore
+func (s *Service) scoreChecked(e Event) bool {
+	return s.MinScore != 0 && (e == EventNewComment || e == EventReply || e == EventMention)
+}
+
+// enoughScore checks the current score of the comment against MinScore, re-reading the comment from the store
+// as score changes after the comment is submitted. Submitted score is used if the comment can't be read.
+func (s *Service) enoughScore(c Request) (score int, ok bool) {
+	if !s.scoreChecked(c.Event) {
+		return c.Comment.Score, true
+	}
+	score = c.Comment.Score
+	if s.dataService != nil {
+		comment, err := s.dataService.Get(c.locator, c.Comment.ID, store.User{})
+		if err != nil {
+			log.Printf("[WARN] can't read score of comment %s, %v", c.Comment.ID, err)
+		} else {
+			score = comment.Score
+		}
+	}
+	return score, score >= s.MinScore
+}
+
+// blocked checks if author of the new, replied or edited comment is blocked on the site,
+// it's checked on dispatch to catch authors blocked while their notifications were queued
+func (s *Service) blocked(req Request) bool {
+	if s.dataService == nil || req.Comment.User.ID == "" {
+		return false
+	}
+	switch req.Event {
+	case EventNewComment, EventReply, EventEdit:
+		return s.dataService.IsBlocked(req.Comment.Locator.SiteID, req.Comment.User.ID)
+	}
+	return false
+}
+
+// fanOut calls fn for all enabled destinations concurrently, up to Concurrency at once, each with DestinationTimeout
+// derived from ctx.
+// Destination not returning in time is abandoned, so the blocked one doesn't delay healthy destinations
+// for longer than the timeout. Returns all errors combined.
+func (s *Service) fanOut(ctx context.Context, fn func(ctx context.Context, d Destination) error) error {
+	type result struct {
+		idx int
+		err error
+	}
+	active := map[int]Destination{}
+	for i, dest := range s.destinations {
+		if s.enabled(dest) {
+			active[i] = dest
+		}
+	}
+	results := make(chan result, len(active)) // buffered to let abandoned sends finish
+	pending := map[int]bool{}
+	rounds := 1 // number of sequential rounds of sends needed with concurrency limit
+	var sem chan struct{}
+	if s.Concurrency > 0 && s.Concurrency < len(active) {
+		sem = make(chan struct{}, s.Concurrency)
+		rounds = (len(active) + s.Concurrency - 1) / s.Concurrency
+	}
+	for i, dest := range active {
+		pending[i] = true
+		go func(i int, d Destination) {
+			if sem != nil {
+				sem <- struct{}{}
+				defer func() { <-sem }()
+			}
+			destCtx, cancel := context.WithTimeout(ctx, s.DestinationTimeout)
+			defer cancel()
+			results <- result{idx: i, err: fn(destCtx, d)}
+		}(i, dest)
+	}
+
+	errs := new(multierror.Error)
+	// grace period for destinations respecting ctx
+	timer := time.NewTimer(time.Duration(rounds)*s.DestinationTimeout + time.Second)
+	defer timer.Stop()
+	for len(pending) > 0 {
+		select {
+		case r := <-results:
+			delete(pending, r.idx)
+			if r.err != nil {
+				errs = multierror.Append(errs, errors.Wrapf(r.err, "failed to send to %s", s.destinations[r.idx]))
+			}
+		case <-timer.C:
+			for i := range pending {
+				errs = multierror.Append(errs, errors.Errorf("%s blocked for more than %s", s.destinations[i], s.DestinationTimeout))
+			}
+			return errs.ErrorOrNil()
+		}
+	}
+	return errs.ErrorOrNil()
+}
+
+// Disable stops sending to destinations with the name, i.e. "telegram", till Enable is called.
+// Notifications and verifications for disabled destinations are skipped without error. Thread safe.
+func (s *Service) Disable(name string) error {
+	return s.setEnabled(name, false)
+}
+
+// Enable resumes sending to destinations with the name disabled by Disable. Thread safe.
+func (s *Service) Enable(name string) error {
+	return s.setEnabled(name, true)
+}
+
+func (s *Service) setEnabled(name string, enabled bool) error {
+	found := false
+	for _, d := range s.destinations {
+		found = found || d.Name() == name
+	}
+	if !found {
+		return errors.Errorf("no notification destination %q", name)
+	}
+	s.disabledLock.Lock()
+	defer s.disabledLock.Unlock()
+	if s.disabled == nil {
+		s.disabled = map[string]bool{}
+	}
+	if enabled {
+		delete(s.disabled, name)
+	} else {
+		s.disabled[name] = true
+	}
+	log.Printf("[INFO] notification destination %s enabled: %v", name, enabled)
+	return nil
+}
+
+// enabled checks destination is not disabled by Disable
+func (s *Service) enabled(d Destination) bool {
+	s.disabledLock.RLock()
+	defer s.disabledLock.RUnlock()
+	return !s.disabled[d.Name()]
+}
+
+// Ping checks all destinations are reachable, concurrently, each within DestinationTimeout.
+// Returns all errors combined, nil if there are no destinations.
+func (s *Service) Ping(ctx context.Context) error {
+	errs := new(multierror.Error)
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for _, dest := range s.destinations {
+		wg.Add(1)
+		go func(d Destination) {
+			defer wg.Done()
+			pingCtx, cancel := context.WithTimeout(ctx, s.DestinationTimeout)
+			defer cancel()
+			if err := d.Ping(pingCtx); err != nil {
+				lock.Lock()
+				errs = multierror.Append(errs, errors.Wrapf(err, "%s is not reachable", d))
+				lock.Unlock()
+			}
+		}(dest)
+	}
+	wg.Wait()
+	return errs.ErrorOrNil()
+}
+
+// accepts checks if destination handles event, destinations not implementing EventFilter
+// get new comments and replies only
+func accepts(d Destination, e Event) bool {
+	if f, ok := d.(EventFilter); ok {
+		return f.Accepts(e)
+	}
+	return e == EventNewComment || e == EventReply
+}
+
+// acceptsSpam checks if destination handles requests about spam, only ones implementing SpamFilter do
+func acceptsSpam(d Destination) bool {
+	f, ok := d.(SpamFilter)
+	return ok && f.AcceptsSpam()
+}
+
 // NopService is do-nothing notifier, without destinations
 var NopService = &Service{}
 
@@ -197,3 +802,33 @@ func deduplicateStrings(source []string) []string {
 
 	return result
 }
+
+// publicURL rewrites the longest matching URLRewrite prefix of the comment URL, returns URL as is if none matches
+func (s *Service) publicURL(u string) string {
+	prefix := ""
+	for p := range s.URLRewrite {
+		if strings.HasPrefix(u, p) && len(p) > len(prefix) {
+			prefix = p
+		}
+	}
+	if prefix == "" {
+		return u
+	}
+	return s.URLRewrite[prefix] + strings.TrimPrefix(u, prefix)
+}
+
+// absoluteURL resolves link relative to base URL, returns link as is if it's absolute or can't be resolved
+func absoluteURL(base, link string) string {
+	if link == "" || base == "" {
+		return link
+	}
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return link
+	}
+	linkURL, err := url.Parse(link)
+	if err != nil {
+		return link
+	}
+	return baseURL.ResolveReference(linkURL).String()
+}
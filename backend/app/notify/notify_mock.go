@@ -14,7 +14,8 @@ type MockDest struct {
 	data             []Request
 	verificationData []VerificationRequest
 	id               int
-	closed           bool
+	closed           bool // set on cancellation of send context
+	shutdown         bool // set by Close
 	lock             sync.Mutex
 }
 
@@ -66,4 +67,18 @@ func (m *MockDest) GetVerify() []VerificationRequest {
 	return res
 }
 
+// Ping mock
+func (m *MockDest) Ping(context.Context) error { return nil }
+
+// Close mock
+func (m *MockDest) Close(context.Context) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.shutdown = true
+	return nil
+}
+
+// Name mock
+func (m *MockDest) Name() string { return fmt.Sprintf("mock%d", m.id) }
+
 func (m *MockDest) String() string { return fmt.Sprintf("mock id=%d, closed=%v", m.id, m.closed) }
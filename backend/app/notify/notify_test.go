@@ -1,13 +1,20 @@
 package notify
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"math/rand"
+	"io/ioutil"
+	"mime/quotedprintable"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/hashicorp/go-multierror"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
@@ -100,7 +107,6 @@ func TestService_Many(t *testing.T) {
 	for i := 0; i < 10; i++ {
 		s.Submit(Request{Comment: store.Comment{ID: fmt.Sprintf("%d", 100+i)}})
 		s.SubmitVerification(VerificationRequest{User: fmt.Sprintf("%d", 100+i)})
-		time.Sleep(time.Millisecond * time.Duration(rand.Int31n(20)))
 	}
 	s.Close()
 	time.Sleep(time.Millisecond * 10)
@@ -110,9 +116,9 @@ func TestService_Many(t *testing.T) {
 	assert.NotEqual(t, 10, len(d2.Get()), "some comments dropped from d2")
 	assert.NotEqual(t, 10, len(d2.GetVerify()), "some verifications dropped from d2")
 
-	assert.True(t, d1.closed)
-	assert.True(t, d2.closed)
-	assert.Equal(t, "mock id=1, closed=true", d1.String())
+	assert.False(t, d1.closed, "queued requests sent on close, send context not canceled")
+	assert.False(t, d2.closed)
+	assert.Equal(t, "mock id=1, closed=false", d1.String())
 }
 
 func TestService_WithParent(t *testing.T) {
@@ -139,6 +145,429 @@ func TestService_WithParent(t *testing.T) {
 	assert.Equal(t, "", destRes[1].parent.ID)
 }
 
+func TestService_URLRewrite(t *testing.T) {
+	dest := &MockDest{id: 1}
+	dataStore := &mockStore{data: map[string]store.Comment{}}
+	dataStore.data["p1"] = store.Comment{ID: "p1", Locator: store.Locator{URL: "http://blog:8080/internal/blog/post1"},
+		User: store.User{ID: "u1", Name: "user1"}}
+
+	s := NewServiceWithParams(dataStore, ServiceParams{QueueSize: 10, URLRewrite: map[string]string{
+		"http://blog:8080/":               "https://example.com/",
+		"http://blog:8080/internal/blog/": "https://example.com/blog/",
+	}}, dest)
+	s.Submit(Request{Comment: store.Comment{ID: "c1", ParentID: "p1", Text: "reply",
+		Locator: store.Locator{SiteID: "remark", URL: "http://blog:8080/internal/blog/post1"}, User: store.User{ID: "u2", Name: "user2"}}})
+	s.Submit(Request{Comment: store.Comment{ID: "c2", Locator: store.Locator{URL: "http://blog:8080/about"}}})
+	s.Submit(Request{Comment: store.Comment{ID: "c3", Locator: store.Locator{URL: "https://other.com/post"}}})
+	time.Sleep(time.Millisecond * 110)
+	s.Close()
+
+	destRes := dest.Get()
+	require.Equal(t, 3, len(destRes))
+	assert.Equal(t, "https://example.com/blog/post1", destRes[0].Comment.Locator.URL, "the longest prefix used")
+	assert.Equal(t, "https://example.com/blog/post1", destRes[0].parent.Locator.URL)
+	assert.Equal(t, "https://example.com/about", destRes[1].Comment.Locator.URL)
+	assert.Equal(t, "https://other.com/post", destRes[2].Comment.Locator.URL, "not matching URL kept as is")
+
+	// rewritten URL used in the rendered message
+	email, err := NewEmail(EmailParams{From: "from@example.org", VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath: "../../templates/email_reply.html.tmpl", TokenGenFn: TokenGenFn}, SMTPParams{})
+	require.NoError(t, err)
+	msg, err := email.buildMessageFromRequest(email.sender(""), destRes[0], "user1@example.org", false)
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(quotedprintable.NewReader(strings.NewReader(msg[strings.Index(msg, "text/html"):])))
+	require.NoError(t, err)
+	assert.Contains(t, string(body), "https://example.com/blog/post1#remark42__comment-c1")
+	assert.NotContains(t, string(body), "blog:8080")
+}
+
+func TestService_BlockedUser(t *testing.T) {
+	dest := &MockDest{id: 1}
+	dataStore := &mockStore{data: map[string]store.Comment{}, blocked: map[string]bool{"remark::u1": true}}
+	s := NewService(dataStore, 10, dest)
+
+	locator := store.Locator{SiteID: "remark", URL: "https://example.com/post"}
+	s.Submit(Request{Comment: store.Comment{ID: "c1", User: store.User{ID: "u1"}, Locator: locator}})
+	s.Submit(Request{Event: EventReply, Comment: store.Comment{ID: "c2", User: store.User{ID: "u1"}, Locator: locator}})
+	s.Submit(Request{Comment: store.Comment{ID: "c3", User: store.User{ID: "u2"}, Locator: locator}})
+	s.Submit(Request{Comment: store.Comment{ID: "c4", User: store.User{ID: "u1"},
+		Locator: store.Locator{SiteID: "other", URL: "https://other.com/post"}}})
+	time.Sleep(time.Millisecond * 110)
+	s.Close()
+
+	ids := []string{}
+	for _, r := range dest.Get() {
+		ids = append(ids, r.Comment.ID)
+	}
+	assert.Equal(t, []string{"c3", "c4"}, ids, "comments of user blocked on the site skipped")
+}
+
+func TestService_MinScore(t *testing.T) {
+	dest := &MockDest{id: 1}
+	locator := store.Locator{SiteID: "remark", URL: "https://example.com/post"}
+	dataStore := &mockStore{data: map[string]store.Comment{
+		"c1": {ID: "c1", Locator: locator, Score: 1},
+		"c2": {ID: "c2", Locator: locator, Score: 5},
+		"c3": {ID: "c3", Locator: locator, Score: 2},
+	}}
+	s := NewServiceWithParams(dataStore, ServiceParams{QueueSize: 10, MinScore: 2,
+		URLRewrite: map[string]string{"https://example.com": "https://public.example.com"}}, dest)
+	s.Submit(Request{Comment: store.Comment{ID: "c1", Locator: locator, Score: 10}})
+	s.Submit(Request{Comment: store.Comment{ID: "c2", Locator: locator}})
+	s.Submit(Request{Event: EventReply, Comment: store.Comment{ID: "c3", Locator: locator}})
+	s.Submit(Request{Comment: store.Comment{ID: "c4", Locator: locator, Score: 3}})
+	s.Submit(Request{Comment: store.Comment{ID: "c5", Locator: locator, Score: 1}})
+	time.Sleep(time.Millisecond * 110)
+	s.Close()
+
+	ids := []string{}
+	for _, r := range dest.Get() {
+		ids = append(ids, r.Comment.ID)
+	}
+	assert.Equal(t, []string{"c2", "c3", "c4"}, ids, "current score checked, submitted one used for missing comment")
+}
+
+func TestService_ScoreDelay(t *testing.T) {
+	dest := &MockDest{id: 1}
+	locator := store.Locator{SiteID: "remark", URL: "https://example.com/post"}
+	dataStore := &mockStore{data: map[string]store.Comment{"c1": {ID: "c1", Locator: locator, Score: 5}}}
+	s := NewServiceWithParams(dataStore, ServiceParams{QueueSize: 10, MinScore: 1, ScoreDelay: 200 * time.Millisecond}, dest)
+	s.Submit(Request{Comment: store.Comment{ID: "c1", Locator: locator}})
+	time.Sleep(time.Millisecond * 100)
+	assert.Equal(t, 0, len(dest.Get()), "notification held")
+	time.Sleep(time.Millisecond * 200)
+	require.Equal(t, 1, len(dest.Get()), "notification sent after delay")
+	assert.Equal(t, "c1", dest.Get()[0].Comment.ID)
+
+	// held notification dropped on close
+	s.Submit(Request{Comment: store.Comment{ID: "c1", Locator: locator}})
+	time.Sleep(time.Millisecond * 50)
+	st := time.Now()
+	s.Close()
+	assert.True(t, time.Since(st) < 150*time.Millisecond, "close doesn't wait for held notifications")
+	assert.Equal(t, 1, len(dest.Get()))
+}
+
+func TestService_QuietHours(t *testing.T) {
+	dest := &MockDest{id: 1}
+	loc := time.FixedZone("UTC+3", 3*60*60)
+	// quiet from 22:00 till 03:00:00.2 local time
+	quiet := &QuietHours{Start: 22 * time.Hour, End: 3*time.Hour + 200*time.Millisecond, Location: loc}
+	s := NewServiceWithParams(nil, ServiceParams{QueueSize: 10, QuietHours: quiet}, dest)
+	var lock sync.Mutex
+	now := time.Date(2020, 11, 4, 12, 0, 0, 0, loc)
+	s.now = func() time.Time {
+		lock.Lock()
+		defer lock.Unlock()
+		return now
+	}
+
+	// outside of quiet hours sent immediately
+	s.Submit(Request{Comment: store.Comment{ID: "c1"}})
+	time.Sleep(time.Millisecond * 50)
+	require.Equal(t, 1, len(dest.Get()), "notification sent right away")
+
+	// inside quiet hours deferred till the end, urgent one sent immediately
+	lock.Lock()
+	now = time.Date(2020, 11, 5, 3, 0, 0, 0, loc)
+	lock.Unlock()
+	s.Submit(Request{Comment: store.Comment{ID: "c2"}})
+	s.Submit(Request{Comment: store.Comment{ID: "c3"}})
+	s.Submit(Request{Comment: store.Comment{ID: "c4"}, Urgent: true})
+	time.Sleep(time.Millisecond * 100)
+	require.Equal(t, 2, len(dest.Get()), "only urgent notification sent during quiet hours")
+	assert.Equal(t, "c4", dest.Get()[1].Comment.ID)
+	time.Sleep(time.Millisecond * 200)
+	ids := []string{}
+	for _, r := range dest.Get() {
+		ids = append(ids, r.Comment.ID)
+	}
+	assert.Equal(t, []string{"c1", "c4", "c2", "c3"}, ids, "deferred notifications sent at the end of quiet hours")
+
+	// deferred notification dispatched on close
+	s.Submit(Request{Comment: store.Comment{ID: "c5"}})
+	time.Sleep(time.Millisecond * 50)
+	assert.Equal(t, 4, len(dest.Get()))
+	st := time.Now()
+	s.Close()
+	assert.True(t, time.Since(st) < 150*time.Millisecond, "close doesn't wait for the end of quiet hours")
+	require.Equal(t, 5, len(dest.Get()))
+	assert.Equal(t, "c5", dest.Get()[4].Comment.ID)
+}
+
+func TestService_CloseDrainsQueue(t *testing.T) {
+	dest := &MockDest{id: 1}
+	s := NewServiceWithParams(nil, ServiceParams{QueueSize: 10}, dest)
+	for i := 0; i < 5; i++ {
+		s.Submit(Request{Comment: store.Comment{ID: fmt.Sprintf("c%d", i)}})
+	}
+	s.SubmitVerification(VerificationRequest{User: "u1", Email: "u1@example.com"})
+	s.Close()
+	assert.Equal(t, 5, len(dest.Get()), "queued notifications sent on close")
+	assert.Equal(t, 1, len(dest.GetVerify()), "queued verification sent on close")
+	assert.False(t, dest.closed, "send context not canceled")
+
+	// drain limited by DestinationTimeout
+	gate := &gateDest{MockDest: MockDest{id: 2}, gate: make(chan struct{})}
+	defer close(gate.gate)
+	s = NewServiceWithParams(nil, ServiceParams{QueueSize: 10, DestinationTimeout: 50 * time.Millisecond}, gate)
+	for i := 0; i < 5; i++ {
+		s.Submit(Request{Comment: store.Comment{ID: fmt.Sprintf("c%d", i)}})
+	}
+	st := time.Now()
+	s.Close()
+	// blocked destination is abandoned by fanOut after a second of grace, the rest of the queue is dropped
+	assert.True(t, time.Since(st) < 2*time.Second, "close doesn't wait for the whole queue, %s", time.Since(st))
+}
+
+func TestService_QuietHoursOverflow(t *testing.T) {
+	quiet := &QuietHours{Start: 0, End: 24*time.Hour - time.Nanosecond}
+	tbl := []struct {
+		policy OverflowPolicy
+		ids    []string
+	}{
+		{OverflowDropNewest, []string{"c1", "c2"}},
+		{OverflowDropOldest, []string{"c3", "c4"}},
+		{OverflowBlock, []string{"c3", "c4", "c1", "c2"}},
+	}
+	for i, tt := range tbl {
+		dest := &MockDest{id: 1}
+		s := NewServiceWithParams(nil, ServiceParams{QueueSize: 2, QuietHours: quiet, OverflowPolicy: tt.policy}, dest)
+		for _, id := range []string{"c1", "c2", "c3", "c4"} {
+			s.Submit(Request{Comment: store.Comment{ID: id}})
+			time.Sleep(time.Millisecond * 10)
+		}
+		s.quietLock.Lock()
+		assert.Equal(t, 2, len(s.quiet), "case #%d, deferred up to queue size", i)
+		s.quietLock.Unlock()
+		s.Close()
+		ids := []string{}
+		for _, r := range dest.Get() {
+			ids = append(ids, r.Comment.ID)
+		}
+		assert.Equal(t, tt.ids, ids, "case #%d", i)
+	}
+}
+
+func TestService_DisableDestination(t *testing.T) {
+	d1, d2 := &MockDest{id: 1}, &MockDest{id: 2}
+	s := NewService(nil, 10, d1, d2)
+	require.NoError(t, s.Disable("mock1"))
+	s.Submit(Request{Comment: store.Comment{ID: "c1"}})
+	s.SubmitVerification(VerificationRequest{User: "u1"})
+	time.Sleep(time.Millisecond * 100)
+	assert.Empty(t, d1.Get(), "disabled destination skipped")
+	assert.Empty(t, d1.GetVerify())
+	require.Equal(t, 1, len(d2.Get()), "enabled destination notified")
+	assert.Equal(t, 1, len(d2.GetVerify()))
+
+	require.NoError(t, s.Enable("mock1"))
+	s.Submit(Request{Comment: store.Comment{ID: "c2"}})
+	time.Sleep(time.Millisecond * 100)
+	s.Close()
+	require.Equal(t, 1, len(d1.Get()), "enabled again")
+	assert.Equal(t, "c2", d1.Get()[0].Comment.ID)
+	assert.Equal(t, 2, len(d2.Get()))
+
+	assert.EqualError(t, s.Disable("bad"), `no notification destination "bad"`)
+	assert.EqualError(t, s.Enable("bad"), `no notification destination "bad"`)
+}
+
+func TestQuietHours_end(t *testing.T) {
+	loc := time.FixedZone("UTC-5", -5*60*60)
+	tbl := []struct {
+		quiet QuietHours
+		now   time.Time
+		res   time.Time
+	}{
+		{QuietHours{Start: 22 * time.Hour, End: 7 * time.Hour}, time.Date(2020, 11, 4, 23, 0, 0, 0, time.UTC),
+			time.Date(2020, 11, 5, 7, 0, 0, 0, time.UTC)},
+		{QuietHours{Start: 22 * time.Hour, End: 7 * time.Hour}, time.Date(2020, 11, 4, 3, 0, 0, 0, time.UTC),
+			time.Date(2020, 11, 4, 7, 0, 0, 0, time.UTC)},
+		{QuietHours{Start: 22 * time.Hour, End: 7 * time.Hour}, time.Date(2020, 11, 4, 7, 0, 0, 0, time.UTC), time.Time{}},
+		{QuietHours{Start: 22 * time.Hour, End: 7 * time.Hour}, time.Date(2020, 11, 4, 12, 0, 0, 0, time.UTC), time.Time{}},
+		{QuietHours{Start: 1 * time.Hour, End: 5 * time.Hour}, time.Date(2020, 11, 4, 1, 0, 0, 0, time.UTC),
+			time.Date(2020, 11, 4, 5, 0, 0, 0, time.UTC)},
+		{QuietHours{Start: 1 * time.Hour, End: 5 * time.Hour}, time.Date(2020, 11, 4, 23, 0, 0, 0, time.UTC), time.Time{}},
+		{QuietHours{Start: 5 * time.Hour, End: 5 * time.Hour}, time.Date(2020, 11, 4, 5, 0, 0, 0, time.UTC), time.Time{}},
+		// 04:00 UTC is 23:00 in UTC-5
+		{QuietHours{Start: 22 * time.Hour, End: 7 * time.Hour, Location: loc}, time.Date(2020, 11, 4, 4, 0, 0, 0, time.UTC),
+			time.Date(2020, 11, 4, 7, 0, 0, 0, loc)},
+		{QuietHours{Start: 22 * time.Hour, End: 7 * time.Hour, Location: loc}, time.Date(2020, 11, 4, 23, 0, 0, 0, time.UTC), time.Time{}},
+	}
+	for i, tt := range tbl {
+		res := tt.quiet.end(tt.now)
+		assert.True(t, tt.res.Equal(res), "#%d: expected %v, got %v", i, tt.res, res)
+	}
+}
+
+func TestService_OverflowDropOldest(t *testing.T) {
+	dest := &gateDest{gate: make(chan struct{})}
+	reg := prometheus.NewRegistry()
+	s := NewServiceWithParams(nil, ServiceParams{QueueSize: 3, OverflowPolicy: OverflowDropOldest, MetricsRegisterer: reg}, dest)
+
+	s.Submit(Request{Comment: store.Comment{ID: "c0"}})
+	time.Sleep(time.Millisecond * 50) // c0 taken by dispatcher, stuck in destination
+	for i := 1; i <= 6; i++ {
+		s.Submit(Request{Comment: store.Comment{ID: fmt.Sprintf("c%d", i)}})
+	}
+	close(dest.gate)
+	time.Sleep(time.Millisecond * 100)
+	s.Close()
+
+	ids := []string{}
+	for _, r := range dest.Get() {
+		ids = append(ids, r.Comment.ID)
+	}
+	assert.Equal(t, []string{"c0", "c4", "c5", "c6"}, ids, "the newest requests kept")
+	assert.Equal(t, 3.0, testutil.ToFloat64(s.metrics.dropped))
+}
+
+func TestService_OverflowBlock(t *testing.T) {
+	dest := &gateDest{gate: make(chan struct{})}
+	s := NewServiceWithParams(nil, ServiceParams{QueueSize: 1, OverflowPolicy: OverflowBlock}, dest)
+
+	s.Submit(Request{Comment: store.Comment{ID: "c0"}})
+	time.Sleep(time.Millisecond * 50) // c0 taken by dispatcher, stuck in destination
+	s.Submit(Request{Comment: store.Comment{ID: "c1"}})
+
+	submitted := make(chan struct{})
+	go func() {
+		s.Submit(Request{Comment: store.Comment{ID: "c2"}})
+		close(submitted)
+	}()
+	select {
+	case <-submitted:
+		t.Fatal("submit to the full queue should wait")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(dest.gate)
+	select {
+	case <-submitted:
+	case <-time.After(time.Second):
+		t.Fatal("submit should proceed once the queue is drained")
+	}
+	time.Sleep(time.Millisecond * 100)
+	s.Close()
+
+	ids := []string{}
+	for _, r := range dest.Get() {
+		ids = append(ids, r.Comment.ID)
+	}
+	assert.Equal(t, []string{"c0", "c1", "c2"}, ids, "nothing dropped")
+}
+
+func TestService_OverflowDropNewest(t *testing.T) {
+	dest := &gateDest{gate: make(chan struct{})}
+	reg := prometheus.NewRegistry()
+	s := NewServiceWithParams(nil, ServiceParams{QueueSize: 2, MetricsRegisterer: reg}, dest)
+
+	s.Submit(Request{Comment: store.Comment{ID: "c0"}})
+	time.Sleep(time.Millisecond * 50)
+	for i := 1; i <= 4; i++ {
+		s.Submit(Request{Comment: store.Comment{ID: fmt.Sprintf("c%d", i)}})
+	}
+	close(dest.gate)
+	time.Sleep(time.Millisecond * 100)
+	s.Close()
+
+	ids := []string{}
+	for _, r := range dest.Get() {
+		ids = append(ids, r.Comment.ID)
+	}
+	assert.Equal(t, []string{"c0", "c1", "c2"}, ids, "the oldest requests kept by default")
+	assert.Equal(t, 2.0, testutil.ToFloat64(s.metrics.dropped))
+}
+
+func TestService_Mentions(t *testing.T) {
+	dest := &eventsDest{events: []Event{EventNewComment, EventReply, EventMention}}
+	locator := store.Locator{SiteID: "remark", URL: "https://example.com/post"}
+	dataStore := &mockStore{
+		data: map[string]store.Comment{
+			"p1": {ID: "p1", Locator: locator, User: store.User{ID: "u1", Name: "Alice"}},
+			"p2": {ID: "p2", Locator: locator, User: store.User{ID: "u2", Name: "bob"}},
+			"p3": {ID: "p3", Locator: locator, User: store.User{ID: "u3", Name: "Carol"}},
+			"p4": {ID: "p4", Locator: locator, User: store.User{ID: "u4", Name: "dave"}},
+			"o1": {ID: "o1", Locator: store.Locator{SiteID: "remark", URL: "https://example.com/other"},
+				User: store.User{ID: "u5", Name: "eve"}},
+		},
+		emailData: map[string]string{"u1": "alice@example.com", "u2": "bob@example.com", "u3": "carol@example.com",
+			"u5": "eve@example.com"},
+	}
+	s := NewServiceWithParams(dataStore, ServiceParams{QueueSize: 10, Mentions: true}, dest)
+
+	// reply to alice by carol, mentioning alice (already notified about the reply), bob twice, herself,
+	// dave without email, eve from another post and unknown user
+	s.Submit(Request{Event: EventReply, Comment: store.Comment{ID: "c1", ParentID: "p1", Locator: locator,
+		User: store.User{ID: "u3", Name: "Carol"}, Orig: "@alice, @Bob and @BOB. cc @carol @dave @eve @nobody"}})
+	time.Sleep(time.Millisecond * 110)
+	s.Close()
+
+	reqs := dest.Get()
+	require.Equal(t, 2, len(reqs))
+	assert.Equal(t, EventReply, reqs[0].Event)
+	assert.Equal(t, []string{"alice@example.com"}, reqs[0].Emails)
+	assert.Equal(t, EventMention, reqs[1].Event)
+	assert.Equal(t, "c1", reqs[1].Comment.ID)
+	assert.Equal(t, []string{"bob@example.com"}, reqs[1].Emails)
+	assert.Equal(t, store.User{ID: "u2", Name: "bob"}, reqs[1].mention)
+
+	// mentions disabled
+	dest = &eventsDest{events: []Event{EventNewComment, EventReply, EventMention}}
+	s = NewServiceWithParams(dataStore, ServiceParams{QueueSize: 10}, dest)
+	s.Submit(Request{Comment: store.Comment{ID: "c2", Locator: locator, User: store.User{ID: "u3"}, Orig: "@bob"}})
+	time.Sleep(time.Millisecond * 110)
+	s.Close()
+	require.Equal(t, 1, len(dest.Get()))
+	assert.Equal(t, EventNewComment, dest.Get()[0].Event)
+}
+
+func TestService_DeleteNotification(t *testing.T) {
+	dest := &eventsDest{events: []Event{EventDelete}}
+	locator := store.Locator{SiteID: "remark", URL: "https://example.com/post"}
+	dataStore := &mockStore{
+		data: map[string]store.Comment{
+			"p1": {ID: "p1", Locator: locator, User: store.User{ID: "u1", Name: "Alice"}},
+		},
+		emailData: map[string]string{"u1": "alice@example.com", "u2": "bob@example.com"},
+	}
+	s := NewServiceWithParams(dataStore, ServiceParams{QueueSize: 10}, dest)
+
+	// deleted by moderator, author notified instead of the reply chain
+	s.Submit(Request{Event: EventDelete, Moderated: true, DeleteReason: "spam", Comment: store.Comment{ID: "c1",
+		ParentID: "p1", Locator: locator, User: store.User{ID: "u2", Name: "bob"}}})
+	// deleted by the author
+	s.Submit(Request{Event: EventDelete, Comment: store.Comment{ID: "c2", ParentID: "p1", Locator: locator,
+		User: store.User{ID: "u2", Name: "bob"}}})
+	time.Sleep(time.Millisecond * 110)
+	s.Close()
+
+	reqs := dest.Get()
+	require.Equal(t, 2, len(reqs))
+	assert.Equal(t, "c1", reqs[0].Comment.ID)
+	assert.Equal(t, []string{"bob@example.com"}, reqs[0].Emails)
+	assert.Equal(t, "spam", reqs[0].DeleteReason)
+	assert.Equal(t, "c2", reqs[1].Comment.ID)
+	assert.Empty(t, reqs[1].Emails)
+}
+
+func TestMentionedNames(t *testing.T) {
+	tbl := []struct {
+		text string
+		res  []string
+	}{
+		{"", nil},
+		{"no mentions, user@example.com", nil},
+		{"@alice hi", []string{"alice"}},
+		{"hi @Alice, @bob. and @ALICE!", []string{"alice", "bob"}},
+		{"(@user_1) @имя @a.b.c. @@double @-", []string{"user_1", "имя", "a.b.c"}},
+		{"see https://example.com/@someone", nil},
+	}
+	for i, tt := range tbl {
+		assert.Equal(t, tt.res, mentionedNames(tt.text), "case #%d", i)
+	}
+}
+
 func TestService_EmailRetrieval(t *testing.T) {
 	dest := &MockDest{id: 1}
 	dataStore := &mockStore{data: map[string]store.Comment{}, emailData: map[string]string{}}
@@ -271,6 +700,50 @@ func TestService_Recursive(t *testing.T) {
 	s.Close()
 }
 
+func TestService_Subscriptions(t *testing.T) {
+	dest := &MockDest{id: 1}
+	dataStore := &mockStore{data: map[string]store.Comment{}, emailData: map[string]string{}}
+	locator := store.Locator{SiteID: "remark", URL: "https://example.com/post"}
+
+	dataStore.data["p1"] = store.Comment{ID: "p1", Locator: locator, User: store.User{ID: "u1"}}
+	dataStore.data["p2"] = store.Comment{ID: "p2", ParentID: "p1", Locator: locator, User: store.User{ID: "u2"}}
+	dataStore.data["p3"] = store.Comment{ID: "p3", ParentID: "p2", Locator: locator, User: store.User{ID: "u3"}}
+	dataStore.emailData["u1"] = "u1@example.com"
+	dataStore.emailData["u2"] = "u2@example.com"
+
+	s := NewServiceWithParams(dataStore, ServiceParams{QueueSize: 1, Subscriptions: NewMemSubscriptions()}, dest)
+	defer s.Close()
+
+	s.Submit(Request{Comment: dataStore.data["p2"]})
+	time.Sleep(time.Millisecond * 110)
+	destRes := dest.Get()
+	require.Equal(t, 1, len(destRes))
+	assert.Equal(t, []string{"u1@example.com"}, destRes[0].Emails, "direct reply notified without subscription")
+
+	s.Submit(Request{Comment: dataStore.data["p3"]})
+	time.Sleep(time.Millisecond * 110)
+	destRes = dest.Get()
+	require.Equal(t, 2, len(destRes))
+	assert.Equal(t, []string{"u2@example.com"}, destRes[1].Emails, "u1 not subscribed to the thread")
+
+	require.NoError(t, s.Subscribe("u1", locator))
+	s.Submit(Request{Comment: dataStore.data["p3"]})
+	time.Sleep(time.Millisecond * 110)
+	destRes = dest.Get()
+	require.Equal(t, 3, len(destRes))
+	assert.ElementsMatch(t, []string{"u1@example.com", "u2@example.com"}, destRes[2].Emails, "u1 subscribed to the thread")
+
+	require.NoError(t, s.Unsubscribe("u1", locator))
+	s.Submit(Request{Comment: dataStore.data["p3"]})
+	time.Sleep(time.Millisecond * 110)
+	destRes = dest.Get()
+	require.Equal(t, 4, len(destRes))
+	assert.Equal(t, []string{"u2@example.com"}, destRes[3].Emails, "u1 unsubscribed")
+
+	assert.EqualError(t, NopService.Subscribe("u1", locator), "subscriptions are not enabled")
+	assert.EqualError(t, NopService.Unsubscribe("u1", locator), "subscriptions are not enabled")
+}
+
 func TestService_Nop(t *testing.T) {
 	s := NopService
 	s.Submit(Request{Comment: store.Comment{}})
@@ -281,6 +754,7 @@ func TestService_Nop(t *testing.T) {
 type mockStore struct {
 	data      map[string]store.Comment
 	emailData map[string]string
+	blocked   map[string]bool // site::user -> blocked
 }
 
 func (m mockStore) Get(_ store.Locator, id string, _ store.User) (store.Comment, error) {
@@ -298,3 +772,198 @@ func (m mockStore) GetUserEmail(_, userID string) (string, error) {
 	}
 	return email, nil
 }
+
+func (m mockStore) IsBlocked(siteID, userID string) bool {
+	return m.blocked[siteID+"::"+userID]
+}
+
+func (m mockStore) Find(locator store.Locator, _ string, _ store.User) (res []store.Comment, err error) {
+	for _, c := range m.data {
+		if c.Locator == locator {
+			res = append(res, c)
+		}
+	}
+	return res, nil
+}
+
+func TestService_FanOut(t *testing.T) {
+	d1, d2 := &MockDest{id: 1}, &MockDest{id: 2}
+	s := NewServiceWithParams(nil, ServiceParams{QueueSize: 10, DestinationTimeout: time.Second}, d1, d2)
+	assert.Equal(t, time.Second, s.DestinationTimeout)
+
+	s.Submit(Request{Comment: store.Comment{ID: "100"}})
+	s.SubmitVerification(VerificationRequest{User: "u1"})
+	time.Sleep(time.Millisecond * 50)
+	s.Close()
+
+	for _, d := range []*MockDest{d1, d2} {
+		require.Equal(t, 1, len(d.Get()), d.String())
+		assert.Equal(t, "100", d.Get()[0].Comment.ID)
+		require.Equal(t, 1, len(d.GetVerify()), d.String())
+		assert.True(t, d.shutdown, "destination closed")
+	}
+}
+
+func TestService_Ping(t *testing.T) {
+	assert.NoError(t, NewService(nil, 1).Ping(context.Background()), "no destinations")
+
+	s := NewServiceWithParams(nil, ServiceParams{DestinationTimeout: time.Second}, &MockDest{id: 1},
+		&Email{smtp: &fakeTestSMTP{fail: map[string]bool{"create": true}}, SMTPParams: SMTPParams{Host: "example.org", Port: 25}})
+	defer s.Close()
+	err := s.Ping(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "example.org:25 is not reachable: can't connect to example.org:25: failed to create client")
+	assert.NotContains(t, err.Error(), "mock")
+}
+
+func TestService_fanOutErrors(t *testing.T) {
+	d1, d2 := &MockDest{id: 1}, &MockDest{id: 2}
+	s := NewServiceWithParams(nil, ServiceParams{DestinationTimeout: 50 * time.Millisecond}, d1, d2)
+	defer s.Close()
+	assert.Equal(t, defaultQueueSize, s.QueueSize)
+
+	var calls int32
+	err := s.fanOut(context.Background(), func(ctx context.Context, d Destination) error {
+		atomic.AddInt32(&calls, 1)
+		if d == d1 {
+			return errors.New("d1 error")
+		}
+		return nil
+	})
+	assert.EqualError(t, err, "1 error occurred:\n\t* failed to send to mock id=1, closed=false: d1 error\n\n")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+	// d1 respects timeout, d2 blocks ignoring it
+	st := time.Now()
+	delivered := make(chan struct{})
+	err = s.fanOut(context.Background(), func(ctx context.Context, d Destination) error {
+		if d == d1 {
+			<-ctx.Done()
+			close(delivered)
+			return ctx.Err()
+		}
+		time.Sleep(5 * time.Second)
+		return nil
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to send to mock id=1, closed=false: context deadline exceeded")
+	assert.Contains(t, err.Error(), "mock id=2, closed=false blocked for more than 50ms")
+	assert.True(t, time.Since(st) < 2*time.Second, "blocked destination abandoned, %s", time.Since(st))
+	<-delivered
+
+	// healthy destination gets next request while the other is still blocked
+	err = s.fanOut(context.Background(), func(ctx context.Context, d Destination) error { return nil })
+	assert.NoError(t, err)
+}
+
+func TestService_EventFilter(t *testing.T) {
+	d1, d2 := &MockDest{id: 1}, &eventsDest{MockDest: MockDest{id: 2}, events: []Event{EventEdit}}
+	s := NewService(nil, 10, d1, d2)
+
+	s.Submit(Request{Comment: store.Comment{ID: "100"}})
+	s.Submit(Request{Event: EventReply, Comment: store.Comment{ID: "101"}})
+	s.Submit(Request{Event: EventEdit, Comment: store.Comment{ID: "102"}})
+	s.Submit(Request{Event: EventDelete, Comment: store.Comment{ID: "103"}})
+	time.Sleep(time.Millisecond * 100)
+	s.Close()
+
+	require.Equal(t, 2, len(d1.Get()), "new comments and replies only by default")
+	assert.Equal(t, EventNewComment, d1.Get()[0].Event, "unset event is new comment")
+	assert.Equal(t, EventReply, d1.Get()[1].Event)
+	require.Equal(t, 1, len(d2.Get()), "filtered by destination")
+	assert.Equal(t, "102", d2.Get()[0].Comment.ID)
+}
+
+func TestService_Concurrency(t *testing.T) {
+	var running, maxRunning int32
+	dests := make([]Destination, 5)
+	for i := range dests {
+		dests[i] = &countingDest{MockDest: MockDest{id: i}, running: &running, maxRunning: &maxRunning}
+	}
+	s := NewServiceWithParams(nil, ServiceParams{QueueSize: 10, Concurrency: 2}, dests...)
+	s.Submit(Request{Comment: store.Comment{ID: "c1"}})
+	s.Submit(Request{Comment: store.Comment{ID: "c2"}})
+	time.Sleep(500 * time.Millisecond)
+	s.Close()
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(&maxRunning), "no more than 2 destinations at once")
+	for _, d := range dests {
+		assert.Equal(t, 2, len(d.(*countingDest).Get()), "all destinations got all requests")
+	}
+
+	// errors of all destinations combined
+	s = NewServiceWithParams(nil, ServiceParams{Concurrency: 2, DestinationTimeout: time.Second}, dests...)
+	err := s.fanOut(context.Background(), func(ctx context.Context, d Destination) error {
+		return errors.New("failed")
+	})
+	require.Error(t, err)
+	assert.Equal(t, 5, len(err.(*multierror.Error).Errors))
+	s.Close()
+}
+
+func Test_absoluteURL(t *testing.T) {
+	tbl := []struct {
+		base, link, res string
+	}{
+		{"https://remark42.example.com", "/api/v1/avatar/a1.image", "https://remark42.example.com/api/v1/avatar/a1.image"},
+		{"https://remark42.example.com/", "https://cdn.example.com/a1.png", "https://cdn.example.com/a1.png"},
+		{"https://remark42.example.com", "", ""},
+		{"", "/api/v1/avatar/a1.image", "/api/v1/avatar/a1.image"},
+		{"https://remark42.example.com", "http://[::1]:namedport", "http://[::1]:namedport"},
+	}
+	for i, tt := range tbl {
+		assert.Equal(t, tt.res, absoluteURL(tt.base, tt.link), "case #%d", i)
+	}
+}
+
+func TestEvent_String(t *testing.T) {
+	tbl := map[Event]string{EventNewComment: "new_comment", EventReply: "reply", EventEdit: "edit",
+		EventDelete: "delete", EventVerification: "verification", EventMention: "mention", Event(42): "event(42)"}
+	for e, str := range tbl {
+		assert.Equal(t, str, e.String())
+	}
+}
+
+type eventsDest struct {
+	MockDest
+	events []Event
+}
+
+func (d *eventsDest) Accepts(e Event) bool {
+	for _, ev := range d.events {
+		if ev == e {
+			return true
+		}
+	}
+	return false
+}
+
+// gateDest is a destination waiting for the gate to be closed before sending
+type gateDest struct {
+	MockDest
+	gate chan struct{}
+}
+
+func (d *gateDest) Send(ctx context.Context, r Request) error {
+	<-d.gate
+	return d.MockDest.Send(ctx, r)
+}
+
+// countingDest is a destination tracking max number of concurrent sends
+type countingDest struct {
+	MockDest
+	running, maxRunning *int32
+}
+
+func (d *countingDest) Send(ctx context.Context, r Request) error {
+	n := atomic.AddInt32(d.running, 1)
+	defer atomic.AddInt32(d.running, -1)
+	for {
+		m := atomic.LoadInt32(d.maxRunning)
+		if n <= m || atomic.CompareAndSwapInt32(d.maxRunning, m, n) {
+			break
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	return d.MockDest.Send(ctx, r)
+}
@@ -0,0 +1,130 @@
+package notify
+
+import (
+	"bytes"
+	"crypto/sha1" //nolint:gosec // used for multipart boundary only
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	// x/crypto/openpgp is frozen upstream, github.com/ProtonMail/go-crypto/openpgp keeps the same API
+	// and replaces it by import path once the module can require go 1.17 and its dependencies
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// PGPKeyStore looks up OpenPGP public keys of recipients, request messages to recipients with a key are encrypted
+type PGPKeyStore interface {
+	// PublicKey returns armored public key of the recipient, empty if the recipient has no key
+	PublicKey(email string) (string, error)
+}
+
+// PGPKeyDir is PGPKeyStore reading keys from files named by recipient email with .asc extension,
+// i.e. user@example.com.asc, in the directory
+type PGPKeyDir string
+
+// PublicKey reads armored key of the recipient, empty if there is no key file
+func (d PGPKeyDir) PublicKey(email string) (string, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if email == "" || strings.ContainsAny(email, `/\`) || strings.HasPrefix(email, ".") {
+		return "", errors.Errorf("invalid email %q for pgp key lookup", email)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(string(d), email+".asc")) //nolint:gosec // name is checked above
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "can't read pgp key of %q", email)
+	}
+	return string(data), nil
+}
+
+// pgpHashSHA256 is OpenPGP id of SHA256 hash algorithm, RFC 4880 section 9.4
+const pgpHashSHA256 = 8
+
+// contentHeaders are headers of the message content, moved into the encrypted part
+var contentHeaders = map[string]bool{"mime-version": true, "content-type": true, "content-transfer-encoding": true}
+
+// encryptMessage returns message with its content encrypted for the recipient's key from PGPKeys,
+// as PGP/MIME (RFC 3156) multipart/encrypted message. Headers other than content ones, including the subject,
+// are left as is. Message is returned unchanged if PGPKeys is not set or the recipient has no key.
+// Copies of the message, see CC and ArchiveEmail, can be read by the recipient's key only.
+func (e *Email) encryptMessage(message, to string) (string, error) {
+	if e.PGPKeys == nil {
+		return message, nil
+	}
+	key, err := e.PGPKeys.PublicKey(to)
+	if err != nil {
+		return "", errors.Wrapf(err, "can't get pgp key of %q", to)
+	}
+	if key == "" {
+		return message, nil
+	}
+	keys, err := openpgp.ReadArmoredKeyRing(strings.NewReader(key))
+	if err != nil {
+		return "", errors.Wrapf(err, "can't read pgp key of %q", to)
+	}
+	// key without hash preferences means RIPEMD160 for openpgp, which is not available, SHA256 used instead
+	for _, entity := range keys {
+		for _, ident := range entity.Identities {
+			if ident.SelfSignature != nil && len(ident.SelfSignature.PreferredHash) == 0 {
+				ident.SelfSignature.PreferredHash = []uint8{pgpHashSHA256}
+			}
+		}
+	}
+
+	sep := strings.Index(message, "\n\n")
+	if sep < 0 {
+		return "", errors.Errorf("no body in message to %q", to)
+	}
+	var headers, content string
+	for _, line := range strings.Split(message[:sep+1], "\n") {
+		if line == "" {
+			continue
+		}
+		name := strings.ToLower(strings.TrimSpace(strings.SplitN(line, ":", 2)[0]))
+		if contentHeaders[name] && name != "mime-version" {
+			content += line + "\n"
+			continue
+		}
+		if !contentHeaders[name] {
+			headers += line + "\n"
+		}
+	}
+	content += message[sep+1:]
+
+	encrypted := bytes.Buffer{}
+	armored, err := armor.Encode(&encrypted, "PGP MESSAGE", nil)
+	if err != nil {
+		return "", errors.Wrap(err, "can't make armored pgp message")
+	}
+	w, err := openpgp.Encrypt(armored, keys, nil, nil, nil)
+	if err != nil {
+		return "", errors.Wrapf(err, "can't encrypt message to %q", to)
+	}
+	if _, err = w.Write([]byte(content)); err != nil {
+		return "", errors.Wrapf(err, "can't encrypt message to %q", to)
+	}
+	if err = w.Close(); err != nil {
+		return "", errors.Wrapf(err, "can't encrypt message to %q", to)
+	}
+	if err = armored.Close(); err != nil {
+		return "", errors.Wrap(err, "can't make armored pgp message")
+	}
+
+	boundary := fmt.Sprintf("remark42-pgp-%x", sha1.Sum(encrypted.Bytes())) //nolint:gosec // not used for security
+	res := addHeader(headers, "MIME-version", "1.0")
+	res = addHeader(res, "Content-Type", fmt.Sprintf(`multipart/encrypted; protocol="application/pgp-encrypted"; boundary=%q`, boundary))
+	res += "\n--" + boundary + "\n"
+	res = addHeader(res, "Content-Type", "application/pgp-encrypted")
+	res = addHeader(res, "Content-Description", "PGP/MIME version identification")
+	res += "\nVersion: 1\n\n--" + boundary + "\n"
+	res = addHeader(res, "Content-Type", `application/octet-stream; name="encrypted.asc"`)
+	res = addHeader(res, "Content-Description", "OpenPGP encrypted message")
+	res = addHeader(res, "Content-Disposition", `inline; filename="encrypted.asc"`)
+	res += "\n" + encrypted.String() + "\n--" + boundary + "--\n"
+	return res, nil
+}
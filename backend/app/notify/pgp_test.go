@@ -0,0 +1,184 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+
+	"github.com/umputun/remark42/backend/app/store"
+)
+
+func TestEmail_EncryptMessage(t *testing.T) {
+	entity, pub := testPGPKey(t)
+	email, err := NewEmail(EmailParams{
+		From:                     "from@example.org",
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "testdata/msg.html.tmpl",
+		TokenGenFn:               TokenGenFn,
+		PGPKeys:                  mockKeyStore{"test@example.org": pub},
+	}, SMTPParams{})
+	require.NoError(t, err)
+	req := Request{
+		Comment: store.Comment{ID: "999", User: store.User{ID: "1", Name: "test_user"}, ParentID: "1", Text: "secret comment",
+			PostTitle: "test_title"},
+		parent: store.Comment{ID: "1", User: store.User{ID: "999", Name: "parent_user"}},
+	}
+
+	res, err := email.buildMessageFromRequest(email.sender(""), req, "test@example.org", false)
+	require.NoError(t, err)
+	assert.NotContains(t, res, "secret comment")
+	msg, err := mail.ReadMessage(strings.NewReader(res))
+	require.NoError(t, err)
+	assert.Equal(t, "test@example.org", msg.Header.Get("To"))
+	assert.Equal(t, `New reply to your comment for "test_title"`, func() string {
+		s, e := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+		require.NoError(t, e)
+		return s
+	}(), "headers are not encrypted")
+	assert.Empty(t, msg.Header.Get("Content-Transfer-Encoding"))
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	assert.Equal(t, "multipart/encrypted", mediaType)
+	assert.Equal(t, "application/pgp-encrypted", params["protocol"])
+
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	part, err := mr.NextPart()
+	require.NoError(t, err)
+	assert.Equal(t, "application/pgp-encrypted", part.Header.Get("Content-Type"))
+	version, err := ioutil.ReadAll(part)
+	require.NoError(t, err)
+	assert.Equal(t, "Version: 1\n", string(version))
+	part, err = mr.NextPart()
+	require.NoError(t, err)
+	assert.Equal(t, `application/octet-stream; name="encrypted.asc"`, part.Header.Get("Content-Type"))
+
+	block, err := armor.Decode(part)
+	require.NoError(t, err)
+	md, err := openpgp.ReadMessage(block.Body, openpgp.EntityList{entity}, nil, nil)
+	require.NoError(t, err)
+	decrypted, err := ioutil.ReadAll(md.UnverifiedBody)
+	require.NoError(t, err)
+	inner, err := mail.ReadMessage(bytes.NewReader(decrypted))
+	require.NoError(t, err)
+	assert.Contains(t, inner.Header.Get("Content-Type"), "multipart/alternative")
+	innerBody, err := ioutil.ReadAll(inner.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(innerBody), "secret comment", "content is encrypted")
+
+	// recipient without key gets plain message
+	res, err = email.buildMessageFromRequest(email.sender(""), req, "nokey@example.org", false)
+	require.NoError(t, err)
+	assert.Contains(t, res, "Content-Type: multipart/alternative")
+	assert.Contains(t, res, "Content-Type: text/html")
+	assert.Contains(t, res, "secret comment")
+	assert.NotContains(t, res, "pgp")
+
+	// key lookup error and bad key fail the message
+	email.PGPKeys = mockKeyStore{"test@example.org": "bad key"}
+	_, err = email.buildMessageFromRequest(email.sender(""), req, "test@example.org", false)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `can't read pgp key of "test@example.org"`)
+	_, err = email.buildMessageFromRequest(email.sender(""), req, "error@example.org", false)
+	assert.EqualError(t, err, `can't get pgp key of "error@example.org": key store error`)
+}
+
+func TestPGPKeyDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pgp")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "user@example.org.asc"), []byte("key"), 0600))
+
+	keys := PGPKeyDir(dir)
+	key, err := keys.PublicKey("User@Example.org")
+	require.NoError(t, err)
+	assert.Equal(t, "key", key)
+	key, err = keys.PublicKey("other@example.org")
+	require.NoError(t, err)
+	assert.Empty(t, key)
+	_, err = keys.PublicKey("../user@example.org")
+	assert.EqualError(t, err, `invalid email "../user@example.org" for pgp key lookup`)
+}
+
+func TestEmail_EncryptAllMessages(t *testing.T) {
+	entity, pub := testPGPKey(t)
+	dir, err := ioutil.TempDir("", "pgp")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fakeSMTP := &fakeTestSMTP{}
+	email := prepDigestEmail(t, fakeSMTP)
+	email.PGPKeys = mockKeyStore{"test@example.org": pub}
+	sent := func() string {
+		defer fakeSMTP.buff.Reset()
+		msg := fakeSMTP.buff.String()
+		assert.Contains(t, msg, "Content-Type: multipart/encrypted")
+		return decryptPGPMessage(t, entity, msg)
+	}
+
+	require.NoError(t, email.SendVerification(context.Background(),
+		VerificationRequest{SiteID: "remark", User: "u", Email: "test@example.org", Token: "secret-token"}))
+	assert.Contains(t, sent(), "secret-token", "verification encrypted")
+
+	require.NoError(t, email.sendSummary(context.Background(), "test@example.org",
+		[]throttledItem{{SiteID: "remark", RecipientID: "u1", UserName: "secret replier", CommentLink: "https://example.com/p#c"}}))
+	assert.Contains(t, sent(), "secret replier", "summary encrypted")
+
+	d, err := NewDigest(email, DigestParams{TemplatePath: "testdata/digest.html.tmpl", DBPath: filepath.Join(dir, "digest.db")})
+	require.NoError(t, err)
+	msg, err := d.buildMessage("test@example.org", []digestItem{{SiteID: "remark", PostURL: "https://example.com/p",
+		UserID: "u1", CommentID: "c1", UserName: "user", Text: "secret comment", Timestamp: time.Now()}}, time.Time{})
+	require.NoError(t, err)
+	assert.NotContains(t, msg.message, "secret comment")
+	assert.Contains(t, decryptPGPMessage(t, entity, msg.message), "secret comment", "digest encrypted")
+}
+
+// testPGPKey generates key pair, returns it with armored public key
+func testPGPKey(t *testing.T) (entity *openpgp.Entity, pub string) {
+	entity, err := openpgp.NewEntity("test", "", "test@example.org", nil)
+	require.NoError(t, err)
+	buf := bytes.Buffer{}
+	w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	require.NoError(t, err)
+	require.NoError(t, entity.Serialize(w))
+	require.NoError(t, w.Close())
+	return entity, buf.String()
+}
+
+// decryptPGPMessage returns decrypted content of PGP/MIME message
+func decryptPGPMessage(t *testing.T, entity *openpgp.Entity, raw string) string {
+	start := strings.Index(raw, "-----BEGIN PGP MESSAGE-----")
+	require.True(t, start >= 0, "no pgp message in %s", raw)
+	block, err := armor.Decode(strings.NewReader(raw[start:]))
+	require.NoError(t, err)
+	md, err := openpgp.ReadMessage(block.Body, openpgp.EntityList{entity}, nil, nil)
+	require.NoError(t, err)
+	decrypted, err := ioutil.ReadAll(md.UnverifiedBody)
+	require.NoError(t, err)
+	dec, err := ioutil.ReadAll(quotedprintable.NewReader(bytes.NewReader(decrypted)))
+	require.NoError(t, err)
+	return string(dec)
+}
+
+type mockKeyStore map[string]string
+
+func (m mockKeyStore) PublicKey(email string) (string, error) {
+	if strings.HasPrefix(email, "error") {
+		return "", errors.New("key store error")
+	}
+	return m[email], nil
+}
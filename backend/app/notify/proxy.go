@@ -0,0 +1,126 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/proxy"
+)
+
+// DialFunc connects to the address on the named network
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// DialContext calls f, making DialFunc usable as proxy.ContextDialer
+func (f DialFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
+
+// Dial calls f with background context, making DialFunc usable as proxy.Dialer
+func (f DialFunc) Dial(network, addr string) (net.Conn, error) {
+	return f(context.Background(), network, addr)
+}
+
+// ProxyDialer makes DialFunc connecting to addresses through the proxy with given URL, socks5://[user:pass@]host:port
+// or http://[user:pass@]host:port for HTTP CONNECT proxy. Connection to the proxy itself is made by forward,
+// net.Dialer is used if forward is nil
+func ProxyDialer(proxyURL string, forward DialFunc) (DialFunc, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't parse proxy URL %q", proxyURL)
+	}
+	if u.Host == "" {
+		return nil, errors.Errorf("no host in proxy URL %q", proxyURL)
+	}
+	if forward == nil {
+		forward = (&net.Dialer{}).DialContext
+	}
+
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if u.User != nil {
+			pass, _ := u.User.Password()
+			auth = &proxy.Auth{User: u.User.Username(), Password: pass}
+		}
+		d, err := proxy.SOCKS5("tcp", u.Host, auth, forward)
+		if err != nil {
+			return nil, errors.Wrapf(err, "can't make socks5 dialer for %s", u.Host)
+		}
+		return d.(proxy.ContextDialer).DialContext, nil
+	case "http":
+		return func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialConnect(ctx, forward, u, addr)
+		}, nil
+	default:
+		return nil, errors.Errorf("unsupported proxy scheme %q, socks5 or http expected", u.Scheme)
+	}
+}
+
+// dialConnect connects to the HTTP proxy and asks it to tunnel the connection to addr with CONNECT request
+func dialConnect(ctx context.Context, forward DialFunc, proxyURL *url.URL, addr string) (net.Conn, error) {
+	conn, err := forward(ctx, "tcp", proxyURL.Host)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to connect to proxy %s", proxyURL.Host)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", addr, addr)
+	if proxyURL.User != nil {
+		pass, _ := proxyURL.User.Password()
+		creds := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + pass))
+		req += "Proxy-Authorization: Basic " + creds + "\r\n"
+	}
+	if _, err = conn.Write([]byte(req + "\r\n")); err != nil {
+		_ = conn.Close()
+		return nil, errors.Wrapf(err, "failed to send connect request to proxy %s", proxyURL.Host)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: "CONNECT"})
+	if err != nil {
+		_ = conn.Close()
+		return nil, errors.Wrapf(err, "failed to read connect response from proxy %s", proxyURL.Host)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, errors.Errorf("proxy %s refused connection to %s: %s", proxyURL.Host, addr, resp.Status)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	if br.Buffered() > 0 {
+		// data sent by the server right after tunnel establishment, i.e. SMTP greeting, is already read
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is net.Conn reading from the buffer holding data already received from the connection
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// Read reads from the buffer, which reads from the connection once drained
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// proxyTransport makes http transport with all connections made by dial, nil (default transport) returned for nil dial
+func proxyTransport(dial DialFunc) http.RoundTripper {
+	if dial == nil {
+		return nil
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil // dial already connects through the proxy
+	transport.DialContext = dial
+	return transport
+}
@@ -0,0 +1,138 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/pkg/errors"
+)
+
+// PushoverParams contain settings for pushover destination
+type PushoverParams struct {
+	Token      string        // application API token
+	User       string        // user or group key of the recipient
+	Device     string        // device name to send notifications to, all user's devices if empty
+	APIURL     string        // messages API endpoint, pushover one used if empty
+	Timeout    time.Duration // request timeout
+	MaxRetries int           // max number of retries on rate limit responses
+}
+
+// Pushover implements notify.Destination for pushover push notifications
+type Pushover struct {
+	PushoverParams
+	hookDestination
+}
+
+const (
+	pushoverAPIURL         = "https://api.pushover.net/1/messages.json"
+	pushoverMaxMessage     = 1024 // max length of message in characters
+	pushoverMaxTitle       = 250  // max length of title in characters
+	pushoverMaxURLTitle    = 100  // max length of url title in characters
+	pushoverBodyLimitBytes = 1024
+)
+
+// NewPushover makes pushover destination
+func NewPushover(params PushoverParams) (*Pushover, error) {
+	if params.Token == "" {
+		return nil, errors.New("pushover application token is required")
+	}
+	if params.User == "" {
+		return nil, errors.New("pushover user key is required")
+	}
+	res := Pushover{PushoverParams: params}
+	if res.APIURL == "" {
+		res.APIURL = pushoverAPIURL
+	}
+	if res.Timeout <= 0 {
+		res.Timeout = hookTimeOut
+	}
+	if res.MaxRetries <= 0 {
+		res.MaxRetries = hookMaxRetries
+	}
+	log.Printf("[DEBUG] create new pushover notifier for %s, timeout=%s", res.APIURL, res.Timeout)
+	return &res, nil
+}
+
+// Send comment as push notification with link to the comment
+func (p *Pushover) Send(ctx context.Context, req Request) error {
+	log.Printf("[DEBUG] send pushover notification, comment id %s", req.Comment.ID)
+	hr := hookRequest{name: "pushover", url: p.APIURL, contentType: "application/x-www-form-urlencoded",
+		body: []byte(p.message(req).Encode()), timeout: p.Timeout, check: checkPushoverResponse}
+	return retryAttempts(ctx, "pushover notification", p.MaxRetries, func() (time.Duration, error) { return postHook(ctx, hr) })
+}
+
+// checkPushoverResponse checks pushover responded with status 1, errors list is set otherwise
+func checkPushoverResponse(resp *http.Response) error {
+	pResp := struct {
+		Status int      `json:"status"`
+		Errors []string `json:"errors"`
+	}{}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, pushoverBodyLimitBytes))
+	if err != nil {
+		return errors.Wrap(err, "failed to read pushover response")
+	}
+	success := resp.StatusCode >= 200 && resp.StatusCode < 300
+	if err = json.Unmarshal(body, &pResp); err != nil && success {
+		return errors.Wrap(err, "can't decode pushover response")
+	}
+	if len(pResp.Errors) > 0 {
+		return errors.Errorf("pushover error, status code %d: %s", resp.StatusCode, strings.Join(pResp.Errors, ", "))
+	}
+	if success && pResp.Status != 1 {
+		return errors.Errorf("unexpected pushover status %d", pResp.Status)
+	}
+	return nil
+}
+
+// message makes pushover message form with post title, comment text and link to the comment
+func (p *Pushover) message(req Request) url.Values {
+	from := req.Comment.User.Name
+	if req.Comment.ParentID != "" {
+		from += " → " + req.parent.User.Name
+	}
+	text := req.Comment.Orig
+	if text == "" {
+		text = htmlToText(req.Comment.Text)
+	}
+	title := "New comment"
+	if req.Comment.PostTitle != "" {
+		title = req.Comment.PostTitle
+	}
+	urlTitle := "original comment"
+	if req.Comment.PostTitle != "" {
+		urlTitle = "comment to " + req.Comment.PostTitle
+	}
+
+	res := url.Values{
+		"token":     {p.Token},
+		"user":      {p.User},
+		"title":     {truncateRunes(title, pushoverMaxTitle)},
+		"message":   {truncateRunes(from+": "+text, pushoverMaxMessage)},
+		"url":       {req.Comment.Locator.URL + uiNav + req.Comment.ID},
+		"url_title": {truncateRunes(urlTitle, pushoverMaxURLTitle)},
+	}
+	if p.Device != "" {
+		res.Set("device", p.Device)
+	}
+	return res
+}
+
+// Name of Pushover destination
+func (p *Pushover) Name() string {
+	return "pushover"
+}
+
+// String representation of Pushover object
+func (p *Pushover) String() string {
+	if p.Device == "" {
+		return "pushover: all devices"
+	}
+	return "pushover: " + p.Device
+}
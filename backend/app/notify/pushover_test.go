@@ -0,0 +1,143 @@
+package notify
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/remark42/backend/app/store"
+)
+
+func TestPushover_New(t *testing.T) {
+	_, err := NewPushover(PushoverParams{User: "user"})
+	assert.EqualError(t, err, "pushover application token is required")
+	_, err = NewPushover(PushoverParams{Token: "token"})
+	assert.EqualError(t, err, "pushover user key is required")
+
+	p, err := NewPushover(PushoverParams{Token: "token", User: "user"})
+	require.NoError(t, err)
+	assert.Equal(t, pushoverAPIURL, p.APIURL)
+	assert.Equal(t, hookTimeOut, p.Timeout)
+	assert.Equal(t, hookMaxRetries, p.MaxRetries)
+	assert.Equal(t, "pushover: all devices", p.String())
+	assert.NoError(t, p.SendVerification(context.Background(), VerificationRequest{}))
+	assert.NoError(t, p.Close(context.Background()))
+
+	p.Device = "phone"
+	assert.Equal(t, "pushover: phone", p.String())
+}
+
+func TestPushover_Send(t *testing.T) {
+	var form url.Values
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "POST", r.Method)
+		assert.Equal(t, "application/x-www-form-urlencoded", r.Header.Get("Content-Type"))
+		require.NoError(t, r.ParseForm())
+		form = r.PostForm
+		if form.Get("user") == "bad" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"user":"invalid","errors":["user identifier is invalid"],"status":0,"request":"r1"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"status":1,"request":"r2"}`))
+	}))
+	defer ts.Close()
+
+	p, err := NewPushover(PushoverParams{Token: "token", User: "user", Device: "phone", APIURL: ts.URL})
+	require.NoError(t, err)
+	req := Request{
+		Comment: store.Comment{ID: "c2", ParentID: "c1", Orig: "**bold** reply", User: store.User{Name: "user2"},
+			PostTitle: "Post title", Locator: store.Locator{SiteID: "remark", URL: "https://example.com/post"}},
+		parent: store.Comment{ID: "c1", User: store.User{Name: "user1"}},
+	}
+	require.NoError(t, p.Send(context.Background(), req))
+	assert.Equal(t, url.Values{
+		"token":     {"token"},
+		"user":      {"user"},
+		"device":    {"phone"},
+		"title":     {"Post title"},
+		"message":   {"user2 → user1: **bold** reply"},
+		"url":       {"https://example.com/post#remark42__comment-c2"},
+		"url_title": {"comment to Post title"},
+	}, form)
+
+	// long comment truncated to the message limit, html text used without orig
+	p.Device = ""
+	req = Request{Comment: store.Comment{ID: "c1", Text: "<p>" + strings.Repeat("text ", 500) + "</p>", User: store.User{Name: "user"}}}
+	require.NoError(t, p.Send(context.Background(), req))
+	assert.Equal(t, pushoverMaxMessage, utf8.RuneCountInString(form.Get("message")))
+	assert.True(t, strings.HasPrefix(form.Get("message"), "user: text text"))
+	assert.True(t, strings.HasSuffix(form.Get("message"), "…"))
+	assert.Equal(t, "New comment", form.Get("title"))
+	assert.Equal(t, "original comment", form.Get("url_title"))
+	assert.NotContains(t, form, "device")
+
+	p.User = "bad"
+	assert.EqualError(t, p.Send(context.Background(), req),
+		"failed after 1 attempt(s): pushover error, status code 400: user identifier is invalid")
+
+	p.APIURL = ts.URL + "/\x7f"
+	err = p.Send(context.Background(), req)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to make pushover request")
+
+	p.APIURL = "http://127.0.0.1:1"
+	err = p.Send(context.Background(), req)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to get pushover response")
+}
+
+func TestPushover_SendUnexpectedResponse(t *testing.T) {
+	status := http.StatusOK
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(`not json`))
+	}))
+	defer ts.Close()
+
+	p, err := NewPushover(PushoverParams{Token: "token", User: "user", APIURL: ts.URL})
+	require.NoError(t, err)
+	req := Request{Comment: store.Comment{ID: "c1", Text: "text"}}
+	err = p.Send(context.Background(), req)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "can't decode pushover response")
+
+	status = http.StatusInternalServerError
+	assert.EqualError(t, p.Send(context.Background(), req), "failed after 1 attempt(s): unexpected pushover status code 500")
+}
+
+func TestPushover_SendRateLimited(t *testing.T) {
+	var attempts int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = w.Write([]byte(`{"status":0,"errors":["application is over its quota"]}`))
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = w.Write([]byte(`{"status":1,"request":"r1"}`))
+	}))
+	defer ts.Close()
+
+	p, err := NewPushover(PushoverParams{Token: "token", User: "user", APIURL: ts.URL})
+	require.NoError(t, err)
+	st := time.Now()
+	require.NoError(t, p.Send(context.Background(), Request{Comment: store.Comment{ID: "c1"}}), "2xx status accepted")
+	assert.Equal(t, int32(3), atomic.LoadInt32(&attempts))
+	assert.True(t, time.Since(st) >= 2*time.Second, "Retry-After honored")
+
+	atomic.StoreInt32(&attempts, 0)
+	p.MaxRetries = 1
+	assert.EqualError(t, p.Send(context.Background(), Request{Comment: store.Comment{ID: "c1"}}),
+		"failed after 2 attempt(s): pushover rate limit exceeded")
+}
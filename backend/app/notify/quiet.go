@@ -0,0 +1,119 @@
+package notify
+
+import (
+	"context"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+)
+
+// QuietHours is the daily period when notifications are not sent. Requests made during it are deferred
+// and delivered once it ends, except urgent ones, see Request.Urgent.
+type QuietHours struct {
+	Start    time.Duration  // start of the period since midnight, i.e. 22*time.Hour
+	End      time.Duration  // end of the period since midnight, earlier than Start for the period over midnight
+	Location *time.Location // time zone of Start and End, UTC if nil
+}
+
+// end returns the end of the quiet period t falls in, zero time if t is outside of quiet hours
+func (q QuietHours) end(t time.Time) time.Time {
+	if q.Start == q.End {
+		return time.Time{}
+	}
+	loc := q.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	t = t.In(loc)
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	since := t.Sub(midnight)
+	switch {
+	case q.Start < q.End && since >= q.Start && since < q.End:
+		return midnight.Add(q.End)
+	case q.Start > q.End && since >= q.Start: // over midnight, ends tomorrow
+		return time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc).Add(q.End)
+	case q.Start > q.End && since < q.End:
+		return midnight.Add(q.End)
+	}
+	return time.Time{}
+}
+
+// deferQuiet keeps request made during QuietHours to dispatch it once the period ends, returns false
+// if the request should be sent right away. Up to QueueSize requests are kept, the rest handled according
+// to OverflowPolicy; with OverflowBlock the request is sent right away, as the dispatcher can't wait for itself.
+// Requests still deferred on shutdown are sent by flushQuiet.
+func (s *Service) deferQuiet(c Request) bool {
+	if s.QuietHours == nil || c.Urgent {
+		return false
+	}
+	now := s.now()
+	end := s.QuietHours.end(now)
+	if end.IsZero() {
+		return false
+	}
+	s.quietLock.Lock()
+	defer s.quietLock.Unlock()
+	scheduled := len(s.quiet) > 0 // dispatch at the end of the period is already scheduled
+	if len(s.quiet) >= s.QueueSize {
+		switch s.OverflowPolicy {
+		case OverflowBlock:
+			log.Printf("[WARN] too many notifications deferred for quiet hours, send %+v right away", c.Comment)
+			return false
+		case OverflowDropOldest:
+			s.metrics.incDropped()
+			log.Printf("[WARN] drop the oldest notification deferred for quiet hours, %+v", s.quiet[0].Comment)
+			s.quiet = s.quiet[1:]
+		default:
+			s.metrics.incDropped()
+			log.Printf("[WARN] can't defer notification for quiet hours, %+v", c.Comment)
+			return true
+		}
+	}
+	log.Printf("[DEBUG] defer notification for comment %s till the end of quiet hours at %s", c.Comment.ID, end.Format(time.RFC3339))
+	s.quiet = append(s.quiet, c)
+	if scheduled {
+		return true
+	}
+
+	s.held.Add(1)
+	go func() {
+		defer s.held.Done()
+		timer := time.NewTimer(end.Sub(now))
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-s.ctx.Done():
+			return // sent by flushQuiet on shutdown
+		}
+		reqs := s.takeQuiet()
+		log.Printf("[DEBUG] quiet hours ended, dispatch %d deferred notification(s)", len(reqs))
+		for _, r := range reqs {
+			s.dispatch(r)
+		}
+	}()
+	return true
+}
+
+// flushQuiet sends requests deferred for quiet hours on shutdown, without ScoreDelay. The service context
+// could be canceled by then on drain deadline, so they are sent with own one limited by DestinationTimeout.
+func (s *Service) flushQuiet() {
+	reqs := s.takeQuiet()
+	if len(reqs) == 0 {
+		return
+	}
+	log.Printf("[INFO] send %d notification(s) deferred for quiet hours on shutdown", len(reqs))
+	ctx, cancel := context.WithTimeout(context.Background(), s.DestinationTimeout)
+	defer cancel()
+	for _, r := range reqs {
+		s.send(ctx, r)
+	}
+}
+
+// takeQuiet returns requests deferred for quiet hours and clears them
+func (s *Service) takeQuiet() []Request {
+	s.quietLock.Lock()
+	defer s.quietLock.Unlock()
+	reqs := s.quiet
+	s.quiet = nil
+	return reqs
+}
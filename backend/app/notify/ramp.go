@@ -0,0 +1,63 @@
+package notify
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rampStartFraction is the part of MaxPerSecond messages are sent with right after recovery of the server
+const rampStartFraction = 0.1
+
+// rateRamp changes limit of the rate limiter after recovery of the server, growing it linearly from
+// rampStartFraction of max to max within duration, so the backlog collected during downtime
+// doesn't trip anti-bulk rules of the provider. Thread safe.
+type rateRamp struct {
+	limiter  *rate.Limiter
+	max      rate.Limit
+	duration time.Duration
+	now      func() time.Time
+
+	lock  sync.Mutex
+	start time.Time // start of the current ramp-up, zero if rate is not ramping
+}
+
+func newRateRamp(limiter *rate.Limiter, duration time.Duration) *rateRamp {
+	return &rateRamp{limiter: limiter, max: limiter.Limit(), duration: duration, now: time.Now}
+}
+
+// restart starts ramp-up from the lowest rate
+func (r *rateRamp) restart() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.start = r.now()
+	r.limiter.SetLimitAt(r.start, r.max*rampStartFraction)
+}
+
+// adjust sets limit of the limiter for the current time of ramp-up, max one once it's over
+func (r *rateRamp) adjust() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.start.IsZero() {
+		return
+	}
+	now := r.now()
+	elapsed := now.Sub(r.start)
+	if elapsed >= r.duration {
+		r.start = time.Time{}
+		r.limiter.SetLimitAt(now, r.max)
+		return
+	}
+	progress := rampStartFraction + (1-rampStartFraction)*float64(elapsed)/float64(r.duration)
+	r.limiter.SetLimitAt(now, r.max*rate.Limit(progress))
+}
+
+// EffectiveMaxPerSecond returns current max number of messages sent per second, lowered after recovery
+// of the server with RampDuration set. Zero if sending is unlimited. Thread safe.
+func (e *Email) EffectiveMaxPerSecond() float64 {
+	if e.limiter == nil {
+		return 0
+	}
+	return float64(e.limiter.Limit())
+}
@@ -0,0 +1,52 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/remark42/backend/app/store"
+)
+
+func TestEmail_RampUp(t *testing.T) {
+	email, err := NewEmail(EmailParams{From: "from@example.org", MsgTemplatePath: "testdata/msg.html.tmpl",
+		VerificationTemplatePath: "testdata/verification.html.tmpl", TokenGenFn: TokenGenFn,
+		MaxPerSecond: 1000, BreakerThreshold: 1, BreakerCooldown: time.Nanosecond, RampDuration: time.Minute,
+		MaxRetries: 1, RetryBaseDelay: time.Millisecond, BufferSize: 10, FlushDuration: time.Hour}, SMTPParams{})
+	require.NoError(t, err)
+	defer email.Close(context.Background())
+	fakeSMTP := &fakeTestSMTP{}
+	email.smtp = &flakySMTPCreator{failures: 1, err: errors.New("connection refused"), smtp: fakeSMTP}
+	now := time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC)
+	email.ramp.now = func() time.Time { return now }
+	assert.Equal(t, 1000., email.EffectiveMaxPerSecond())
+
+	flush := func(id string) float64 {
+		req := Request{Comment: store.Comment{ID: id, Locator: store.Locator{SiteID: "remark"}}, Emails: []string{id + "@example.org"}}
+		require.NoError(t, email.Send(context.Background(), req))
+		email.autoFlush()
+		return email.EffectiveMaxPerSecond()
+	}
+	assert.InDelta(t, 100., flush("u1"), 0.001, "rate lowered after recovery")
+	now = now.Add(20 * time.Second)
+	assert.InDelta(t, 400., flush("u2"), 0.001)
+	now = now.Add(20 * time.Second)
+	assert.InDelta(t, 700., flush("u3"), 0.001)
+	now = now.Add(20 * time.Second)
+	assert.InDelta(t, 1000., flush("u4"), 0.001, "max rate at the end of ramp-up")
+	now = now.Add(time.Minute)
+	assert.InDelta(t, 1000., flush("u5"), 0.001)
+	assert.Equal(t, []string{"u1@example.org", "u2@example.org", "u3@example.org", "u4@example.org", "u5@example.org"},
+		fakeSMTP.rcpts)
+
+	unlimited, err := NewEmail(EmailParams{From: "from@example.org", MsgTemplatePath: "testdata/msg.html.tmpl",
+		VerificationTemplatePath: "testdata/verification.html.tmpl", TokenGenFn: TokenGenFn, RampDuration: time.Minute},
+		SMTPParams{})
+	require.NoError(t, err)
+	assert.Nil(t, unlimited.ramp, "no ramp-up without MaxPerSecond")
+	assert.Equal(t, 0., unlimited.EffectiveMaxPerSecond())
+}
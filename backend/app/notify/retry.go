@@ -0,0 +1,30 @@
+package notify
+
+import (
+	"context"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/pkg/errors"
+)
+
+// retryAttempts calls attempt until it succeeds, up to maxRetries times after the first call.
+// Along with the error attempt returns delay before the next one, zero for error which can't be retried.
+// Name identifies the request in log messages.
+func retryAttempts(ctx context.Context, name string, maxRetries int, attempt func() (retryAfter time.Duration, err error)) error {
+	for i := 1; ; i++ {
+		retryAfter, err := attempt()
+		if err == nil {
+			return nil
+		}
+		if retryAfter == 0 || i > maxRetries {
+			return errors.Wrapf(err, "failed after %d attempt(s)", i)
+		}
+		log.Printf("[DEBUG] %s failed, attempt %d, retry in %s, %v", name, i, retryAfter, err)
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(err, "aborted due to canceled context after %d attempt(s)", i)
+		case <-time.After(retryAfter):
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryAttempts(t *testing.T) {
+	calls := 0
+	err := retryAttempts(context.Background(), "test", 3, func() (time.Duration, error) {
+		if calls++; calls < 3 {
+			return time.Millisecond, errors.New("rate limited")
+		}
+		return 0, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls, "retried till success")
+
+	calls = 0
+	err = retryAttempts(context.Background(), "test", 2, func() (time.Duration, error) {
+		calls++
+		return time.Millisecond, errors.New("rate limited")
+	})
+	assert.EqualError(t, err, "failed after 3 attempt(s): rate limited")
+	assert.Equal(t, 3, calls, "max retries after the first attempt")
+
+	calls = 0
+	err = retryAttempts(context.Background(), "test", 2, func() (time.Duration, error) {
+		calls++
+		return 0, errors.New("bad request")
+	})
+	assert.EqualError(t, err, "failed after 1 attempt(s): bad request")
+	assert.Equal(t, 1, calls, "not retryable error")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = retryAttempts(ctx, "test", 2, func() (time.Duration, error) { return time.Hour, errors.New("rate limited") })
+	assert.EqualError(t, err, "aborted due to canceled context after 1 attempt(s): rate limited")
+}
@@ -0,0 +1,88 @@
+package notify
+
+import (
+	"sync"
+)
+
+// threadSequencer keeps messages to the recipient about the same thread in order of comments.
+// Message is held back while the message about an earlier comment of the thread to the same recipient
+// is still being sent or retried, so the retried message is not delivered after the later one.
+// Zero value is ready to use.
+type threadSequencer struct {
+	lock    sync.Mutex
+	pending map[string]map[int64]int // thread key -> sequence -> number of messages being sent
+	changed chan struct{}            // closed and replaced once any message is done
+}
+
+// threadKey identifies thread of the request comment for the recipient, empty if the comment has no timestamp
+// to order messages by
+func threadKey(req Request, email string) string {
+	if req.Comment.Timestamp.IsZero() {
+		return ""
+	}
+	return req.Comment.Locator.SiteID + "|" + req.Comment.Locator.URL + "|" + email
+}
+
+// add registers messages as being sent, messages without thread are not sequenced
+func (s *threadSequencer) add(msgs []emailMessage) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, m := range msgs {
+		if m.thread == "" {
+			continue
+		}
+		if s.pending == nil {
+			s.pending = map[string]map[int64]int{}
+		}
+		if s.pending[m.thread] == nil {
+			s.pending[m.thread] = map[int64]int{}
+		}
+		s.pending[m.thread][m.seq]++
+	}
+}
+
+// done unregisters the message sent or failed permanently, releasing messages held back by it
+func (s *threadSequencer) done(m emailMessage) {
+	if m.thread == "" {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	seqs := s.pending[m.thread]
+	if seqs[m.seq]--; seqs[m.seq] <= 0 {
+		delete(seqs, m.seq)
+	}
+	if len(seqs) == 0 {
+		delete(s.pending, m.thread)
+	}
+	if s.changed != nil {
+		close(s.changed)
+		s.changed = nil
+	}
+}
+
+// ready returns true if no message with an earlier sequence of the same thread is being sent
+func (s *threadSequencer) ready(m emailMessage) bool {
+	if m.thread == "" {
+		return true
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for seq := range s.pending[m.thread] {
+		if seq < m.seq {
+			return false
+		}
+	}
+	return true
+}
+
+// changes returns channel closed once any message is done. Should be taken before checking ready,
+// to not miss the message done in between.
+func (s *threadSequencer) changes() <-chan struct{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.changed == nil {
+		s.changed = make(chan struct{})
+	}
+	return s.changed
+}
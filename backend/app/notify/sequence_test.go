@@ -0,0 +1,95 @@
+package notify
+
+import (
+	"context"
+	"net/textproto"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/remark42/backend/app/store"
+)
+
+func TestThreadSequencer(t *testing.T) {
+	s := threadSequencer{}
+	first := emailMessage{thread: "t1", seq: 1}
+	second := emailMessage{thread: "t1", seq: 2}
+	other := emailMessage{thread: "t2", seq: 0}
+	s.add([]emailMessage{first, second, other})
+
+	assert.True(t, s.ready(first))
+	assert.False(t, s.ready(second), "held back by the first message of the thread")
+	assert.True(t, s.ready(other), "other thread is not affected")
+	assert.True(t, s.ready(emailMessage{}), "message without thread is never held back")
+
+	changed := s.changes()
+	s.done(first)
+	select {
+	case <-changed:
+	default:
+		t.Fatal("changes channel should be closed on done")
+	}
+	assert.True(t, s.ready(second))
+
+	s.done(second)
+	s.done(other)
+	s.done(emailMessage{})
+	assert.Empty(t, s.pending)
+}
+
+func TestThreadKey(t *testing.T) {
+	req := Request{Comment: store.Comment{Timestamp: time.Date(2020, 11, 4, 8, 30, 0, 0, time.UTC),
+		Locator: store.Locator{SiteID: "remark", URL: "https://example.com/post"}}}
+	assert.Equal(t, "remark|https://example.com/post|to@example.org", threadKey(req, "to@example.org"))
+	assert.NotEqual(t, threadKey(req, "to@example.org"), threadKey(req, "other@example.org"))
+
+	req.Comment.Timestamp = time.Time{}
+	assert.Empty(t, threadKey(req, "to@example.org"), "comment without timestamp is not sequenced")
+}
+
+func TestEmail_SendRetriedInOrder(t *testing.T) {
+	fakeSMTP := &fakeTestSMTP{}
+	flaky := &flakySMTPCreator{failures: 1, err: &textproto.Error{Code: 421, Msg: "service not available"}, smtp: fakeSMTP}
+	e := Email{smtp: flaky, EmailParams: EmailParams{MaxRetries: 3, RetryBaseDelay: 100 * time.Millisecond}}
+	first := emailMessage{from: "from@example.org", to: "to@example.org", message: "first", thread: "t1", seq: 1}
+	second := emailMessage{from: "from@example.org", to: "to@example.org", message: "second", thread: "t1", seq: 2}
+	other := emailMessage{from: "from@example.org", to: "to@example.org", message: "other", thread: "t2", seq: 3}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.NoError(t, e.sendWithRetries(context.Background(), []emailMessage{first})[0])
+	}()
+	require.Eventually(t, func() bool { return flaky.readAttempts() == 1 }, time.Second, time.Millisecond,
+		"first message failed and waits for retry")
+
+	// later message of the thread is held back till the retried first one is sent, other thread is not affected
+	errs := e.sendWithRetries(context.Background(), []emailMessage{second, other})
+	wg.Wait()
+	assert.Equal(t, []error{nil, nil}, errs)
+	fakeSMTP.lock.RLock()
+	assert.Equal(t, "otherfirstsecond", fakeSMTP.buff.String())
+	fakeSMTP.lock.RUnlock()
+	assert.Empty(t, e.sequencer.pending)
+
+	// held back message is aborted with the context
+	flaky = &flakySMTPCreator{failures: 10, err: &textproto.Error{Code: 421, Msg: "service not available"}, smtp: &fakeTestSMTP{}}
+	e.smtp = flaky
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		assert.Error(t, e.sendWithRetries(context.Background(), []emailMessage{first})[0])
+	}()
+	require.Eventually(t, func() bool { return flaky.readAttempts() == 1 }, time.Second, time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := e.sendWithRetries(ctx, []emailMessage{second})[0]
+	assert.EqualError(t, err, "aborted due to canceled context while waiting for earlier message of the thread: "+
+		"context deadline exceeded")
+	assert.Equal(t, 1, flaky.readAttempts(), "held back message is not sent")
+	wg.Wait()
+}
@@ -0,0 +1,186 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/pkg/errors"
+)
+
+// SlackParams contain settings for slack destination
+type SlackParams struct {
+	Token        string            // bot token, chat.postMessage API is used if set
+	WebhookURL   string            // incoming webhook URL, used if Token is not set
+	Channel      string            // default channel
+	SiteChannels map[string]string // channel overrides for sites, site id -> channel
+	Timeout      time.Duration     // request timeout
+	MaxRetries   int               // max number of retries on rate limit responses
+	APIURL       string            // chat.postMessage URL, https://slack.com/api/chat.postMessage by default
+}
+
+// Slack implements notify.Destination for slack, with Block Kit formatted messages
+type Slack struct {
+	SlackParams
+	hookDestination
+}
+
+const (
+	slackAPIURL    = "https://slack.com/api/chat.postMessage"
+	slackTextLimit = 3000 // max length of section block text
+)
+
+var (
+	slackLinkRe   = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+	slackBoldRe   = regexp.MustCompile(`(\*\*|__)(.+?)(\*\*|__)`)
+	slackItalicRe = regexp.MustCompile(`\*([^*\n]+)\*`)
+	slackStrikeRe = regexp.MustCompile(`~~(.+?)~~`)
+	slackHeaderRe = regexp.MustCompile(`(?m)^#{1,6}\s+(.+)$`)
+)
+
+// NewSlack makes slack destination
+func NewSlack(params SlackParams) (*Slack, error) {
+	if params.Token == "" && params.WebhookURL == "" {
+		return nil, errors.New("slack token or webhook URL is required")
+	}
+	res := Slack{SlackParams: params}
+	if res.Timeout <= 0 {
+		res.Timeout = hookTimeOut
+	}
+	if res.MaxRetries <= 0 {
+		res.MaxRetries = hookMaxRetries
+	}
+	if res.APIURL == "" {
+		res.APIURL = slackAPIURL
+	}
+	log.Printf("[DEBUG] create new slack notifier for chan %s, timeout=%s", res.Channel, res.Timeout)
+	return &res, nil
+}
+
+// Send comment to slack channel of the comment's site
+func (s *Slack) Send(ctx context.Context, req Request) error {
+	channel := s.Channel
+	if ch, ok := s.SiteChannels[req.Comment.Locator.SiteID]; ok {
+		channel = ch
+	}
+	if s.Token != "" && channel == "" {
+		return errors.Errorf("no slack channel for site %q", req.Comment.Locator.SiteID)
+	}
+	log.Printf("[DEBUG] send slack notification to %s, comment id %s", channel, req.Comment.ID)
+
+	b, err := json.Marshal(s.message(req, channel))
+	if err != nil {
+		return errors.Wrap(err, "failed to make slack body")
+	}
+
+	hr := hookRequest{name: "slack", url: s.WebhookURL, contentType: "application/json; charset=utf-8", body: b, timeout: s.Timeout}
+	if s.Token != "" {
+		// incoming webhook responds with plain "ok", API one with JSON
+		hr.url, hr.header, hr.check = s.APIURL, http.Header{"Authorization": {"Bearer " + s.Token}}, checkSlackResponse
+	}
+	return retryAttempts(ctx, "slack notification", s.MaxRetries, func() (time.Duration, error) { return postHook(ctx, hr) })
+}
+
+// checkSlackResponse checks chat.postMessage API response is ok
+func checkSlackResponse(resp *http.Response) error {
+	if resp.StatusCode != http.StatusOK {
+		return nil // reported as unexpected status
+	}
+	slackResp := struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&slackResp); err != nil {
+		return errors.Wrap(err, "can't decode slack response")
+	}
+	if !slackResp.OK {
+		return errors.Errorf("slack error %q", slackResp.Error)
+	}
+	return nil
+}
+
+// message makes slack message with Block Kit blocks: author with comment text and link to the comment
+func (s *Slack) message(req Request, channel string) interface{} {
+	type text struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	type block struct {
+		Type     string `json:"type"`
+		Text     *text  `json:"text,omitempty"`
+		Elements []text `json:"elements,omitempty"`
+	}
+
+	from := "*" + slackEscape(req.Comment.User.Name) + "*"
+	if req.Comment.ParentID != "" {
+		from += " → *" + slackEscape(req.parent.User.Name) + "*"
+	}
+	commentText := req.Comment.Orig
+	if commentText == "" {
+		commentText = htmlToText(req.Comment.Text)
+	}
+	commentText = truncateRunes(markdownToSlack(commentText), slackTextLimit-len([]rune(from))-1)
+
+	link := req.Comment.Locator.URL + uiNav + req.Comment.ID
+	title := "original comment"
+	if req.Comment.PostTitle != "" {
+		title = slackEscape(req.Comment.PostTitle)
+	}
+
+	return struct {
+		Channel string  `json:"channel,omitempty"`
+		Text    string  `json:"text"`
+		Blocks  []block `json:"blocks"`
+	}{
+		Channel: channel,
+		Text:    "New comment from " + req.Comment.User.Name, // fallback for notifications
+		Blocks: []block{
+			{Type: "section", Text: &text{Type: "mrkdwn", Text: from + "\n" + commentText}},
+			{Type: "context", Elements: []text{{Type: "mrkdwn", Text: "↦ <" + link + "|" + title + ">"}}},
+		},
+	}
+}
+
+// Name of Slack destination
+func (s *Slack) Name() string {
+	return "slack"
+}
+
+func (s *Slack) String() string {
+	if s.Token == "" {
+		return "slack: webhook"
+	}
+	return "slack: " + s.Channel
+}
+
+// markdownToSlack converts common markdown markup to slack mrkdwn
+func markdownToSlack(md string) string {
+	res := slackEscape(md)
+	res = slackLinkRe.ReplaceAllString(res, "<$2|$1>")
+	res = slackHeaderRe.ReplaceAllString(res, "\x00$1\x00")
+	res = slackBoldRe.ReplaceAllString(res, "\x00$2\x00") // mark bold to keep it from italic conversion
+	res = slackItalicRe.ReplaceAllString(res, "_${1}_")
+	res = slackStrikeRe.ReplaceAllString(res, "~$1~")
+	return strings.ReplaceAll(res, "\x00", "*")
+}
+
+// slackEscape escapes control characters of slack messages
+func slackEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+// truncateRunes cuts string to max runes, with ellipsis at the end of truncated one
+func truncateRunes(s string, max int) string {
+	r := []rune(s)
+	if len(r) <= max {
+		return s
+	}
+	if max < 1 {
+		return ""
+	}
+	return string(r[:max-1]) + "…"
+}
@@ -0,0 +1,170 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/remark42/backend/app/store"
+)
+
+func TestSlack_New(t *testing.T) {
+	_, err := NewSlack(SlackParams{})
+	assert.EqualError(t, err, "slack token or webhook URL is required")
+
+	s, err := NewSlack(SlackParams{Token: "xoxb-token", Channel: "#general"})
+	require.NoError(t, err)
+	assert.Equal(t, hookTimeOut, s.Timeout)
+	assert.Equal(t, slackAPIURL, s.APIURL)
+	assert.Equal(t, "slack: #general", s.String())
+	assert.NoError(t, s.SendVerification(context.Background(), VerificationRequest{}))
+
+	s, err = NewSlack(SlackParams{WebhookURL: "https://hooks.slack.com/services/xxx"})
+	require.NoError(t, err)
+	assert.Equal(t, "slack: webhook", s.String())
+}
+
+func TestSlack_SendAPI(t *testing.T) {
+	var body, auth string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		body, auth = string(b), r.Header.Get("Authorization")
+		if strings.Contains(body, "#bad") {
+			_, _ = w.Write([]byte(`{"ok":false,"error":"channel_not_found"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"ok":true}`))
+	}))
+	defer ts.Close()
+
+	s, err := NewSlack(SlackParams{Token: "xoxb-token", Channel: "#general", APIURL: ts.URL,
+		SiteChannels: map[string]string{"site2": "#site2", "bad": "#bad"}})
+	require.NoError(t, err)
+	req := Request{
+		Comment: store.Comment{ID: "c2", ParentID: "c1", Orig: "**bold** and [link](https://example.com)",
+			User: store.User{Name: "user2"}, PostTitle: "Post <1>",
+			Locator: store.Locator{SiteID: "remark", URL: "https://example.com/post"}},
+		parent: store.Comment{ID: "c1", User: store.User{Name: "user1"}},
+	}
+	require.NoError(t, s.Send(context.Background(), req))
+	assert.Equal(t, "Bearer xoxb-token", auth)
+	assert.JSONEq(t, `{"channel":"#general","text":"New comment from user2","blocks":[
+		{"type":"section","text":{"type":"mrkdwn","text":"*user2* → *user1*\n*bold* and <https://example.com|link>"}},
+		{"type":"context","elements":[{"type":"mrkdwn","text":"↦ <https://example.com/post#remark42__comment-c2|Post &lt;1&gt;>"}]}]}`, body)
+
+	req.Comment.Locator.SiteID = "site2"
+	require.NoError(t, s.Send(context.Background(), req))
+	assert.Contains(t, body, `"channel":"#site2"`, "per-site channel")
+
+	req.Comment.Locator.SiteID = "bad"
+	assert.EqualError(t, s.Send(context.Background(), req), `failed after 1 attempt(s): slack error "channel_not_found"`)
+
+	s.Channel = ""
+	req.Comment.Locator.SiteID = "remark"
+	assert.EqualError(t, s.Send(context.Background(), req), `no slack channel for site "remark"`)
+}
+
+func TestSlack_SendWebhook(t *testing.T) {
+	var body string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		body = string(b)
+		if r.URL.Path == "/bad" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	s, err := NewSlack(SlackParams{WebhookURL: ts.URL})
+	require.NoError(t, err)
+	req := Request{Comment: store.Comment{ID: "c1", Text: "<p>html <b>text</b></p>", User: store.User{Name: "user"}}}
+	require.NoError(t, s.Send(context.Background(), req))
+	msg := struct {
+		Channel string `json:"channel"`
+		Blocks  []struct {
+			Text struct {
+				Text string `json:"text"`
+			} `json:"text"`
+		} `json:"blocks"`
+	}{}
+	require.NoError(t, json.Unmarshal([]byte(body), &msg))
+	assert.Empty(t, msg.Channel)
+	assert.Equal(t, "*user*\nhtml text", msg.Blocks[0].Text.Text, "html text used without orig")
+
+	s.WebhookURL = ts.URL + "/bad"
+	assert.EqualError(t, s.Send(context.Background(), req), "failed after 1 attempt(s): unexpected slack status code 404")
+}
+
+func TestSlack_SendRateLimited(t *testing.T) {
+	var attempts int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	s, err := NewSlack(SlackParams{WebhookURL: ts.URL})
+	require.NoError(t, err)
+	st := time.Now()
+	require.NoError(t, s.Send(context.Background(), Request{Comment: store.Comment{ID: "c1"}}))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&attempts))
+	assert.True(t, time.Since(st) >= 2*time.Second, "Retry-After honored")
+
+	atomic.StoreInt32(&attempts, 0)
+	s.MaxRetries = 1
+	assert.EqualError(t, s.Send(context.Background(), Request{Comment: store.Comment{ID: "c1"}}),
+		"failed after 2 attempt(s): slack rate limit exceeded")
+
+	atomic.StoreInt32(&attempts, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = s.Send(ctx, Request{Comment: store.Comment{ID: "c1"}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "aborted due to canceled context after 1 attempt(s)")
+}
+
+func Test_markdownToSlack(t *testing.T) {
+	tbl := []struct {
+		md, res string
+	}{
+		{"**bold** and *italic*", "*bold* and _italic_"},
+		{"__bold__ and _italic_", "*bold* and _italic_"},
+		{"~~strike~~", "~strike~"},
+		{"[link](https://example.com/?a=1&b=2)", "<https://example.com/?a=1&amp;b=2|link>"},
+		{"# Header\ntext", "*Header*\ntext"},
+		{"a < b > c & d", "a &lt; b &gt; c &amp; d"},
+		{"`code` stays", "`code` stays"},
+	}
+	for _, tt := range tbl {
+		assert.Equal(t, tt.res, markdownToSlack(tt.md), tt.md)
+	}
+}
+
+func Test_truncateRunes(t *testing.T) {
+	assert.Equal(t, "short", truncateRunes("short", 10))
+	assert.Equal(t, "при…", truncateRunes("привет", 4))
+	assert.Equal(t, "", truncateRunes("привет", 0))
+
+	s, err := NewSlack(SlackParams{WebhookURL: "http://example.com"})
+	require.NoError(t, err)
+	msg, err := json.Marshal(s.message(Request{Comment: store.Comment{Orig: strings.Repeat("x", 5000), User: store.User{Name: "user"}}}, ""))
+	require.NoError(t, err)
+	assert.Contains(t, string(msg), `"text":"*user*\n`+strings.Repeat("x", slackTextLimit-8)+`…"`)
+}
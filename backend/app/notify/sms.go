@@ -0,0 +1,140 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/pkg/errors"
+)
+
+// SMSParams contain settings for SMS verification sender
+type SMSParams struct {
+	URL             string        // gateway endpoint accepting Twilio-style form with To, From and Body, Twilio API used if empty
+	AccountSID      string        // account id, used as basic auth username and in default Twilio URL
+	AuthToken       string        // auth token, used as basic auth password
+	From            string        // sender phone number or id
+	MessageTemplate string        // text/template for the message with smsTmplData, default one used if empty
+	Timeout         time.Duration // request timeout
+}
+
+// SMS implements notify.Destination sending verification tokens as SMS via HTTP gateway.
+// Comment notifications are not sent by SMS.
+type SMS struct {
+	SMSParams
+	tmpl *template.Template
+}
+
+// smsTmplData store data for SMS message template execution
+type smsTmplData struct {
+	User  string
+	Token string
+	Site  string
+}
+
+const (
+	smsTimeOut             = 5000 * time.Millisecond
+	smsTwilioURL           = "https://api.twilio.com/2010-04-01/Accounts/%s/Messages.json"
+	defaultSMSTemplate     = `Your {{if .Site}}{{.Site}} {{end}}verification token: {{.Token}}`
+	smsErrorBodyLimitBytes = 1024
+)
+
+// NewSMS makes SMS verification sender
+func NewSMS(params SMSParams) (*SMS, error) {
+	if params.From == "" {
+		return nil, errors.New("sms sender number is required")
+	}
+	res := SMS{SMSParams: params}
+	if res.URL == "" {
+		if res.AccountSID == "" {
+			return nil, errors.New("sms gateway URL or account SID is required")
+		}
+		res.URL = fmt.Sprintf(smsTwilioURL, url.PathEscape(res.AccountSID))
+	}
+	if res.Timeout <= 0 {
+		res.Timeout = smsTimeOut
+	}
+	if res.MessageTemplate == "" {
+		res.MessageTemplate = defaultSMSTemplate
+	}
+	var err error
+	if res.tmpl, err = template.New("smsTmpl").Funcs(templateFuncs).Parse(res.MessageTemplate); err != nil {
+		return nil, errors.Wrap(err, "can't parse sms message template")
+	}
+	log.Printf("[DEBUG] create new sms notifier for %s, timeout=%s", res.URL, res.Timeout)
+	return &res, nil
+}
+
+// Send does nothing, comment notifications are not sent by SMS
+func (s *SMS) Send(context.Context, Request) error {
+	return nil
+}
+
+// Ping does nothing, sms gateway can't be checked without sending a message
+func (s *SMS) Ping(context.Context) error {
+	return nil
+}
+
+// SendVerification sends verification token to VerificationRequest.Phone, does nothing if phone is not set
+func (s *SMS) SendVerification(ctx context.Context, req VerificationRequest) error {
+	if req.Phone == "" {
+		return nil
+	}
+	msg := bytes.Buffer{}
+	if err := s.tmpl.Execute(&msg, smsTmplData{User: req.User, Token: req.Token, Site: req.SiteID}); err != nil {
+		return errors.Wrap(err, "failed to execute sms message template")
+	}
+	log.Printf("[DEBUG] send sms verification to user %s", req.User)
+
+	form := url.Values{"To": {req.Phone}, "From": {s.From}, "Body": {msg.String()}}
+	ctx, cancel := context.WithTimeout(ctx, s.Timeout)
+	defer cancel()
+	r, err := http.NewRequest("POST", s.URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return errors.Wrap(err, "failed to make sms request")
+	}
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if s.AccountSID != "" || s.AuthToken != "" {
+		r.SetBasicAuth(s.AccountSID, s.AuthToken)
+	}
+
+	resp, err := http.DefaultClient.Do(r.WithContext(ctx))
+	if err != nil {
+		return errors.Wrap(err, "failed to get sms gateway response")
+	}
+	defer func() {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		if err := resp.Body.Close(); err != nil {
+			log.Printf("[WARN] can't close response body, %s", err)
+		}
+	}()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, smsErrorBodyLimitBytes))
+		return errors.Errorf("unexpected sms gateway status code %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// Close does nothing, sms has no pending notifications or resources to release
+func (s *SMS) Close(context.Context) error {
+	return nil
+}
+
+// Name of SMS destination
+func (s *SMS) Name() string {
+	return "sms"
+}
+
+// String representation of SMS object
+func (s *SMS) String() string {
+	return fmt.Sprintf("sms: from %s via %s", s.From, s.URL)
+}
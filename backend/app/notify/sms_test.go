@@ -0,0 +1,95 @@
+package notify
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSMS_New(t *testing.T) {
+	_, err := NewSMS(SMSParams{})
+	assert.EqualError(t, err, "sms sender number is required")
+
+	_, err = NewSMS(SMSParams{From: "+15005550006"})
+	assert.EqualError(t, err, "sms gateway URL or account SID is required")
+
+	_, err = NewSMS(SMSParams{From: "+15005550006", AccountSID: "AC1", MessageTemplate: "{{.Token"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "can't parse sms message template")
+
+	s, err := NewSMS(SMSParams{From: "+15005550006", AccountSID: "AC1"})
+	require.NoError(t, err)
+	assert.Equal(t, "https://api.twilio.com/2010-04-01/Accounts/AC1/Messages.json", s.URL)
+	assert.Equal(t, smsTimeOut, s.Timeout)
+	assert.Equal(t, "sms: from +15005550006 via https://api.twilio.com/2010-04-01/Accounts/AC1/Messages.json", s.String())
+	assert.NoError(t, s.Send(context.Background(), Request{}), "comments are not sent by sms")
+	assert.NoError(t, s.Close(context.Background()))
+}
+
+func TestSMS_SendVerification(t *testing.T) {
+	var form map[string][]string
+	var user, pass string
+	var calls int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		assert.Equal(t, "application/x-www-form-urlencoded", r.Header.Get("Content-Type"))
+		user, pass, _ = r.BasicAuth()
+		require.NoError(t, r.ParseForm())
+		form = r.PostForm
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer ts.Close()
+
+	s, err := NewSMS(SMSParams{URL: ts.URL, AccountSID: "AC1", AuthToken: "secret", From: "+15005550006", Timeout: time.Second})
+	require.NoError(t, err)
+
+	req := VerificationRequest{SiteID: "remark", User: "user1", Phone: "+15005550001", Token: "tkn-123"}
+	require.NoError(t, s.SendVerification(context.Background(), req))
+	assert.Equal(t, "AC1", user)
+	assert.Equal(t, "secret", pass)
+	assert.Equal(t, []string{"+15005550001"}, form["To"])
+	assert.Equal(t, []string{"+15005550006"}, form["From"])
+	assert.Equal(t, []string{"Your remark verification token: tkn-123"}, form["Body"])
+
+	// email verification is not sent by sms
+	require.NoError(t, s.SendVerification(context.Background(), VerificationRequest{User: "user1", Email: "u@example.org", Token: "t"}))
+	assert.Equal(t, 1, calls)
+
+	// custom template
+	s, err = NewSMS(SMSParams{URL: ts.URL, From: "remark42", MessageTemplate: "{{.User}}, code {{.Token}}"})
+	require.NoError(t, err)
+	require.NoError(t, s.SendVerification(context.Background(), req))
+	assert.Equal(t, []string{"user1, code tkn-123"}, form["Body"])
+	assert.Equal(t, "", user, "no auth without credentials")
+}
+
+func TestSMS_SendVerificationErrors(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"code": 21211, "message": "invalid 'To' phone number"}`))
+	}))
+	defer ts.Close()
+
+	s, err := NewSMS(SMSParams{URL: ts.URL, From: "+15005550006"})
+	require.NoError(t, err)
+	req := VerificationRequest{User: "user1", Phone: "bad", Token: "t"}
+	assert.EqualError(t, s.SendVerification(context.Background(), req),
+		`unexpected sms gateway status code 400: {"code": 21211, "message": "invalid 'To' phone number"}`)
+
+	s, err = NewSMS(SMSParams{URL: "http://127.0.0.1:1", From: "+15005550006"})
+	require.NoError(t, err)
+	err = s.SendVerification(context.Background(), req)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to get sms gateway response")
+
+	s, err = NewSMS(SMSParams{URL: ts.URL, From: "+15005550006", MessageTemplate: "{{.NoSuchField}}"})
+	require.NoError(t, err)
+	err = s.SendVerification(context.Background(), req)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to execute sms message template")
+}
@@ -0,0 +1,82 @@
+package notify
+
+import (
+	"regexp"
+	"strings"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/pkg/errors"
+)
+
+// SpamChecker classifies comments of requests as spam, notifications about spam comments are not sent to users.
+// It's called by the dispatcher right before sending, so it may be slow, i.e. calling external classifier.
+type SpamChecker interface {
+	IsSpam(req Request) bool
+}
+
+// KeywordSpamChecker treats comment as spam if its text contains any of keywords, case-insensitive,
+// or matches any of regular expressions
+type KeywordSpamChecker struct {
+	keywords []string
+	patterns []*regexp.Regexp
+}
+
+// NewKeywordSpamChecker makes spam checker with keywords and regular expressions, error returned for invalid expression
+func NewKeywordSpamChecker(keywords, patterns []string) (*KeywordSpamChecker, error) {
+	res := KeywordSpamChecker{}
+	for _, k := range keywords {
+		if k = strings.TrimSpace(k); k != "" {
+			res.keywords = append(res.keywords, strings.ToLower(k))
+		}
+	}
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid spam pattern %q", p)
+		}
+		res.patterns = append(res.patterns, re)
+	}
+	return &res, nil
+}
+
+// IsSpam checks original text of the comment, rendered one is used if it's not set
+func (k *KeywordSpamChecker) IsSpam(req Request) bool {
+	text := req.Comment.Orig
+	if text == "" {
+		text = req.Comment.Text
+	}
+	lower := strings.ToLower(text)
+	for _, kw := range k.keywords {
+		if strings.Contains(lower, kw) {
+			return true
+		}
+	}
+	for _, re := range k.patterns {
+		if re.MatchString(text) {
+			return true
+		}
+	}
+	return false
+}
+
+// spamChecked tells if the event is about the comment text checked by SpamChecker
+func spamChecked(e Event) bool {
+	return e == EventNewComment || e == EventReply || e == EventEdit || e == EventMention
+}
+
+// filterSpam returns request to send about the comment, false if nothing should be sent.
+// Spam is dropped, or routed to admin emails only with SpamToAdmin: users and other destinations are not notified
+// and Request.Spam is set.
+// Mentions of spam are always dropped, as they are sent to users only.
+func (s *Service) filterSpam(c Request) (Request, bool) {
+	if s.SpamChecker == nil || !spamChecked(c.Event) || !s.SpamChecker.IsSpam(c) {
+		return c, true
+	}
+	if !s.SpamToAdmin || c.Event == EventMention {
+		log.Printf("[INFO] skip notification for spam comment %s of user %s", c.Comment.ID, c.Comment.User.ID)
+		return c, false
+	}
+	log.Printf("[INFO] notify admins only about spam comment %s of user %s", c.Comment.ID, c.Comment.User.ID)
+	c.Emails, c.Spam = nil, true
+	return c, true
+}
@@ -0,0 +1,94 @@
+package notify
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/remark42/backend/app/store"
+)
+
+func TestKeywordSpamChecker(t *testing.T) {
+	checker, err := NewKeywordSpamChecker([]string{"Casino", " ", "free money"}, []string{`https?://[^/]*\.xyz\b`})
+	require.NoError(t, err)
+	tbl := []struct {
+		comment store.Comment
+		spam    bool
+	}{
+		{store.Comment{Orig: "nice post, thanks"}, false},
+		{store.Comment{Orig: "best CASINO online"}, true},
+		{store.Comment{Orig: "get Free Money now"}, true},
+		{store.Comment{Orig: "visit http://cheap.xyz/offer"}, true},
+		{store.Comment{Orig: "visit http://example.com/xyz"}, false},
+		{store.Comment{Text: "<p>casino</p>"}, true},
+		{store.Comment{}, false},
+	}
+	for i, tt := range tbl {
+		assert.Equal(t, tt.spam, checker.IsSpam(Request{Comment: tt.comment}), "#%d", i)
+	}
+
+	_, err = NewKeywordSpamChecker(nil, []string{"[a-"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `invalid spam pattern "[a-"`)
+}
+
+func TestService_Spam(t *testing.T) {
+	checker, err := NewKeywordSpamChecker([]string{"casino"}, nil)
+	require.NoError(t, err)
+
+	dest := &eventsDest{events: []Event{EventNewComment, EventReply, EventDelete, EventMention}}
+	s := NewServiceWithParams(nil, ServiceParams{QueueSize: 10, SpamChecker: checker}, dest)
+	s.Submit(Request{Comment: store.Comment{ID: "c1", Orig: "best casino"}, Emails: []string{"u@example.com"}})
+	s.Submit(Request{Comment: store.Comment{ID: "c2", Orig: "clean comment"}, Emails: []string{"u@example.com"}})
+	s.Submit(Request{Event: EventDelete, Comment: store.Comment{ID: "c3", Orig: "casino"}})
+	time.Sleep(time.Millisecond * 100)
+	s.Close()
+	res := dest.Get()
+	require.Equal(t, 2, len(res), "spam comment suppressed")
+	assert.Equal(t, "c2", res[0].Comment.ID)
+	assert.False(t, res[0].Spam)
+	assert.Equal(t, "c3", res[1].Comment.ID, "deletion is not checked")
+
+	// spam routed to admin emails only
+	email, err := NewEmail(EmailParams{
+		From:                     "from@example.org",
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "../../templates/email_reply.html.tmpl",
+		TokenGenFn:               TokenGenFn,
+		AdminEmails:              []string{"admin@example.org"},
+	}, SMTPParams{})
+	require.NoError(t, err)
+	fakeSMTP := &fakeTestSMTP{}
+	email.smtp = fakeSMTP
+	dest = &eventsDest{events: []Event{EventNewComment, EventReply, EventDelete, EventMention}}
+	s = NewServiceWithParams(nil, ServiceParams{QueueSize: 10, SpamChecker: checker, SpamToAdmin: true}, dest, email)
+	s.Submit(Request{Comment: store.Comment{ID: "c1", Orig: "best casino", User: store.User{Name: "spammer"}},
+		Emails: []string{"u@example.com"}})
+	s.Submit(Request{Event: EventMention, Comment: store.Comment{ID: "c1", Orig: "best casino"}, Emails: []string{"u@example.com"}})
+	time.Sleep(time.Millisecond * 100)
+	s.Close()
+	assert.Empty(t, dest.Get(), "spam is not sent to destinations other than email")
+	assert.Equal(t, []string{"admin@example.org"}, fakeSMTP.rcpts, "users not notified")
+	assert.Contains(t, fakeSMTP.buff.String(), "Subject: Spam comment to your site\n")
+	assert.Contains(t, fakeSMTP.buff.String(), "Spam comment from spammer on your site")
+
+	// spam sent to any destination implementing SpamFilter
+	dest = &eventsDest{events: []Event{EventNewComment, EventReply}}
+	s = NewServiceWithParams(nil, ServiceParams{QueueSize: 10, SpamChecker: checker, SpamToAdmin: true}, spamDest{dest})
+	s.Submit(Request{Comment: store.Comment{ID: "c1", Orig: "best casino"}, Emails: []string{"u@example.com"}})
+	time.Sleep(time.Millisecond * 100)
+	s.Close()
+	res = dest.Get()
+	require.Equal(t, 1, len(res))
+	assert.True(t, res[0].Spam)
+	assert.Empty(t, res[0].Emails, "users not notified")
+}
+
+// spamDest is eventsDest accepting requests about spam
+type spamDest struct {
+	*eventsDest
+}
+
+func (d spamDest) AcceptsSpam() bool { return true }
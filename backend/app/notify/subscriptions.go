@@ -0,0 +1,54 @@
+package notify
+
+import (
+	"sync"
+
+	"github.com/umputun/remark42/backend/app/store"
+)
+
+// Subscriptions defines interface for storage of users subscriptions to comment threads (posts).
+// Subscribe and Unsubscribe are idempotent.
+type Subscriptions interface {
+	Subscribe(userID string, locator store.Locator) error
+	Unsubscribe(userID string, locator store.Locator) error
+	IsSubscribed(userID string, locator store.Locator) (bool, error)
+}
+
+// MemSubscriptions implements Subscriptions in memory, thread safe
+type MemSubscriptions struct {
+	lock sync.RWMutex
+	subs map[string]struct{}
+}
+
+// NewMemSubscriptions makes empty in-memory subscriptions storage
+func NewMemSubscriptions() *MemSubscriptions {
+	return &MemSubscriptions{subs: map[string]struct{}{}}
+}
+
+// Subscribe user to the thread
+func (m *MemSubscriptions) Subscribe(userID string, locator store.Locator) error {
+	m.lock.Lock()
+	m.subs[subscriptionKey(userID, locator)] = struct{}{}
+	m.lock.Unlock()
+	return nil
+}
+
+// Unsubscribe user from the thread, does nothing if user is not subscribed
+func (m *MemSubscriptions) Unsubscribe(userID string, locator store.Locator) error {
+	m.lock.Lock()
+	delete(m.subs, subscriptionKey(userID, locator))
+	m.lock.Unlock()
+	return nil
+}
+
+// IsSubscribed checks if user subscribed to the thread
+func (m *MemSubscriptions) IsSubscribed(userID string, locator store.Locator) (bool, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	_, ok := m.subs[subscriptionKey(userID, locator)]
+	return ok, nil
+}
+
+func subscriptionKey(userID string, locator store.Locator) string {
+	return locator.SiteID + "::" + locator.URL + "::" + userID
+}
@@ -0,0 +1,41 @@
+package notify
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/remark42/backend/app/store"
+)
+
+func TestMemSubscriptions(t *testing.T) {
+	subs := NewMemSubscriptions()
+	post1 := store.Locator{SiteID: "remark", URL: "https://example.com/post1"}
+	post2 := store.Locator{SiteID: "remark", URL: "https://example.com/post2"}
+
+	ok, err := subs.IsSubscribed("u1", post1)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	require.NoError(t, subs.Subscribe("u1", post1))
+	require.NoError(t, subs.Subscribe("u1", post1), "second subscription is no-op")
+	ok, err = subs.IsSubscribed("u1", post1)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, _ = subs.IsSubscribed("u1", post2)
+	assert.False(t, ok, "other post")
+	ok, _ = subs.IsSubscribed("u2", post1)
+	assert.False(t, ok, "other user")
+	ok, _ = subs.IsSubscribed("u1", store.Locator{SiteID: "other", URL: post1.URL})
+	assert.False(t, ok, "other site")
+
+	require.NoError(t, subs.Unsubscribe("u1", post1))
+	ok, _ = subs.IsSubscribed("u1", post1)
+	assert.False(t, ok, "unsubscribed once despite double subscription")
+	require.NoError(t, subs.Unsubscribe("u1", post1), "second unsubscription is no-op")
+	require.NoError(t, subs.Unsubscribe("u2", post2), "not subscribed user")
+	ok, _ = subs.IsSubscribed("u1", post1)
+	assert.False(t, ok)
+}
@@ -5,107 +5,154 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"html"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	log "github.com/go-pkgz/lgr"
 	"github.com/go-pkgz/repeater"
 	"github.com/pkg/errors"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
 )
 
 // Telegram implements notify.Destination for telegram
 type Telegram struct {
-	channelID string // unique identifier for the target chat or username of the target channel (in the format @channelusername)
-	token     string
-	apiPrefix string
-	timeout   time.Duration
+	channelID    string            // unique identifier for the target chat or username of the target channel (in the format @channelusername)
+	siteChannels map[string]string // channel overrides for sites, site id -> channel
+	token        string
+	apiPrefix    string
+	timeout      time.Duration
+	transport    http.RoundTripper // transport making connections through the proxy, default one used if nil
+	buttons      bool              // add moderation buttons to messages, enabled by TelegramModerator
+
+	pollLock   sync.Mutex
+	pollCancel context.CancelFunc // stops updates poller of TelegramModerator, nil if it's not running
+	pollDone   chan struct{}      // closed on termination of the poller
 }
 
 const telegramTimeOut = 5000 * time.Millisecond
 const telegramAPIPrefix = "https://api.telegram.org/bot"
+const telegramMaxLength = 4096 // max length of message text accepted by telegram
 
-// NewTelegram makes telegram bot for notifications
-func NewTelegram(token, channelID string, timeout time.Duration, api string) (*Telegram, error) {
-	if _, err := strconv.ParseInt(channelID, 10, 64); err != nil {
-		channelID = "@" + channelID // if channelID not a number enforce @ prefix
+// NewTelegram makes telegram bot for notifications. Comments of sites from siteChannels are sent
+// to the channels set for them, all others to channelID. Requests are made through the proxy if proxyURL is set
+func NewTelegram(token, channelID string, siteChannels map[string]string, timeout time.Duration, api, proxyURL string) (*Telegram, error) {
+	if channelID == "" {
+		return nil, errors.New("default telegram channel is required")
 	}
+	channelID = telegramChannel(channelID)
 
-	res := Telegram{channelID: channelID, token: token, apiPrefix: api, timeout: timeout}
+	res := Telegram{channelID: channelID, siteChannels: map[string]string{}, token: token, apiPrefix: api, timeout: timeout}
+	for site, ch := range siteChannels {
+		if ch == "" {
+			return nil, errors.Errorf("empty telegram channel for site %q", site)
+		}
+		res.siteChannels[site] = telegramChannel(ch)
+	}
 	if res.apiPrefix == "" {
 		res.apiPrefix = telegramAPIPrefix
 	}
 	if res.timeout == 0 {
 		res.timeout = telegramTimeOut
 	}
+	if proxyURL != "" {
+		dial, err := ProxyDialer(proxyURL, nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "can't make telegram proxy dialer")
+		}
+		res.transport = proxyTransport(dial)
+	}
 	log.Printf("[DEBUG] create new telegram notifier for chan %s, timeout=%s, api=%s", channelID, res.timeout, res.timeout)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
 	err := repeater.NewDefault(5, time.Millisecond*250).Do(ctx, func() error {
-		client := http.Client{Timeout: telegramTimeOut}
-		resp, err := client.Get(fmt.Sprintf("%s%s/getMe", res.apiPrefix, token))
-		if err != nil {
-			return errors.Wrap(err, "can't initialize telegram notifications")
-		}
-		defer func() {
-			if err = resp.Body.Close(); err != nil {
-				log.Printf("[WARN] can't close request body, %s", err)
-			}
-		}()
+		return res.getMe(ctx)
+	})
 
-		if resp.StatusCode != http.StatusOK {
-			return errors.Errorf("unexpected telegram status code %d", resp.StatusCode)
-		}
+	return &res, err
+}
 
-		tgResp := struct {
-			OK     bool `json:"ok"`
-			Result struct {
-				FirstName string `json:"first_name"`
-				ID        uint64 `json:"id"`
-				IsBot     bool   `json:"is_bot"`
-				UserName  string `json:"username"`
-			}
-		}{}
+// Ping checks telegram bot is reachable with getMe call
+func (t *Telegram) Ping(ctx context.Context) error {
+	return t.getMe(ctx)
+}
 
-		if err = json.NewDecoder(resp.Body).Decode(&tgResp); err != nil {
-			return errors.Wrap(err, "can't decode response")
+// getMe checks the token belongs to telegram bot
+func (t *Telegram) getMe(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s%s/getMe", t.apiPrefix, t.token), nil)
+	if err != nil {
+		return errors.Wrap(err, "can't make getMe request")
+	}
+	client := http.Client{Timeout: telegramTimeOut, Transport: t.transport}
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "can't initialize telegram notifications")
+	}
+	defer func() {
+		if err = resp.Body.Close(); err != nil {
+			log.Printf("[WARN] can't close request body, %s", err)
 		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("unexpected telegram status code %d", resp.StatusCode)
+	}
 
-		if !tgResp.OK || !tgResp.Result.IsBot {
-			return errors.Errorf("unexpected telegram response %+v", tgResp)
+	tgResp := struct {
+		OK     bool `json:"ok"`
+		Result struct {
+			FirstName string `json:"first_name"`
+			ID        uint64 `json:"id"`
+			IsBot     bool   `json:"is_bot"`
+			UserName  string `json:"username"`
 		}
-		return nil
-	})
+	}{}
 
-	return &res, err
+	if err = json.NewDecoder(resp.Body).Decode(&tgResp); err != nil {
+		return errors.Wrap(err, "can't decode response")
+	}
+
+	if !tgResp.OK || !tgResp.Result.IsBot {
+		return errors.Errorf("unexpected telegram response %+v", tgResp)
+	}
+	return nil
 }
 
 // Send to telegram channel
 func (t *Telegram) Send(ctx context.Context, req Request) error {
-	client := http.Client{Timeout: telegramTimeOut}
-	log.Printf("[DEBUG] send telegram notification to %s, comment id %s", t.channelID, req.Comment.ID)
+	client := http.Client{Timeout: telegramTimeOut, Transport: t.transport}
+	channelID := t.channel(req.Comment.Locator.SiteID)
+	log.Printf("[DEBUG] send telegram notification to %s, comment id %s", channelID, req.Comment.ID)
 
 	from := req.Comment.User.Name
 	if req.Comment.ParentID != "" {
 		from += " → " + req.parent.User.Name
 	}
-	from = "*" + from + "*"
-	link := fmt.Sprintf("↦ [original comment](%s)", req.Comment.Locator.URL+uiNav+req.Comment.ID)
+	from = "<b>" + html.EscapeString(from) + "</b>"
+	title := "original comment"
 	if req.Comment.PostTitle != "" {
-		link = fmt.Sprintf("↦ [%s](%s)", t.escapeTitle(req.Comment.PostTitle), req.Comment.Locator.URL+uiNav+req.Comment.ID)
+		title = req.Comment.PostTitle
 	}
-	u := fmt.Sprintf("%s%s/sendMessage?chat_id=%s&parse_mode=Markdown&disable_web_page_preview=true",
-		t.apiPrefix, t.token, t.channelID)
+	link := fmt.Sprintf(`↦ <a href="%s">%s</a>`, html.EscapeString(req.Comment.Locator.URL+uiNav+req.Comment.ID), html.EscapeString(title))
+	u := fmt.Sprintf("%s%s/sendMessage?chat_id=%s&parse_mode=HTML&disable_web_page_preview=true",
+		t.apiPrefix, t.token, channelID)
 
-	msg := fmt.Sprintf("%s\n\n%s\n\n%s", from, req.Comment.Orig, link)
-	msg = html.UnescapeString(msg)
+	limit := telegramMaxLength - utf8.RuneCountInString(from+link) - 4 // 4 is for line breaks between parts
+	msg := fmt.Sprintf("%s\n\n%s\n\n%s", from, telegramHTML(req.Comment.Text, limit), link)
 	body := struct {
-		Text string `json:"text"`
+		Text        string            `json:"text"`
+		ReplyMarkup *tgInlineKeyboard `json:"reply_markup,omitempty"`
 	}{Text: msg}
+	if t.buttons {
+		body.ReplyMarkup = moderationKeyboard(req.Comment)
+	}
 
 	b, err := json.Marshal(body)
 	if err != nil {
@@ -143,13 +190,190 @@ func (t *Telegram) Send(ctx context.Context, req Request) error {
 	return nil
 }
 
-func (t *Telegram) escapeTitle(title string) string {
-	escSymbols := []string{"[", "]", "(", ")"}
-	res := title
-	for _, esc := range escSymbols {
-		res = strings.Replace(res, esc, "\\"+esc, -1)
+// channel returns channel for the site, default one if site has no own channel
+func (t *Telegram) channel(siteID string) string {
+	if ch, ok := t.siteChannels[siteID]; ok {
+		return ch
+	}
+	return t.channelID
+}
+
+// isChannel checks if chat is one of the channels notifications sent to
+func (t *Telegram) isChannel(chatID int64, userName string) bool {
+	match := func(ch string) bool {
+		return ch == strconv.FormatInt(chatID, 10) || (userName != "" && ch == "@"+userName)
+	}
+	if match(t.channelID) {
+		return true
+	}
+	for _, ch := range t.siteChannels {
+		if match(ch) {
+			return true
+		}
 	}
-	return res
+	return false
+}
+
+// telegramChannel enforces @ prefix for channel names, numeric ids are used as is
+func telegramChannel(channelID string) string {
+	if _, err := strconv.ParseInt(channelID, 10, 64); err != nil {
+		return "@" + strings.TrimPrefix(channelID, "@")
+	}
+	return channelID
+}
+
+// telegramHTML converts comment html to the subset supported by telegram with parse_mode=HTML.
+// Tags b, i, a, code and pre are kept (strong and em mapped to b and i), block elements are replaced
+// by line breaks, all other tags dropped and text escaped. Result longer than limit characters is cut
+// on tag boundary with all open tags closed.
+func telegramHTML(htmlText string, limit int) string {
+	res := strings.Builder{}
+	var open []string // tags opened in res, closed in reverse order
+	length, skip, truncated := 0, 0, false
+
+	closing := func() (s string) {
+		for i := len(open) - 1; i >= 0; i-- {
+			s += "</" + open[i] + ">"
+		}
+		return s
+	}
+	// fits checks if n more characters can be written, leaving room for closing tags and ellipsis
+	fits := func(n int, closeTag string) bool {
+		return length+n+utf8.RuneCountInString(closing()+closeTag)+1 <= limit
+	}
+	isOpen := func(tag string) bool {
+		for _, o := range open {
+			if o == tag {
+				return true
+			}
+		}
+		return false
+	}
+	writeText := func(text string) {
+		for _, r := range text {
+			esc := html.EscapeString(string(r))
+			if !fits(utf8.RuneCountInString(esc), "") {
+				truncated = true
+				return
+			}
+			res.WriteString(esc)
+			length += utf8.RuneCountInString(esc)
+		}
+	}
+	openTag := func(tag, markup string) {
+		if !fits(utf8.RuneCountInString(markup), "</"+tag+">") {
+			truncated = true
+			return
+		}
+		res.WriteString(markup)
+		length += utf8.RuneCountInString(markup)
+		open = append(open, tag)
+	}
+	closeTag := func(tag string) {
+		if !isOpen(tag) {
+			return
+		}
+		for len(open) > 0 {
+			last := open[len(open)-1]
+			res.WriteString("</" + last + ">")
+			length += utf8.RuneCountInString("</" + last + ">")
+			open = open[:len(open)-1]
+			if last == tag {
+				return
+			}
+		}
+	}
+	atLineStart := func() bool {
+		s := res.String()
+		return s == "" || strings.HasSuffix(s, "\n")
+	}
+
+	tokenizer := html.NewTokenizer(strings.NewReader(htmlText))
+	for !truncated {
+		tt := tokenizer.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		inCode := isOpen("code") || isOpen("pre")
+		switch tt {
+		case html.TextToken:
+			if skip > 0 {
+				continue
+			}
+			text := string(tokenizer.Text())
+			if !inCode {
+				text = spacesRe.ReplaceAllString(text, " ")
+				if atLineStart() {
+					text = strings.TrimLeft(text, " ")
+				}
+			}
+			writeText(text)
+		case html.StartTagToken, html.SelfClosingTagToken, html.EndTagToken:
+			tok := tokenizer.Token()
+			start := tt != html.EndTagToken
+			switch tok.DataAtom {
+			case atom.Script, atom.Style, atom.Head, atom.Title:
+				if tt == html.StartTagToken {
+					skip++
+				}
+				if tt == html.EndTagToken && skip > 0 {
+					skip--
+				}
+			case atom.B, atom.Strong, atom.I, atom.Em:
+				tag := "b"
+				if tok.DataAtom == atom.I || tok.DataAtom == atom.Em {
+					tag = "i"
+				}
+				switch {
+				case tt == html.StartTagToken && !inCode:
+					openTag(tag, "<"+tag+">")
+				case tt == html.EndTagToken:
+					closeTag(tag)
+				}
+			case atom.Code, atom.Pre:
+				tag := tok.Data
+				switch {
+				case tt == html.StartTagToken && (!inCode || (tag == "code" && isOpen("pre") && !isOpen("code"))):
+					openTag(tag, "<"+tag+">")
+				case tt == html.EndTagToken:
+					closeTag(tag)
+				}
+			case atom.A:
+				if tt == html.EndTagToken {
+					closeTag("a")
+					continue
+				}
+				if tt != html.StartTagToken || inCode || isOpen("a") {
+					continue
+				}
+				for _, attr := range tok.Attr {
+					if attr.Key != "href" {
+						continue
+					}
+					if u, err := url.Parse(attr.Val); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+						openTag("a", `<a href="`+html.EscapeString(attr.Val)+`">`)
+					}
+				}
+			case atom.Br:
+				writeText("\n")
+			case atom.Li:
+				if start {
+					writeText("\n• ")
+				}
+			case atom.P, atom.Div, atom.Blockquote, atom.Ul, atom.Ol, atom.H1, atom.H2, atom.H3, atom.H4, atom.H5,
+				atom.H6, atom.Table, atom.Tr, atom.Hr:
+				if !inCode {
+					writeText("\n")
+				}
+			}
+		}
+	}
+
+	body := strings.TrimSpace(res.String())
+	if truncated {
+		body += "…"
+	}
+	return blankLinesRe.ReplaceAllString(body+closing(), "\n\n")
 }
 
 // SendVerification is not implemented for telegram
@@ -157,6 +381,41 @@ func (t *Telegram) SendVerification(_ context.Context, _ VerificationRequest) er
 	return nil
 }
 
+// Close stops updates poller of TelegramModerator, if it's running
+func (t *Telegram) Close(ctx context.Context) error {
+	t.pollLock.Lock()
+	cancel, done := t.pollCancel, t.pollDone
+	t.pollLock.Unlock()
+	if cancel == nil {
+		return nil
+	}
+	cancel()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "telegram updates poller is not stopped")
+	}
+}
+
+// startPolling registers running updates poller, returns context canceled by Close and function to call on poller termination
+func (t *Telegram) startPolling(ctx context.Context) (pollCtx context.Context, stopped func()) {
+	t.pollLock.Lock()
+	defer t.pollLock.Unlock()
+	pollCtx, t.pollCancel = context.WithCancel(ctx)
+	done, cancel := make(chan struct{}), t.pollCancel
+	t.pollDone = done
+	return pollCtx, func() {
+		cancel()
+		close(done)
+	}
+}
+
+// Name of Telegram destination
+func (t *Telegram) Name() string {
+	return "telegram"
+}
+
 func (t *Telegram) String() string {
 	return "telegram: " + t.channelID
 }
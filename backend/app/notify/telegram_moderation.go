@@ -0,0 +1,284 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/pkg/errors"
+
+	"github.com/umputun/remark42/backend/app/store"
+)
+
+// ModerationStore defines store actions performed by telegram moderation buttons
+type ModerationStore interface {
+	Get(locator store.Locator, id string, user store.User) (store.Comment, error)
+	Delete(locator store.Locator, commentID string, mode store.DeleteMode) error
+	SetBlock(siteID string, userID string, status bool, ttl time.Duration) error
+}
+
+// TelegramModerator receives callbacks of moderation buttons attached to telegram notifications
+// and performs requested actions with the store. Only callbacks of the listed admins from the notification chat
+// are accepted, as anyone able to see notifications in a channel can press the buttons.
+type TelegramModerator struct {
+	tg     *Telegram
+	store  ModerationStore
+	admins map[int64]bool
+	offset int64 // next update id to request
+}
+
+// moderation actions, used as the first part of callback_data
+const (
+	tgActionDelete  = "d"
+	tgActionApprove = "a"
+	tgActionBlock   = "b"
+)
+
+const tgCallbackDataLimit = 64         // max size of callback_data allowed by telegram
+const tgPollTimeout = 30 * time.Second // long polling timeout of getUpdates
+
+type tgInlineKeyboard struct {
+	InlineKeyboard [][]tgInlineButton `json:"inline_keyboard"`
+}
+
+type tgInlineButton struct {
+	Text         string `json:"text"`
+	CallbackData string `json:"callback_data"`
+}
+
+type tgCallbackQuery struct {
+	ID   string `json:"id"`
+	From struct {
+		ID       int64  `json:"id"`
+		UserName string `json:"username"`
+	} `json:"from"`
+	Message *tgMessage `json:"message"`
+	Data    string     `json:"data"`
+}
+
+type tgMessage struct {
+	MessageID int64 `json:"message_id"`
+	Chat      struct {
+		ID       int64  `json:"id"`
+		UserName string `json:"username"`
+	} `json:"chat"`
+	Entities []struct {
+		Type string `json:"type"`
+		URL  string `json:"url"`
+	} `json:"entities"`
+}
+
+// NewTelegramModerator makes moderator for telegram notifier, tg starts to add moderation buttons to messages.
+// Admins is a list of telegram user ids allowed to moderate, nobody is allowed if empty.
+func NewTelegramModerator(tg *Telegram, st ModerationStore, admins []int64) *TelegramModerator {
+	res := TelegramModerator{tg: tg, store: st, admins: map[int64]bool{}}
+	for _, a := range admins {
+		res.admins[a] = true
+	}
+	tg.buttons = true
+	log.Printf("[DEBUG] create new telegram moderator for chan %s, admins=%v", tg.channelID, admins)
+	return &res
+}
+
+// Run polls telegram for callback queries of moderation buttons, blocking until ctx canceled or Telegram closed
+func (m *TelegramModerator) Run(ctx context.Context) {
+	ctx, stopped := m.tg.startPolling(ctx)
+	defer stopped()
+	log.Printf("[INFO] start telegram moderation for %s", m.tg.channelID)
+	for {
+		callbacks, err := m.getUpdates(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				log.Print("[INFO] telegram moderation terminated")
+				return
+			}
+			log.Printf("[WARN] failed to get telegram updates, %v", err)
+			select {
+			case <-ctx.Done():
+				log.Print("[INFO] telegram moderation terminated")
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		for _, cb := range callbacks {
+			m.onCallback(ctx, cb)
+		}
+	}
+}
+
+// onCallback performs action of a callback and reports result back to telegram
+func (m *TelegramModerator) onCallback(ctx context.Context, cb tgCallbackQuery) {
+	answer, err := m.handleCallback(cb)
+	if err != nil {
+		log.Printf("[WARN] telegram moderation callback %q from %d failed, %v", cb.Data, cb.From.ID, err)
+		answer = "failed: " + err.Error()
+	}
+	if e := m.request(ctx, "answerCallbackQuery", map[string]interface{}{"callback_query_id": cb.ID, "text": answer}, nil); e != nil {
+		log.Printf("[WARN] can't answer telegram callback, %v", e)
+	}
+	if err != nil || cb.Message == nil {
+		return
+	}
+	// remove buttons of the processed message
+	params := map[string]interface{}{"chat_id": cb.Message.Chat.ID, "message_id": cb.Message.MessageID,
+		"reply_markup": tgInlineKeyboard{InlineKeyboard: [][]tgInlineButton{}}}
+	if e := m.request(ctx, "editMessageReplyMarkup", params, nil); e != nil {
+		log.Printf("[WARN] can't remove buttons from telegram message, %v", e)
+	}
+}
+
+// handleCallback checks callback is allowed and performs moderation action, returns text of the answer
+func (m *TelegramModerator) handleCallback(cb tgCallbackQuery) (string, error) {
+	if cb.Message == nil || !m.isAdminChat(cb) {
+		return "", errors.Errorf("not allowed for user %d", cb.From.ID)
+	}
+	action, locator, id, err := decodeTelegramCallback(cb.Data, *cb.Message)
+	if err != nil {
+		return "", err
+	}
+
+	switch action {
+	case tgActionDelete:
+		if err := m.store.Delete(locator, id, store.SoftDelete); err != nil {
+			return "", errors.Wrapf(err, "can't delete comment %s", id)
+		}
+		log.Printf("[INFO] comment %s deleted by telegram user %d", id, cb.From.ID)
+		return "comment deleted", nil
+	case tgActionBlock:
+		comment, err := m.store.Get(locator, id, store.User{})
+		if err != nil {
+			return "", errors.Wrapf(err, "can't get comment %s", id)
+		}
+		if err := m.store.SetBlock(locator.SiteID, comment.User.ID, true, 0); err != nil {
+			return "", errors.Wrapf(err, "can't block user %s", comment.User.ID)
+		}
+		log.Printf("[INFO] user %s blocked by telegram user %d", comment.User.ID, cb.From.ID)
+		return "user " + comment.User.Name + " blocked", nil
+	case tgActionApprove:
+		// comments are published without premoderation, approval only marks notification as reviewed
+		log.Printf("[INFO] comment %s approved by telegram user %d", id, cb.From.ID)
+		return "comment approved", nil
+	}
+	return "", errors.Errorf("unknown moderation action %q", action)
+}
+
+// isAdminChat checks callback came from one of the notification chats and from one of admins
+func (m *TelegramModerator) isAdminChat(cb tgCallbackQuery) bool {
+	if !m.tg.isChannel(cb.Message.Chat.ID, cb.Message.Chat.UserName) {
+		return false
+	}
+	return m.admins[cb.From.ID]
+}
+
+// getUpdates long-polls telegram for callback queries
+func (m *TelegramModerator) getUpdates(ctx context.Context) ([]tgCallbackQuery, error) {
+	var updates []struct {
+		UpdateID      int64            `json:"update_id"`
+		CallbackQuery *tgCallbackQuery `json:"callback_query"`
+	}
+	params := map[string]interface{}{"offset": m.offset, "timeout": int(tgPollTimeout.Seconds()),
+		"allowed_updates": []string{"callback_query"}}
+	if err := m.request(ctx, "getUpdates", params, &updates); err != nil {
+		return nil, err
+	}
+	res := []tgCallbackQuery{}
+	for _, u := range updates {
+		if u.UpdateID >= m.offset {
+			m.offset = u.UpdateID + 1
+		}
+		if u.CallbackQuery != nil {
+			res = append(res, *u.CallbackQuery)
+		}
+	}
+	return res, nil
+}
+
+// request calls telegram bot api method with params, decodes result to res if not nil
+func (m *TelegramModerator) request(ctx context.Context, method string, params, res interface{}) error {
+	b, err := json.Marshal(params)
+	if err != nil {
+		return errors.Wrapf(err, "failed to make telegram %s body", method)
+	}
+	r, err := http.NewRequest("POST", fmt.Sprintf("%s%s/%s", m.tg.apiPrefix, m.tg.token, method), bytes.NewReader(b))
+	if err != nil {
+		return errors.Wrapf(err, "failed to make telegram %s request", method)
+	}
+	r.Header.Set("Content-Type", "application/json; charset=utf-8")
+
+	client := http.Client{Timeout: tgPollTimeout + m.tg.timeout, Transport: m.tg.transport}
+	resp, err := client.Do(r.WithContext(ctx))
+	if err != nil {
+		return errors.Wrapf(err, "failed to get telegram %s response", method)
+	}
+	defer func() {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		if err = resp.Body.Close(); err != nil {
+			log.Printf("[WARN] can't close request body, %s", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("unexpected telegram status code %d for %s", resp.StatusCode, method)
+	}
+	tgResp := struct {
+		OK     bool            `json:"ok"`
+		Result json.RawMessage `json:"result"`
+	}{}
+	if err = json.NewDecoder(resp.Body).Decode(&tgResp); err != nil {
+		return errors.Wrapf(err, "can't decode telegram %s response", method)
+	}
+	if !tgResp.OK {
+		return errors.Errorf("unexpected telegram %s response", method)
+	}
+	if res == nil {
+		return nil
+	}
+	return errors.Wrapf(json.Unmarshal(tgResp.Result, res), "can't decode telegram %s result", method)
+}
+
+// moderationKeyboard makes inline keyboard with moderation buttons for the comment,
+// returns nil if callback data doesn't fit telegram limit
+func moderationKeyboard(c store.Comment) *tgInlineKeyboard {
+	buttons := []tgInlineButton{
+		{Text: "Delete", CallbackData: encodeTelegramCallback(tgActionDelete, c.Locator, c.ID)},
+		{Text: "Approve", CallbackData: encodeTelegramCallback(tgActionApprove, c.Locator, c.ID)},
+		{Text: "Block user", CallbackData: encodeTelegramCallback(tgActionBlock, c.Locator, c.ID)},
+	}
+	for _, b := range buttons {
+		if len(b.CallbackData) > tgCallbackDataLimit {
+			log.Printf("[WARN] callback data %q is too long, moderation buttons skipped", b.CallbackData)
+			return nil
+		}
+	}
+	return &tgInlineKeyboard{InlineKeyboard: [][]tgInlineButton{buttons}}
+}
+
+// encodeTelegramCallback makes callback_data as action|site|id. Post URL doesn't fit 64 bytes limit of
+// callback_data and restored from the link to the comment in the message by decodeTelegramCallback
+func encodeTelegramCallback(action string, locator store.Locator, id string) string {
+	return action + "|" + locator.SiteID + "|" + id
+}
+
+// decodeTelegramCallback parses callback_data of the message to action, comment locator and id
+func decodeTelegramCallback(data string, msg tgMessage) (action string, locator store.Locator, id string, err error) {
+	elems := strings.SplitN(data, "|", 3)
+	if len(elems) != 3 || elems[0] == "" || elems[1] == "" || elems[2] == "" {
+		return "", store.Locator{}, "", errors.Errorf("invalid callback data %q", data)
+	}
+	action, locator.SiteID, id = elems[0], elems[1], elems[2]
+	for _, e := range msg.Entities {
+		if e.Type == "text_link" && strings.HasSuffix(e.URL, uiNav+id) {
+			locator.URL = strings.TrimSuffix(e.URL, uiNav+id)
+			return action, locator, id, nil
+		}
+	}
+	return "", store.Locator{}, "", errors.Errorf("no link to comment %s in message", id)
+}
@@ -0,0 +1,209 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/remark42/backend/app/store"
+)
+
+func Test_telegramCallbackRoundTrip(t *testing.T) {
+	locator := store.Locator{SiteID: "remark", URL: "https://example.com/post/1?a=b"}
+	id := "a8a3e2e4-2a0a-4b5d-8e2c-1f6a2a7d8f90"
+	for _, action := range []string{tgActionDelete, tgActionApprove, tgActionBlock} {
+		data := encodeTelegramCallback(action, locator, id)
+		assert.True(t, len(data) <= tgCallbackDataLimit, data)
+
+		msg := tgMessage{}
+		msg.Entities = append(msg.Entities, struct {
+			Type string `json:"type"`
+			URL  string `json:"url"`
+		}{Type: "text_link", URL: locator.URL + uiNav + id})
+
+		a, l, i, err := decodeTelegramCallback(data, msg)
+		require.NoError(t, err)
+		assert.Equal(t, action, a)
+		assert.Equal(t, locator, l)
+		assert.Equal(t, id, i)
+	}
+
+	_, _, _, err := decodeTelegramCallback("d|remark", tgMessage{})
+	assert.EqualError(t, err, `invalid callback data "d|remark"`)
+	_, _, _, err = decodeTelegramCallback("d|remark|123", tgMessage{})
+	assert.EqualError(t, err, "no link to comment 123 in message")
+}
+
+func Test_moderationKeyboard(t *testing.T) {
+	kb := moderationKeyboard(store.Comment{ID: "123", Locator: store.Locator{SiteID: "remark", URL: "https://example.com"}})
+	require.NotNil(t, kb)
+	b, err := json.Marshal(kb)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"inline_keyboard":[[{"text":"Delete","callback_data":"d|remark|123"},
+		{"text":"Approve","callback_data":"a|remark|123"},{"text":"Block user","callback_data":"b|remark|123"}]]}`, string(b))
+
+	assert.Nil(t, moderationKeyboard(store.Comment{ID: strings.Repeat("x", 64), Locator: store.Locator{SiteID: "remark"}}))
+}
+
+func TestTelegramModerator_handleCallback(t *testing.T) {
+	st := &mockModerationStore{comments: map[string]store.Comment{"123": {ID: "123", User: store.User{ID: "u1", Name: "user1"}}}}
+	tg := &Telegram{channelID: "@remark_test"}
+	m := NewTelegramModerator(tg, st, []int64{42})
+	assert.True(t, tg.buttons, "buttons enabled")
+
+	cb := tgCallbackQuery{Data: "d|remark|123", Message: &tgMessage{}}
+	cb.From.ID = 42
+	cb.Message.Chat.UserName = "remark_test"
+	cb.Message.Entities = append(cb.Message.Entities, struct {
+		Type string `json:"type"`
+		URL  string `json:"url"`
+	}{Type: "text_link", URL: "https://example.com/post" + uiNav + "123"})
+
+	res, err := m.handleCallback(cb)
+	require.NoError(t, err)
+	assert.Equal(t, "comment deleted", res)
+	assert.Equal(t, []string{"https://example.com/post 123"}, st.deleted)
+
+	cb.Data = "b|remark|123"
+	res, err = m.handleCallback(cb)
+	require.NoError(t, err)
+	assert.Equal(t, "user user1 blocked", res)
+	assert.Equal(t, []string{"remark u1"}, st.blocked)
+
+	cb.Data = "a|remark|123"
+	res, err = m.handleCallback(cb)
+	require.NoError(t, err)
+	assert.Equal(t, "comment approved", res)
+
+	cb.Data = "x|remark|123"
+	_, err = m.handleCallback(cb)
+	assert.EqualError(t, err, `unknown moderation action "x"`)
+
+	cb.Data = "b|remark|bad"
+	cb.Message.Entities[0].URL = "https://example.com/post" + uiNav + "bad"
+	_, err = m.handleCallback(cb)
+	assert.EqualError(t, err, "can't get comment bad: not found")
+
+	cb.From.ID = 1
+	_, err = m.handleCallback(cb)
+	assert.EqualError(t, err, "not allowed for user 1", "not an admin")
+
+	cb.From.ID = 42
+	cb.Message.Chat.UserName = "other"
+	_, err = m.handleCallback(cb)
+	assert.EqualError(t, err, "not allowed for user 42", "not an admin chat")
+
+	m = NewTelegramModerator(&Telegram{channelID: "-100500"}, st, nil)
+	cb.From.ID = 1
+	cb.Message.Chat.ID = -100500
+	cb.Data = "a|remark|bad"
+	_, err = m.handleCallback(cb)
+	assert.EqualError(t, err, "not allowed for user 1", "chat id matched, nobody allowed without admins")
+
+	m = NewTelegramModerator(&Telegram{channelID: "-100500"}, st, []int64{1})
+	_, err = m.handleCallback(cb)
+	assert.NoError(t, err, "chat id matched, admin allowed")
+}
+
+func TestTelegramModerator_Run(t *testing.T) {
+	var lock sync.Mutex
+	var calls []string
+	polls := 0
+	router := chi.NewRouter()
+	router.Post("/good-token/{method}", func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		lock.Lock()
+		defer lock.Unlock()
+		method := chi.URLParam(r, "method")
+		if method != "getUpdates" {
+			calls = append(calls, method+" "+string(b))
+			_, _ = w.Write([]byte(`{"ok":true,"result":true}`))
+			return
+		}
+		polls++
+		if polls > 1 {
+			assert.Contains(t, string(b), `"offset":11`)
+			time.Sleep(10 * time.Millisecond)
+			_, _ = w.Write([]byte(`{"ok":true,"result":[]}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"ok":true,"result":[{"update_id":10,"callback_query":{"id":"cb1","from":{"id":42},
+			"data":"a|remark|123","message":{"message_id":7,"chat":{"id":1,"username":"remark_test"},
+			"entities":[{"type":"text_link","url":"https://example.com/post#remark42__comment-123"}]}}}]}`))
+	})
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	tg := &Telegram{channelID: "@remark_test", token: "good-token", apiPrefix: ts.URL + "/", timeout: time.Second}
+	m := NewTelegramModerator(tg, &mockModerationStore{}, []int64{42})
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	m.Run(ctx)
+
+	lock.Lock()
+	defer lock.Unlock()
+	require.Equal(t, 2, len(calls), calls)
+	assert.Equal(t, `answerCallbackQuery {"callback_query_id":"cb1","text":"comment approved"}`, calls[0])
+	assert.Equal(t, `editMessageReplyMarkup {"chat_id":1,"message_id":7,"reply_markup":{"inline_keyboard":[]}}`, calls[1])
+}
+
+func TestTelegram_ClosePoller(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		_, _ = w.Write([]byte(`{"ok":true,"result":[]}`))
+	}))
+	defer ts.Close()
+
+	tg := &Telegram{channelID: "@remark_test", token: "good-token", apiPrefix: ts.URL + "/", timeout: time.Second}
+	assert.NoError(t, tg.Close(context.Background()), "nothing to stop")
+
+	m := NewTelegramModerator(tg, &mockModerationStore{}, nil)
+	done := make(chan struct{})
+	go func() {
+		m.Run(context.Background())
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, tg.Close(context.Background()))
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("poller is not stopped")
+	}
+}
+
+type mockModerationStore struct {
+	comments map[string]store.Comment
+	deleted  []string
+	blocked  []string
+}
+
+func (m *mockModerationStore) Get(_ store.Locator, id string, _ store.User) (store.Comment, error) {
+	c, ok := m.comments[id]
+	if !ok {
+		return store.Comment{}, errors.New("not found")
+	}
+	return c, nil
+}
+
+func (m *mockModerationStore) Delete(locator store.Locator, id string, _ store.DeleteMode) error {
+	m.deleted = append(m.deleted, locator.URL+" "+id)
+	return nil
+}
+
+func (m *mockModerationStore) SetBlock(siteID, userID string, _ bool, _ time.Duration) error {
+	m.blocked = append(m.blocked, siteID+" "+userID)
+	return nil
+}
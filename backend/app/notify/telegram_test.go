@@ -2,11 +2,14 @@ package notify
 
 import (
 	"context"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
-	"strconv"
+	"regexp"
+	"strings"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	"github.com/go-chi/chi"
 	"github.com/stretchr/testify/assert"
@@ -20,45 +23,119 @@ func TestTelegram_New(t *testing.T) {
 	ts := mockTelegramServer()
 	defer ts.Close()
 
-	tb, err := NewTelegram("good-token", "remark_test", 2*time.Second, ts.URL+"/")
+	tb, err := NewTelegram("good-token", "remark_test", nil, 2*time.Second, ts.URL+"/", "")
 	assert.NoError(t, err)
 	assert.NotNil(t, tb)
 	assert.Equal(t, "@remark_test", tb.channelID, "@ added")
 
 	st := time.Now()
-	_, err = NewTelegram("bad-resp", "remark_test", 2*time.Second, ts.URL+"/")
+	_, err = NewTelegram("bad-resp", "remark_test", nil, 2*time.Second, ts.URL+"/", "")
 	assert.EqualError(t, err, "unexpected telegram response {OK:false Result:{FirstName:comments_test ID:707381019 IsBot:false UserName:remark42_test_bot}}")
 	assert.True(t, time.Since(st) >= 250*5*time.Millisecond)
 
-	_, err = NewTelegram("non-json-resp", "remark_test", 2*time.Second, ts.URL+"/")
+	_, err = NewTelegram("non-json-resp", "remark_test", nil, 2*time.Second, ts.URL+"/", "")
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "can't decode response:")
 
-	_, err = NewTelegram("404", "remark_test", 2*time.Second, ts.URL+"/")
+	_, err = NewTelegram("404", "remark_test", nil, 2*time.Second, ts.URL+"/", "")
 	assert.EqualError(t, err, "unexpected telegram status code 404")
 
-	_, err = NewTelegram("no-such-thing", "remark_test", 2*time.Second, "http://127.0.0.1:4321/")
+	_, err = NewTelegram("no-such-thing", "remark_test", nil, 2*time.Second, "http://127.0.0.1:4321/", "")
 	require.Error(t, err)
 	assert.Contains(t, err.Error(), "can't initialize telegram notifications")
 	assert.Contains(t, err.Error(), "dial tcp 127.0.0.1:4321: connect: connection refused")
 
-	_, err = NewTelegram("good-token", "remark_test", 2*time.Second, "")
+	_, err = NewTelegram("good-token", "remark_test", nil, 2*time.Second, "", "")
 	assert.Error(t, err, "empty api url not allowed")
 
-	_, err = NewTelegram("good-token", "remark_test", 0, ts.URL+"/")
+	_, err = NewTelegram("good-token", "remark_test", nil, 0, ts.URL+"/", "")
 	assert.NoError(t, err, "0 timeout allowed as default")
 
-	tb, err = NewTelegram("good-token", "1234567890", 2*time.Second, ts.URL+"/")
+	tb, err = NewTelegram("good-token", "1234567890", nil, 2*time.Second, ts.URL+"/", "")
 	assert.NoError(t, err)
 	assert.NotNil(t, tb)
 	assert.Equal(t, "1234567890", tb.channelID, "no @ prefix")
 }
 
+func TestTelegram_Ping(t *testing.T) {
+	ts := mockTelegramServer()
+	defer ts.Close()
+
+	tb, err := NewTelegram("good-token", "remark_test", nil, 2*time.Second, ts.URL+"/", "")
+	require.NoError(t, err)
+	assert.NoError(t, tb.Ping(context.Background()))
+
+	tb.token = "404"
+	assert.EqualError(t, tb.Ping(context.Background()), "unexpected telegram status code 404")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Error(t, tb.Ping(ctx), "canceled context")
+}
+
+func TestTelegram_NewWithSiteChannels(t *testing.T) {
+	ts := mockTelegramServer()
+	defer ts.Close()
+
+	_, err := NewTelegram("good-token", "", map[string]string{"site1": "chan1"}, 2*time.Second, ts.URL+"/", "")
+	assert.EqualError(t, err, "default telegram channel is required")
+
+	_, err = NewTelegram("good-token", "remark_test", map[string]string{"site1": ""}, 2*time.Second, ts.URL+"/", "")
+	assert.EqualError(t, err, `empty telegram channel for site "site1"`)
+
+	tb, err := NewTelegram("good-token", "remark_test", map[string]string{"site1": "chan1", "site2": "-100123"},
+		2*time.Second, ts.URL+"/", "")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"site1": "@chan1", "site2": "-100123"}, tb.siteChannels)
+}
+
+func TestTelegram_channel(t *testing.T) {
+	tb := Telegram{channelID: "@default", siteChannels: map[string]string{"site1": "@chan1", "site2": "-100123"}}
+	assert.Equal(t, "@chan1", tb.channel("site1"))
+	assert.Equal(t, "-100123", tb.channel("site2"))
+	assert.Equal(t, "@default", tb.channel("unknown"), "unknown site uses default")
+	assert.Equal(t, "@default", tb.channel(""))
+
+	assert.True(t, tb.isChannel(0, "default"))
+	assert.True(t, tb.isChannel(0, "chan1"))
+	assert.True(t, tb.isChannel(-100123, ""))
+	assert.False(t, tb.isChannel(-100124, "other"))
+	assert.False(t, tb.isChannel(0, ""))
+}
+
+func Test_telegramChannel(t *testing.T) {
+	assert.Equal(t, "@chan", telegramChannel("chan"))
+	assert.Equal(t, "@chan", telegramChannel("@chan"))
+	assert.Equal(t, "-100123", telegramChannel("-100123"))
+}
+
+func TestTelegram_SendToSiteChannel(t *testing.T) {
+	var chats []string
+	router := chi.NewRouter()
+	router.Get("/good-token/getMe", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"ok": true, "result": {"id": 707381019, "is_bot": true}}`))
+	})
+	router.Post("/good-token/sendMessage", func(w http.ResponseWriter, r *http.Request) {
+		chats = append(chats, r.URL.Query().Get("chat_id"))
+		_, _ = w.Write([]byte(`{"ok": true}`))
+	})
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	tb, err := NewTelegram("good-token", "remark_test", map[string]string{"site1": "chan1"}, 2*time.Second, ts.URL+"/", "")
+	require.NoError(t, err)
+	c := store.Comment{ID: "999", Text: "some text", Locator: store.Locator{SiteID: "site1"}}
+	require.NoError(t, tb.Send(context.TODO(), Request{Comment: c}))
+	c.Locator.SiteID = "site2"
+	require.NoError(t, tb.Send(context.TODO(), Request{Comment: c}))
+	assert.Equal(t, []string{"@chan1", "@remark_test"}, chats)
+}
+
 func TestTelegram_Send(t *testing.T) {
 	ts := mockTelegramServer()
 	defer ts.Close()
 
-	tb, err := NewTelegram("good-token", "remark_test", 2*time.Second, ts.URL+"/")
+	tb, err := NewTelegram("good-token", "remark_test", nil, 2*time.Second, ts.URL+"/", "")
 	assert.NoError(t, err)
 	assert.NotNil(t, tb)
 	c := store.Comment{Text: "some text", ParentID: "1", ID: "999"}
@@ -78,7 +155,7 @@ func TestTelegram_Send(t *testing.T) {
 	err = tb.Send(context.TODO(), Request{Comment: c, parent: cp})
 	assert.NoError(t, err)
 
-	tb, err = NewTelegram("non-json-resp", "remark_test", 2*time.Second, ts.URL+"/")
+	tb, err = NewTelegram("non-json-resp", "remark_test", nil, 2*time.Second, ts.URL+"/", "")
 	assert.Error(t, err, "should failed")
 	err = tb.Send(context.TODO(), Request{Comment: c, parent: cp})
 	require.Error(t, err)
@@ -87,11 +164,31 @@ func TestTelegram_Send(t *testing.T) {
 	assert.Equal(t, "telegram: @remark_test", tb.String())
 }
 
+func TestTelegram_SendProxy(t *testing.T) {
+	ts := mockTelegramServer()
+	defer ts.Close()
+	proxy := startConnectProxy(t, "")
+	defer proxy.close()
+
+	_, err := NewTelegram("good-token", "remark_test", nil, 2*time.Second, ts.URL+"/", "ftp://"+proxy.addr)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "can't make telegram proxy dialer")
+
+	tb, err := NewTelegram("good-token", "remark_test", nil, 2*time.Second, ts.URL+"/", "http://"+proxy.addr)
+	require.NoError(t, err)
+	c := store.Comment{Text: "some text", ID: "999", User: store.User{Name: "from"}}
+	require.NoError(t, tb.Send(context.Background(), Request{Comment: c}))
+	require.NotEmpty(t, proxy.targets(), "getMe and sendMessage made through proxy")
+	for _, tgt := range proxy.targets() {
+		assert.Equal(t, ts.Listener.Addr().String(), tgt)
+	}
+}
+
 func TestTelegram_SendVerification(t *testing.T) {
 	ts := mockTelegramServer()
 	defer ts.Close()
 
-	tb, err := NewTelegram("good-token", "remark_test", 2*time.Second, ts.URL+"/")
+	tb, err := NewTelegram("good-token", "remark_test", nil, 2*time.Second, ts.URL+"/", "")
 	assert.NoError(t, err)
 	assert.NotNil(t, tb)
 
@@ -142,25 +239,78 @@ func mockTelegramServer() *httptest.Server {
 	return httptest.NewServer(router)
 }
 
-func TestTelegram_escapeTitle(t *testing.T) {
+func TestTelegram_SendHTML(t *testing.T) {
+	var msgs []string
+	allowedTags := regexp.MustCompile(`^</?(b|i|code|pre|a( href="[^"]+")?)>$`)
+	router := chi.NewRouter()
+	router.Get("/good-token/getMe", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"ok": true, "result": {"id": 707381019, "is_bot": true}}`))
+	})
+	router.Post("/good-token/sendMessage", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "HTML", r.URL.Query().Get("parse_mode"))
+		body := struct {
+			Text string `json:"text"`
+		}{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		msgs = append(msgs, body.Text)
+		// mimic telegram rejecting unsupported tags and too long messages
+		for _, tag := range regexp.MustCompile(`<[^>]*>`).FindAllString(body.Text, -1) {
+			if !allowedTags.MatchString(tag) {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"ok": false, "description": "can't parse entities"}`))
+				return
+			}
+		}
+		if utf8.RuneCountInString(body.Text) > telegramMaxLength {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"ok": false, "description": "message is too long"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"ok": true}`))
+	})
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	tb, err := NewTelegram("good-token", "remark_test", nil, 2*time.Second, ts.URL+"/", "")
+	require.NoError(t, err)
+	c := store.Comment{ID: "999", ParentID: "1", PostTitle: "<title> & [more]",
+		Text: `<div class="x"><p>see <a href="https://example.com/?a=1&amp;b=2">this</a> & <strong>that</strong></p></div>`,
+		User: store.User{Name: "from <user>"}, Locator: store.Locator{URL: "https://example.com/post"}}
+	require.NoError(t, tb.Send(context.TODO(), Request{Comment: c, parent: store.Comment{User: store.User{Name: "to"}}}))
+	require.Len(t, msgs, 1)
+	assert.Equal(t, "<b>from &lt;user&gt; → to</b>\n\n"+
+		`see <a href="https://example.com/?a=1&amp;b=2">this</a> &amp; <b>that</b>`+"\n\n"+
+		`↦ <a href="https://example.com/post#remark42__comment-999">&lt;title&gt; &amp; [more]</a>`, msgs[0])
+
+	c.Text = "<p>" + strings.Repeat("<b>long</b> text ", 1000) + "</p>"
+	require.NoError(t, tb.Send(context.TODO(), Request{Comment: c}))
+	require.Len(t, msgs, 2)
+	assert.Contains(t, msgs[1], "…")
+}
 
+func Test_telegramHTML(t *testing.T) {
 	tbl := []struct {
-		inp string
-		out string
+		inp   string
+		limit int
+		out   string
 	}{
-		{"", ""},
-		{"something 123", "something 123"},
-		{"something [123]", "something \\[123\\]"},
-		{"something (123)", "something \\(123\\)"},
-		{"something (123) [aaa]", "something \\(123\\) \\[aaa\\]"},
+		{"", 100, ""},
+		{"plain & simple", 100, "plain &amp; simple"},
+		{"<p>first</p>\n<p>second<br>line</p>", 100, "first\n\nsecond\nline"},
+		{`<div onclick="x()">text</div><img src="a.png"><script>alert(1)</script>`, 100, "text"},
+		{"<em>a</em> <b><i>b</i></b> <u>c</u>", 100, "<i>a</i> <b><i>b</i></b> c"},
+		{`<a href="javascript:alert(1)">bad</a> <a href="/rel">rel</a>`, 100, "bad rel"},
+		{"<pre><code>a &lt; b\n  c</code></pre>", 100, "<pre><code>a &lt; b\n  c</code></pre>"},
+		{"<code><b>x</b></code>", 100, "<code>x</code>"},
+		{"<ul><li>one</li><li>two</li></ul>", 100, "• one\n• two"},
+		{"<b>unclosed <i>tags", 100, "<b>unclosed <i>tags</i></b>"},
+		{"<b>bold text</b> tail", 12, "<b>bold…</b>"},
+		{"<b>bold</b> text", 10, "<b>bo…</b>"},
+		{"<b>bold</b>", 7, "…"},
+		{"a &amp; b", 7, "a…"},
 	}
-
-	tb := Telegram{}
 	for i, tt := range tbl {
-		tt := tt
-		t.Run(strconv.Itoa(i), func(t *testing.T) {
-			assert.Equal(t, tt.out, tb.escapeTitle(tt.inp))
-		})
+		assert.Equal(t, tt.out, telegramHTML(tt.inp, tt.limit), "case #%d", i)
+		assert.True(t, utf8.RuneCountInString(telegramHTML(tt.inp, tt.limit)) <= tt.limit, "case #%d", i)
 	}
-
 }
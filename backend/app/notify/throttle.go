@@ -0,0 +1,167 @@
+package notify
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/pkg/errors"
+)
+
+// recipientThrottle limits number of request messages sent to each recipient within the window.
+// Notifications over the limit are collected and sent as a single summary message at the end of the window.
+type recipientThrottle struct {
+	max    int
+	window time.Duration
+
+	lock    sync.Mutex
+	windows map[string]*throttleWindow // recipient email -> current window
+	closed  bool
+	sending sync.WaitGroup // summaries being sent
+}
+
+// throttleWindow is the period of counting messages to the recipient, started by the first message
+type throttleWindow struct {
+	sent    int
+	pending []throttledItem // notifications over the limit, to be sent in the summary
+	timer   *time.Timer     // ends the window
+}
+
+// throttledItem is the notification over the limit, shown in the summary message
+type throttledItem struct {
+	SiteID      string
+	RecipientID string // id of the recipient, used for unsubscribe link
+	UserName    string
+	PostTitle   string
+	CommentLink string
+	Lang        string // language of the request, summary is rendered with templates of the last one
+}
+
+func newRecipientThrottle(max int, window time.Duration) *recipientThrottle {
+	return &recipientThrottle{max: max, window: window, windows: map[string]*throttleWindow{}}
+}
+
+// allow counts the message to the recipient and returns true if it's within the limit of the current window.
+// Otherwise the item is kept for the summary and flush is called with pending items at the end of the window.
+func (t *recipientThrottle) allow(email string, item throttledItem, flush func(email string, items []throttledItem)) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return true
+	}
+	w, ok := t.windows[email]
+	if !ok {
+		w = &throttleWindow{}
+		t.windows[email] = w
+		w.timer = time.AfterFunc(t.window, func() { t.end(email, w, flush) })
+	}
+	if w.sent < t.max {
+		w.sent++
+		return true
+	}
+	w.pending = append(w.pending, item)
+	return false
+}
+
+// end closes the recipient window and flushes items collected in it, if any
+func (t *recipientThrottle) end(email string, w *throttleWindow, flush func(email string, items []throttledItem)) {
+	t.lock.Lock()
+	if t.windows[email] != w || t.closed {
+		t.lock.Unlock()
+		return
+	}
+	delete(t.windows, email)
+	if len(w.pending) == 0 {
+		t.lock.Unlock()
+		return
+	}
+	t.sending.Add(1)
+	t.lock.Unlock()
+	defer t.sending.Done()
+	flush(email, w.pending)
+}
+
+// close stops all windows and returns pending items for each recipient. Waits for summaries being sent.
+// Messages allowed after close are not counted.
+func (t *recipientThrottle) close() map[string][]throttledItem {
+	t.lock.Lock()
+	res := map[string][]throttledItem{}
+	for email, w := range t.windows {
+		w.timer.Stop()
+		if len(w.pending) > 0 {
+			res[email] = w.pending
+		}
+	}
+	t.windows, t.closed = map[string]*throttleWindow{}, true
+	t.lock.Unlock()
+	t.sending.Wait()
+	return res
+}
+
+// throttled returns true if the request message to the recipient is over EmailParams.MaxPerWindow
+// and will be included in the summary message instead
+func (e *Email) throttled(req Request, email string) bool {
+	if e.throttle == nil || req.Event == EventDelete {
+		return false
+	}
+	recipientID := req.parent.User.ID
+	if req.Event == EventMention {
+		recipientID = req.mention.ID
+	}
+	item := throttledItem{SiteID: req.Comment.Locator.SiteID, RecipientID: recipientID, UserName: req.Comment.User.Name,
+		PostTitle: req.Comment.PostTitle, CommentLink: req.Comment.Locator.URL + uiNav + req.Comment.ID, Lang: req.Lang}
+	return !e.throttle.allow(email, item, func(email string, items []throttledItem) {
+		ctx, cancel := context.WithTimeout(context.Background(), e.SendTimeout*time.Duration(e.MaxRetries+1))
+		defer cancel()
+		if err := e.sendSummary(ctx, email, items); err != nil {
+			log.Printf("[WARN] %v", err)
+		}
+	})
+}
+
+// sendSummary sends message listing notifications to the recipient over the limit of the window,
+// rendered with message templates with Count and Replies set
+func (e *Email) sendSummary(ctx context.Context, email string, items []throttledItem) error {
+	last := items[len(items)-1]
+	token, err := e.TokenGenFn(last.RecipientID, email, last.SiteID)
+	if err != nil {
+		return errors.Wrapf(err, "error creating token for unsubscribe link of summary to %q", email)
+	}
+	data := msgTmplData{
+		Email:           email,
+		UnsubscribeLink: e.UnsubscribeURL + "?site=" + last.SiteID + "&tkn=" + token,
+		SiteID:          last.SiteID,
+		Lang:            last.Lang,
+		Count:           len(items),
+	}
+	data.SiteTitle, data.SiteLogoURL = e.branding(last.SiteID)
+	for _, item := range items {
+		data.Replies = append(data.Replies, replyTmplData{UserName: item.UserName, CommentLink: item.CommentLink,
+			PostTitle: item.PostTitle})
+	}
+
+	sender := e.requestSender(last.SiteID, email)
+	msg, err := e.renderMessage(sender, data, e.customHeaders(), time.Time{})
+	if err == nil {
+		msg, err = e.encryptMessage(msg, email)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "can't build summary to %q", email)
+	}
+	log.Printf("[DEBUG] send summary of %d notification(s) to %q", len(items), email)
+	msgs := []emailMessage{{from: sender.From, to: email, message: msg, cid: correlationID(ctx)}}
+	return errors.Wrapf(e.sendWithRetries(ctx, msgs)[0], "problem sending summary to %q", email)
+}
+
+// flushThrottled stops throttling and sends summaries of notifications pending in the current windows
+func (e *Email) flushThrottled(ctx context.Context) {
+	if e.throttle == nil {
+		return
+	}
+	for email, items := range e.throttle.close() {
+		if err := e.sendSummary(ctx, email, items); err != nil {
+			log.Printf("[WARN] %v", err)
+		}
+	}
+}
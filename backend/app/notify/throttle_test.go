@@ -0,0 +1,102 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"mime/quotedprintable"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/remark42/backend/app/store"
+)
+
+func TestEmail_Throttle(t *testing.T) {
+	email, err := NewEmail(EmailParams{
+		From:                     "from@example.org",
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "testdata/msg.html.tmpl",
+		UnsubscribeURL:           "https://remark42.com/api/v1/email/unsubscribe",
+		TokenGenFn:               TokenGenFn,
+		MaxPerWindow:             10,
+		ThrottleWindow:           time.Minute,
+		AdminEmails:              []string{"admin@example.org"},
+	}, SMTPParams{})
+	require.NoError(t, err)
+	fakeSMTP := &fakeTestSMTP{}
+	email.smtp = fakeSMTP
+
+	reqFor := func(i int, to string) Request {
+		return Request{Event: EventReply, Emails: []string{to},
+			Comment: store.Comment{ID: fmt.Sprintf("c%d", i), ParentID: "p1", PostTitle: "Hot thread",
+				User: store.User{Name: fmt.Sprintf("user%d", i)}, Locator: store.Locator{URL: "https://example.com/post", SiteID: "remark"}},
+			parent: store.Comment{ID: "p1", User: store.User{ID: "u1"}}}
+	}
+	for i := 1; i <= 12; i++ {
+		require.NoError(t, email.Send(context.Background(), reqFor(i, "u1@example.org")))
+	}
+	require.NoError(t, email.Send(context.Background(), reqFor(13, "u2@example.org")))
+	fakeSMTP.lock.RLock()
+	assert.Equal(t, 13+11, fakeSMTP.dataCount, "10 messages to u1, one to u2 and 13 admin copies")
+	assert.Equal(t, 10, strings.Count(strings.Join(fakeSMTP.rcpts, " "), "u1@example.org"))
+	fakeSMTP.lock.RUnlock()
+
+	// 11th and 12th messages sent as summary at the end of the window, shortened to not wait for it
+	email.throttle.lock.Lock()
+	email.throttle.windows["u1@example.org"].timer.Reset(time.Millisecond)
+	email.throttle.lock.Unlock()
+	assert.Eventually(t, func() bool {
+		fakeSMTP.lock.RLock()
+		defer fakeSMTP.lock.RUnlock()
+		return fakeSMTP.dataCount == 25
+	}, time.Second, 10*time.Millisecond)
+	require.NoError(t, email.Close(context.Background())) // waits for summary to be written
+	summary := fakeSMTP.buff.String()[strings.LastIndex(fakeSMTP.buff.String(), "From: from@example.org"):]
+	assert.Contains(t, summary, "To: u1@example.org")
+	assert.Contains(t, summary, "Subject: 2 new replies\n", "rendered with subject template")
+	assert.Contains(t, summary, "List-Unsubscribe: <https://remark42.com/api/v1/email/unsubscribe?site=remark&tkn=token>")
+	dec, err := ioutil.ReadAll(quotedprintable.NewReader(strings.NewReader(summary[strings.Index(summary, "text/html"):])))
+	require.NoError(t, err)
+	body := string(dec)
+	assert.Contains(t, body, "\r\n2 new replies\r\n", "rendered with message template")
+	assert.Contains(t, body, `Reply: <b>user11</b> on "Hot thread" https://example.com/post#remark42__comment-c11`)
+	assert.Contains(t, body, `Reply: <b>user12</b> on "Hot thread" https://example.com/post#remark42__comment-c12`)
+	assert.NotContains(t, body, "comment-c10")
+	assert.Contains(t, body, "Unsubscribe link: https://remark42.com/api/v1/email/unsubscribe?site=remark&tkn=token")
+}
+
+func TestEmail_ThrottleFlushOnClose(t *testing.T) {
+	email, err := NewEmail(EmailParams{
+		From:                     "from@example.org",
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "testdata/msg.html.tmpl",
+		TokenGenFn:               TokenGenFn,
+		MaxPerWindow:             1,
+		Format:                   EmailFormatText,
+	}, SMTPParams{})
+	require.NoError(t, err)
+	assert.Equal(t, time.Hour, email.ThrottleWindow, "default window")
+	fakeSMTP := &fakeTestSMTP{}
+	email.smtp = fakeSMTP
+
+	for _, id := range []string{"c1", "c2"} {
+		req := Request{Event: EventNewComment, Emails: []string{"u1@example.org"},
+			Comment: store.Comment{ID: id, User: store.User{Name: "dev"}, Locator: store.Locator{URL: "https://example.com/post"}}}
+		require.NoError(t, email.Send(context.Background(), req))
+	}
+	assert.Equal(t, 1, fakeSMTP.dataCount)
+
+	require.NoError(t, email.Close(context.Background()))
+	assert.Equal(t, 2, fakeSMTP.dataCount, "pending summary sent on close")
+	assert.Contains(t, fakeSMTP.buff.String(), "Subject: 1 new replies\n")
+	assert.Contains(t, fakeSMTP.buff.String(), "Content-Type: text/plain")
+
+	// not throttled after close
+	req := Request{Event: EventNewComment, Emails: []string{"u1@example.org"}, Comment: store.Comment{ID: "c3"}}
+	require.NoError(t, email.Send(context.Background(), req))
+	assert.Equal(t, 3, fakeSMTP.dataCount)
+}
@@ -0,0 +1,58 @@
+package notify
+
+import (
+	"context"
+	"strings"
+)
+
+// Tracer starts spans of notification delivery. It's a subset of OpenTelemetry trace.Tracer,
+// so the tracer used by the rest of application can be plugged in with a thin adapter.
+// Span started by Start is a child of the span in ctx, if any.
+type Tracer interface {
+	Start(ctx context.Context, spanName string) (context.Context, Span)
+}
+
+// Span is a single traced operation, subset of OpenTelemetry trace.Span
+type Span interface {
+	SetAttribute(key string, value interface{})
+	RecordError(err error)
+	End()
+}
+
+// span names and attributes of email delivery
+const (
+	spanEmailSend        = "notify.email.send"
+	spanEmailSendBuffer  = "notify.email.send_buffer"
+	spanEmailSendMessage = "notify.email.send_message"
+
+	attrEvent           = "notify.event"
+	attrCommentID       = "notify.comment_id"
+	attrMessages        = "notify.messages"
+	attrAttempts        = "notify.attempts"
+	attrAttempt         = "notify.attempt"
+	attrRecipientDomain = "notify.recipient_domain"
+	attrMessageSize     = "notify.message_size"
+)
+
+// nopSpan is used when tracing is not configured
+type nopSpan struct{}
+
+func (nopSpan) SetAttribute(string, interface{}) {}
+func (nopSpan) RecordError(error)                {}
+func (nopSpan) End()                             {}
+
+// startSpan starts span with EmailParams.Tracer, no-op one returned if tracing is not configured
+func (e *Email) startSpan(ctx context.Context, spanName string) (context.Context, Span) {
+	if e.Tracer == nil {
+		return ctx, nopSpan{}
+	}
+	return e.Tracer.Start(ctx, spanName)
+}
+
+// recipientDomain returns domain part of the address, recipient itself is not exposed to traces
+func recipientDomain(email string) string {
+	if at := strings.LastIndex(email, "@"); at >= 0 {
+		return strings.ToLower(strings.TrimSuffix(email[at+1:], ">"))
+	}
+	return ""
+}
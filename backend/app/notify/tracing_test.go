@@ -0,0 +1,127 @@
+package notify
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/remark42/backend/app/store"
+)
+
+func TestEmail_Tracing(t *testing.T) {
+	tracer := &spanRecorder{}
+	email, err := NewEmail(EmailParams{
+		From:                     "from@example.org",
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "testdata/msg.html.tmpl",
+		TokenGenFn:               TokenGenFn,
+		RetryBaseDelay:           time.Millisecond,
+		MaxRetries:               1,
+		Tracer:                   tracer,
+	}, SMTPParams{})
+	require.NoError(t, err)
+	email.smtp = &fakeTestSMTP{}
+
+	ctx, parent := tracer.Start(context.Background(), "rest.create_comment")
+	req := Request{Event: EventReply, Comment: store.Comment{ID: "999"}, Emails: []string{"u1@Example.org", "u2@example.com"}}
+	require.NoError(t, email.Send(ctx, req))
+	parent.End()
+
+	spans := tracer.ended()
+	require.Equal(t, 4, len(spans))
+	send, buffer := spans[3], spans[2]
+	assert.Equal(t, spanEmailSend, send.name)
+	assert.Equal(t, "rest.create_comment", send.parent.name, "span context propagated from incoming ctx")
+	assert.Equal(t, map[string]interface{}{attrEvent: "reply", attrCommentID: "999"}, send.attrs)
+	assert.Equal(t, spanEmailSendBuffer, buffer.name)
+	assert.Equal(t, send, buffer.parent)
+	assert.Equal(t, 2, buffer.attrs[attrMessages])
+	assert.Equal(t, 1, buffer.attrs[attrAttempts])
+	for i, domain := range []string{"example.org", "example.com"} {
+		assert.Equal(t, spanEmailSendMessage, spans[i].name)
+		assert.Equal(t, buffer, spans[i].parent)
+		assert.Equal(t, domain, spans[i].attrs[attrRecipientDomain])
+		assert.Equal(t, 1, spans[i].attrs[attrAttempt])
+		assert.Greater(t, spans[i].attrs[attrMessageSize], 100)
+		assert.Empty(t, spans[i].errs)
+	}
+	assert.Empty(t, send.errs)
+
+	// failed delivery recorded on all spans, each attempt has its own message span
+	tracer.reset()
+	email.smtp = &fakeTestSMTP{fail: map[string]bool{"data": true}}
+	req.Emails = []string{"u1@example.org"}
+	require.Error(t, email.Send(context.Background(), req))
+	spans = tracer.ended()
+	require.Equal(t, 4, len(spans))
+	for i, s := range spans[:2] {
+		assert.Equal(t, spanEmailSendMessage, s.name)
+		assert.Equal(t, i+1, s.attrs[attrAttempt])
+		assert.Equal(t, 1, len(s.errs))
+	}
+	assert.Equal(t, 2, spans[2].attrs[attrAttempts])
+	assert.Equal(t, 1, len(spans[2].errs))
+	assert.Nil(t, spans[3].parent)
+	require.Equal(t, 1, len(spans[3].errs))
+	assert.Contains(t, spans[3].errs[0].Error(), "failed after 2 attempt(s)")
+}
+
+func TestRecipientDomain(t *testing.T) {
+	assert.Equal(t, "example.org", recipientDomain("u1@Example.ORG"))
+	assert.Equal(t, "example.org", recipientDomain("User <u1@example.org>"))
+	assert.Equal(t, "", recipientDomain("bad"))
+}
+
+// spanRecorder is Tracer recording finished spans
+type spanRecorder struct {
+	lock  sync.Mutex
+	spans []*recordedSpan
+}
+
+type recordedSpan struct {
+	rec    *spanRecorder
+	name   string
+	parent *recordedSpan
+	attrs  map[string]interface{}
+	errs   []error
+}
+
+type spanCtxKey struct{}
+
+func (r *spanRecorder) Start(ctx context.Context, name string) (context.Context, Span) {
+	s := &recordedSpan{rec: r, name: name, attrs: map[string]interface{}{}}
+	s.parent, _ = ctx.Value(spanCtxKey{}).(*recordedSpan)
+	return context.WithValue(ctx, spanCtxKey{}, s), s
+}
+
+// ended returns spans in order of End calls, recorder's own spans without parent excluded
+func (r *spanRecorder) ended() []*recordedSpan {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var res []*recordedSpan
+	for _, s := range r.spans {
+		if s.name != "rest.create_comment" {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+func (r *spanRecorder) reset() {
+	r.lock.Lock()
+	r.spans = nil
+	r.lock.Unlock()
+}
+
+func (s *recordedSpan) SetAttribute(key string, value interface{}) { s.attrs[key] = value }
+func (s *recordedSpan) RecordError(err error)                      { s.errs = append(s.errs, err) }
+
+func (s *recordedSpan) End() {
+	s.rec.lock.Lock()
+	s.rec.spans = append(s.rec.spans, s)
+	s.rec.lock.Unlock()
+}
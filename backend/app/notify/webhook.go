@@ -0,0 +1,344 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+
+	"github.com/umputun/remark42/backend/app/store"
+)
+
+// WebhookParams contain settings for webhook destination
+type WebhookParams struct {
+	URL             string            // URL to POST payload to
+	Headers         map[string]string // additional request headers, i.e. with auth token
+	Timeout         time.Duration     // request timeout
+	PayloadTemplate string            // text/template for the request body, JSON of webhookPayload is sent if empty
+	Secret          string            // secret to sign request body with, not signed if empty
+	MaxRetries      int               // max number of retries on network errors, 5xx and 429 responses
+	RetryBaseDelay  time.Duration     // delay before the first retry, doubled for each next one
+	DeadLetter      DeadLetterSink    // receives payloads failed after all retries, optional
+	BaseURL         string            // remark42 URL, relative avatar URLs are resolved against it
+	Proxy           string            // proxy URL for requests, socks5:// or http://, direct connection if empty
+	IncludeRaw      bool              // add comment and parent as stored under "raw" key of the payload
+	// IncludeSensitive keeps users IPs and voted IPs hashes in the raw comment and parent, and adds emails
+	// of notified users to it. They are omitted otherwise.
+	IncludeSensitive bool
+}
+
+// DeadLetterSink receives webhook payloads which failed to be delivered, so they can be replayed later
+type DeadLetterSink interface {
+	Put(letter DeadLetter) error
+}
+
+// DeadLetter is a failed webhook delivery
+type DeadLetter struct {
+	Time     time.Time `json:"time"`
+	URL      string    `json:"url"`
+	Delivery string    `json:"delivery"`
+	Event    string    `json:"event"`
+	Payload  string    `json:"payload"`
+	Error    string    `json:"error"`
+}
+
+// DeadLetterFunc functional struct implementing DeadLetterSink
+type DeadLetterFunc func(letter DeadLetter) error
+
+// Put calls func for given letter
+func (f DeadLetterFunc) Put(letter DeadLetter) error {
+	return f(letter)
+}
+
+// DeadLetterWriter implements DeadLetterSink writing letters to io.Writer as JSON lines. Thread safe
+type DeadLetterWriter struct {
+	io.Writer
+	lock sync.Mutex
+}
+
+// Put writes letter as a single JSON line
+func (d *DeadLetterWriter) Put(letter DeadLetter) error {
+	b, err := json.Marshal(letter)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal dead letter")
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	_, err = d.Write(append(b, '\n'))
+	return errors.Wrap(err, "failed to write dead letter")
+}
+
+// Webhook implements notify.Destination posting new comments to the configured URL
+type Webhook struct {
+	WebhookParams
+	tmpl   *template.Template
+	client *http.Client
+}
+
+// webhookPayload is the default request body, also used as data for WebhookParams.PayloadTemplate
+type webhookPayload struct {
+	Site    string         `json:"site"`
+	Comment store.Comment  `json:"comment"`
+	Parent  *store.Comment `json:"parent,omitempty"`
+	User    store.User     `json:"user"`
+
+	AvatarURL string      `json:"avatar_url,omitempty"` // absolute URL of the commenting user's avatar
+	Raw       *webhookRaw `json:"raw,omitempty"`        // set with WebhookParams.IncludeRaw only
+}
+
+// webhookRaw is the comment with its parent as stored, set with WebhookParams.IncludeRaw
+type webhookRaw struct {
+	Comment store.Comment  `json:"comment"`
+	Parent  *store.Comment `json:"parent,omitempty"`
+	Emails  []string       `json:"emails,omitempty"` // emails of notified users, with WebhookParams.IncludeSensitive only
+}
+
+const (
+	webhookTimeOut        = 5000 * time.Millisecond
+	webhookMaxRetries     = 3
+	webhookRetryBaseDelay = 250 * time.Millisecond
+)
+
+// webhook headers, signature is made GitHub-style as "sha256=" followed by hex HMAC-SHA256 of the body
+const (
+	WebhookSignatureHeader = "X-Remark42-Signature"
+	WebhookDeliveryHeader  = "X-Remark42-Delivery"
+	WebhookEventHeader     = "X-Remark42-Event"
+)
+
+const webhookEventComment = "comment" // event header value for new comments and replies
+
+// NewWebhook makes webhook destination
+func NewWebhook(params WebhookParams) (*Webhook, error) {
+	if params.URL == "" {
+		return nil, errors.New("webhook URL is required")
+	}
+	res := Webhook{WebhookParams: params, client: http.DefaultClient}
+	if res.Timeout <= 0 {
+		res.Timeout = webhookTimeOut
+	}
+	if res.MaxRetries <= 0 {
+		res.MaxRetries = webhookMaxRetries
+	}
+	if res.RetryBaseDelay <= 0 {
+		res.RetryBaseDelay = webhookRetryBaseDelay
+	}
+	if res.PayloadTemplate != "" {
+		funcs := template.FuncMap{"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		}}
+		var err error
+		if res.tmpl, err = template.New("webhookTmpl").Funcs(funcs).Parse(res.PayloadTemplate); err != nil {
+			return nil, errors.Wrap(err, "can't parse webhook payload template")
+		}
+	}
+	if res.Proxy != "" {
+		dial, err := ProxyDialer(res.Proxy, nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "can't make webhook proxy dialer")
+		}
+		res.client = &http.Client{Transport: proxyTransport(dial)}
+	}
+	log.Printf("[DEBUG] create new webhook notifier for %s, timeout=%s", res.URL, res.Timeout)
+	return &res, nil
+}
+
+// Send POSTs comment with its parent to webhook URL, non-2xx response status is an error.
+// Network errors, 5xx and 429 responses are retried up to MaxRetries times with exponential backoff,
+// payload failed after all attempts goes to DeadLetter if set.
+func (w *Webhook) Send(ctx context.Context, req Request) error {
+	log.Printf("[DEBUG] send webhook notification to %s, comment id %s", w.URL, req.Comment.ID)
+	body, err := w.payload(req)
+	if err != nil {
+		return err
+	}
+
+	delivery := uuid.New().String() // the same for all attempts, so receiver can detect duplicates
+	event := webhookEvent(req.Event)
+	delay := w.RetryBaseDelay
+	err = retryAttempts(ctx, "webhook delivery "+delivery, w.MaxRetries, func() (time.Duration, error) {
+		retryable, err := w.post(ctx, body, delivery, event)
+		if err == nil || !retryable {
+			return 0, err
+		}
+		retryAfter := delay
+		delay *= 2
+		return retryAfter, err
+	})
+	if err != nil {
+		return w.deadLetter(body, delivery, event, err)
+	}
+	return nil
+}
+
+// post makes a single delivery attempt, returns whether failed one can be retried
+func (w *Webhook) post(ctx context.Context, body []byte, delivery, event string) (retryable bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, w.Timeout)
+	defer cancel()
+	r, err := http.NewRequest("POST", w.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, errors.Wrap(err, "failed to make webhook request")
+	}
+	r.Header.Set("Content-Type", "application/json; charset=utf-8")
+	for k, v := range w.Headers {
+		r.Header.Set(k, v)
+	}
+	r.Header.Set(WebhookDeliveryHeader, delivery)
+	r.Header.Set(WebhookEventHeader, event)
+	if w.Secret != "" {
+		r.Header.Set(WebhookSignatureHeader, signWebhookPayload(body, w.Secret))
+	}
+
+	resp, err := w.client.Do(r.WithContext(ctx))
+	if err != nil {
+		return true, errors.Wrap(err, "failed to get webhook response")
+	}
+	defer func() {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		if err := resp.Body.Close(); err != nil {
+			log.Printf("[WARN] can't close response body, %s", err)
+		}
+	}()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		retryable = resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return retryable, errors.Errorf("unexpected webhook status code %d for url %q", resp.StatusCode, w.URL)
+	}
+	return false, nil
+}
+
+// deadLetter puts failed payload to DeadLetter if it's set, returns delivery error
+func (w *Webhook) deadLetter(body []byte, delivery, event string, deliveryErr error) error {
+	if w.DeadLetter == nil {
+		return deliveryErr
+	}
+	letter := DeadLetter{Time: time.Now(), URL: w.URL, Delivery: delivery, Event: event,
+		Payload: string(body), Error: deliveryErr.Error()}
+	if err := w.DeadLetter.Put(letter); err != nil {
+		return errors.Wrapf(deliveryErr, "failed to save dead letter (%v)", err)
+	}
+	return deliveryErr
+}
+
+// newWebhookPayload makes payload of the request comment with its parent, without users IPs and voted IPs
+func newWebhookPayload(req Request, baseURL string) webhookPayload {
+	data := webhookPayload{Site: req.Comment.Locator.SiteID, Comment: req.Comment, User: req.Comment.User,
+		AvatarURL: absoluteURL(baseURL, req.Comment.User.Picture)}
+	data.Comment.VotedIPs = nil // hide voted ips (hashes)
+	data.Comment.User.IP, data.User.IP = "", ""
+	if req.Comment.ParentID != "" {
+		parent := req.parent
+		parent.VotedIPs = nil
+		parent.User.IP = ""
+		data.Parent = &parent
+	}
+	return data
+}
+
+// payload makes request body with PayloadTemplate or default JSON
+func (w *Webhook) payload(req Request) ([]byte, error) {
+	data := newWebhookPayload(req, w.BaseURL)
+	if w.IncludeRaw {
+		data.Raw = w.raw(req)
+	}
+
+	if w.tmpl == nil {
+		b, err := json.Marshal(data)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to make webhook body")
+		}
+		return b, nil
+	}
+	buf := bytes.Buffer{}
+	if err := w.tmpl.Execute(&buf, data); err != nil {
+		return nil, errors.Wrap(err, "failed to execute webhook payload template")
+	}
+	return buf.Bytes(), nil
+}
+
+// raw returns the comment and its parent as stored, with sensitive fields omitted unless IncludeSensitive is set
+func (w *Webhook) raw(req Request) *webhookRaw {
+	res := webhookRaw{Comment: req.Comment}
+	if req.Comment.ParentID != "" {
+		parent := req.parent
+		res.Parent = &parent
+	}
+	if w.IncludeSensitive {
+		res.Emails = req.Emails
+		return &res
+	}
+	res.Comment.VotedIPs, res.Comment.User.IP = nil, ""
+	if res.Parent != nil {
+		res.Parent.VotedIPs, res.Parent.User.IP = nil, ""
+	}
+	return &res
+}
+
+// VerifyWebhookSignature checks signature header value of webhook request against its body
+func VerifyWebhookSignature(body []byte, header, secret string) error {
+	if !strings.HasPrefix(header, "sha256=") {
+		return errors.New("webhook signature should have sha256= prefix")
+	}
+	if !hmac.Equal([]byte(header), []byte(signWebhookPayload(body, secret))) {
+		return errors.New("webhook signature mismatch")
+	}
+	return nil
+}
+
+func signWebhookPayload(body []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Accepts all comment events, receiver can tell them apart by event header.
+// Mentions are skipped as they are personal notifications about the comment already sent.
+func (w *Webhook) Accepts(e Event) bool {
+	return e != EventVerification && e != EventMention
+}
+
+// webhookEvent returns value of event header, "comment" for new comments and replies
+func webhookEvent(e Event) string {
+	if e == EventNewComment || e == EventReply {
+		return webhookEventComment
+	}
+	return e.String()
+}
+
+// Ping does nothing, webhook can't be checked without posting a comment
+func (w *Webhook) Ping(context.Context) error {
+	return nil
+}
+
+// SendVerification is not implemented for webhook
+func (w *Webhook) SendVerification(_ context.Context, _ VerificationRequest) error {
+	return nil
+}
+
+// Close does nothing, webhook has no pending notifications or resources to release
+func (w *Webhook) Close(_ context.Context) error {
+	return nil
+}
+
+// Name of Webhook destination
+func (w *Webhook) Name() string {
+	return "webhook"
+}
+
+func (w *Webhook) String() string {
+	return "webhook: " + w.URL
+}
@@ -0,0 +1,339 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/remark42/backend/app/store"
+)
+
+func TestWebhook_New(t *testing.T) {
+	_, err := NewWebhook(WebhookParams{})
+	assert.EqualError(t, err, "webhook URL is required")
+
+	_, err = NewWebhook(WebhookParams{URL: "http://example.com", PayloadTemplate: "{{.Bad"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "can't parse webhook payload template")
+
+	wh, err := NewWebhook(WebhookParams{URL: "http://example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, webhookTimeOut, wh.Timeout)
+	assert.Equal(t, "webhook: http://example.com", wh.String())
+	assert.NoError(t, wh.SendVerification(context.Background(), VerificationRequest{}))
+}
+
+func TestWebhook_Send(t *testing.T) {
+	var body, auth, contentType string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		body, auth, contentType = string(b), r.Header.Get("Authorization"), r.Header.Get("Content-Type")
+	}))
+	defer ts.Close()
+
+	wh, err := NewWebhook(WebhookParams{URL: ts.URL, Headers: map[string]string{"Authorization": "Bearer secret"}})
+	require.NoError(t, err)
+	ts1 := time.Date(2020, 11, 4, 8, 30, 0, 0, time.UTC)
+	req := Request{
+		Comment: store.Comment{ID: "c2", ParentID: "c1", Text: "reply", Timestamp: ts1,
+			User:    store.User{ID: "u2", Name: "user2", IP: "hashed-ip"},
+			Locator: store.Locator{SiteID: "remark", URL: "https://example.com/post"}},
+		parent: store.Comment{ID: "c1", Text: "parent", Timestamp: ts1, User: store.User{ID: "u1", Name: "user1", IP: "hashed-ip"},
+			VotedIPs: map[string]store.VotedIPInfo{"ip": {}}},
+	}
+	require.NoError(t, wh.Send(context.Background(), req))
+	assert.Equal(t, "Bearer secret", auth)
+	assert.Equal(t, "application/json; charset=utf-8", contentType)
+	assert.JSONEq(t, `{"site":"remark",
+		"comment":{"id":"c2","pid":"c1","text":"reply","user":{"name":"user2","id":"u2","picture":"","admin":false},
+			"locator":{"site":"remark","url":"https://example.com/post"},"score":0,"vote":0,"time":"2020-11-04T08:30:00Z"},
+		"parent":{"id":"c1","pid":"","text":"parent","user":{"name":"user1","id":"u1","picture":"","admin":false},
+			"locator":{"url":""},"score":0,"vote":0,"time":"2020-11-04T08:30:00Z"},
+		"user":{"name":"user2","id":"u2","picture":"","admin":false}}`, body)
+
+	// top level comment has no parent
+	req.Comment.ParentID = ""
+	require.NoError(t, wh.Send(context.Background(), req))
+	assert.NotContains(t, body, `"parent"`)
+}
+
+func TestWebhook_SendRaw(t *testing.T) {
+	var body string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		body = string(b)
+	}))
+	defer ts.Close()
+
+	req := Request{
+		Comment: store.Comment{ID: "c2", ParentID: "c1", Text: "reply", Orig: "reply orig",
+			User:     store.User{ID: "u2", Name: "user2", IP: "hashed-ip2"},
+			VotedIPs: map[string]store.VotedIPInfo{"voted-ip": {Value: true}},
+			Locator:  store.Locator{SiteID: "remark", URL: "https://example.com/post"}},
+		parent: store.Comment{ID: "c1", Text: "parent", User: store.User{ID: "u1", Name: "user1", IP: "hashed-ip1"}},
+		Emails: []string{"u1@example.com"},
+	}
+
+	wh, err := NewWebhook(WebhookParams{URL: ts.URL, IncludeRaw: true})
+	require.NoError(t, err)
+	require.NoError(t, wh.Send(context.Background(), req))
+	var payload struct {
+		Raw struct {
+			Comment store.Comment  `json:"comment"`
+			Parent  *store.Comment `json:"parent"`
+			Emails  []string       `json:"emails"`
+		} `json:"raw"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(body), &payload))
+	assert.Equal(t, "reply orig", payload.Raw.Comment.Orig)
+	require.NotNil(t, payload.Raw.Parent)
+	assert.Equal(t, "c1", payload.Raw.Parent.ID)
+	assert.NotContains(t, body, "hashed-ip")
+	assert.NotContains(t, body, "voted-ip")
+	assert.NotContains(t, body, "u1@example.com")
+	assert.Equal(t, "hashed-ip2", req.Comment.User.IP, "request comment not changed")
+
+	wh, err = NewWebhook(WebhookParams{URL: ts.URL, IncludeRaw: true, IncludeSensitive: true})
+	require.NoError(t, err)
+	require.NoError(t, wh.Send(context.Background(), req))
+	payload.Raw.Parent, payload.Raw.Emails = nil, nil
+	require.NoError(t, json.Unmarshal([]byte(body), &payload))
+	assert.Equal(t, []string{"u1@example.com"}, payload.Raw.Emails)
+	require.NotNil(t, payload.Raw.Parent)
+	assert.Equal(t, "hashed-ip1", payload.Raw.Parent.User.IP)
+	assert.Contains(t, body, "voted-ip")
+
+	// raw is not added by default
+	wh, err = NewWebhook(WebhookParams{URL: ts.URL, IncludeSensitive: true})
+	require.NoError(t, err)
+	require.NoError(t, wh.Send(context.Background(), req))
+	assert.NotContains(t, body, `"raw"`)
+}
+
+func TestWebhook_SendProxy(t *testing.T) {
+	var body string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		body = string(b)
+	}))
+	defer ts.Close()
+	proxy := startConnectProxy(t, "user:pass")
+	defer proxy.close()
+
+	_, err := NewWebhook(WebhookParams{URL: ts.URL, Proxy: "ftp://" + proxy.addr})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "can't make webhook proxy dialer")
+
+	wh, err := NewWebhook(WebhookParams{URL: ts.URL, Proxy: "http://user:pass@" + proxy.addr})
+	require.NoError(t, err)
+	req := Request{Comment: store.Comment{ID: "c1", Text: "text", Locator: store.Locator{SiteID: "remark"}}}
+	require.NoError(t, wh.Send(context.Background(), req))
+	assert.Contains(t, body, `"id":"c1"`)
+	assert.Equal(t, []string{ts.Listener.Addr().String()}, proxy.targets())
+}
+
+func TestWebhook_SendTemplate(t *testing.T) {
+	var body string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		body = string(b)
+	}))
+	defer ts.Close()
+
+	wh, err := NewWebhook(WebhookParams{URL: ts.URL,
+		PayloadTemplate: `{"text": {{json (printf "%s: %s" .User.Name .Comment.Text)}}{{if .Parent}}, "reply_to": {{json .Parent.User.Name}}{{end}}}`})
+	require.NoError(t, err)
+	req := Request{Comment: store.Comment{ID: "c2", ParentID: "c1", Text: `say "hi"`, User: store.User{Name: "user2"}},
+		parent: store.Comment{ID: "c1", User: store.User{Name: "user1"}}}
+	require.NoError(t, wh.Send(context.Background(), req))
+	assert.Equal(t, `{"text": "user2: say \"hi\"", "reply_to": "user1"}`, body)
+
+	// relative avatar resolved against base URL
+	wh, err = NewWebhook(WebhookParams{URL: ts.URL, BaseURL: "https://remark42.example.com", PayloadTemplate: `{{.AvatarURL}}`})
+	require.NoError(t, err)
+	req.Comment.User.Picture = "/api/v1/avatar/a1.image"
+	require.NoError(t, wh.Send(context.Background(), req))
+	assert.Equal(t, "https://remark42.example.com/api/v1/avatar/a1.image", body)
+
+	wh, err = NewWebhook(WebhookParams{URL: ts.URL, PayloadTemplate: `{{.NoSuchField}}`})
+	require.NoError(t, err)
+	err = wh.Send(context.Background(), req)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to execute webhook payload template")
+}
+
+func TestWebhook_SendSigned(t *testing.T) {
+	var body []byte
+	var headers http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		body, err = ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		headers = r.Header
+	}))
+	defer ts.Close()
+
+	wh, err := NewWebhook(WebhookParams{URL: ts.URL, Secret: "secret"})
+	require.NoError(t, err)
+	require.NoError(t, wh.Send(context.Background(), Request{Comment: store.Comment{ID: "c1"}}))
+	assert.Equal(t, "comment", headers.Get(WebhookEventHeader))
+	_, err = uuid.Parse(headers.Get(WebhookDeliveryHeader))
+	assert.NoError(t, err, "delivery id is uuid")
+	delivery := headers.Get(WebhookDeliveryHeader)
+
+	sig := headers.Get(WebhookSignatureHeader)
+	assert.True(t, strings.HasPrefix(sig, "sha256="), sig)
+	assert.NoError(t, VerifyWebhookSignature(body, sig, "secret"))
+	assert.EqualError(t, VerifyWebhookSignature(body, sig, "other secret"), "webhook signature mismatch")
+	assert.EqualError(t, VerifyWebhookSignature(append(body, ' '), sig, "secret"), "webhook signature mismatch")
+	assert.EqualError(t, VerifyWebhookSignature(body, strings.TrimPrefix(sig, "sha256="), "secret"),
+		"webhook signature should have sha256= prefix")
+
+	require.NoError(t, wh.Send(context.Background(), Request{Comment: store.Comment{ID: "c1"}}))
+	assert.NotEqual(t, delivery, headers.Get(WebhookDeliveryHeader), "new delivery id for each request")
+
+	require.NoError(t, wh.Send(context.Background(), Request{Event: EventEdit, Comment: store.Comment{ID: "c1"}}))
+	assert.Equal(t, "edit", headers.Get(WebhookEventHeader))
+	require.NoError(t, wh.Send(context.Background(), Request{Event: EventReply, Comment: store.Comment{ID: "c1"}}))
+	assert.Equal(t, "comment", headers.Get(WebhookEventHeader))
+	assert.True(t, wh.Accepts(EventDelete))
+	assert.False(t, wh.Accepts(EventVerification))
+	assert.False(t, wh.Accepts(EventMention))
+
+	// no signature without secret
+	wh, err = NewWebhook(WebhookParams{URL: ts.URL})
+	require.NoError(t, err)
+	require.NoError(t, wh.Send(context.Background(), Request{Comment: store.Comment{ID: "c1"}}))
+	assert.Empty(t, headers.Get(WebhookSignatureHeader))
+	assert.NotEmpty(t, headers.Get(WebhookDeliveryHeader))
+}
+
+func Test_signWebhookPayload(t *testing.T) {
+	// reference value from `echo -n '{"id":1}' | openssl dgst -sha256 -hmac secret`
+	assert.Equal(t, "sha256=03def589620c813f198fd03d7967e292b163ef0435ebf43071ce0e9519763cb7", signWebhookPayload([]byte(`{"id":1}`), "secret"))
+}
+
+func TestWebhook_SendErrors(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer ts.Close()
+
+	wh, err := NewWebhook(WebhookParams{URL: ts.URL + "/hook", RetryBaseDelay: time.Millisecond})
+	require.NoError(t, err)
+	err = wh.Send(context.Background(), Request{Comment: store.Comment{ID: "c1"}})
+	assert.EqualError(t, err, `failed after 4 attempt(s): unexpected webhook status code 502 for url "`+ts.URL+`/hook"`)
+
+	wh, err = NewWebhook(WebhookParams{URL: ts.URL + "/slow", Timeout: 10 * time.Millisecond, MaxRetries: 1, RetryBaseDelay: time.Millisecond})
+	require.NoError(t, err)
+	err = wh.Send(context.Background(), Request{Comment: store.Comment{ID: "c1"}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed after 2 attempt(s): failed to get webhook response")
+
+	wh, err = NewWebhook(WebhookParams{URL: "bad url\x7f"})
+	require.NoError(t, err)
+	err = wh.Send(context.Background(), Request{Comment: store.Comment{ID: "c1"}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed after 1 attempt(s): failed to make webhook request")
+}
+
+func TestWebhook_SendRetry(t *testing.T) {
+	var attempts int32
+	var deliveries []string
+	lock := sync.Mutex{}
+	statuses := []int{http.StatusInternalServerError, http.StatusTooManyRequests, http.StatusOK}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&attempts, 1)
+		lock.Lock()
+		deliveries = append(deliveries, r.Header.Get(WebhookDeliveryHeader))
+		lock.Unlock()
+		w.WriteHeader(statuses[int(n-1)%len(statuses)])
+	}))
+	defer ts.Close()
+
+	var letters []DeadLetter
+	wh, err := NewWebhook(WebhookParams{URL: ts.URL, RetryBaseDelay: time.Millisecond,
+		DeadLetter: DeadLetterFunc(func(l DeadLetter) error { letters = append(letters, l); return nil })})
+	require.NoError(t, err)
+	require.NoError(t, wh.Send(context.Background(), Request{Comment: store.Comment{ID: "c1"}}), "succeed on 3rd attempt")
+	assert.Equal(t, int32(3), atomic.LoadInt32(&attempts))
+	assert.Empty(t, letters)
+	lock.Lock()
+	assert.Equal(t, deliveries[0], deliveries[2], "same delivery id for all attempts")
+	lock.Unlock()
+
+	// retries exhausted
+	atomic.StoreInt32(&attempts, 0)
+	wh.MaxRetries = 1
+	err = wh.Send(context.Background(), Request{Comment: store.Comment{ID: "c2"}})
+	assert.EqualError(t, err, `failed after 2 attempt(s): unexpected webhook status code 429 for url "`+ts.URL+`"`)
+	require.Len(t, letters, 1)
+	assert.Equal(t, ts.URL, letters[0].URL)
+	assert.Equal(t, "comment", letters[0].Event)
+	assert.Contains(t, letters[0].Payload, `"id":"c2"`)
+	assert.Equal(t, err.Error(), letters[0].Error)
+	assert.NotEmpty(t, letters[0].Delivery)
+}
+
+func TestWebhook_SendNoRetryOnClientError(t *testing.T) {
+	var attempts int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer ts.Close()
+
+	buf := bytes.Buffer{}
+	wh, err := NewWebhook(WebhookParams{URL: ts.URL, RetryBaseDelay: time.Millisecond, DeadLetter: &DeadLetterWriter{Writer: &buf}})
+	require.NoError(t, err)
+	err = wh.Send(context.Background(), Request{Comment: store.Comment{ID: "c1"}})
+	assert.EqualError(t, err, `failed after 1 attempt(s): unexpected webhook status code 403 for url "`+ts.URL+`"`)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&attempts))
+
+	letter := DeadLetter{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &letter), "single JSON line written")
+	assert.Equal(t, err.Error(), letter.Error)
+	assert.True(t, strings.HasSuffix(buf.String(), "}\n"))
+
+	// failed dead letter sink is reported along with delivery error
+	wh.DeadLetter = DeadLetterFunc(func(DeadLetter) error { return errors.New("disk full") })
+	err = wh.Send(context.Background(), Request{Comment: store.Comment{ID: "c1"}})
+	assert.EqualError(t, err, `failed to save dead letter (disk full): failed after 1 attempt(s): unexpected webhook status code 403 for url "`+ts.URL+`"`)
+}
+
+func TestWebhook_SendCanceled(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	wh, err := NewWebhook(WebhookParams{URL: ts.URL, RetryBaseDelay: time.Second})
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	st := time.Now()
+	err = wh.Send(ctx, Request{Comment: store.Comment{ID: "c1"}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "aborted due to canceled context after 1 attempt(s)")
+	assert.True(t, time.Since(st) < time.Second, "retry delay interrupted")
+}
@@ -0,0 +1,526 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/go-pkgz/syncs"
+	"github.com/google/uuid"
+	"github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+// WebSubParams contain settings for WebSub hub destination
+type WebSubParams struct {
+	BaseURL          string        // root URL of remark42 server, topics and hub URLs are made from it
+	Timeout          time.Duration // timeout of verification and delivery requests
+	DefaultLease     time.Duration // lease of subscription without hub.lease_seconds, default one used if not set
+	MaxLease         time.Duration // max lease of subscription, longer requested leases are cut to it
+	MaxSubscriptions int           // max number of active subscriptions of all threads, default one used if not set
+	Concurrency      int           // max number of parallel deliveries to subscribers, default one used if not set
+	DBPath           string        // path to bolt file with active subscriptions, kept in memory only if not set
+}
+
+// WebSub implements notify.Destination as WebSub hub of comment threads. Subscribers register callback URLs
+// for the thread topic, see Topic, with requests to the hub handler, see ServeHTTP. Intent of subscriber is
+// verified by callback before subscription or unsubscription. Comments of the thread are POSTed to its
+// active subscribers as JSON, signed with subscription secret in X-Hub-Signature header if it's set.
+// Subscriptions are stored in bolt file of WebSubParams.DBPath and survive restart, if the path is set.
+// Callbacks on loopback, private and link-local addresses are rejected, checked on dial to cover
+// hostnames resolved to such addresses and redirects as well.
+type WebSub struct {
+	WebSubParams
+	client       *http.Client
+	now          func() time.Time
+	allowPrivate bool // allows callbacks on private and loopback hosts, for tests only
+
+	db   *bolt.DB // nil if subscriptions are kept in memory only
+	lock sync.Mutex
+	subs map[string]map[string]webSubscription // topic -> callback -> subscription
+}
+
+// webSubscription is the active subscription of the callback to the thread topic
+type webSubscription struct {
+	callback string
+	secret   string
+	expires  time.Time
+}
+
+// webSubRecord is webSubscription stored in bolt
+type webSubRecord struct {
+	Topic    string    `json:"topic"`
+	Callback string    `json:"callback"`
+	Secret   string    `json:"secret,omitempty"`
+	Expires  time.Time `json:"expires"`
+}
+
+const (
+	webSubTimeout          = 5 * time.Second
+	webSubDefaultLease     = 10 * 24 * time.Hour
+	webSubMaxLease         = 30 * 24 * time.Hour
+	webSubMaxSubscriptions = 1000
+	webSubConcurrency      = 8
+	webSubMaxSecretLen     = 200 // bytes, as limited by WebSub spec
+)
+
+var webSubBucket = []byte("subscriptions") // topic and callback -> json of webSubRecord
+
+// WebSubHubPath is path of the hub handler, relative to WebSubParams.BaseURL
+const WebSubHubPath = "/api/v1/websub"
+
+// WebSubSignatureHeader is header with "sha256=" followed by hex HMAC-SHA256 of the body made with subscription secret
+const WebSubSignatureHeader = "X-Hub-Signature"
+
+// NewWebSub makes WebSub hub destination, loads active subscriptions from WebSubParams.DBPath if it's set
+func NewWebSub(params WebSubParams) (*WebSub, error) {
+	dialer := &net.Dialer{Timeout: webSubTimeout, Control: webSubDialControl}
+	res := WebSub{WebSubParams: params, now: time.Now, subs: map[string]map[string]webSubscription{},
+		client: &http.Client{Transport: &http.Transport{DialContext: dialer.DialContext, MaxIdleConns: 10,
+			IdleConnTimeout: 90 * time.Second, TLSHandshakeTimeout: 10 * time.Second}}}
+	if res.Timeout <= 0 {
+		res.Timeout = webSubTimeout
+	}
+	if res.MaxLease <= 0 {
+		res.MaxLease = webSubMaxLease
+	}
+	if res.DefaultLease <= 0 {
+		res.DefaultLease = webSubDefaultLease
+	}
+	if res.DefaultLease > res.MaxLease {
+		res.DefaultLease = res.MaxLease
+	}
+	if res.MaxSubscriptions <= 0 {
+		res.MaxSubscriptions = webSubMaxSubscriptions
+	}
+	if res.Concurrency <= 0 {
+		res.Concurrency = webSubConcurrency
+	}
+	if res.DBPath != "" {
+		if err := res.load(); err != nil {
+			return nil, err
+		}
+	}
+	log.Printf("[DEBUG] create new websub notifier, default lease=%s, max lease=%s, %d subscription(s) loaded",
+		res.DefaultLease, res.MaxLease, res.count())
+	return &res, nil
+}
+
+// load opens bolt file of subscriptions and reads active ones, expired subscriptions are removed from it
+func (h *WebSub) load() (err error) {
+	if h.db, err = bolt.Open(h.DBPath, 0600, &bolt.Options{Timeout: 30 * time.Second}); err != nil { //nolint:gocritic //octalLiteral is OK as FileMode
+		return errors.Wrapf(err, "failed to open websub db %s", h.DBPath)
+	}
+	err = h.db.Update(func(tx *bolt.Tx) error {
+		bkt, e := tx.CreateBucketIfNotExists(webSubBucket)
+		if e != nil {
+			return errors.Wrapf(e, "failed to create bucket %s", string(webSubBucket))
+		}
+		var expired [][]byte
+		e = bkt.ForEach(func(k, v []byte) error {
+			rec := webSubRecord{}
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return errors.Wrapf(err, "failed to unmarshal websub subscription %s", string(k))
+			}
+			if h.now().After(rec.Expires) {
+				expired = append(expired, k)
+				return nil
+			}
+			if h.subs[rec.Topic] == nil {
+				h.subs[rec.Topic] = map[string]webSubscription{}
+			}
+			h.subs[rec.Topic][rec.Callback] = webSubscription{callback: rec.Callback, secret: rec.Secret, expires: rec.Expires}
+			return nil
+		})
+		if e != nil {
+			return e
+		}
+		for _, k := range expired {
+			if e := bkt.Delete(k); e != nil {
+				return errors.Wrapf(e, "failed to delete expired websub subscription %s", string(k))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = h.db.Close()
+		return err
+	}
+	return nil
+}
+
+// Topic returns topic URL of the comment thread, the same as of the thread comments feed served by remark42
+func (h *WebSub) Topic(siteID, postURL string) string {
+	return h.BaseURL + "/api/v1/rss/post?" + url.Values{"site": {siteID}, "url": {postURL}}.Encode()
+}
+
+// ServeHTTP handles subscription requests to the hub, POSTed as form with hub.mode, hub.topic, hub.callback
+// and optional hub.lease_seconds and hub.secret. Responds with 202 once intent of subscriber is verified.
+func (h *WebSub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "can't parse subscription request", http.StatusBadRequest)
+		return
+	}
+	mode, topic, callback := r.PostForm.Get("hub.mode"), r.PostForm.Get("hub.topic"), r.PostForm.Get("hub.callback")
+	if err := h.validate(topic, callback); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	switch mode {
+	case "subscribe":
+		secret := r.PostForm.Get("hub.secret")
+		if len(secret) > webSubMaxSecretLen {
+			http.Error(w, "hub.secret is too long", http.StatusBadRequest)
+			return
+		}
+		lease := h.DefaultLease
+		if s := r.PostForm.Get("hub.lease_seconds"); s != "" {
+			secs, e := strconv.Atoi(s)
+			if e != nil || secs <= 0 {
+				http.Error(w, "invalid hub.lease_seconds", http.StatusBadRequest)
+				return
+			}
+			lease = time.Duration(secs) * time.Second
+		}
+		err = h.subscribe(r.Context(), topic, callback, secret, lease)
+	case "unsubscribe":
+		err = h.unsubscribe(r.Context(), topic, callback)
+	default:
+		http.Error(w, "hub.mode should be subscribe or unsubscribe", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("[WARN] websub %s of %s to %s rejected, %v", mode, callback, topic, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// validate checks topic is a thread topic of the hub and callback is http(s) URL of public host
+func (h *WebSub) validate(topic, callback string) error {
+	u, err := url.Parse(topic)
+	if err != nil || !strings.HasPrefix(topic, h.BaseURL+"/api/v1/rss/post?") ||
+		u.Query().Get("site") == "" || u.Query().Get("url") == "" {
+		return errors.Errorf("invalid hub.topic %q", topic)
+	}
+	if topic != h.Topic(u.Query().Get("site"), u.Query().Get("url")) {
+		return errors.Errorf("invalid hub.topic %q", topic)
+	}
+	cb, err := url.Parse(callback)
+	if err != nil || (cb.Scheme != "http" && cb.Scheme != "https") || cb.Host == "" {
+		return errors.Errorf("invalid hub.callback %q", callback)
+	}
+	if h.allowPrivate {
+		return nil
+	}
+	host := strings.ToLower(strings.TrimSuffix(cb.Hostname(), "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return errors.Errorf("invalid hub.callback %q, private host", callback)
+	}
+	if ip := net.ParseIP(host); ip != nil && !isPublicIP(ip) {
+		return errors.Errorf("invalid hub.callback %q, private host", callback)
+	}
+	return nil
+}
+
+// webSubPrivateNets are address ranges not routed to public internet, in addition to
+// loopback, link-local and unspecified ones checked by isPublicIP
+var webSubPrivateNets = func() (res []*net.IPNet) {
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7"} {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		res = append(res, n)
+	}
+	return res
+}()
+
+// isPublicIP checks ip is not loopback, private, link-local or unspecified
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		ip.IsUnspecified() {
+		return false
+	}
+	for _, n := range webSubPrivateNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// webSubDialControl rejects connections to non-public addresses, the address is already resolved on dial
+func webSubDialControl(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return errors.Wrapf(err, "invalid websub callback address %s", address)
+	}
+	if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+		return errors.Errorf("websub callback address %s is not public", address)
+	}
+	return nil
+}
+
+// subscribe verifies intent of subscriber and adds subscription, replacing the existing one of the callback
+func (h *WebSub) subscribe(ctx context.Context, topic, callback, secret string, lease time.Duration) error {
+	if lease > h.MaxLease {
+		lease = h.MaxLease
+	}
+	h.lock.Lock()
+	_, exists := h.subs[topic][callback]
+	full := !exists && h.count() >= h.MaxSubscriptions
+	h.lock.Unlock()
+	if full {
+		return errors.New("too many subscriptions")
+	}
+
+	if err := h.verify(ctx, "subscribe", topic, callback, lease); err != nil {
+		return err
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	sub := webSubscription{callback: callback, secret: secret, expires: h.now().Add(lease)}
+	if err := h.save(topic, sub); err != nil {
+		return err
+	}
+	if h.subs[topic] == nil {
+		h.subs[topic] = map[string]webSubscription{}
+	}
+	h.subs[topic][callback] = sub
+	log.Printf("[INFO] websub subscription of %s to %s till %s", callback, topic, h.now().Add(lease).Format(time.RFC3339))
+	return nil
+}
+
+// unsubscribe verifies intent of subscriber and removes subscription
+func (h *WebSub) unsubscribe(ctx context.Context, topic, callback string) error {
+	if err := h.verify(ctx, "unsubscribe", topic, callback, 0); err != nil {
+		return err
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.remove(topic, callback)
+	log.Printf("[INFO] websub subscription of %s to %s removed", callback, topic)
+	return nil
+}
+
+// count returns number of active subscriptions, called under lock
+func (h *WebSub) count() (res int) {
+	for _, subs := range h.subs {
+		res += len(subs)
+	}
+	return res
+}
+
+// remove deletes subscription, called under lock
+func (h *WebSub) remove(topic, callback string) {
+	delete(h.subs[topic], callback)
+	if len(h.subs[topic]) == 0 {
+		delete(h.subs, topic)
+	}
+	if h.db == nil {
+		return
+	}
+	err := h.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(webSubBucket).Delete(webSubKey(topic, callback))
+	})
+	if err != nil {
+		log.Printf("[WARN] can't delete websub subscription of %s to %s, %v", callback, topic, err)
+	}
+}
+
+// save stores subscription in bolt, does nothing if subscriptions are kept in memory only
+func (h *WebSub) save(topic string, sub webSubscription) error {
+	if h.db == nil {
+		return nil
+	}
+	v, err := json.Marshal(webSubRecord{Topic: topic, Callback: sub.callback, Secret: sub.secret, Expires: sub.expires})
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal websub subscription")
+	}
+	err = h.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(webSubBucket).Put(webSubKey(topic, sub.callback), v)
+	})
+	return errors.Wrapf(err, "failed to save websub subscription of %s", sub.callback)
+}
+
+// webSubKey makes bolt key of subscription, newline can't be a part of valid topic or callback URL
+func webSubKey(topic, callback string) []byte {
+	return []byte(topic + "\n" + callback)
+}
+
+// verify sends GET request to callback with random challenge, subscriber confirms intent by responding
+// with 2xx status and the challenge as body
+func (h *WebSub) verify(ctx context.Context, mode, topic, callback string, lease time.Duration) error {
+	u, err := url.Parse(callback)
+	if err != nil {
+		return errors.Wrapf(err, "invalid callback %q", callback)
+	}
+	challenge := uuid.New().String()
+	q := u.Query()
+	q.Set("hub.mode", mode)
+	q.Set("hub.topic", topic)
+	q.Set("hub.challenge", challenge)
+	if mode == "subscribe" {
+		q.Set("hub.lease_seconds", strconv.Itoa(int(lease.Seconds())))
+	}
+	u.RawQuery = q.Encode()
+
+	ctx, cancel := context.WithTimeout(ctx, h.Timeout)
+	defer cancel()
+	r, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to make websub verification request")
+	}
+	resp, err := h.client.Do(r.WithContext(ctx))
+	if err != nil {
+		return errors.Wrap(err, "failed to get websub verification response")
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Printf("[WARN] can't close response body, %s", err)
+		}
+	}()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, int64(len(challenge)+1)))
+	if err != nil {
+		return errors.Wrap(err, "failed to read websub verification response")
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 || string(body) != challenge {
+		return errors.Errorf("%s of %s is not verified by the callback, status code %d", mode, callback, resp.StatusCode)
+	}
+	return nil
+}
+
+// Send POSTs comment with its parent to active subscribers of the comment thread, up to WebSubParams.Concurrency
+// of them in parallel. Expired subscriptions are removed, as well as ones which callback responded with 410 Gone.
+func (h *WebSub) Send(ctx context.Context, req Request) error {
+	topic := h.Topic(req.Comment.Locator.SiteID, req.Comment.Locator.URL)
+	h.lock.Lock()
+	var subs []webSubscription
+	for callback, sub := range h.subs[topic] {
+		if h.now().After(sub.expires) {
+			log.Printf("[DEBUG] websub subscription of %s to %s expired", callback, topic)
+			h.remove(topic, callback)
+			continue
+		}
+		subs = append(subs, sub)
+	}
+	h.lock.Unlock()
+	if len(subs) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(newWebhookPayload(req, h.BaseURL))
+	if err != nil {
+		return errors.Wrap(err, "failed to make websub body")
+	}
+	log.Printf("[DEBUG] send websub notification to %d subscriber(s) of %s, comment id %s", len(subs), topic, req.Comment.ID)
+	var errLock sync.Mutex
+	errs := new(multierror.Error)
+	grp := syncs.NewSizedGroup(h.Concurrency, syncs.Preemptive)
+	for _, sub := range subs {
+		sub := sub
+		grp.Go(func(context.Context) {
+			gone, err := h.post(ctx, sub, topic, webhookEvent(req.Event), body)
+			if gone {
+				h.lock.Lock()
+				h.remove(topic, sub.callback)
+				h.lock.Unlock()
+			}
+			if err != nil {
+				errLock.Lock()
+				errs = multierror.Append(errs, err)
+				errLock.Unlock()
+			}
+		})
+	}
+	grp.Wait()
+	return errs.ErrorOrNil()
+}
+
+// post delivers body to the subscriber, returns true if the subscription is gone on callback side
+func (h *WebSub) post(ctx context.Context, sub webSubscription, topic, event string, body []byte) (gone bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, h.Timeout)
+	defer cancel()
+	r, err := http.NewRequest("POST", sub.callback, bytes.NewReader(body))
+	if err != nil {
+		return false, errors.Wrap(err, "failed to make websub request")
+	}
+	r.Header.Set("Content-Type", "application/json; charset=utf-8")
+	r.Header.Set("Link", fmt.Sprintf(`<%s>; rel="hub", <%s>; rel="self"`, h.BaseURL+WebSubHubPath, topic))
+	r.Header.Set(WebhookEventHeader, event)
+	if sub.secret != "" {
+		r.Header.Set(WebSubSignatureHeader, signWebhookPayload(body, sub.secret))
+	}
+
+	resp, err := h.client.Do(r.WithContext(ctx))
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to get websub response from %s", sub.callback)
+	}
+	defer func() {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		if err := resp.Body.Close(); err != nil {
+			log.Printf("[WARN] can't close response body, %s", err)
+		}
+	}()
+	if resp.StatusCode == http.StatusGone {
+		log.Printf("[INFO] websub subscription of %s to %s is gone", sub.callback, topic)
+		return true, nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return false, errors.Errorf("unexpected websub status code %d for callback %q", resp.StatusCode, sub.callback)
+	}
+	return false, nil
+}
+
+// Accepts new comments and replies, edits and deletions are not sent to thread subscribers
+func (h *WebSub) Accepts(e Event) bool {
+	return e == EventNewComment || e == EventReply
+}
+
+// Ping does nothing, subscribers are checked on subscription
+func (h *WebSub) Ping(context.Context) error {
+	return nil
+}
+
+// SendVerification is not implemented for websub
+func (h *WebSub) SendVerification(_ context.Context, _ VerificationRequest) error {
+	return nil
+}
+
+// Close closes bolt file of subscriptions, if any
+func (h *WebSub) Close(_ context.Context) error {
+	if h.db == nil {
+		return nil
+	}
+	return errors.Wrap(h.db.Close(), "failed to close websub db")
+}
+
+// Name of WebSub destination
+func (h *WebSub) Name() string {
+	return "websub"
+}
+
+func (h *WebSub) String() string {
+	return "websub hub: " + h.BaseURL + WebSubHubPath
+}
@@ -0,0 +1,298 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/remark42/backend/app/store"
+)
+
+func TestWebSub_Lifecycle(t *testing.T) {
+	var lock sync.Mutex
+	var verified []url.Values
+	var bodies []string
+	var signature, link string
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if r.Method == http.MethodGet {
+			verified = append(verified, r.URL.Query())
+			_, _ = w.Write([]byte(r.URL.Query().Get("hub.challenge")))
+			return
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		bodies = append(bodies, string(b))
+		signature, link = r.Header.Get(WebSubSignatureHeader), r.Header.Get("Link")
+	}))
+	defer callback.Close()
+
+	hub, err := NewWebSub(WebSubParams{BaseURL: "https://remark42.example.com"})
+	require.NoError(t, err)
+	hub.client, hub.allowPrivate = http.DefaultClient, true // callback is on loopback
+	now := time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC)
+	hub.now = func() time.Time { return now }
+	topic := hub.Topic("remark", "https://example.com/post")
+	assert.Equal(t, "https://remark42.example.com/api/v1/rss/post?site=remark&url=https%3A%2F%2Fexample.com%2Fpost", topic)
+
+	request := func(form url.Values) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", WebSubHubPath, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		hub.ServeHTTP(rr, r)
+		return rr
+	}
+	reply := func(postURL string) Request {
+		return Request{Event: EventReply, Comment: store.Comment{ID: "c2", ParentID: "c1", Text: "reply",
+			User:    store.User{ID: "u2", Name: "user2", IP: "hashed-ip"},
+			Locator: store.Locator{SiteID: "remark", URL: postURL}},
+			parent: store.Comment{ID: "c1", Text: "parent", User: store.User{ID: "u1", Name: "user1"}}}
+	}
+
+	// subscribe with lease and secret, verified by the callback
+	rr := request(url.Values{"hub.mode": {"subscribe"}, "hub.topic": {topic}, "hub.callback": {callback.URL + "/cb?id=1"},
+		"hub.lease_seconds": {"3600"}, "hub.secret": {"s3cret"}})
+	require.Equal(t, http.StatusAccepted, rr.Code, rr.Body.String())
+	require.Equal(t, 1, len(verified))
+	assert.Equal(t, "subscribe", verified[0].Get("hub.mode"))
+	assert.Equal(t, topic, verified[0].Get("hub.topic"))
+	assert.Equal(t, "3600", verified[0].Get("hub.lease_seconds"))
+	assert.Equal(t, "1", verified[0].Get("id"), "query of callback kept")
+
+	// deliver comment of the thread, signed with the secret
+	require.NoError(t, hub.Send(context.Background(), reply("https://example.com/post")))
+	require.Equal(t, 1, len(bodies))
+	assert.Contains(t, bodies[0], `"id":"c2"`)
+	assert.Contains(t, bodies[0], `"parent":{"id":"c1"`)
+	assert.NotContains(t, bodies[0], "hashed-ip")
+	assert.NoError(t, VerifyWebhookSignature([]byte(bodies[0]), signature, "s3cret"))
+	assert.Equal(t, `<https://remark42.example.com/api/v1/websub>; rel="hub", <`+topic+`>; rel="self"`, link)
+
+	// other thread is not delivered
+	require.NoError(t, hub.Send(context.Background(), reply("https://example.com/other")))
+	assert.Equal(t, 1, len(bodies))
+
+	// lease expired
+	now = now.Add(time.Hour + time.Second)
+	require.NoError(t, hub.Send(context.Background(), reply("https://example.com/post")))
+	assert.Equal(t, 1, len(bodies), "expired subscription not delivered")
+	assert.Empty(t, hub.subs, "expired subscription removed")
+
+	// subscribe again and unsubscribe
+	rr = request(url.Values{"hub.mode": {"subscribe"}, "hub.topic": {topic}, "hub.callback": {callback.URL + "/cb?id=1"}})
+	require.Equal(t, http.StatusAccepted, rr.Code, rr.Body.String())
+	assert.Equal(t, "864000", verified[1].Get("hub.lease_seconds"), "default lease")
+	require.NoError(t, hub.Send(context.Background(), reply("https://example.com/post")))
+	require.Equal(t, 2, len(bodies))
+	assert.Empty(t, signature, "not signed without secret")
+
+	rr = request(url.Values{"hub.mode": {"unsubscribe"}, "hub.topic": {topic}, "hub.callback": {callback.URL + "/cb?id=1"}})
+	require.Equal(t, http.StatusAccepted, rr.Code, rr.Body.String())
+	assert.Equal(t, "unsubscribe", verified[2].Get("hub.mode"))
+	require.NoError(t, hub.Send(context.Background(), reply("https://example.com/post")))
+	assert.Equal(t, 2, len(bodies), "not delivered after unsubscribe")
+	assert.Empty(t, hub.subs)
+}
+
+func TestWebSub_Rejected(t *testing.T) {
+	status := http.StatusOK
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			_, _ = w.Write([]byte("wrong challenge"))
+			return
+		}
+		w.WriteHeader(status)
+	}))
+	defer callback.Close()
+
+	hub, err := NewWebSub(WebSubParams{BaseURL: "https://remark42.example.com", MaxSubscriptions: 1})
+	require.NoError(t, err)
+	hub.client, hub.allowPrivate = http.DefaultClient, true // callback is on loopback
+	topic := hub.Topic("remark", "https://example.com/post")
+	request := func(form url.Values) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", WebSubHubPath, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		hub.ServeHTTP(rr, r)
+		return rr
+	}
+
+	tbl := []struct {
+		form url.Values
+		err  string
+	}{
+		{url.Values{"hub.mode": {"subscribe"}, "hub.topic": {topic}, "hub.callback": {callback.URL}}, "is not verified by the callback"},
+		{url.Values{"hub.mode": {"subscribe"}, "hub.topic": {"https://example.com/post"}, "hub.callback": {callback.URL}}, "invalid hub.topic"},
+		{url.Values{"hub.mode": {"subscribe"}, "hub.topic": {topic}, "hub.callback": {"ftp://example.com"}}, "invalid hub.callback"},
+		{url.Values{"hub.mode": {"publish"}, "hub.topic": {topic}, "hub.callback": {callback.URL}}, "hub.mode should be"},
+		{url.Values{"hub.mode": {"subscribe"}, "hub.topic": {topic}, "hub.callback": {callback.URL},
+			"hub.lease_seconds": {"-1"}}, "invalid hub.lease_seconds"},
+	}
+	for i, tt := range tbl {
+		rr := request(tt.form)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, "case #%d", i)
+		assert.Contains(t, rr.Body.String(), tt.err, "case #%d", i)
+	}
+	assert.Empty(t, hub.subs, "nothing subscribed")
+
+	rr := httptest.NewRecorder()
+	hub.ServeHTTP(rr, httptest.NewRequest("GET", WebSubHubPath, nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
+
+	// callback responding with 410 to delivery is unsubscribed, subscriptions are limited
+	hub.subs[topic] = map[string]webSubscription{callback.URL: {callback: callback.URL, expires: time.Now().Add(time.Hour)}}
+	rr = request(url.Values{"hub.mode": {"subscribe"}, "hub.topic": {topic}, "hub.callback": {callback.URL + "/other"}})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "too many subscriptions")
+
+	req := Request{Comment: store.Comment{ID: "c1", Locator: store.Locator{SiteID: "remark", URL: "https://example.com/post"}}}
+	status = http.StatusInternalServerError
+	assert.EqualError(t, hub.Send(context.Background(), req), "1 error occurred:\n\t* unexpected websub status code 500 for callback \""+
+		callback.URL+"\"\n\n")
+	assert.Equal(t, 1, len(hub.subs[topic]), "kept after failure")
+	status = http.StatusGone
+	assert.NoError(t, hub.Send(context.Background(), req))
+	assert.Empty(t, hub.subs, "removed as gone")
+}
+
+func TestWebSub_PrivateCallback(t *testing.T) {
+	verified := false
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		verified = true
+		_, _ = w.Write([]byte(r.URL.Query().Get("hub.challenge")))
+	}))
+	defer callback.Close()
+
+	hub, err := NewWebSub(WebSubParams{BaseURL: "https://remark42.example.com"})
+	require.NoError(t, err)
+	topic := hub.Topic("remark", "https://example.com/post")
+	for _, cb := range []string{"http://127.0.0.1:8080/cb", "http://localhost/cb", "http://api.localhost/cb", "http://10.1.2.3/cb",
+		"http://172.16.0.1/cb", "http://192.168.1.1/cb", "http://169.254.169.254/latest/meta-data", "http://0.0.0.0/cb",
+		"http://[::1]/cb", "http://[fe80::1]/cb", "http://[fd00::1]/cb"} {
+		assert.EqualError(t, hub.validate(topic, cb), fmt.Sprintf("invalid hub.callback %q, private host", cb))
+	}
+	assert.NoError(t, hub.validate(topic, "https://example.com/cb"))
+	assert.NoError(t, hub.validate(topic, "http://8.8.8.8/cb"))
+
+	// address is checked on dial as well, for hostnames resolved to private addresses and redirects
+	err = hub.verify(context.Background(), "subscribe", topic, callback.URL, time.Hour)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "is not public")
+	assert.False(t, verified, "callback not requested")
+	assert.Empty(t, hub.subs)
+}
+
+func TestWebSub_Accepts(t *testing.T) {
+	hub, err := NewWebSub(WebSubParams{BaseURL: "https://remark42.example.com"})
+	require.NoError(t, err)
+	assert.True(t, hub.Accepts(EventNewComment))
+	assert.True(t, hub.Accepts(EventReply))
+	for _, e := range []Event{EventEdit, EventDelete, EventVerification, EventMention} {
+		assert.False(t, hub.Accepts(e), "event %d", e)
+	}
+}
+
+func TestWebSub_Persisted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "websub")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var delivered int32
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			_, _ = w.Write([]byte(r.URL.Query().Get("hub.challenge")))
+			return
+		}
+		atomic.AddInt32(&delivered, 1)
+	}))
+	defer callback.Close()
+
+	makeHub := func() *WebSub {
+		hub, e := NewWebSub(WebSubParams{BaseURL: "https://remark42.example.com", DBPath: filepath.Join(dir, "websub.db")})
+		require.NoError(t, e)
+		hub.client, hub.allowPrivate = http.DefaultClient, true // callback is on loopback
+		return hub
+	}
+	_, err = NewWebSub(WebSubParams{BaseURL: "https://remark42.example.com", DBPath: filepath.Join(dir, "no-such-dir", "websub.db")})
+	require.Error(t, err)
+
+	hub := makeHub()
+	topic := hub.Topic("remark", "https://example.com/post")
+	require.NoError(t, hub.subscribe(context.Background(), topic, callback.URL+"/1", "s3cret", time.Hour))
+	require.NoError(t, hub.subscribe(context.Background(), topic, callback.URL+"/2", "", 2*time.Hour))
+	require.NoError(t, hub.subscribe(context.Background(), topic, callback.URL+"/3", "", 10*time.Millisecond))
+	require.NoError(t, hub.Close(context.Background()))
+	time.Sleep(20 * time.Millisecond)
+
+	// active subscriptions survive restart, expired one is dropped on load
+	hub = makeHub()
+	require.Equal(t, 2, len(hub.subs[topic]))
+	sub := hub.subs[topic][callback.URL+"/1"]
+	assert.Equal(t, "s3cret", sub.secret)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), sub.expires, time.Minute)
+	req := Request{Comment: store.Comment{ID: "c1", Locator: store.Locator{SiteID: "remark", URL: "https://example.com/post"}}}
+	require.NoError(t, hub.Send(context.Background(), req))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&delivered))
+
+	require.NoError(t, hub.unsubscribe(context.Background(), topic, callback.URL+"/2"))
+	require.NoError(t, hub.Close(context.Background()))
+
+	// unsubscribed one is not loaded
+	hub = makeHub()
+	require.Equal(t, 1, len(hub.subs[topic]))
+	assert.Contains(t, hub.subs[topic], callback.URL+"/1")
+	require.NoError(t, hub.Close(context.Background()))
+}
+
+func TestWebSub_SendConcurrency(t *testing.T) {
+	var active, maxActive int32
+	release := make(chan struct{})
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&active, 1)
+		defer atomic.AddInt32(&active, -1)
+		for {
+			m := atomic.LoadInt32(&maxActive)
+			if n <= m || atomic.CompareAndSwapInt32(&maxActive, m, n) {
+				break
+			}
+		}
+		<-release
+	}))
+	defer callback.Close()
+
+	hub, err := NewWebSub(WebSubParams{BaseURL: "https://remark42.example.com", Concurrency: 3})
+	require.NoError(t, err)
+	hub.client, hub.allowPrivate = http.DefaultClient, true // callback is on loopback
+	topic := hub.Topic("remark", "https://example.com/post")
+	hub.subs[topic] = map[string]webSubscription{}
+	for i := 0; i < 10; i++ {
+		cb := fmt.Sprintf("%s/cb%d", callback.URL, i)
+		hub.subs[topic][cb] = webSubscription{callback: cb, expires: time.Now().Add(time.Hour)}
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- hub.Send(context.Background(), Request{Comment: store.Comment{ID: "c1",
+			Locator: store.Locator{SiteID: "remark", URL: "https://example.com/post"}}})
+	}()
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&active) == 3 }, time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&active), "deliveries limited by concurrency")
+	close(release)
+	require.NoError(t, <-done)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&maxActive))
+}
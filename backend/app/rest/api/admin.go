@@ -13,6 +13,7 @@ import (
 	log "github.com/go-pkgz/lgr"
 	R "github.com/go-pkgz/rest"
 
+	"github.com/umputun/remark42/backend/app/notify"
 	"github.com/umputun/remark42/backend/app/rest"
 	"github.com/umputun/remark42/backend/app/store"
 	"github.com/umputun/remark42/backend/app/store/engine"
@@ -25,10 +26,12 @@ type admin struct {
 	authenticator *auth.Service
 	readOnlyAge   int
 	migrator      *Migrator
+	notifyService *notify.Service
 }
 
 type adminStore interface {
 	Delete(locator store.Locator, commentID string, mode store.DeleteMode) error
+	Get(locator store.Locator, commentID string, user store.User) (store.Comment, error)
 	DeleteUser(siteID string, userID string, mode store.DeleteMode) error
 	DeleteUserDetail(siteID string, userID string, detail engine.UserDetail) error
 	User(siteID, userID string, limit, skip int, user store.User) ([]store.Comment, error)
@@ -42,19 +45,28 @@ type adminStore interface {
 	SetPin(locator store.Locator, commentID string, status bool) error
 }
 
-// DELETE /comment/{id}?site=siteID&url=post-url - removes comment
+// DELETE /comment/{id}?site=siteID&url=post-url&reason=text - removes comment, optional reason is sent to its author
 func (a *admin) deleteCommentCtrl(w http.ResponseWriter, r *http.Request) {
 
 	id := chi.URLParam(r, "id")
 	locator := store.Locator{SiteID: r.URL.Query().Get("site"), URL: r.URL.Query().Get("url")}
 	log.Printf("[INFO] delete comment %s", id)
 
-	err := a.dataService.Delete(locator, id, store.SoftDelete)
+	// comment is read before the deletion to notify its author
+	comment, err := a.dataService.Get(locator, id, store.User{})
+	if err != nil {
+		comment = store.Comment{ID: id, Locator: locator}
+	}
+	err = a.dataService.Delete(locator, id, store.SoftDelete)
 	if err != nil {
 		rest.SendErrorJSON(w, r, http.StatusInternalServerError, err, "can't delete comment", rest.ErrInternal)
 		return
 	}
 	a.cache.Flush(cache.Flusher(locator.SiteID).Scopes(locator.SiteID, locator.URL, lastCommentsScope))
+	if a.notifyService != nil {
+		a.notifyService.Submit(notify.Request{Event: notify.EventDelete, Comment: comment, Moderated: true,
+			DeleteReason: r.URL.Query().Get("reason")})
+	}
 	render.Status(r, http.StatusOK)
 	render.JSON(w, r, R.JSON{"id": id, "locator": locator})
 }
@@ -61,7 +61,9 @@ type Rest struct {
 	SimpleView         bool
 	ProxyCORS          bool
 	SendJWTHeader      bool
-	AllowedAncestors   []string // sets Content-Security-Policy "frame-ancestors ..."
+	AllowedAncestors   []string     // sets Content-Security-Policy "frame-ancestors ..."
+	MetricsHandler     http.Handler // serves prometheus metrics on /metrics, disabled if nil
+	WebSubHandler      http.Handler // serves websub hub on /api/v1/websub, disabled if nil
 
 	SSLConfig   SSLConfig
 	httpsServer *http.Server
@@ -223,6 +225,14 @@ func (s *Rest) routes() chi.Router {
 		r.Mount("/avatar", avatarHandler)
 	})
 
+	if s.MetricsHandler != nil {
+		router.Group(func(r chi.Router) {
+			r.Use(middleware.Timeout(5 * time.Second))
+			r.Use(tollbooth_chi.LimitHandler(tollbooth.NewLimiter(10, nil)), middleware.NoCache)
+			r.Handle("/metrics", s.MetricsHandler)
+		})
+	}
+
 	authMiddleware := s.Authenticator.Middleware()
 
 	// api routes
@@ -267,6 +277,16 @@ func (s *Rest) routes() chi.Router {
 			ropen.Get("/picture/{user}/{id}", s.pubRest.loadPictureCtrl)
 		})
 
+		// websub hub, each subscription request makes verification request to the callback
+		if s.WebSubHandler != nil {
+			rapi.Group(func(rhub chi.Router) {
+				rhub.Use(middleware.Timeout(30 * time.Second))
+				rhub.Use(tollbooth_chi.LimitHandler(tollbooth.NewLimiter(1, nil)))
+				rhub.Use(middleware.NoCache, logInfoWithBody)
+				rhub.Handle("/websub", s.WebSubHandler)
+			})
+		}
+
 		// protected routes, require auth
 		rapi.Group(func(rauth chi.Router) {
 			rauth.Use(middleware.Timeout(30 * time.Second))
@@ -375,6 +395,7 @@ func (s *Rest) controllerGroups() (public, private, admin, rss) {
 		cache:         s.Cache,
 		authenticator: s.Authenticator,
 		readOnlyAge:   s.ReadOnlyAge,
+		notifyService: s.NotifyService,
 	}
 
 	rssGrp := rss{
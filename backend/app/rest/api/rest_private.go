@@ -119,7 +119,11 @@ func (s *private) createCommentCtrl(w http.ResponseWriter, r *http.Request) {
 		Scopes(comment.Locator.URL, lastCommentsScope, comment.User.ID, comment.Locator.SiteID))
 
 	if s.notifyService != nil {
-		s.notifyService.Submit(notify.Request{Comment: finalComment})
+		event := notify.EventNewComment
+		if finalComment.ParentID != "" {
+			event = notify.EventReply
+		}
+		s.notifyService.Submit(notify.Request{Event: event, Comment: finalComment})
 	}
 
 	log.Printf("[DEBUG] created commend %+v", finalComment)
@@ -181,6 +185,14 @@ func (s *private) updateCommentCtrl(w http.ResponseWriter, r *http.Request) {
 	}
 
 	s.cache.Flush(cache.Flusher(locator.SiteID).Scopes(locator.SiteID, locator.URL, lastCommentsScope, user.ID))
+
+	if s.notifyService != nil {
+		event := notify.EventEdit
+		if edit.Delete {
+			event = notify.EventDelete
+		}
+		s.notifyService.Submit(notify.Request{Event: event, Comment: res, PrevOrig: currComment.Orig})
+	}
 	render.JSON(w, r, res)
 }
 
@@ -79,6 +79,46 @@ func TestRest_GetStarted(t *testing.T) {
 
 }
 
+func TestRest_Metrics(t *testing.T) {
+	ts, srv, teardown := startupT(t)
+	defer teardown()
+	_, code := get(t, ts.URL+"/metrics")
+	assert.Equal(t, 404, code, "metrics disabled by default")
+
+	srv.MetricsHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("remark42_metric 1"))
+	})
+	ts2 := httptest.NewServer(srv.routes())
+	defer ts2.Close()
+	body, code := get(t, ts2.URL+"/metrics")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "remark42_metric 1", body)
+}
+
+func TestRest_WebSub(t *testing.T) {
+	ts, srv, teardown := startupT(t)
+	defer teardown()
+	resp, err := post(t, ts.URL+"/api/v1/websub", "hub.mode=subscribe")
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "websub disabled by default")
+
+	srv.WebSubHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	})
+	ts2 := httptest.NewServer(srv.routes())
+	defer ts2.Close()
+	resp, err = post(t, ts2.URL+"/api/v1/websub", "hub.mode=subscribe")
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	resp, err = post(t, ts2.URL+"/api/v1/websub", "hub.mode=subscribe")
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode, "rate limited")
+}
+
 func TestRest_Shutdown(t *testing.T) {
 	srv := Rest{Authenticator: &auth.Service{}, ImageProxy: &proxy.Image{}}
 	done := make(chan bool)
@@ -13,6 +13,7 @@ require (
 	github.com/go-chi/cors v1.1.1
 	github.com/go-chi/render v1.0.1
 	github.com/go-pkgz/auth v1.14.0
+	github.com/go-pkgz/expirable-cache v0.0.3
 	github.com/go-pkgz/jrpc v0.2.0
 	github.com/go-pkgz/lcw v0.8.1
 	github.com/go-pkgz/lgr v0.10.4
@@ -25,6 +26,7 @@ require (
 	github.com/kyokomi/emoji v2.2.1+incompatible
 	github.com/microcosm-cc/bluemonday v1.0.4
 	github.com/pkg/errors v0.9.1
+	github.com/prometheus/client_golang v1.7.1
 	github.com/rakyll/statik v0.1.7
 	github.com/rs/xid v1.2.1
 	github.com/russross/blackfriday/v2 v2.1.0
@@ -35,4 +37,5 @@ require (
 	golang.org/x/crypto v0.0.0-20200406173513-056763e48d71
 	golang.org/x/image v0.0.0-20200119044424-58c23975cae1
 	golang.org/x/net v0.0.0-20200520182314-0ba52f642ac2
+	golang.org/x/time v0.0.0-20200416051211-89c76fbcd5d1
 )